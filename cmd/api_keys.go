@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+)
+
+var apiKeysCmd = NewApiKeysCommand()
+
+var apiKeyName string
+var apiKeyScopes []string
+var apiKeyExpiresIn time.Duration
+var apiKeysIncludeRevoked bool
+
+func NewApiKeysCommand() *cobra.Command {
+	apiKeysCmd := &cobra.Command{
+		Use:   "api-keys",
+		Short: "Manage api keys",
+		Long:  `Manage the api keys that callers can use instead of jwts when auth is enabled`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return initializeConfig(cmd)
+		},
+	}
+	addCockroachdbFlags(apiKeysCmd.PersistentFlags())
+
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create an api key",
+		Long:  `Create an api key and print it. The key is only printed once, only its hash is stored.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return createApiKey()
+		},
+	}
+	createCmd.Flags().StringVar(&apiKeyName, "name", "", "name of the api key, e.g. the service that uses it")
+	createCmd.Flags().StringSliceVar(&apiKeyScopes, "scopes", nil, fmt.Sprintf("scopes to give the api key, any of %s", strings.Join(internal.ApiKeyScopes, ", ")))
+	createCmd.Flags().DurationVar(&apiKeyExpiresIn, "expires-in", 0, "how long until the api key expires, 0 means it doesn't expire")
+	apiKeysCmd.AddCommand(createCmd)
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List api keys",
+		Long:  `List api keys`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listApiKeys()
+		},
+	}
+	listCmd.Flags().BoolVar(&apiKeysIncludeRevoked, "include-revoked", false, "include revoked api keys")
+	apiKeysCmd.AddCommand(listCmd)
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an api key",
+		Long:  `Revoke an api key, requests made with it are rejected from then on`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return revokeApiKey(args[0])
+		},
+	}
+	apiKeysCmd.AddCommand(revokeCmd)
+
+	rootCmd.AddCommand(apiKeysCmd)
+	return apiKeysCmd
+}
+
+func createApiKey() error {
+	deferredFunc, err := initializeDatabase()
+	if err != nil {
+		return err
+	}
+	defer deferredFunc()
+	apiKey, key, err := internal.CreateApiKey(apiKeyName, apiKeyScopes, apiKeyExpiresIn)
+	if err != nil {
+		return err
+	}
+	logging.Log.WithField("id", apiKey.Id).Info("created api key")
+	fmt.Println(key)
+	return nil
+}
+
+func listApiKeys() error {
+	deferredFunc, err := initializeDatabase()
+	if err != nil {
+		return err
+	}
+	defer deferredFunc()
+	apiKeys, err := internal.ListApiKeys(apiKeysIncludeRevoked)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tPREFIX\tSCOPES\tEXPIRES\tREVOKED")
+	for _, apiKey := range apiKeys {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", apiKey.Id, apiKey.Name, apiKey.Prefix, apiKey.Scopes, formatOptionalTime(apiKey.ExpiresAt), formatOptionalTime(apiKey.RevokedAt))
+	}
+	return writer.Flush()
+}
+
+func revokeApiKey(id string) error {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return errorx.IllegalArgument.Wrap(err, "invalid id")
+	}
+	deferredFunc, err := initializeDatabase()
+	if err != nil {
+		return err
+	}
+	defer deferredFunc()
+	err = internal.RevokeApiKey(parsed)
+	if err != nil {
+		return err
+	}
+	logging.Log.WithField("id", parsed).Info("revoked api key")
+	return nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"os"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/client"
+	"github.com/catalystsquad/go-notifications/internal/secrets"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	OutputTable = client.OutputTable
+	OutputJson  = client.OutputJson
+	OutputYaml  = client.OutputYaml
+)
+
+// clientOptions are the options of the commands that call a running server
+type clientOptions struct {
+	address    string
+	tls        bool
+	caPath     string
+	certPath   string
+	keyPath    string
+	serverName string
+	token      string
+	tokenFile  string
+	timeout    time.Duration
+	output     string
+}
+
+var clientOpts clientOptions
+
+// addClientFlags adds the connection, auth, and output flags of the commands that call a running server
+func addClientFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&clientOpts.address, "address", "localhost:6000", "host:port of the notifications grpc server")
+	flags.BoolVar(&clientOpts.tls, "tls", false, "connect with tls")
+	flags.StringVar(&clientOpts.caPath, "ca-path", "", "path to the ca certificate used to verify the server, the system roots are used when empty")
+	flags.StringVar(&clientOpts.certPath, "cert-path", "", "path to a client certificate, for mutual tls")
+	flags.StringVar(&clientOpts.keyPath, "key-path", "", "path to the client certificate's key, for mutual tls")
+	flags.StringVar(&clientOpts.serverName, "server-name", "", "server name to verify the server's certificate against, defaults to the address's host")
+	flags.StringVar(&clientOpts.token, "token", "", "bearer jwt or api key to authenticate with")
+	flags.StringVar(&clientOpts.tokenFile, "token-file", "", "file to read the bearer jwt or api key from instead of --token")
+	flags.DurationVar(&clientOpts.timeout, "timeout", 30*time.Second, "timeout for each request")
+	flags.StringVarP(&clientOpts.output, "output", "o", OutputTable, "output format, one of table, json, or yaml")
+}
+
+// newClientCommand returns a command group whose subcommands call a running server
+func newClientCommand(use, short, long string) *cobra.Command {
+	command := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Long:  long,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// the flags and args have been parsed by now, so errors aren't about usage
+			cmd.SilenceUsage = true
+			return initializeConfig(cmd)
+		},
+	}
+	addClientFlags(command.PersistentFlags())
+	return command
+}
+
+// withClient connects to the server and calls f with a client and a context that carries the token and times out
+// after the timeout
+func withClient(f func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error) error {
+	err := validateOutput()
+	if err != nil {
+		return err
+	}
+	transportCredentials, err := clientCredentials()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(clientOpts.address, grpc.WithTransportCredentials(transportCredentials))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), clientOpts.timeout)
+	defer cancel()
+	token, err := clientToken()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	return f(ctx, notificationsv1alpha1.NewNotificationsServiceClient(conn))
+}
+
+func clientToken() (string, error) {
+	if clientOpts.tokenFile != "" {
+		return secrets.ReadFile(clientOpts.tokenFile)
+	}
+	return clientOpts.token, nil
+}
+
+func validateOutput() error {
+	return client.ValidateFormat(clientOpts.output)
+}
+
+func clientCredentials() (credentials.TransportCredentials, error) {
+	if !clientOpts.tls {
+		return insecure.NewCredentials(), nil
+	}
+	tlsConfig, err := clientTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// clientTlsConfig returns the tls config for connecting to the server, from the ca, cert, key, and server name flags
+func clientTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: clientOpts.serverName}
+	if clientOpts.caPath != "" {
+		ca, err := os.ReadFile(clientOpts.caPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errorx.IllegalFormat.New("no certificates found in %s", clientOpts.caPath)
+		}
+	}
+	if clientOpts.certPath != "" || clientOpts.keyPath != "" {
+		certificate, err := tls.LoadX509KeyPair(clientOpts.certPath, clientOpts.keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// readMessages reads protojson encoded messages from a file, or stdin when the path is -, see client.ReadMessages
+func readMessages(path string, newMessage func() proto.Message) error {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+	return client.ReadMessages(input, newMessage)
+}
+
+func printer() client.Printer {
+	return client.Printer{Out: os.Stdout, Format: clientOpts.output}
+}
+
+func printMessages(messages []proto.Message, columns []string) error {
+	return printer().PrintMessages(messages, columns)
+}
+
+func printResult(result map[string]interface{}) error {
+	return printer().PrintResult(result)
+}
+
+func printValues(values interface{}) error {
+	return printer().PrintValues(values)
+}
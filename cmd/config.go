@@ -0,0 +1,473 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/secrets"
+	"github.com/catalystsquad/go-notifications/internal/sliceutil"
+	"github.com/catalystsquad/go-notifications/internal/tracing"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const redactedValue = "<redacted>"
+
+var configCmd = NewConfigCommand()
+
+// configKey maps a key in a section of the config file to the flag it sets
+type configKey struct {
+	key    string
+	flag   string
+	secret bool
+}
+
+type configSection struct {
+	name string
+	keys []configKey
+}
+
+// configSchema is every key that can be set in the config file, by section. Each key sets the flag of the same
+// meaning, see config.example.yaml for the descriptions. Flags take precedence over environment variables, which take
+// precedence over the config file.
+var configSchema = []configSection{
+	{name: "server", keys: []configKey{
+		{key: "port", flag: "port"},
+		{key: "tls-cert-path", flag: "tls-cert-path"},
+		{key: "tls-key-path", flag: "tls-key-path"},
+		{key: "tls-ca-path", flag: "tls-ca-path"},
+		{key: "min-tls-version", flag: "min-tls-version"},
+		{key: "sentry-enabled", flag: "sentry-enabled"},
+		{key: "capture-error-message", flag: "capture-error-message"},
+		{key: "prometheus-enabled", flag: "prometheus-enabled"},
+		{key: "prometheus-port", flag: "prometheus-port"},
+		{key: "prometheus-path", flag: "prometheus-path"},
+		{key: "metrics-definitions-interval", flag: "metrics-definitions-interval"},
+		{key: "health-check-interval", flag: "health-check-interval"},
+		{key: "health-check-timeout", flag: "health-check-timeout"},
+		{key: "shutdown-grace-period", flag: "shutdown-grace-period"},
+		{key: "shutdown-readiness-delay", flag: "shutdown-readiness-delay"},
+	}},
+	{name: "gateway", keys: []configKey{
+		{key: "enabled", flag: "serve-http"},
+		{key: "port", flag: "http-port"},
+	}},
+	{name: "scheduler", keys: []configKey{
+		{key: "schedule-window", flag: "schedule-window"},
+		{key: "runner-window", flag: "runner-window"},
+		{key: "cleanup-window", flag: "cleanup-window"},
+		{key: "resolver-secret", flag: "resolver-secret", secret: true},
+		{key: "resolver-secret-file", flag: "resolver-secret-file"},
+		{key: "resolver-timeout", flag: "resolver-timeout"},
+		{key: "resolver-fallback", flag: "resolver-fallback"},
+		{key: "resolver-max-retries", flag: "resolver-max-retries"},
+	}},
+	{name: "store", keys: []configKey{
+		{key: "notifo-base-url", flag: "notifo-base-url"},
+		{key: "notifo-api-key", flag: "notifo-api-key", secret: true},
+		{key: "notifo-api-key-file", flag: "notifo-api-key-file"},
+		{key: "notifo-app-id", flag: "notifo-app-id"},
+		{key: "notifo-concurrency", flag: "notifo-concurrency"},
+		{key: "user-cache-ttl", flag: "user-cache-ttl"},
+		{key: "user-cache-negative-ttl", flag: "user-cache-negative-ttl"},
+		{key: "user-cache-max-size", flag: "user-cache-max-size"},
+		{key: "middlewares", flag: "store-middlewares"},
+		{key: "faults-file", flag: "store-faults-file"},
+		{key: "retry-attempts", flag: "store-retry-attempts"},
+		{key: "retry-backoff", flag: "store-retry-backoff"},
+		{key: "cockroachdb-uri", flag: "cockroachdb-uri", secret: true},
+		{key: "cockroachdb-uri-file", flag: "cockroachdb-uri-file"},
+		{key: "cockroachdb-max-idle-connections", flag: "cockroachdb-max-idle-connections"},
+		{key: "cockroachdb-max-open-connections", flag: "cockroachdb-max-open-connections"},
+		{key: "cockroachdb-connection-max-lifetime", flag: "cockroachdb-connection-max-lifetime"},
+	}},
+	{name: "auth", keys: []configKey{
+		{key: "enabled", flag: "auth-enabled"},
+		{key: "jwks-path", flag: "auth-jwks-path"},
+		{key: "jwks-url", flag: "auth-jwks-url"},
+		{key: "jwks-refresh-interval", flag: "auth-jwks-refresh-interval"},
+		{key: "issuer", flag: "auth-issuer"},
+		{key: "audience", flag: "auth-audience"},
+		{key: "roles-claim", flag: "auth-roles-claim"},
+		{key: "user-id-claim", flag: "auth-user-id-claim"},
+		{key: "end-user-roles", flag: "auth-end-user-roles"},
+		{key: "service-roles", flag: "auth-service-roles"},
+		{key: "admin-roles", flag: "auth-admin-roles"},
+		{key: "audit-retention", flag: "audit-retention"},
+	}},
+	{name: "tracing", keys: []configKey{
+		{key: "exporter", flag: "tracing-exporter"},
+		{key: "otlp-endpoint", flag: "tracing-otlp-endpoint"},
+		{key: "otlp-insecure", flag: "tracing-otlp-insecure"},
+		{key: "sample-ratio", flag: "tracing-sample-ratio"},
+		{key: "service-name", flag: "tracing-service-name"},
+	}},
+}
+
+// secretFileFlags are the flags of secrets that can be read from a file instead, by the flag of the file. TLS material
+// is always read from files, see the tls-*-path flags.
+var secretFileFlags = map[string]string{
+	"notifo-api-key-file":  "notifo-api-key",
+	"resolver-secret-file": "resolver-secret",
+	"cockroachdb-uri-file": "cockroachdb-uri",
+}
+
+// configValidators check the values of flags beyond their type, they're run for the flags that the command has
+var configValidators = map[string]func(value string) error{
+	"port":                             validatePort,
+	"http-port":                        validatePort,
+	"schedule-window":                  validatePositiveDuration,
+	"runner-window":                    validatePositiveDuration,
+	"cleanup-window":                   validatePositiveDuration,
+	"health-check-interval":            validatePositiveDuration,
+	"health-check-timeout":             validatePositiveDuration,
+	"shutdown-grace-period":            validatePositiveDuration,
+	"shutdown-readiness-delay":         validateNonNegativeDuration,
+	"resolver-fallback":                validateOneOf(internal.ResolverFallbackStale, internal.ResolverFallbackSkip, internal.ResolverFallbackRetry),
+	"notifo-base-url":                  validateHttpUrl,
+	"notifo-api-key":                   validateRequired,
+	"notifo-app-id":                    validateRequired,
+	"notifo-concurrency":               validatePositiveInt,
+	"user-cache-max-size":              validatePositiveInt,
+	"store-middlewares":                validateStoreMiddlewares,
+	"store-faults-file":                validateStoreFaultsFile,
+	"store-retry-attempts":             validatePositiveInt,
+	"store-retry-backoff":              validatePositiveDuration,
+	"cockroachdb-uri":                  validateCockroachdbUri,
+	"cockroachdb-max-idle-connections": validateNonNegativeInt,
+	"cockroachdb-max-open-connections": validateNonNegativeInt,
+	"tracing-exporter":                 validateOneOf(tracing.ExporterNone, tracing.ExporterOtlp, tracing.ExporterStdout),
+	"tracing-sample-ratio":             validateRatio,
+}
+
+func NewConfigCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the service's config",
+		Long:  `Inspect the service's config`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// config subcommands work with the config of the run command
+			return initializeConfig(runCmd)
+		},
+	}
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the config and print the effective config",
+		Long: `Validate the config that the run command would use, merged from the config file and environment variables,
+and print it as yaml with secrets redacted`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			effectiveConfig, err := yaml.Marshal(effectiveConfig(runCmd.Flags()))
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(os.Stdout, string(effectiveConfig))
+			return nil
+		},
+	}
+	configCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(configCmd)
+	return configCmd
+}
+
+// applyConfigFile sets the command's flags from the config file, for flags that haven't been set by a flag or
+// environment variable. Unknown sections and keys, and values that aren't valid for their flag, are errors.
+func applyConfigFile(cmd *cobra.Command, v *viper.Viper) error {
+	problems := []string{}
+	for sectionName, sectionValue := range v.AllSettings() {
+		section, ok := findConfigSection(sectionName)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown section %s, must be one of %s", sectionName, strings.Join(configSectionNames(), ", ")))
+			continue
+		}
+		values, ok := sectionValue.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("section %s must be a map", sectionName))
+			continue
+		}
+		for key, value := range values {
+			configKey, ok := section.findKey(key)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown key %s.%s", sectionName, key))
+				continue
+			}
+			flag := cmd.Flags().Lookup(configKey.flag)
+			if flag == nil || flag.Changed || value == nil {
+				continue
+			}
+			err := cmd.Flags().Set(configKey.flag, configValueString(value))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s.%s: %s", sectionName, key, err.Error()))
+			}
+		}
+	}
+	return configError(problems)
+}
+
+// readSecretFiles sets secrets from their files, when the file flag is set. Setting both a secret and its file is an
+// error.
+func readSecretFiles(flags *pflag.FlagSet) error {
+	problems := []string{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		secretFlag, ok := secretFileFlags[f.Name]
+		if !ok || f.Value.String() == "" {
+			return
+		}
+		if flags.Lookup(secretFlag).Changed {
+			problems = append(problems, fmt.Sprintf("only one of %s and %s can be set", secretFlag, f.Name))
+			return
+		}
+		value, err := secrets.ReadFile(f.Value.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s: %s", f.Name, err.Error()))
+			return
+		}
+		err = flags.Set(secretFlag, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s: %s", f.Name, err.Error()))
+		}
+	})
+	return configError(problems)
+}
+
+// validateConfig runs the validators of the command's flags
+func validateConfig(flags *pflag.FlagSet) error {
+	problems := []string{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		validator, ok := configValidators[f.Name]
+		if !ok {
+			return
+		}
+		err := validator(f.Value.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s: %s", f.Name, errorx.Cast(err).Message()))
+		}
+	})
+	return configError(problems)
+}
+
+// effectiveConfig returns the values of the flags in the config schema, by section, with secrets redacted
+func effectiveConfig(flags *pflag.FlagSet) map[string]map[string]interface{} {
+	result := map[string]map[string]interface{}{}
+	for _, section := range configSchema {
+		values := map[string]interface{}{}
+		for _, key := range section.keys {
+			flag := flags.Lookup(key.flag)
+			if flag == nil {
+				continue
+			}
+			values[key.key] = flagValue(flags, flag)
+			if key.secret {
+				values[key.key] = redact(flag.Name, flag.Value.String())
+			}
+		}
+		result[section.name] = values
+	}
+	return result
+}
+
+func findConfigSection(name string) (configSection, bool) {
+	for _, section := range configSchema {
+		if section.name == name {
+			return section, true
+		}
+	}
+	return configSection{}, false
+}
+
+func (s configSection) findKey(key string) (configKey, bool) {
+	for _, configKey := range s.keys {
+		if configKey.key == key {
+			return configKey, true
+		}
+	}
+	return configKey{}, false
+}
+
+func configSectionNames() []string {
+	names := []string{}
+	for _, section := range configSchema {
+		names = append(names, section.name)
+	}
+	return names
+}
+
+// configValueString formats a config file value as a flag value, lists are comma separated
+func configValueString(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		values := []string{}
+		for _, item := range list {
+			values = append(values, fmt.Sprintf("%v", item))
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func configError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errorx.IllegalArgument.New("invalid config:\n  %s", strings.Join(problems, "\n  "))
+}
+
+func flagValue(flags *pflag.FlagSet, flag *pflag.Flag) interface{} {
+	var value interface{}
+	var err error
+	switch flag.Value.Type() {
+	case "stringSlice":
+		value, err = flags.GetStringSlice(flag.Name)
+	case "bool":
+		value, err = flags.GetBool(flag.Name)
+	case "int":
+		value, err = flags.GetInt(flag.Name)
+	case "uint16":
+		value, err = flags.GetUint16(flag.Name)
+	case "float64":
+		value, err = flags.GetFloat64(flag.Name)
+	default:
+		return flag.Value.String()
+	}
+	if err != nil {
+		return flag.Value.String()
+	}
+	return value
+}
+
+// redact hides a secret value. The password in the cockroachdb uri is hidden rather than the whole uri, so the host
+// and database can still be checked.
+func redact(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if name != "cockroachdb-uri" {
+		return redactedValue
+	}
+	uri, err := url.Parse(value)
+	if err != nil {
+		return redactedValue
+	}
+	if _, ok := uri.User.Password(); ok {
+		uri.User = url.UserPassword(uri.User.Username(), redactedValue)
+	}
+	query := uri.Query()
+	if query.Has("password") {
+		query.Set("password", redactedValue)
+		uri.RawQuery = query.Encode()
+	}
+	redacted, _ := url.PathUnescape(uri.String())
+	return redacted
+}
+
+func validateRequired(value string) error {
+	if value == "" {
+		return errorx.IllegalArgument.New("must be set")
+	}
+	return nil
+}
+
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return errorx.IllegalArgument.New("%s is not a port between 1 and 65535", value)
+	}
+	return nil
+}
+
+func validatePositiveDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return errorx.IllegalArgument.New("%s is not a positive duration", value)
+	}
+	return nil
+}
+
+func validateNonNegativeDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return errorx.IllegalArgument.New("%s is not a non negative duration", value)
+	}
+	return nil
+}
+
+func validatePositiveInt(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return errorx.IllegalArgument.New("%s is not a positive integer", value)
+	}
+	return nil
+}
+
+func validateNonNegativeInt(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return errorx.IllegalArgument.New("%s is not a non negative integer", value)
+	}
+	return nil
+}
+
+func validateRatio(value string) error {
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return errorx.IllegalArgument.New("%s is not a ratio between 0 and 1", value)
+	}
+	return nil
+}
+
+func validateOneOf(allowed ...string) func(value string) error {
+	return func(value string) error {
+		if !sliceutil.Contains(allowed, value) {
+			return errorx.IllegalArgument.New("%s must be one of %s", value, strings.Join(allowed, ", "))
+		}
+		return nil
+	}
+}
+
+// validateStoreMiddlewares validates a string slice flag's value, which is formatted like [a,b]
+func validateStoreMiddlewares(value string) error {
+	names := []string{}
+	trimmed := strings.Trim(value, "[]")
+	if trimmed != "" {
+		names = strings.Split(trimmed, ",")
+	}
+	return notification_store.ValidateMiddlewareNames(names)
+}
+
+func validateStoreFaultsFile(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := notification_store.LoadFaultRules(value)
+	return err
+}
+
+func validateHttpUrl(value string) error {
+	uri, err := url.Parse(value)
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+		return errorx.IllegalArgument.New("%s is not an http or https url", value)
+	}
+	return nil
+}
+
+// validateCockroachdbUri checks that the uri is a postgres connection url, which is what cockroachdb uses
+func validateCockroachdbUri(value string) error {
+	if value == "" {
+		return errorx.IllegalArgument.New("must be set")
+	}
+	uri, err := url.Parse(value)
+	if err != nil || (uri.Scheme != "postgres" && uri.Scheme != "postgresql") || uri.Host == "" {
+		return errorx.IllegalArgument.New("must be a postgresql:// connection url with a host")
+	}
+	return nil
+}
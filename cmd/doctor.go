@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/internal/doctor"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = NewDoctorCommand()
+
+var doctorTimeout time.Duration
+var doctorExpiryWarning time.Duration
+var doctorOutput string
+
+// schedulerTables are the tables that the scheduler's cockroachdb store creates when it starts
+var schedulerTables = []string{"task_definitions", "task_instances"}
+
+func NewDoctorCommand() *cobra.Command {
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose a deployment",
+		Long: fmt.Sprintf(`Load the config that the run command would use and check the deployment: the config itself, notifo's
+reachability, api key, and app id, the cockroachdb connection and schema, the scheduler's tables, the tls certificate
+and key, and whether the ports are available. Each check is reported with a hint on how to fix it.
+
+The exit code is %d when every check passes or is skipped, %d when a check warns, and %d when a check fails. Run it
+where the service runs, but with the service stopped, otherwise the port checks fail.`, doctor.ExitOk, doctor.ExitWarning, doctor.ExitFailure),
+		// the config is loaded when the command runs, so that a bad config is reported as a check rather than stopping
+		// the other checks
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if doctorOutput != OutputTable && doctorOutput != OutputJson {
+				return errorx.IllegalArgument.New("output must be one of %s or %s", OutputTable, OutputJson)
+			}
+			configErr := initializeConfig(runCmd)
+			results := doctor.RunChecks(context.Background(), doctorChecks(configErr), doctorTimeout)
+			err := printDoctorResults(results)
+			if err != nil {
+				return err
+			}
+			os.Exit(doctor.ExitCode(results))
+			return nil
+		},
+	}
+	doctorCmd.Flags().DurationVar(&doctorTimeout, "timeout", 10*time.Second, "timeout for each check")
+	doctorCmd.Flags().DurationVar(&doctorExpiryWarning, "cert-expiry-warning", 30*24*time.Hour, "warn about certificates that expire within this duration")
+	doctorCmd.Flags().StringVarP(&doctorOutput, "output", "o", OutputTable, "output format, one of table or json")
+	rootCmd.AddCommand(doctorCmd)
+	return doctorCmd
+}
+
+// doctorChecks returns the checks in the order they're run. configErr is the error loading the config, the other
+// checks run with whatever config was loaded so that they can point out more problems.
+func doctorChecks(configErr error) []doctor.Check {
+	checks := []doctor.Check{{
+		Name: "config",
+		Run: func(ctx context.Context) doctor.Result {
+			if configErr != nil {
+				return doctor.Fail(configErr, "fix the config, see config.example.yaml for the schema")
+			}
+			return doctor.Ok("valid")
+		},
+	}}
+	checks = append(checks, doctor.NotifoReachable(config.AppConfig.NotifoBaseUrl))
+	checks = append(checks, doctor.NotifoAuth(config.AppConfig.NotifoBaseUrl, config.AppConfig.NotifoApiKey, config.AppConfig.NotifoAppId)...)
+	checks = append(checks, doctor.Cockroachdb(config.AppConfig.CockroachdbUri, schedulerTables, internal.DatabaseModels...)...)
+	checks = append(checks, doctor.Tls("grpc tls", ServerConfig.TlsCertPath, ServerConfig.TlsKeyPath, ServerConfig.TlsCaPath, doctorExpiryWarning))
+	checks = append(checks, doctor.Port("grpc port", ServerConfig.Port))
+	if config.AppConfig.ServeHttp {
+		checks = append(checks, doctor.Port("http port", config.AppConfig.HttpPort))
+	}
+	if ServerConfig.PrometheusEnabled && ServerConfig.PrometheusPort != 0 {
+		checks = append(checks, doctor.Port("prometheus port", ServerConfig.PrometheusPort))
+	}
+	return checks
+}
+
+func printDoctorResults(results []doctor.Result) error {
+	if doctorOutput == OutputJson {
+		marshalled, err := json.MarshalIndent(map[string]interface{}{"results": results, "exit_code": doctor.ExitCode(results)}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(marshalled))
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "CHECK\tSTATUS\tDETAIL")
+	for _, result := range results {
+		// multi line details, like config errors, continue in the detail column
+		lines := strings.Split(result.Detail, "\n")
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", result.Name, result.Status, lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(writer, "\t\t%s\n", strings.TrimSpace(line))
+		}
+		if result.Hint != "" {
+			fmt.Fprintf(writer, "\t\t  hint: %s\n", result.Hint)
+		}
+	}
+	return writer.Flush()
+}
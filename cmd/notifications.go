@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+)
+
+var sendCmd = NewSendCommand()
+var inboxCmd = NewInboxCommand()
+var subscriptionsCmd = NewSubscriptionsCommand()
+
+var sendInputPath string
+var sendTopic string
+var sendData string
+var inboxRequest notificationsv1alpha1.NotificationsServiceGetNotificationsRequest
+var inboxCorrelationId string
+var subscribeTopicPrefixes []string
+var unsubscribeTopicPrefixes []string
+var subscriptionsInputPath string
+
+// table columns for notifications
+var notificationColumns = []string{"id", "subject", "topic", "created", "correlationId"}
+
+func NewSendCommand() *cobra.Command {
+	sendCmd := newClientCommand("send", "Send notifications through a running server",
+		`Send notifications through a running server. Send a single notification with --topic and --data, or send
+notification events read as protojson, either a json array or one event per line, from the input file or stdin`)
+	sendCmd.Args = cobra.NoArgs
+	sendCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return sendNotifications()
+	}
+	sendCmd.Flags().StringVarP(&sendInputPath, "input", "i", "-", "file to read notification events from, - reads from stdin")
+	sendCmd.Flags().StringVar(&sendTopic, "topic", "", "topic to send a single notification to, e.g. users/<user id>")
+	sendCmd.Flags().StringVar(&sendData, "data", "", "json data of the single notification")
+	rootCmd.AddCommand(sendCmd)
+	return sendCmd
+}
+
+func NewInboxCommand() *cobra.Command {
+	inboxCmd := newClientCommand("inbox <user id>", "List a user's notifications on a running server",
+		`List a user's notifications on a running server`)
+	inboxCmd.Args = cobra.ExactArgs(1)
+	inboxCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		inboxRequest.UserId = args[0]
+		if inboxCorrelationId != "" {
+			inboxRequest.CorrelationId = &inboxCorrelationId
+		}
+		return getInbox()
+	}
+	inboxCmd.Flags().StringSliceVar(&inboxRequest.Channels, "channels", nil, "only list notifications sent on these channels")
+	inboxCmd.Flags().StringVar(&inboxRequest.Query, "query", "", "only list notifications matching this query")
+	inboxCmd.Flags().StringVar(&inboxCorrelationId, "correlation-id", "", "only list notifications with this correlation id, e.g. a scheduled notification's id")
+	inboxCmd.Flags().Int32Var(&inboxRequest.Skip, "skip", 0, "number of notifications to skip")
+	inboxCmd.Flags().Int32Var(&inboxRequest.Limit, "limit", 20, "max number of notifications to list")
+	rootCmd.AddCommand(inboxCmd)
+	return inboxCmd
+}
+
+func NewSubscriptionsCommand() *cobra.Command {
+	subscriptionsCmd := newClientCommand("subscriptions <user id>", "Update a user's subscriptions on a running server",
+		`Update a user's subscriptions on a running server. Subscribe to and unsubscribe from topic prefixes with
+--subscribe and --unsubscribe, or read subscription settings as protojson, either a json array or one per line, from
+the file given with --input`)
+	subscriptionsCmd.Args = cobra.ExactArgs(1)
+	subscriptionsCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return updateSubscriptions(args[0])
+	}
+	subscriptionsCmd.Flags().StringSliceVar(&subscribeTopicPrefixes, "subscribe", nil, "topic prefixes to subscribe to")
+	subscriptionsCmd.Flags().StringSliceVar(&unsubscribeTopicPrefixes, "unsubscribe", nil, "topic prefixes to unsubscribe from")
+	subscriptionsCmd.Flags().StringVarP(&subscriptionsInputPath, "input", "i", "", "file to read subscription settings from, - reads from stdin")
+	rootCmd.AddCommand(subscriptionsCmd)
+	return subscriptionsCmd
+}
+
+func sendNotifications() error {
+	events := []*notificationsv1alpha1.NotificationEvent{}
+	if sendTopic != "" {
+		events = append(events, &notificationsv1alpha1.NotificationEvent{Topic: sendTopic, Data: sendData})
+	} else {
+		err := readMessages(sendInputPath, func() proto.Message {
+			event := &notificationsv1alpha1.NotificationEvent{}
+			events = append(events, event)
+			return event
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(events) == 0 {
+		return errorx.IllegalArgument.New("no notifications to send")
+	}
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.SendNotifications(ctx, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{Notifications: events})
+		if err != nil {
+			return err
+		}
+		return printResult(map[string]interface{}{"success": response.Success, "sent": len(events)})
+	})
+}
+
+func getInbox() error {
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.GetNotifications(ctx, &inboxRequest)
+		if err != nil {
+			return err
+		}
+		messages := []proto.Message{}
+		for _, notification := range response.Notifications {
+			messages = append(messages, notification)
+		}
+		return printMessages(messages, notificationColumns)
+	})
+}
+
+func updateSubscriptions(userId string) error {
+	subscribe := []*notificationsv1alpha1.SubscriptionSettings{}
+	for _, topicPrefix := range subscribeTopicPrefixes {
+		subscribe = append(subscribe, &notificationsv1alpha1.SubscriptionSettings{TopicPrefix: topicPrefix})
+	}
+	if subscriptionsInputPath != "" {
+		err := readMessages(subscriptionsInputPath, func() proto.Message {
+			settings := &notificationsv1alpha1.SubscriptionSettings{}
+			subscribe = append(subscribe, settings)
+			return settings
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(subscribe) == 0 && len(unsubscribeTopicPrefixes) == 0 {
+		return errorx.IllegalArgument.New("nothing to subscribe to or unsubscribe from")
+	}
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		request := &notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest{
+			UserId:      userId,
+			Subscribe:   subscribe,
+			Unsubscribe: unsubscribeTopicPrefixes,
+		}
+		response, err := client.UpdateSubscriptions(ctx, request)
+		if err != nil {
+			return err
+		}
+		return printResult(map[string]interface{}{
+			"success":      response.Success,
+			"subscribed":   len(subscribe),
+			"unsubscribed": len(unsubscribeTopicPrefixes),
+		})
+	})
+}
@@ -12,7 +12,7 @@ import (
 
 const (
 	// The name of our config file, without the file extension because viper supports many different config file languages.
-	defaultConfigFilename = "pipelines-api-grpc"
+	defaultConfigFilename = "go-notifications"
 
 	// The environment variable prefix of all environment variables bound to our command line flags.
 	// For example, --number is bound to STING_NUMBER.
@@ -22,6 +22,10 @@ const (
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = NewRootCommand()
 
+// configPath is the config file set with --config. When it's empty, a go-notifications config file in the working
+// directory is used if there is one.
+var configPath string
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -42,73 +46,98 @@ func NewRootCommand() *cobra.Command {
 
 	// Define our command
 	rootCmd := &cobra.Command{
-		Use:   "stingoftheviper",
-		Short: "Cober and Viper together at last",
-		Long:  `Demonstrate how to get cobra flags to bind to viper properly`,
+		Use:   "go-notifications",
+		Short: "Notifications service",
+		Long:  `Notifications service, backed by notifo, with scheduled notifications stored in cockroachdb`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			// You can bind cobra and viper in a few locations, but PersistencePreRunE on the root command works well
 			return initializeConfig(cmd)
 		},
 		Run: func(cmd *cobra.Command, args []string) {},
 	}
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "path to a yaml, json, or toml config file, see config.example.yaml for the schema")
 
 	return rootCmd
 }
 
 func initializeConfig(cmd *cobra.Command) error {
-	v := viper.New()
-
-	// Set the base name of the config file, without the file extension.
-	v.SetConfigName(defaultConfigFilename)
+	return LoadConfig(cmd, configPath)
+}
 
-	// Set as many paths as you like where viper should look for the
-	// config file. We are only looking in the current working directory.
-	v.AddConfigPath(".")
+// LoadConfig sets the command's flags that weren't set on the command line from environment variables, then from the
+// config file at the path, reads secrets from their files, and validates the flags. When the path is empty, a
+// go-notifications config file in the working directory is used if there is one.
+func LoadConfig(cmd *cobra.Command, path string) error {
+	v := viper.New()
 
-	// Attempt to read the config file, gracefully ignoring errors
-	// caused by a config file not being found. Return an error
-	// if we cannot parse the config file.
-	if err := v.ReadInConfig(); err != nil {
-		// It's okay if there isn't a config file
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+	if path != "" {
+		// a config file that was asked for must exist
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
 			return err
 		}
+	} else {
+		// Set the base name of the config file, without the file extension.
+		v.SetConfigName(defaultConfigFilename)
+
+		// Set as many paths as you like where viper should look for the
+		// config file. We are only looking in the current working directory.
+		v.AddConfigPath(".")
+
+		// Attempt to read the config file, gracefully ignoring errors
+		// caused by a config file not being found. Return an error
+		// if we cannot parse the config file.
+		if err := v.ReadInConfig(); err != nil {
+			// It's okay if there isn't a config file
+			if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+				return err
+			}
+		}
 	}
 
-	// When we bind flags to environment variables expect that the
-	// environment variables are prefixed, e.g. a flag like --number
-	// binds to an environment variable STING_NUMBER. This helps
-	// avoid conflicts.
-	v.SetEnvPrefix(envPrefix)
+	// Bind the current command's flags to environment variables first, so that they take precedence over the config
+	// file
+	err := bindFlags(cmd)
+	if err != nil {
+		return err
+	}
 
-	// Bind to environment variables
-	// Works great for simple config names, but needs help for names
-	// like --favorite-color which we fix in the bindFlags function
-	v.AutomaticEnv()
+	// Apply the config file, which is organized in sections, to the flags that are still unset
+	err = applyConfigFile(cmd, v)
+	if err != nil {
+		return err
+	}
 
-	// Bind the current command's flags to viper
-	bindFlags(cmd, v)
+	// Read secrets that are set with a file
+	err = readSecretFiles(cmd.Flags())
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return validateConfig(cmd.Flags())
 }
 
-// Bind each cobra flag to its associated viper configuration (config file and environment variable)
-func bindFlags(cmd *cobra.Command, v *viper.Viper) {
+// Bind each cobra flag to its associated environment variable. Environment variables can't have dashes in them, so
+// a flag like --favorite-color is bound to FAVORITE_COLOR.
+func bindFlags(cmd *cobra.Command) error {
+	problems := []string{}
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
-		// Environment variables can't have dashes in them, so bind them to their equivalent
-		// keys with underscores, e.g. --favorite-color to STING_FAVORITE_COLOR
-		if strings.Contains(f.Name, "-") {
-			envVarSuffix := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
-			// if we ever decide to use an envPrefix, use the below BindEnv call which handles the prefix, rather than
-			// the one below it, which doesn't
-			//v.BindEnv(f.Name, fmt.Sprintf("%s_%s", envPrefix, envVarSuffix))
-			v.BindEnv(f.Name, envVarSuffix)
+		// the config file has already been read by now
+		if f.Name == "config" {
+			return
+		}
+		envVar := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if envPrefix != "" {
+			envVar = fmt.Sprintf("%s_%s", envPrefix, envVar)
 		}
 
-		// Apply the viper config value to the flag when the flag is not set and viper has a value
-		if !f.Changed && v.IsSet(f.Name) {
-			val := v.Get(f.Name)
-			cmd.Flags().Set(f.Name, fmt.Sprintf("%v", val))
+		// Apply the environment variable to the flag when the flag is not set
+		if val, ok := os.LookupEnv(envVar); ok && !f.Changed {
+			err := cmd.Flags().Set(f.Name, val)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s: %s", envVar, err.Error()))
+			}
 		}
 	})
+	return configError(problems)
 }
@@ -3,22 +3,36 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/catalystsquad/app-utils-go/logging"
+	sentryutils "github.com/catalystsquad/app-utils-go/sentry"
 	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/auth"
 	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	"github.com/catalystsquad/go-notifications/internal/lifecycle"
+	"github.com/catalystsquad/go-notifications/internal/tracing"
 	"github.com/catalystsquad/go-notifications/notification_store"
 	"github.com/catalystsquad/go-notifications/notification_store/notifo_store"
 	pkg2 "github.com/catalystsquad/go-scheduler/pkg"
 	"github.com/catalystsquad/go-scheduler/pkg/cockroachdb_store"
 	"github.com/catalystsquad/grpc-base-go/pkg"
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/joomcode/errorx"
 	"github.com/nozzle/e"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
@@ -44,77 +58,316 @@ func NewRunCommand() *cobra.Command {
 	runCmd.Flags().BoolVar(&ServerConfig.PrometheusEnabled, "prometheus-enabled", false, "set the flag to enable grpc prometheus metrics")
 	runCmd.Flags().IntVar(&ServerConfig.PrometheusPort, "prometheus-port", 0, "what port to serve prometheus metrics on")
 	runCmd.Flags().StringVar(&ServerConfig.PrometheusPath, "prometheus-path", "", "what path to serve prometheus metrics on")
+	runCmd.Flags().DurationVar(&config.AppConfig.MetricsDefinitionsInterval, "metrics-definitions-interval", 5*time.Minute, "how often to count scheduled notification definitions by trigger type for the scheduled definitions metric, 0 disables it")
+	runCmd.Flags().DurationVar(&config.AppConfig.HealthCheckInterval, "health-check-interval", 10*time.Second, "how often to check cockroachdb, notifo, and the scheduler for readiness")
+	runCmd.Flags().DurationVar(&config.AppConfig.HealthCheckTimeout, "health-check-timeout", 5*time.Second, "timeout for each round of readiness checks")
+	runCmd.Flags().DurationVar(&config.AppConfig.ShutdownGracePeriod, "shutdown-grace-period", 30*time.Second, "how long to wait for in flight requests and scheduled notifications to finish on shutdown")
+	runCmd.Flags().DurationVar(&config.AppConfig.ShutdownReadinessDelay, "shutdown-readiness-delay", 5*time.Second, "how long to keep serving requests on shutdown after readiness starts failing, so that load balancers stop routing to the service first, counted in the grace period")
 	runCmd.Flags().StringVar(&ServerConfig.CaptureErrormessage, "capture-error-message", "", "sets the error message used when capturing errors in sentry")
 	runCmd.Flags().StringVar(&ServerConfig.TlsCertPath, "tls-cert-path", "", "path to tls certificates")
 	runCmd.Flags().StringVar(&ServerConfig.TlsKeyPath, "tls-key-path", "", "path to tls key")
 	runCmd.Flags().StringVar(&ServerConfig.TlsCaPath, "tls-ca-path", "", "path to tls ca certificate")
-	runCmd.Flags().Uint16Var(&ServerConfig.MinTlsVersion, "min-tls-version", 0, "set the flag to enable sentry integration")
+	runCmd.Flags().Uint16Var(&ServerConfig.MinTlsVersion, "min-tls-version", 0, "minimum tls version, as the crypto/tls constant, e.g. 771 for tls 1.2. Defaults to tls 1.0")
 	runCmd.Flags().IntVar(&config.AppConfig.HttpPort, "http-port", 1323, "port to serve http on")
 	runCmd.Flags().BoolVar(&config.AppConfig.ServeHttp, "serve-http", false, "use this flag to enable http server via grpc gateway")
 	runCmd.Flags().DurationVar(&config.AppConfig.ScheduleWindow, "schedule-window", 1*time.Second, "the time window to schedule notifications for. If this is set to 30 seconds for example, it will schedule notifications set to be delivered in the next 30 seconds, every 30 seconds.")
 	runCmd.Flags().DurationVar(&config.AppConfig.RunnerWindow, "runner-window", 1*time.Second, "the time window to run notifications for. If this is set to 30 seconds for example, it will deliver notifications set to be delivered in the next 30 seconds, every 30 seconds.")
 	runCmd.Flags().DurationVar(&config.AppConfig.CleanupWindow, "cleanup-window", 1*time.Second, "the time window to cleanup for. If this is set to 30 seconds for example, it will clean up delivered notifications every 30 seconds.")
-	runCmd.Flags().StringVar(&config.AppConfig.CockroachdbUri, "cockroachdb-uri", "", "the cockroachdb connection string")
-	runCmd.Flags().IntVar(&config.AppConfig.CockroachdbMaxIdleConnections, "cockroachdb-max-idle-connections", 5, "max idle connections for cockroachdb")
-	runCmd.Flags().IntVar(&config.AppConfig.CockroachdbMaxOpenConnections, "cockroachdb-max-open-connections", 10, "max open connections for cockroachdb")
-	runCmd.Flags().DurationVar(&config.AppConfig.CockroachdbConnMaxLifetime, "cockroachdb-connection-max-lifetime", time.Hour, "max connection lifetime for cockroachdb")
+	addCockroachdbFlags(runCmd.Flags())
+	runCmd.Flags().BoolVar(&config.AppConfig.AuthEnabled, "auth-enabled", false, "require a bearer jwt or api key on grpc and http requests")
+	runCmd.Flags().StringVar(&config.AppConfig.AuthJwksPath, "auth-jwks-path", "", "path to a jwks file with the keys used to verify jwts, only api keys are accepted when neither this nor --auth-jwks-url is set")
+	runCmd.Flags().StringVar(&config.AppConfig.AuthJwksUrl, "auth-jwks-url", "", "url of a jwks with the keys used to verify jwts, e.g. an oidc provider's jwks_uri")
+	runCmd.Flags().DurationVar(&config.AppConfig.AuthJwksRefreshInterval, "auth-jwks-refresh-interval", time.Hour, "how often to reload the jwks, 0 disables periodic reloads")
+	runCmd.Flags().StringVar(&config.AppConfig.AuthIssuer, "auth-issuer", "", "required jwt issuer, not checked when empty")
+	runCmd.Flags().StringVar(&config.AppConfig.AuthAudience, "auth-audience", "", "required jwt audience, not checked when empty")
+	runCmd.Flags().StringVar(&config.AppConfig.AuthRolesClaim, "auth-roles-claim", "roles", "jwt claim holding the caller's roles")
+	runCmd.Flags().StringVar(&config.AppConfig.AuthUserIdClaim, "auth-user-id-claim", "sub", "jwt claim holding an end user's user id")
+	runCmd.Flags().StringSliceVar(&config.AppConfig.AuthEndUserRoles, "auth-end-user-roles", []string{"end-user"}, "role claim values that grant the end user role, which can only access the caller's own inbox, subscriptions and profile")
+	runCmd.Flags().StringSliceVar(&config.AppConfig.AuthServiceRoles, "auth-service-roles", []string{"service"}, "role claim values that grant the service role, which can call everything except admin operations")
+	runCmd.Flags().StringSliceVar(&config.AppConfig.AuthAdminRoles, "auth-admin-roles", []string{"admin"}, "role claim values that grant the admin role, which adds user deletion and bulk operations to the service role")
+	runCmd.Flags().DurationVar(&config.AppConfig.AuditRetention, "audit-retention", 0, "how long to keep audit log entries, 0 keeps them forever")
+	runCmd.Flags().StringVar(&config.AppConfig.TracingExporter, "tracing-exporter", tracing.ExporterNone, "where to export traces, one of none, otlp, or stdout")
+	runCmd.Flags().StringVar(&config.AppConfig.TracingOtlpEndpoint, "tracing-otlp-endpoint", "", "host:port of the otlp grpc collector, defaults to the OTEL_EXPORTER_OTLP_ENDPOINT env var")
+	runCmd.Flags().BoolVar(&config.AppConfig.TracingOtlpInsecure, "tracing-otlp-insecure", false, "connect to the otlp collector without tls")
+	runCmd.Flags().Float64Var(&config.AppConfig.TracingSampleRatio, "tracing-sample-ratio", 1, "fraction of traces to sample, between 0 and 1. Traces started by callers follow the caller's sampling decision")
+	runCmd.Flags().StringVar(&config.AppConfig.TracingServiceName, "tracing-service-name", "go-notifications", "service name reported on spans")
 	runCmd.Flags().StringVar(&config.AppConfig.NotifoApiKey, "notifo-api-key", "", "the notifo api key")
+	runCmd.Flags().StringVar(&config.AppConfig.NotifoApiKeyFile, "notifo-api-key-file", "", "file to read the notifo api key from instead of --notifo-api-key. The file is watched and the key is reloaded when it changes")
 	runCmd.Flags().StringVar(&config.AppConfig.NotifoBaseUrl, "notifo-base-url", "http://localhost:5000", "the notifo base url")
 	runCmd.Flags().StringVar(&config.AppConfig.NotifoAppId, "notifo-app-id", "", "the notifo app id")
+	runCmd.Flags().IntVar(&config.AppConfig.NotifoConcurrency, "notifo-concurrency", 10, "max number of concurrent notifo requests when getting or deleting many users, which notifo handles one user at a time")
+	runCmd.Flags().DurationVar(&config.AppConfig.UserCacheTtl, "user-cache-ttl", 0, "how long to cache users looked up by id, 0 disables the user cache. Users upserted or deleted through another replica are seen when their entries expire")
+	runCmd.Flags().DurationVar(&config.AppConfig.UserCacheNegativeTtl, "user-cache-negative-ttl", time.Minute, "how long to cache that a user id wasn't found, 0 doesn't cache unknown ids")
+	runCmd.Flags().IntVar(&config.AppConfig.UserCacheMaxSize, "user-cache-max-size", 10000, "max number of users and unknown ids in the user cache, the least recently used are evicted")
+	runCmd.Flags().StringSliceVar(&config.AppConfig.StoreMiddlewares, "store-middlewares", []string{notification_store.MiddlewareCache, notification_store.MiddlewareInstrumented}, fmt.Sprintf("middlewares to wrap the notification store in, outermost first, any of %s", strings.Join(notification_store.MiddlewareNames(), ", ")))
+	runCmd.Flags().StringVar(&config.AppConfig.StoreFaultsFile, "store-faults-file", "", "file with a json array of fault rules to inject into notification store calls from startup, for rehearsing outages. Requires the faults store middleware, rules can also be changed at runtime with the store faults admin endpoint")
+	runCmd.Flags().IntVar(&config.AppConfig.StoreRetryAttempts, "store-retry-attempts", 3, "max number of calls the retry store middleware makes for a failed notification store call, including the first")
+	runCmd.Flags().DurationVar(&config.AppConfig.StoreRetryBackoff, "store-retry-backoff", 100*time.Millisecond, "how long the retry store middleware waits before the first retry, doubled for each retry after")
+	runCmd.Flags().StringVar(&config.AppConfig.ResolverSecret, "resolver-secret", "", "secret used to sign resolver requests. When set, requests include an X-Notifications-Signature header with the hmac sha256 of the timestamp and body")
+	runCmd.Flags().StringVar(&config.AppConfig.ResolverSecretFile, "resolver-secret-file", "", "file to read the resolver secret from instead of --resolver-secret. The file is read once on startup, restart the service to pick up a new secret")
+	runCmd.Flags().DurationVar(&config.AppConfig.ResolverTimeout, "resolver-timeout", 5*time.Second, "timeout for each resolver request")
+	runCmd.Flags().StringVar(&config.AppConfig.ResolverFallback, "resolver-fallback", internal.ResolverFallbackStale, "what to do when the resolver fails or times out. One of stale (send the scheduled data), skip (don't send), or retry (retry the resolver, then fail the execution)")
+	runCmd.Flags().IntVar(&config.AppConfig.ResolverMaxRetries, "resolver-max-retries", 3, "max number of times to retry the resolver when resolver-fallback is retry")
 	rootCmd.AddCommand(runCmd)
 
 	return runCmd
 }
 
 func runServer() {
+	err := serve()
+	if err != nil {
+		logging.Log.WithError(e.Wrap(err)).Error("error running notifications service")
+		os.Exit(1)
+	}
+}
+
+// serve initializes the service and runs it until it's signalled to stop or a critical component fails. Cleanup is
+// deferred so that it runs after the components have been drained, whichever way it stops.
+func serve() error {
+	tracingDeferredFunc, err := tracing.Initialize(
+		config.AppConfig.TracingExporter,
+		config.AppConfig.TracingOtlpEndpoint,
+		config.AppConfig.TracingOtlpInsecure,
+		config.AppConfig.TracingSampleRatio,
+		config.AppConfig.TracingServiceName,
+	)
+	if err != nil {
+		return errorx.Decorate(err, "error initializing tracing")
+	}
+	defer tracingDeferredFunc()
 	// instantiate store
-	notification_store.NotificationStore = notifo_store.NotifoNotificationStore{}
+	notification_store.NotificationStore, err = notification_store.Chain(notifo_store.NotifoNotificationStore{}, config.AppConfig.StoreMiddlewares)
+	if err != nil {
+		return errorx.Decorate(err, "error building notification store middlewares")
+	}
+	if config.AppConfig.StoreFaultsFile != "" {
+		if !notification_store.Faults.Enabled() {
+			return errorx.IllegalArgument.New("store-faults-file requires the %s store middleware", notification_store.MiddlewareFaults)
+		}
+		rules, err := notification_store.LoadFaultRules(config.AppConfig.StoreFaultsFile)
+		if err != nil {
+			return err
+		}
+		err = notification_store.Faults.SetRules(rules)
+		if err != nil {
+			return err
+		}
+	}
 	notificationStoreDeferredFunc, err := notification_store.NotificationStore.Initialize()
 	if err != nil {
-		logging.Log.WithError(err).Fatal("error initializing notification store")
+		return errorx.Decorate(err, "error initializing notification store")
 	}
 	if notificationStoreDeferredFunc != nil {
 		defer notificationStoreDeferredFunc()
 	}
-	go startScheduler()
+	databaseDeferredFunc, err := initializeDatabase()
+	if err != nil {
+		return errorx.Decorate(err, "error initializing database")
+	}
+	defer databaseDeferredFunc()
+	go internal.PurgeAuditLog(context.Background(), config.AppConfig.AuditRetention)
+	go internal.PurgeFiredRelativeSchedules(context.Background())
+	ServerConfig.HealthServer = internal.Health.Server
+	ServerConfig.UnaryServerInterceptors = append(ServerConfig.UnaryServerInterceptors, otelgrpc.UnaryServerInterceptor())
+	ServerConfig.StreamServerInterceptors = append(ServerConfig.StreamServerInterceptors, otelgrpc.StreamServerInterceptor())
+	// audit before authenticating so that denied requests are recorded too. The base server runs its AuthFunc ahead of
+	// every other interceptor, so authentication is added as an interceptor instead.
+	ServerConfig.UnaryServerInterceptors = append(ServerConfig.UnaryServerInterceptors, internal.AuditUnary)
+	authenticator, err := maybeInitializeAuth()
+	if err != nil {
+		return errorx.Decorate(err, "error initializing auth")
+	}
+	if authenticator != nil {
+		ServerConfig.UnaryServerInterceptors = append(ServerConfig.UnaryServerInterceptors, grpc_auth.UnaryServerInterceptor(authenticator.AuthFunc), internal.AuthorizeUnary)
+		ServerConfig.StreamServerInterceptors = append(ServerConfig.StreamServerInterceptors, grpc_auth.StreamServerInterceptor(authenticator.AuthFunc))
+	}
 	server, err := pkg.NewGrpcServer(ServerConfig)
 	if err != nil {
-		logging.Log.WithError(e.Wrap(err)).Error("error instantiating grpc server")
-		os.Exit(1)
+		return errorx.Decorate(err, "error instantiating grpc server")
 	}
 	registerServices(server.Server)
-	err = maybeServeHttp()
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", ServerConfig.Port))
 	if err != nil {
-		logging.Log.WithError(e.Wrap(err)).Error("error serving grpc gateway")
-		os.Exit(1)
+		return errorx.Decorate(err, "error creating grpc listener")
+	}
+	if ServerConfig.SentryEnabled {
+		sentryutils.MaybeInitSentry(ServerConfig.SentryClientOptions, nil)
 	}
-	err = server.Run()
+	httpServer, err := maybeNewHttpServer(authenticator)
 	if err != nil {
-		logging.Log.WithError(e.Wrap(err)).Error("error running grpc server")
-		os.Exit(1)
+		return errorx.Decorate(err, "error initializing grpc gateway")
 	}
+	// components are stopped in the reverse of this order, so readiness fails first, then http and grpc requests are
+	// drained, then metrics stop being served, and then scheduled notifications are drained
+	manager := lifecycle.NewManager(config.AppConfig.ShutdownGracePeriod)
+	manager.Add(lifecycle.Component{
+		Name:     "scheduler",
+		Critical: true,
+		Run:      runScheduler,
+		Stop:     internal.DrainScheduledNotifications,
+	})
+	if ServerConfig.PrometheusEnabled {
+		metricsServer := newMetricsServer(server.Server)
+		manager.Add(lifecycle.Component{
+			Name:     "metrics server",
+			Critical: true,
+			Run: func(ctx context.Context) error {
+				return serveHttp(metricsServer)
+			},
+			Stop: metricsServer.Shutdown,
+		})
+	}
+	manager.Add(lifecycle.Component{
+		Name:     "grpc server",
+		Critical: true,
+		Run: func(ctx context.Context) error {
+			logging.Log.WithField("listening_on", listener.Addr().String()).Info("grpc server started")
+			return server.Server.Serve(listener)
+		},
+		Stop: func(ctx context.Context) error {
+			return gracefulStop(ctx, server.Server)
+		},
+	})
+	if httpServer != nil {
+		manager.Add(lifecycle.Component{
+			Name:     "http server",
+			Critical: true,
+			Run: func(ctx context.Context) error {
+				return serveHttp(httpServer)
+			},
+			Stop: httpServer.Shutdown,
+		})
+	}
+	manager.Add(lifecycle.Component{
+		Name: "health checker",
+		Run: func(ctx context.Context) error {
+			internal.Health.Run(ctx, config.AppConfig.HealthCheckInterval, config.AppConfig.HealthCheckTimeout)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			internal.Health.Shutdown()
+			// give load balancers time to see readiness fail and stop routing requests before the servers stop
+			// accepting them
+			select {
+			case <-time.After(config.AppConfig.ShutdownReadinessDelay):
+			case <-ctx.Done():
+			}
+			return nil
+		},
+	})
+	return manager.Run(context.Background())
 }
 
-func startScheduler() error {
+// serveHttp serves http until the server is shut down
+func serveHttp(httpServer *http.Server) error {
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// newMetricsServer registers the grpc server's prometheus metrics and returns an http server for them, along with the
+// service's metrics. The grpc server is served on a listener the service owns rather than by the base server's Run, so
+// that shutdown is left to the lifecycle manager, which means serving metrics is too.
+func newMetricsServer(grpcServer *grpc.Server) *http.Server {
+	grpc_prometheus.Register(grpcServer)
+	if ServerConfig.PrometheusEnableLatencyHistograms {
+		grpc_prometheus.EnableHandlingTimeHistogram()
+	}
+	path := ServerConfig.PrometheusPath
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	return &http.Server{Addr: fmt.Sprintf(":%d", ServerConfig.PrometheusPort), Handler: mux}
+}
+
+// gracefulStop stops the grpc server from accepting requests and waits for the ones in flight to finish, after which
+// Serve returns. Requests still running when the context is done are cancelled.
+func gracefulStop(ctx context.Context, server *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return errorx.TimeoutElapsed.New("timed out waiting for grpc requests to finish")
+	}
+}
+
+// initializeDatabase connects to cockroachdb and migrates the service's tables
+func initializeDatabase() (func(), error) {
+	return database.Initialize(
+		config.AppConfig.CockroachdbUri,
+		config.AppConfig.CockroachdbMaxIdleConnections,
+		config.AppConfig.CockroachdbMaxOpenConnections,
+		config.AppConfig.CockroachdbConnMaxLifetime,
+		internal.DatabaseModels...,
+	)
+}
+
+// addCockroachdbFlags adds the cockroachdb connection flags, which are shared by every command that uses the database
+func addCockroachdbFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&config.AppConfig.CockroachdbUri, "cockroachdb-uri", "", "the cockroachdb connection string")
+	flags.StringVar(&config.AppConfig.CockroachdbUriFile, "cockroachdb-uri-file", "", "file to read the cockroachdb connection string from instead of --cockroachdb-uri. The file is read once on startup, restart the service to pick up a new connection string")
+	flags.IntVar(&config.AppConfig.CockroachdbMaxIdleConnections, "cockroachdb-max-idle-connections", 5, "max idle connections for cockroachdb")
+	flags.IntVar(&config.AppConfig.CockroachdbMaxOpenConnections, "cockroachdb-max-open-connections", 10, "max open connections for cockroachdb")
+	flags.DurationVar(&config.AppConfig.CockroachdbConnMaxLifetime, "cockroachdb-connection-max-lifetime", time.Hour, "max connection lifetime for cockroachdb")
+}
+
+// runScheduler instantiates and runs the scheduler until the context is done. It returns an error if the scheduler
+// can't be started or stops running, which also fails the readiness check.
+func runScheduler(ctx context.Context) error {
+	scheduler, err := newScheduler()
+	if err != nil {
+		internal.Health.SchedulerFailed(err)
+		return err
+	}
+	internal.Scheduler = scheduler
+	if ServerConfig.PrometheusEnabled {
+		go internal.RecordScheduledDefinitionCounts(ctx, config.AppConfig.MetricsDefinitionsInterval)
+	}
+	internal.Health.SchedulerStarted()
+	stopped := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				stopped <- errorx.IllegalState.New("scheduler panicked: %v", r)
+			}
+		}()
+		internal.Scheduler.Run()
+		stopped <- errorx.IllegalState.New("scheduler stopped running")
+	}()
+	select {
+	case err = <-stopped:
+		internal.Health.SchedulerFailed(err)
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// newScheduler instantiates the scheduler without running it
+func newScheduler() (*pkg2.Scheduler, error) {
 	cockroachdbStore := cockroachdb_store.NewCockroachdbStore(config.AppConfig.CockroachdbUri, nil,
 		cockroachdb_store.WithConnectionSettings(
 			config.AppConfig.CockroachdbMaxIdleConnections,
 			config.AppConfig.CockroachdbMaxOpenConnections,
 			config.AppConfig.CockroachdbConnMaxLifetime,
 		))
-	var err error
-	internal.Scheduler, err = pkg2.NewScheduler(
+	return pkg2.NewScheduler(
 		config.AppConfig.ScheduleWindow,
 		config.AppConfig.RunnerWindow,
 		config.AppConfig.CleanupWindow,
 		internal.HandleScheduledNotification,
 		cockroachdbStore,
 	)
-	if err != nil {
-		return err
-	}
-	internal.Scheduler.Run()
-	return nil
 }
 
 func registerServices(server *grpc.Server) {
@@ -122,21 +375,61 @@ func registerServices(server *grpc.Server) {
 	notificationsv1alpha1.RegisterNotificationsServiceServer(server, notificationsApiServer)
 }
 
-func maybeServeHttp() error {
-	if config.AppConfig.ServeHttp {
-		// Register gRPC server endpoint
-		// Note: Make sure the gRPC server is running properly and accessible
-		mux := runtime.NewServeMux()
-		opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
-		grpcAddress := fmt.Sprintf("localhost:%d", ServerConfig.Port)
-		err := notificationsv1alpha1.RegisterNotificationsServiceHandlerFromEndpoint(context.Background(), mux, grpcAddress, opts)
+// maybeInitializeAuth returns an authenticator when auth is enabled, and nil otherwise
+func maybeInitializeAuth() (*auth.Authenticator, error) {
+	if !config.AppConfig.AuthEnabled {
+		return nil, nil
+	}
+	var verifier *auth.Verifier
+	if config.AppConfig.AuthJwksPath != "" || config.AppConfig.AuthJwksUrl != "" {
+		keySet, err := auth.NewKeySet(config.AppConfig.AuthJwksPath, config.AppConfig.AuthJwksUrl)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		// Start HTTP server (and proxy calls to gRPC server endpoint)
-		// TODO detect liveness?
-		go http.ListenAndServe(fmt.Sprintf(":%d", config.AppConfig.HttpPort), mux)
-		return nil
+		go keySet.Refresh(context.Background(), config.AppConfig.AuthJwksRefreshInterval)
+		verifier = auth.NewVerifier(keySet, config.AppConfig.AuthIssuer, config.AppConfig.AuthAudience)
+	}
+	roles := auth.RoleMapping{
+		RolesClaim:   config.AppConfig.AuthRolesClaim,
+		UserIdClaim:  config.AppConfig.AuthUserIdClaim,
+		EndUserRoles: config.AppConfig.AuthEndUserRoles,
+		ServiceRoles: config.AppConfig.AuthServiceRoles,
+		AdminRoles:   config.AppConfig.AuthAdminRoles,
+	}
+	return auth.NewAuthenticator(verifier, roles, internal.ApiKeyStore{}), nil
+}
+
+// maybeNewHttpServer returns the grpc gateway's http server when http is enabled, and nil otherwise. The server isn't
+// started.
+func maybeNewHttpServer(authenticator *auth.Authenticator) (*http.Server, error) {
+	if !config.AppConfig.ServeHttp {
+		return nil, nil
+	}
+	// Register gRPC server endpoint
+	// Note: Make sure the gRPC server is running properly and accessible
+	mux := runtime.NewServeMux()
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+	}
+	grpcAddress := fmt.Sprintf("localhost:%d", ServerConfig.Port)
+	err := notificationsv1alpha1.RegisterNotificationsServiceHandlerFromEndpoint(context.Background(), mux, grpcAddress, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = internal.RegisterHttpHandlers(mux)
+	if err != nil {
+		return nil, err
+	}
+	var handler http.Handler = mux
+	if authenticator != nil {
+		handler = authenticator.HttpMiddleware(mux)
 	}
-	return nil
+	handler = otelhttp.NewHandler(handler, "grpc-gateway")
+	// health endpoints are unauthenticated so that probes don't need credentials
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/healthz", internal.HandleLiveness)
+	serveMux.HandleFunc("/readyz", internal.HandleReadiness)
+	serveMux.Handle("/", handler)
+	return &http.Server{Addr: fmt.Sprintf(":%d", config.AppConfig.HttpPort), Handler: serveMux}, nil
 }
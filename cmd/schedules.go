@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+)
+
+var schedulesCmd = NewSchedulesCommand()
+
+var exportFilter internal.ExportFilter
+var exportOutputPath string
+var importOptions internal.ImportOptions
+var importInputPath string
+var importIdMapPath string
+var createInputPath string
+var listRequest notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest
+var previewCron string
+var previewCount int
+var previewJitterWindow time.Duration
+var previewFrom string
+
+// table columns for scheduled notifications
+var scheduledNotificationColumns = []string{"id", "userId", "cronTrigger.expression", "executeOnceTrigger.fireAt", "notification.topic"}
+
+func NewSchedulesCommand() *cobra.Command {
+	schedulesCmd := &cobra.Command{
+		Use:   "schedules",
+		Short: "Manage scheduled notifications",
+		Long:  `Manage scheduled notifications`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return initializeConfig(cmd)
+		},
+	}
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export scheduled notifications as jsonl",
+		Long: `Export scheduled notifications as jsonl. Each line holds a protojson encoded scheduled notification under
+scheduledNotification, and its resolver url, calendar, and jitter window under settings.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return exportSchedules()
+		},
+	}
+	exportCmd.Flags().StringVarP(&exportOutputPath, "output", "o", "-", "file to write to, - writes to stdout")
+	exportCmd.Flags().StringSliceVar(&exportFilter.Ids, "ids", nil, "only export scheduled notifications with these ids")
+	exportCmd.Flags().StringVar(&exportFilter.UserId, "user-id", "", "only export scheduled notifications for this user")
+	exportCmd.Flags().StringVar(&exportFilter.TriggerType, "trigger", "", "only export scheduled notifications with this trigger type, cron or execute-once")
+	exportCmd.Flags().IntVar(&exportFilter.PageSize, "page-size", 500, "number of scheduled notifications to read from the database at a time")
+	addCockroachdbFlags(exportCmd.Flags())
+	schedulesCmd.AddCommand(exportCmd)
+
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import scheduled notifications from jsonl",
+		Long: `Import scheduled notifications from jsonl in the format written by export. Every line is validated, and
+with --on-conflict fail every id is checked for conflicts, before anything is saved. The input is spooled to a
+temporary file rather than held in memory.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return importSchedules()
+		},
+	}
+	importCmd.Flags().StringVarP(&importInputPath, "input", "i", "-", "file to read from, - reads from stdin")
+	importCmd.Flags().BoolVar(&importOptions.DryRun, "dry-run", false, "validate and report what would be imported without saving anything")
+	importCmd.Flags().BoolVar(&importOptions.RemapIds, "remap-ids", false, "give every imported scheduled notification a new id")
+	importCmd.Flags().StringVar(&importIdMapPath, "id-map", "", "file to write the old to new id mapping to, as json, when ids are remapped or missing. Lines without an id are keyed as line:<n>")
+	importCmd.Flags().StringVar(&importOptions.OnConflict, "on-conflict", internal.ConflictStrategyFail, "what to do when a scheduled notification with the same id exists. One of fail, skip, or overwrite")
+	addCockroachdbFlags(importCmd.Flags())
+	schedulesCmd.AddCommand(importCmd)
+
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create or update scheduled notifications on a running server",
+		Long: `Create or update scheduled notifications on a running server, read as protojson, either a json array or one
+scheduled notification per line, from the input file or stdin`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return createSchedules()
+		},
+	}
+	createCmd.Flags().StringVarP(&createInputPath, "input", "i", "-", "file to read scheduled notifications from, - reads from stdin")
+	addClientFlags(createCmd.Flags())
+	schedulesCmd.AddCommand(createCmd)
+
+	listCmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List scheduled notifications on a running server",
+		Long:         `List scheduled notifications on a running server`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listSchedules()
+		},
+	}
+	listCmd.Flags().StringSliceVar(&listRequest.Ids, "ids", nil, "only list scheduled notifications with these ids")
+	listCmd.Flags().StringVar(&listRequest.UserId, "user-id", "", "only list scheduled notifications for this user")
+	listCmd.Flags().Int32Var(&listRequest.Skip, "skip", 0, "number of scheduled notifications to skip")
+	listCmd.Flags().Int32Var(&listRequest.Limit, "limit", 100, "max number of scheduled notifications to list")
+	addClientFlags(listCmd.Flags())
+	schedulesCmd.AddCommand(listCmd)
+
+	deleteCmd := &cobra.Command{
+		Use:          "delete <id>...",
+		Short:        "Delete scheduled notifications on a running server",
+		Long:         `Delete scheduled notifications by id on a running server`,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteSchedules(args)
+		},
+	}
+	addClientFlags(deleteCmd.Flags())
+	schedulesCmd.AddCommand(deleteCmd)
+
+	previewCmd := &cobra.Command{
+		Use:   "preview [id]...",
+		Short: "Preview when scheduled notifications will be sent",
+		Long: `Preview when scheduled notifications will be sent. Scheduled notifications are read from a running server by
+id, or a cron expression can be previewed with --cron. Fire times are computed locally in utc and include each
+scheduled notification's offset in --jitter-window, which should match the window set on them. Calendars are applied
+when notifications fire, so they aren't reflected in the preview.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return previewSchedules(args)
+		},
+	}
+	previewCmd.Flags().StringVar(&previewCron, "cron", "", "cron expression to preview instead of scheduled notifications")
+	previewCmd.Flags().IntVar(&previewCount, "count", 5, "number of fire times to preview for each scheduled notification")
+	previewCmd.Flags().StringVar(&previewFrom, "from", "", "rfc3339 time to preview fire times after, defaults to now")
+	previewCmd.Flags().DurationVar(&previewJitterWindow, "jitter-window", 0, "the jitter window set on the scheduled notifications")
+	addClientFlags(previewCmd.Flags())
+	schedulesCmd.AddCommand(previewCmd)
+
+	rootCmd.AddCommand(schedulesCmd)
+	return schedulesCmd
+}
+
+func exportSchedules() error {
+	var err error
+	internal.Scheduler, err = newScheduler()
+	if err != nil {
+		return err
+	}
+	var output io.Writer = os.Stdout
+	if exportOutputPath != "-" {
+		file, err := os.Create(exportOutputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	exported, err := internal.ExportScheduledNotifications(output, exportFilter)
+	logging.Log.WithField("exported", exported).Info("exported scheduled notifications")
+	return err
+}
+
+func importSchedules() error {
+	var err error
+	internal.Scheduler, err = newScheduler()
+	if err != nil {
+		return err
+	}
+	var input io.Reader = os.Stdin
+	if importInputPath != "-" {
+		file, err := os.Open(importInputPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+	result, err := internal.ImportScheduledNotifications(input, importOptions)
+	if result != nil {
+		logging.Log.WithFields(logrus.Fields{
+			"created": result.Created,
+			"updated": result.Updated,
+			"skipped": result.Skipped,
+			"dry_run": importOptions.DryRun,
+		}).Info("imported scheduled notifications")
+		if importIdMapPath != "" && len(result.IdMap) > 0 {
+			idMapErr := writeIdMap(importIdMapPath, result.IdMap)
+			if idMapErr != nil {
+				return idMapErr
+			}
+		}
+	}
+	return err
+}
+
+func writeIdMap(path string, idMap map[string]string) error {
+	bytes, err := json.MarshalIndent(idMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(fmt.Sprintf("%s\n", bytes)), 0644)
+}
+
+func createSchedules() error {
+	scheduledNotifications := []*notificationsv1alpha1.ScheduledNotification{}
+	err := readMessages(createInputPath, func() proto.Message {
+		scheduledNotification := &notificationsv1alpha1.ScheduledNotification{}
+		scheduledNotifications = append(scheduledNotifications, scheduledNotification)
+		return scheduledNotification
+	})
+	if err != nil {
+		return err
+	}
+	if len(scheduledNotifications) == 0 {
+		return errorx.IllegalArgument.New("no scheduled notifications to create")
+	}
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		request := &notificationsv1alpha1.NotificationsServiceUpsertScheduledNotificationsRequest{Notifications: scheduledNotifications}
+		response, err := client.UpsertScheduledNotifications(ctx, request)
+		if err != nil {
+			return err
+		}
+		return printResult(map[string]interface{}{"success": response.Success, "upserted": len(scheduledNotifications)})
+	})
+}
+
+func listSchedules() error {
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.GetScheduledNotifications(ctx, &listRequest)
+		if err != nil {
+			return err
+		}
+		messages := []proto.Message{}
+		for _, scheduledNotification := range response.ScheduledNotifications {
+			messages = append(messages, scheduledNotification)
+		}
+		return printMessages(messages, scheduledNotificationColumns)
+	})
+}
+
+func deleteSchedules(ids []string) error {
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.DeleteScheduledNotifications(ctx, &notificationsv1alpha1.NotificationsServiceDeleteScheduledNotificationsRequest{Ids: ids})
+		if err != nil {
+			return err
+		}
+		return printResult(map[string]interface{}{"success": response.Success, "deleted": len(ids)})
+	})
+}
+
+func previewSchedules(ids []string) error {
+	if (previewCron == "") == (len(ids) == 0) {
+		return errorx.IllegalArgument.New("preview either scheduled notification ids or a --cron expression")
+	}
+	from := clock.Now()
+	if previewFrom != "" {
+		var err error
+		from, err = time.Parse(time.RFC3339, previewFrom)
+		if err != nil {
+			return errorx.IllegalArgument.Wrap(err, "invalid --from time")
+		}
+	}
+	if previewCron != "" {
+		err := validateOutput()
+		if err != nil {
+			return err
+		}
+		scheduledNotification := &notificationsv1alpha1.ScheduledNotification{
+			Trigger: &notificationsv1alpha1.ScheduledNotification_CronTrigger{CronTrigger: &notificationsv1alpha1.CronTrigger{Expression: previewCron}},
+		}
+		return printPreview([]*notificationsv1alpha1.ScheduledNotification{scheduledNotification}, from)
+	}
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.GetScheduledNotifications(ctx, &notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest{Ids: ids, Limit: int32(len(ids))})
+		if err != nil {
+			return err
+		}
+		if len(response.ScheduledNotifications) == 0 {
+			return errorx.DataUnavailable.New("no scheduled notifications found")
+		}
+		return printPreview(response.ScheduledNotifications, from)
+	})
+}
+
+func printPreview(scheduledNotifications []*notificationsv1alpha1.ScheduledNotification, from time.Time) error {
+	previews := []map[string]interface{}{}
+	for _, scheduledNotification := range scheduledNotifications {
+		fireTimes, err := internal.PreviewFireTimes(scheduledNotification, previewJitterWindow, from, previewCount)
+		if err != nil {
+			return err
+		}
+		formatted := []string{}
+		for _, fireTime := range fireTimes {
+			formatted = append(formatted, fireTime.Format(time.RFC3339))
+		}
+		previews = append(previews, map[string]interface{}{"id": scheduledNotification.Id, "fireTimes": formatted})
+	}
+	if clientOpts.output != OutputTable {
+		return printValues(previews)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tFIRE TIMES")
+	for _, preview := range previews {
+		fmt.Fprintf(writer, "%s\t%s\n", preview["id"], strings.Join(preview["fireTimes"].([]string), ", "))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/client"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	userFormatCsv   = "csv"
+	userFormatJsonl = "jsonl"
+	bulkUsersPath   = "/v1alpha1/bulk/users"
+	maxUserLineSize = 1 << 20
+)
+
+var gatewayUrl string
+var userTransferPath string
+var userTransferFormat string
+var userImportCheckpointPath string
+var userExportColumns []string
+var userExportResume bool
+
+// addUserTransferCommands adds the import and export commands, which stream users through the grpc gateway's bulk
+// endpoints
+func addUserTransferCommands(usersCmd *cobra.Command) {
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import users from csv or jsonl",
+		Long: `Import users from csv or jsonl through the http gateway's bulk endpoint, which upserts them in batches and
+reports the rows that fail without stopping. Jsonl has one protojson encoded user per line. Csv has a header of
+protojson field names, e.g. id,fullName,emailAddress, with dots for nested fields, and a user per row. Empty cells are
+left unset, and cells are converted to the type of their field, with lists, maps, and messages as json like the export
+writes them. Rows are numbered from the first user.
+
+With --checkpoint-file, the last checkpoint is saved as the import progresses, and an import that stopped resumes
+from it when run again with the same input. The file is removed when the import finishes.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return importUsers()
+		},
+	}
+	importCmd.Flags().StringVarP(&userTransferPath, "input", "i", "-", "file to read users from, - reads from stdin")
+	importCmd.Flags().StringVar(&userImportCheckpointPath, "checkpoint-file", "", "file to save the import's checkpoint to, and resume from")
+	addUserTransferFlags(importCmd.Flags())
+	usersCmd.AddCommand(importCmd)
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export users as csv or jsonl",
+		Long: `Export every user as csv or jsonl through the http gateway's bulk endpoint. With --resume, an export to a
+file that stopped is continued after the users already in the file.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return exportUsers()
+		},
+	}
+	exportCmd.Flags().StringVarP(&userTransferPath, "file", "f", "-", "file to write users to, - writes to stdout")
+	exportCmd.Flags().StringSliceVar(&userExportColumns, "columns", userColumns, "protojson field names to export as csv columns, with dots for nested fields")
+	exportCmd.Flags().BoolVar(&userExportResume, "resume", false, "append to the file, skipping the users already in it")
+	addUserTransferFlags(exportCmd.Flags())
+	usersCmd.AddCommand(exportCmd)
+}
+
+func addUserTransferFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&gatewayUrl, "gateway-url", "http://localhost:1323", "url of the notifications http gateway. The tls flags apply to https urls.")
+	flags.StringVar(&userTransferFormat, "format", "", "csv or jsonl, defaults to csv for .csv files and jsonl otherwise")
+}
+
+func importUsers() error {
+	format, err := getUserTransferFormat()
+	if err != nil {
+		return err
+	}
+	var input io.ReadCloser = os.Stdin
+	if userTransferPath != "-" {
+		input, err = os.Open(userTransferPath)
+		if err != nil {
+			return err
+		}
+	}
+	defer input.Close()
+	skip, err := readImportCheckpoint()
+	if err != nil {
+		return err
+	}
+	body := io.Reader(input)
+	if format == userFormatCsv {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(csvToJsonLines(input, writer))
+		}()
+		body = reader
+	}
+	response, err := gatewayRequest(http.MethodPost, bulkUsersPath, skip, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		event := internal.UserImportEvent{}
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return errorx.IllegalFormat.Wrap(err, "invalid response line")
+		}
+		switch {
+		case event.Row != 0:
+			logging.Log.WithFields(logrus.Fields{"row": event.Row, "id": event.Id}).Warn(event.Error)
+		case event.Checkpoint != 0:
+			err = writeImportCheckpoint(event.Checkpoint)
+			if err != nil {
+				return err
+			}
+		case event.Summary != nil:
+			logging.Log.WithFields(logrus.Fields{
+				"imported": event.Summary.Imported,
+				"failed":   event.Summary.Failed,
+				"skipped":  event.Summary.Skipped,
+			}).Info("imported users")
+			if userImportCheckpointPath != "" {
+				return os.Remove(userImportCheckpointPath)
+			}
+			return nil
+		case event.Error != "":
+			return errorx.ExternalError.New("import stopped, run it again with the same --checkpoint-file to resume: %s", event.Error)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return errorx.ExternalError.New("import stopped before it finished")
+}
+
+// csvToJsonLines converts csv with a header of protojson field names to a json object per row. Dotted names are set on
+// nested objects, and cells are converted to the type of their field, see csvValue.
+func csvToJsonLines(input io.Reader, output io.Writer) error {
+	reader := csv.NewReader(input)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return errorx.IllegalFormat.Wrap(err, "invalid csv header")
+	}
+	descriptor := (&notificationsv1alpha1.NotificationUser{}).ProtoReflect().Descriptor()
+	fields := make([]protoreflect.FieldDescriptor, len(header))
+	for i, column := range header {
+		fields[i], err = lookupUserField(descriptor, column)
+		if err != nil {
+			return err
+		}
+	}
+	encoder := json.NewEncoder(output)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errorx.IllegalFormat.Wrap(err, "invalid csv on row %d", row)
+		}
+		user := map[string]interface{}{}
+		for i, value := range record {
+			if value != "" {
+				setJsonPath(user, header[i], csvValue(fields[i], value))
+			}
+		}
+		err = encoder.Encode(user)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// lookupUserField returns the field of a csv column, which is a protojson field name with dots for nested fields
+func lookupUserField(descriptor protoreflect.MessageDescriptor, column string) (protoreflect.FieldDescriptor, error) {
+	var field protoreflect.FieldDescriptor
+	for _, name := range strings.Split(column, ".") {
+		if field != nil {
+			if field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() {
+				return nil, errorx.IllegalArgument.New("invalid csv column %s, %s has no fields", column, field.JSONName())
+			}
+			descriptor = field.Message()
+		}
+		field = descriptor.Fields().ByJSONName(name)
+		if field == nil {
+			field = descriptor.Fields().ByName(protoreflect.Name(name))
+		}
+		if field == nil {
+			return nil, errorx.IllegalArgument.New("invalid csv column %s, users have no field %s", column, name)
+		}
+	}
+	return field, nil
+}
+
+// csvValue converts a cell to the json type of its field. Booleans and 32 bit numbers are converted, lists, maps, and
+// messages are read as json, which is how the export writes them, and everything else, like 64 bit numbers, enums, and
+// timestamps, is a string in protojson. Cells that can't be converted are left as strings, so that the import reports
+// the row.
+func csvValue(field protoreflect.FieldDescriptor, value string) interface{} {
+	if field.IsList() || field.IsMap() || field.Kind() == protoreflect.MessageKind {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value), &decoded); err == nil {
+			return decoded
+		}
+		return value
+	}
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind, protoreflect.Uint32Kind,
+		protoreflect.Fixed32Kind, protoreflect.FloatKind, protoreflect.DoubleKind:
+		var number json.Number
+		if err := json.Unmarshal([]byte(value), &number); err == nil {
+			return number
+		}
+	}
+	return value
+}
+
+// setJsonPath sets a value in a json object at a dotted path, creating the nested objects
+func setJsonPath(object map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[key] = child
+		}
+		object = child
+	}
+	object[keys[len(keys)-1]] = value
+}
+
+func readImportCheckpoint() (int, error) {
+	if userImportCheckpointPath == "" {
+		return 0, nil
+	}
+	contents, err := os.ReadFile(userImportCheckpointPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	checkpoint, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0, errorx.IllegalFormat.Wrap(err, "invalid checkpoint file %s", userImportCheckpointPath)
+	}
+	logging.Log.WithField("checkpoint", checkpoint).Info("resuming import")
+	return checkpoint, nil
+}
+
+func writeImportCheckpoint(checkpoint int) error {
+	if userImportCheckpointPath == "" {
+		return nil
+	}
+	return os.WriteFile(userImportCheckpointPath, []byte(fmt.Sprintf("%d\n", checkpoint)), 0644)
+}
+
+func exportUsers() error {
+	format, err := getUserTransferFormat()
+	if err != nil {
+		return err
+	}
+	if userExportResume && userTransferPath == "-" {
+		return errorx.IllegalArgument.New("--resume needs a file to resume")
+	}
+	skip := 0
+	var output io.Writer = os.Stdout
+	if userTransferPath != "-" {
+		if userExportResume {
+			skip, err = countExportedUsers(userTransferPath, format)
+			if err != nil {
+				return err
+			}
+		}
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if userExportResume {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		file, err := os.OpenFile(userTransferPath, flags, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	response, err := gatewayRequest(http.MethodGet, bulkUsersPath, skip, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	writer := bufio.NewWriter(output)
+	defer writer.Flush()
+	csvWriter := csv.NewWriter(writer)
+	if format == userFormatCsv && skip == 0 {
+		err = csvWriter.Write(userExportColumns)
+		if err != nil {
+			return err
+		}
+	}
+	exported := 0
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxUserLineSize)
+	for scanner.Scan() {
+		user := map[string]interface{}{}
+		err = json.Unmarshal(scanner.Bytes(), &user)
+		if err != nil {
+			return errorx.IllegalFormat.Wrap(err, "invalid response line")
+		}
+		if message, ok := user["error"]; ok && len(user) == 1 {
+			return errorx.ExternalError.New("export stopped after %d users, resume with --resume: %v", skip+exported, message)
+		}
+		if format == userFormatCsv {
+			record := []string{}
+			for _, column := range userExportColumns {
+				record = append(record, client.TableCell(client.LookupPath(user, column)))
+			}
+			err = csvWriter.Write(record)
+		} else {
+			_, err = writer.Write(append(scanner.Bytes(), '\n'))
+		}
+		if err != nil {
+			return err
+		}
+		exported++
+	}
+	csvWriter.Flush()
+	if err = csvWriter.Error(); err != nil {
+		return err
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	logging.Log.WithFields(logrus.Fields{"exported": exported, "skipped": skip}).Info("exported users")
+	return nil
+}
+
+// countExportedUsers returns the number of users in an export file, which is zero if it doesn't exist
+func countExportedUsers(path, format string) (int, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if format == userFormatCsv {
+		records, err := csv.NewReader(bytes.NewReader(contents)).ReadAll()
+		if err != nil {
+			return 0, errorx.IllegalFormat.Wrap(err, "can't resume from %s", path)
+		}
+		if len(records) == 0 {
+			return 0, nil
+		}
+		return len(records) - 1, nil
+	}
+	contents = bytes.TrimSpace(contents)
+	if len(contents) == 0 {
+		return 0, nil
+	}
+	return len(bytes.Split(contents, []byte("\n"))), nil
+}
+
+func getUserTransferFormat() (string, error) {
+	switch userTransferFormat {
+	case userFormatCsv, userFormatJsonl:
+		return userTransferFormat, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(userTransferPath), ".csv") {
+			return userFormatCsv, nil
+		}
+		return userFormatJsonl, nil
+	default:
+		return "", errorx.IllegalArgument.New("format must be one of %s or %s", userFormatCsv, userFormatJsonl)
+	}
+}
+
+// gatewayRequest makes a streaming request to the http gateway. The request timeout doesn't apply, since streams last
+// as long as there are users to transfer.
+func gatewayRequest(method, path string, skip int, body io.Reader) (*http.Response, error) {
+	requestUrl, err := url.Parse(strings.TrimSuffix(gatewayUrl, "/") + path)
+	if err != nil {
+		return nil, errorx.IllegalArgument.Wrap(err, "invalid gateway url")
+	}
+	if skip > 0 {
+		requestUrl.RawQuery = url.Values{"skip": {strconv.Itoa(skip)}}.Encode()
+	}
+	request, err := http.NewRequestWithContext(context.Background(), method, requestUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	token, err := clientToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpClient := &http.Client{}
+	if requestUrl.Scheme == "https" {
+		tlsConfig, err := clientTlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		responseBody, _ := io.ReadAll(response.Body)
+		return nil, errorx.ExternalError.New("gateway returned %d: %s", response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	return response, nil
+}
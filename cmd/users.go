@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/client"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+var usersCmd = NewUsersCommand()
+
+var usersInputPath string
+var usersSkip int32
+var usersLimit int32
+
+// table columns for users
+var userColumns = []string{"id", "fullName", "emailAddress", "phoneNumber"}
+
+func NewUsersCommand() *cobra.Command {
+	usersCmd := newClientCommand("users", "Manage users on a running server", `Manage notification users on a running server`)
+
+	upsertCmd := &cobra.Command{
+		Use:   "upsert",
+		Short: "Create or update users",
+		Long: `Create or update users. Users are read as protojson, either a json array or one user per line, from the
+input file or stdin`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return upsertUsers()
+		},
+	}
+	upsertCmd.Flags().StringVarP(&usersInputPath, "input", "i", "-", "file to read users from, - reads from stdin")
+	usersCmd.AddCommand(upsertCmd)
+
+	getCmd := &cobra.Command{
+		Use:   "get <id>...",
+		Short: "Get users by id",
+		Long:  `Get users by id`,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getUsers(args)
+		},
+	}
+	usersCmd.AddCommand(getCmd)
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List users",
+		Long:  `List users`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listUsers()
+		},
+	}
+	listCmd.Flags().Int32Var(&usersSkip, "skip", 0, "number of users to skip")
+	listCmd.Flags().Int32Var(&usersLimit, "limit", 100, "max number of users to list")
+	usersCmd.AddCommand(listCmd)
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <id>...",
+		Short: "Delete users by id",
+		Long:  `Delete users by id`,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteUsers(args)
+		},
+	}
+	usersCmd.AddCommand(deleteCmd)
+	addUserTransferCommands(usersCmd)
+
+	rootCmd.AddCommand(usersCmd)
+	return usersCmd
+}
+
+func upsertUsers() error {
+	users := []*notificationsv1alpha1.NotificationUser{}
+	err := readMessages(usersInputPath, func() proto.Message {
+		user := &notificationsv1alpha1.NotificationUser{}
+		users = append(users, user)
+		return user
+	})
+	if err != nil {
+		return err
+	}
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.UpsertUsers(ctx, &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: users})
+		if err != nil {
+			return err
+		}
+		return printUsers(response.Users)
+	})
+}
+
+func getUsers(ids []string) error {
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		header := metadata.MD{}
+		response, err := client.GetUsers(ctx, &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: ids}, grpc.Header(&header))
+		if err != nil {
+			return err
+		}
+		logNotFoundIds(header)
+		return printUsers(response.Users)
+	})
+}
+
+func listUsers() error {
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		response, err := client.ListUsers(ctx, &notificationsv1alpha1.NotificationsServiceListUsersRequest{Skip: usersSkip, Limit: usersLimit})
+		if err != nil {
+			return err
+		}
+		return printUsers(response.Users)
+	})
+}
+
+func deleteUsers(ids []string) error {
+	return withClient(func(ctx context.Context, client notificationsv1alpha1.NotificationsServiceClient) error {
+		header := metadata.MD{}
+		response, err := client.DeleteUsers(ctx, &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: ids}, grpc.Header(&header))
+		if err != nil {
+			return err
+		}
+		logNotFoundIds(header)
+		return printResult(map[string]interface{}{"success": response.Success, "ids": ids})
+	})
+}
+
+func printUsers(users []*notificationsv1alpha1.NotificationUser) error {
+	messages := []proto.Message{}
+	for _, user := range users {
+		messages = append(messages, user)
+	}
+	return printMessages(messages, userColumns)
+}
+
+// logNotFoundIds logs the requested ids that the server didn't find
+func logNotFoundIds(header metadata.MD) {
+	ids := client.NotFoundIds(header)
+	if len(ids) > 0 {
+		logging.Log.WithField("ids", strings.Join(ids, ",")).Warn("users not found")
+	}
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/auth"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	"github.com/catalystsquad/go-notifications/internal/sliceutil"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"gorm.io/gorm"
+)
+
+const (
+	ScopeNotificationsRead = "notifications:read"
+	ScopeNotificationsSend = "notifications:send"
+	ScopeSchedulesRead     = "schedules:read"
+	ScopeSchedulesWrite    = "schedules:write"
+	ScopeUsersRead         = "users:read"
+	ScopeUsersWrite        = "users:write"
+	ScopeUsersAdmin        = "users:admin"
+	ScopeApiKeysAdmin      = "api-keys:admin"
+	ScopeAuditRead         = "audit:read"
+	ScopeFaultsAdmin       = "faults:admin"
+)
+
+// ApiKeyScopes are the scopes an api key can be given
+var ApiKeyScopes = []string{
+	ScopeNotificationsRead,
+	ScopeNotificationsSend,
+	ScopeSchedulesRead,
+	ScopeSchedulesWrite,
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeUsersAdmin,
+	ScopeApiKeysAdmin,
+	ScopeAuditRead,
+	ScopeFaultsAdmin,
+}
+
+// impliedScopes are the scopes that come with another scope
+var impliedScopes = map[string][]string{
+	ScopeSchedulesWrite: {ScopeSchedulesRead},
+	ScopeUsersWrite:     {ScopeUsersRead},
+	ScopeUsersAdmin:     {ScopeUsersRead, ScopeUsersWrite},
+}
+
+// number of random bytes in an api key
+const apiKeyBytes = 32
+
+// number of characters of the key, including the prefix, that are stored so keys can be recognized
+const apiKeyDisplayPrefixLength = 11
+
+// ApiKey is an api key issued by the service. Only the sha256 hash of the key is stored, the key itself is returned
+// once when it's created.
+type ApiKey struct {
+	Id        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Name      string    `gorm:"not null"`
+	Prefix    string    `gorm:"not null"`
+	Hash      string    `gorm:"uniqueIndex;not null"`
+	Scopes    string    // comma separated
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"`
+}
+
+type apiKeyResponse struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// Key is only set when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+// CreateApiKey issues a new api key with the scopes. The key is returned along with the saved record and can't be
+// retrieved again. An expiresIn of 0 creates a key that doesn't expire.
+func CreateApiKey(name string, scopes []string, expiresIn time.Duration) (*ApiKey, string, error) {
+	if name == "" {
+		return nil, "", errorx.IllegalArgument.New("api keys must have a name")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errorx.IllegalArgument.New("api keys must have at least one scope")
+	}
+	for _, scope := range scopes {
+		if !sliceutil.Contains(ApiKeyScopes, scope) {
+			return nil, "", errorx.IllegalArgument.New("invalid scope %s, must be one of %s", scope, strings.Join(ApiKeyScopes, ", "))
+		}
+	}
+	if expiresIn < 0 {
+		return nil, "", errorx.IllegalArgument.New("api key expiry must not be negative")
+	}
+	random := make([]byte, apiKeyBytes)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, "", err
+	}
+	key := auth.ApiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+	apiKey := &ApiKey{
+		Id:     uuid.New(),
+		Name:   name,
+		Prefix: key[:apiKeyDisplayPrefixLength],
+		Hash:   hashApiKey(key),
+		Scopes: strings.Join(scopes, ","),
+	}
+	if expiresIn > 0 {
+		expiresAt := clock.Now().Add(expiresIn)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	err = database.DB.Create(apiKey).Error
+	if err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
+// ListApiKeys lists api keys, oldest first
+func ListApiKeys(includeRevoked bool) ([]ApiKey, error) {
+	apiKeys := []ApiKey{}
+	query := database.DB.Order("created_at")
+	if !includeRevoked {
+		query = query.Where("revoked_at IS NULL")
+	}
+	err := query.Find(&apiKeys).Error
+	return apiKeys, err
+}
+
+// RevokeApiKey revokes an api key, requests made with it are rejected from then on
+func RevokeApiKey(id uuid.UUID) error {
+	result := database.DB.Model(&ApiKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", clock.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errorx.DataUnavailable.New("api key %s not found or already revoked", id)
+	}
+	return nil
+}
+
+// ApiKeyStore authenticates api keys against the keys in the database
+type ApiKeyStore struct{}
+
+func (s ApiKeyStore) AuthenticateApiKey(key string) (*auth.Principal, error) {
+	apiKey := ApiKey{}
+	err := database.DB.Where("hash = ?", hashApiKey(key)).First(&apiKey).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, auth.InvalidToken.New("unknown api key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, auth.InvalidToken.New("api key %s was revoked", apiKey.Id)
+	}
+	if apiKey.ExpiresAt != nil && clock.Now().After(*apiKey.ExpiresAt) {
+		return nil, auth.InvalidToken.New("api key %s expired at %s", apiKey.Id, apiKey.ExpiresAt)
+	}
+	return &auth.Principal{
+		Subject:  apiKey.Name,
+		ApiKeyId: apiKey.Id.String(),
+		Scopes:   splitList(apiKey.Scopes),
+	}, nil
+}
+
+// hasScope returns true if the api key principal has the scope, directly or through a scope that implies it
+func hasScope(principal *auth.Principal, scope string) bool {
+	for _, principalScope := range principal.Scopes {
+		if principalScope == scope || sliceutil.Contains(impliedScopes[principalScope], scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (k ApiKey) toResponse() apiKeyResponse {
+	return apiKeyResponse{
+		Id:        k.Id.String(),
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Scopes:    splitList(k.Scopes),
+		ExpiresAt: k.ExpiresAt,
+		RevokedAt: k.RevokedAt,
+		CreatedAt: k.CreatedAt,
+	}
+}
+
+func handleCreateApiKey(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	request := apiKeyRequest{}
+	err := decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	var expiresIn time.Duration
+	if request.ExpiresIn != "" {
+		expiresIn, err = time.ParseDuration(request.ExpiresIn)
+		if err != nil {
+			writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid expires_in"))
+			return
+		}
+	}
+	apiKey, key, err := CreateApiKey(request.Name, request.Scopes, expiresIn)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	response := apiKey.toResponse()
+	response.Key = key
+	writeJson(w, http.StatusCreated, response)
+}
+
+func handleListApiKeys(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	apiKeys, err := ListApiKeys(r.URL.Query().Get("include_revoked") == "true")
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	response := []apiKeyResponse{}
+	for _, apiKey := range apiKeys {
+		response = append(response, apiKey.toResponse())
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func handleRevokeApiKey(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	err = RevokeApiKey(id)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusNoContent, nil)
+}
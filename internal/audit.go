@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/auth"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/joomcode/errorx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+const anonymousActor = "anonymous"
+
+// default and maximum number of audit entries returned by a query
+const defaultAuditQueryLimit = 100
+const maxAuditQueryLimit = 1000
+
+// how often expired audit entries are purged
+const auditPurgeInterval = time.Hour
+
+// max size of an audited http request body, which is read to hash it
+const maxAuditedBodySize = 1024 * 1024
+
+// AuditEntry is a record of an administrative or destructive operation. Entries are only ever inserted, the only
+// deletes are purges of entries older than the retention period.
+type AuditEntry struct {
+	Id          uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Actor       string    `gorm:"index;not null"`
+	ApiKeyId    string
+	Source      string
+	Action      string `gorm:"index;not null"`
+	TargetIds   string `gorm:"type:jsonb;not null"`
+	RequestHash string
+	Success     bool
+	Error       string
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+// AuditQuery filters audit entries, zero values aren't filtered on
+type AuditQuery struct {
+	Actor    string
+	Action   string
+	TargetId string
+	Since    time.Time
+	Until    time.Time
+	Skip     int
+	Limit    int
+}
+
+type auditEntryResponse struct {
+	Id          string    `json:"id"`
+	Actor       string    `json:"actor"`
+	ApiKeyId    string    `json:"api_key_id,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Action      string    `json:"action"`
+	TargetIds   []string  `json:"target_ids"`
+	RequestHash string    `json:"request_hash,omitempty"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// auditTargets returns the target ids of audited grpc requests, and false for requests that aren't audited
+func auditTargets(req interface{}) ([]string, bool) {
+	switch request := req.(type) {
+	case *notificationsv1alpha1.NotificationsServiceDeleteUsersRequest:
+		return request.Ids, true
+	case *notificationsv1alpha1.NotificationsServiceDeleteScheduledNotificationsRequest:
+		return request.Ids, true
+	case *notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest:
+		return []string{request.UserId}, true
+	default:
+		return nil, false
+	}
+}
+
+// AuditUnary is a grpc interceptor that records audited requests in the audit log once they've been handled,
+// including requests that fail or are denied
+func AuditUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	targetIds, ok := auditTargets(req)
+	if !ok {
+		return handler(ctx, req)
+	}
+	response, err := handler(ctx, req)
+	entry := newAuditEntry(ctx, info.FullMethod, targetIds, err)
+	if message, ok := req.(proto.Message); ok {
+		entry.RequestHash = hashRequest(message)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.Source = p.Addr.String()
+	}
+	recordAuditEntry(entry)
+	return response, err
+}
+
+// auditHttp wraps an http only endpoint so that its requests are recorded in the audit log. The targets are the path
+// parameters, in the order they're in the path.
+func auditHttp(method, path string, handlerFunc runtime.HandlerFunc) runtime.HandlerFunc {
+	action := fmt.Sprintf("%s %s", method, path)
+	pathParamNames := []string{}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			pathParamNames = append(pathParamNames, strings.Trim(segment, "{}"))
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAuditedBodySize))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			err = errorx.IllegalArgument.Wrap(err, "request body is larger than %d bytes", maxAuditedBodySize)
+			writeJson(recorder, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		} else if err != nil {
+			err = errorx.IllegalFormat.Wrap(err, "error reading request body")
+			writeHttpError(recorder, err)
+		} else {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			handlerFunc(recorder, r, pathParams)
+			if recorder.statusCode >= http.StatusBadRequest {
+				err = errorx.IllegalState.New("status code %d", recorder.statusCode)
+			}
+		}
+		targetIds := []string{}
+		for _, name := range pathParamNames {
+			targetIds = append(targetIds, pathParams[name])
+		}
+		entry := newAuditEntry(r.Context(), action, targetIds, err)
+		entry.Source = r.RemoteAddr
+		entry.RequestHash = hashBytes(body)
+		recordAuditEntry(entry)
+	}
+}
+
+// isAuditedHttpHandler returns true for http only endpoints that delete data, manage api keys, or inject store faults
+func isAuditedHttpHandler(handler httpHandler) bool {
+	return handler.method == http.MethodDelete || handler.scope == ScopeApiKeysAdmin || handler.scope == ScopeFaultsAdmin
+}
+
+// QueryAuditLog returns audit entries matching the query, newest first
+func QueryAuditLog(query AuditQuery) ([]AuditEntry, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultAuditQueryLimit
+	}
+	if query.Limit > maxAuditQueryLimit {
+		return nil, errorx.IllegalArgument.New("limit must not be more than %d", maxAuditQueryLimit)
+	}
+	db := database.DB.Order("created_at DESC").Offset(query.Skip).Limit(query.Limit)
+	if query.Actor != "" {
+		db = db.Where("actor = ?", query.Actor)
+	}
+	if query.Action != "" {
+		db = db.Where("action = ?", query.Action)
+	}
+	if query.TargetId != "" {
+		targetIdJson, err := json.Marshal([]string{query.TargetId})
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where("target_ids @> ?", string(targetIdJson))
+	}
+	if !query.Since.IsZero() {
+		db = db.Where("created_at >= ?", query.Since)
+	}
+	if !query.Until.IsZero() {
+		db = db.Where("created_at < ?", query.Until)
+	}
+	entries := []AuditEntry{}
+	err := db.Find(&entries).Error
+	return entries, err
+}
+
+// PurgeAuditLog deletes audit entries older than the retention period every hour until the context is done. A
+// retention of 0 keeps entries forever.
+func PurgeAuditLog(ctx context.Context, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(auditPurgeInterval)
+	defer ticker.Stop()
+	for {
+		result := database.DB.Where("created_at < ?", clock.Now().Add(-retention)).Delete(&AuditEntry{})
+		if result.Error != nil {
+			logging.Log.WithError(result.Error).Error("error purging audit log")
+		} else if result.RowsAffected > 0 {
+			logging.Log.WithField("purged", result.RowsAffected).Info("purged audit log")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func newAuditEntry(ctx context.Context, action string, targetIds []string, err error) AuditEntry {
+	entry := AuditEntry{
+		Id:      uuid.New(),
+		Actor:   anonymousActor,
+		Action:  action,
+		Success: err == nil,
+	}
+	if principal, ok := auth.FromContext(ctx); ok {
+		entry.Actor = principal.Subject
+		entry.ApiKeyId = principal.ApiKeyId
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	targetIdsJson, _ := json.Marshal(targetIds)
+	entry.TargetIds = string(targetIdsJson)
+	return entry
+}
+
+// recordAuditEntry saves an audit entry. Failing to save one doesn't fail the request, which has already been handled,
+// but it's logged with everything in the entry so it isn't lost.
+func recordAuditEntry(entry AuditEntry) {
+	err := database.DB.Create(&entry).Error
+	if err != nil {
+		logging.Log.WithError(err).WithField("entry", entry).Error("error recording audit entry")
+	}
+}
+
+func hashRequest(message proto.Message) string {
+	marshalled, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	if err != nil {
+		return ""
+	}
+	return hashBytes(marshalled)
+}
+
+func hashBytes(value []byte) string {
+	hash := sha256.Sum256(value)
+	return hex.EncodeToString(hash[:])
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (e AuditEntry) toResponse() auditEntryResponse {
+	targetIds := []string{}
+	_ = json.Unmarshal([]byte(e.TargetIds), &targetIds)
+	return auditEntryResponse{
+		Id:          e.Id.String(),
+		Actor:       e.Actor,
+		ApiKeyId:    e.ApiKeyId,
+		Source:      e.Source,
+		Action:      e.Action,
+		TargetIds:   targetIds,
+		RequestHash: e.RequestHash,
+		Success:     e.Success,
+		Error:       e.Error,
+		CreatedAt:   e.CreatedAt,
+	}
+}
+
+func handleQueryAuditLog(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	values := r.URL.Query()
+	query := AuditQuery{
+		Actor:    values.Get("actor"),
+		Action:   values.Get("action"),
+		TargetId: values.Get("target_id"),
+	}
+	var err error
+	for name, dest := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := values.Get(name); value != "" {
+			*dest, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid %s, must be an RFC3339 timestamp", name))
+				return
+			}
+		}
+	}
+	for name, dest := range map[string]*int{"skip": &query.Skip, "limit": &query.Limit} {
+		if value := values.Get(name); value != "" {
+			*dest, err = strconv.Atoi(value)
+			if err != nil || *dest < 0 {
+				writeHttpError(w, errorx.IllegalArgument.New("invalid %s, must be a non negative integer", name))
+				return
+			}
+		}
+	}
+	entries, err := QueryAuditLog(query)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	response := []auditEntryResponse{}
+	for _, entry := range entries {
+		response = append(response, entry.toResponse())
+	}
+	writeJson(w, http.StatusOK, response)
+}
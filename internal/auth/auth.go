@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/sliceutil"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const healthServicePrefix = "/grpc.health.v1.Health/"
+
+// ApiKeyPrefix is the prefix of every api key, bearer tokens with it are checked as api keys instead of jwts
+const ApiKeyPrefix = "gn_"
+
+type principalContextKey struct{}
+
+// Role is what a principal is allowed to do
+type Role string
+
+const (
+	// RoleEndUser can only read and update its own inbox, subscriptions and profile
+	RoleEndUser Role = "end-user"
+	// RoleService can call everything except the admin only operations
+	RoleService Role = "service"
+	// RoleAdmin can call everything, including user deletion and bulk operations
+	RoleAdmin Role = "admin"
+)
+
+// RoleMapping maps token claims to roles
+type RoleMapping struct {
+	// RolesClaim is the claim holding the caller's roles, as a string or a list of strings
+	RolesClaim string
+	// UserIdClaim is the claim holding an end user's user id
+	UserIdClaim  string
+	EndUserRoles []string
+	ServiceRoles []string
+	AdminRoles   []string
+}
+
+// ApiKeyAuthenticator looks up the principal for an api key
+type ApiKeyAuthenticator interface {
+	AuthenticateApiKey(key string) (*Principal, error)
+}
+
+// Principal is the authenticated caller of a request. Jwt principals have roles and claims, api key principals have
+// the key's id and scopes.
+type Principal struct {
+	Subject  string
+	UserId   string
+	Roles    []Role
+	Claims   Claims
+	ApiKeyId string
+	Scopes   []string
+}
+
+// HasRole returns true if the principal has the role. Admins have the service role too.
+func (p *Principal) HasRole(role Role) bool {
+	for _, principalRole := range p.Roles {
+		if principalRole == role || (principalRole == RoleAdmin && role == RoleService) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// FromContext returns the principal stored in the context, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return principal, ok
+}
+
+// IsApiKey returns true if the principal authenticated with an api key
+func (p *Principal) IsApiKey() bool {
+	return p.ApiKeyId != ""
+}
+
+// Authenticator authenticates grpc and http requests with bearer jwts or api keys
+type Authenticator struct {
+	verifier *Verifier
+	roles    RoleMapping
+	apiKeys  ApiKeyAuthenticator
+}
+
+// NewAuthenticator returns an authenticator. The verifier may be nil, in which case only api keys are accepted.
+func NewAuthenticator(verifier *Verifier, roles RoleMapping, apiKeys ApiKeyAuthenticator) *Authenticator {
+	return &Authenticator{verifier: verifier, roles: roles, apiKeys: apiKeys}
+}
+
+// AuthFunc authenticates grpc requests, it's used as the grpc server's auth func. The health service is left
+// unauthenticated so that probes keep working.
+func (a *Authenticator) AuthFunc(ctx context.Context) (context.Context, error) {
+	if method, ok := grpc.Method(ctx); ok && strings.HasPrefix(method, healthServicePrefix) {
+		return ctx, nil
+	}
+	token, err := grpc_auth.AuthFromMD(ctx, "bearer")
+	if err != nil {
+		return nil, err
+	}
+	principal, err := a.authenticate(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return NewContext(ctx, principal), nil
+}
+
+// HttpMiddleware authenticates http requests before they reach the gateway. Requests proxied to the grpc server are
+// authenticated again there, because the gateway forwards the authorization header.
+func (a *Authenticator) HttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "bearer") {
+			writeUnauthenticated(w)
+			return
+		}
+		principal, err := a.authenticate(token)
+		if err != nil {
+			writeUnauthenticated(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
+	})
+}
+
+func (a *Authenticator) authenticate(token string) (*Principal, error) {
+	if strings.HasPrefix(token, ApiKeyPrefix) && a.apiKeys != nil {
+		principal, err := a.apiKeys.AuthenticateApiKey(token)
+		if err != nil {
+			logging.Log.WithError(err).Debug("rejected api key")
+		}
+		return principal, err
+	}
+	if a.verifier == nil {
+		return nil, InvalidToken.New("jwt authentication is not configured")
+	}
+	claims, err := a.verifier.Verify(token)
+	if err != nil {
+		logging.Log.WithError(err).Debug("rejected bearer token")
+		return nil, err
+	}
+	return &Principal{
+		Subject: claims.String("sub"),
+		UserId:  claims.String(a.roles.UserIdClaim),
+		Roles:   a.roles.rolesFromClaims(claims),
+		Claims:  claims,
+	}, nil
+}
+
+func (r RoleMapping) rolesFromClaims(claims Claims) []Role {
+	roles := []Role{}
+	for _, value := range claims.Strings(r.RolesClaim) {
+		if sliceutil.Contains(r.EndUserRoles, value) {
+			roles = append(roles, RoleEndUser)
+		}
+		if sliceutil.Contains(r.ServiceRoles, value) {
+			roles = append(roles, RoleService)
+		}
+		if sliceutil.Contains(r.AdminRoles, value) {
+			roles = append(roles, RoleAdmin)
+		}
+	}
+	return roles
+}
+
+func writeUnauthenticated(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(`{"error":"invalid bearer token"}`))
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/joomcode/errorx"
+)
+
+// minimum time between jwks reloads triggered by unknown key ids, so that tokens with made up key ids can't be used to
+// hammer the jwks url
+const minUnknownKeyReloadInterval = 30 * time.Second
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// KeySet is a set of public keys loaded from a jwks file or url, keyed by key id
+type KeySet struct {
+	path       string
+	url        string
+	httpClient *http.Client
+	mutex      sync.RWMutex
+	keys       map[string]crypto.PublicKey
+	loadedAt   time.Time
+}
+
+// NewKeySet loads a jwks from a local file path or a url, exactly one must be set
+func NewKeySet(path, url string) (*KeySet, error) {
+	if (path == "") == (url == "") {
+		return nil, errorx.IllegalArgument.New("exactly one of a jwks path or a jwks url is required")
+	}
+	keySet := &KeySet{
+		path:       path,
+		url:        url,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	err := keySet.Load()
+	return keySet, err
+}
+
+// Get returns the public key with the key id. If the key isn't found and the key set hasn't been loaded recently it's
+// reloaded once, to pick up rotated keys.
+func (k *KeySet) Get(kid string) (crypto.PublicKey, bool) {
+	k.mutex.RLock()
+	key, ok := k.keys[kid]
+	loadedAt := k.loadedAt
+	k.mutex.RUnlock()
+	if ok || clock.Since(loadedAt) < minUnknownKeyReloadInterval {
+		return key, ok
+	}
+	err := k.Load()
+	if err != nil {
+		logging.Log.WithError(err).Error("error reloading jwks")
+		return nil, false
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	key, ok = k.keys[kid]
+	return key, ok
+}
+
+// Load reads the jwks and replaces the keys in the set
+func (k *KeySet) Load() error {
+	bytes, err := k.read()
+	if err != nil {
+		return err
+	}
+	set := jwks{}
+	err = json.Unmarshal(bytes, &set)
+	if err != nil {
+		return errorx.IllegalFormat.Wrap(err, "invalid jwks")
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := parseJwk(key)
+		if err != nil {
+			logging.Log.WithError(err).WithField("kid", key.Kid).Warn("skipping invalid jwk")
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+	if len(keys) == 0 {
+		return errorx.IllegalState.New("jwks has no usable signing keys")
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = keys
+	k.loadedAt = clock.Now()
+	return nil
+}
+
+// Refresh reloads the jwks every interval until the context is done
+func (k *KeySet) Refresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := k.Load()
+			if err != nil {
+				logging.Log.WithError(err).Error("error refreshing jwks")
+			}
+		}
+	}
+}
+
+func (k *KeySet) read() ([]byte, error) {
+	if k.path != "" {
+		return os.ReadFile(k.path)
+	}
+	response, err := k.httpClient.Get(k.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errorx.IllegalState.New("expected status code %d from jwks url but got %d", http.StatusOK, response.StatusCode)
+	}
+	return io.ReadAll(response.Body)
+}
+
+func parseJwk(key jwk) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errorx.UnsupportedOperation.New("unsupported curve %s", key.Crv)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errorx.IllegalArgument.New("ec key is not on curve %s", key.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errorx.UnsupportedOperation.New("unsupported key type %s", key.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/joomcode/errorx"
+)
+
+// allowed clock skew when checking token times
+const clockSkew = time.Minute
+
+var InvalidToken = errorx.CommonErrors.NewType("invalid_token")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Claims are the claims of a verified token
+type Claims map[string]interface{}
+
+// String returns a string claim, or an empty string if the claim isn't set or isn't a string
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Strings returns a claim that's either a string or a list of strings as a list
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// Verifier verifies jwts signed by keys in a key set
+type Verifier struct {
+	keys     *KeySet
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// NewVerifier returns a verifier that requires tokens to be signed by a key in the key set, and when they're set,
+// to be issued by the issuer for the audience
+func NewVerifier(keys *KeySet, issuer, audience string) *Verifier {
+	return &Verifier{keys: keys, issuer: issuer, audience: audience, now: clock.Now}
+}
+
+// Verify verifies the token's signature, expiry, issuer and audience and returns its claims
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidToken.New("token must have 3 parts")
+	}
+	header := jwtHeader{}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := v.keys.Get(header.Kid)
+	if !ok {
+		return nil, InvalidToken.New("unknown key id %s", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, InvalidToken.Wrap(err, "invalid signature encoding")
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+	claims := Claims{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, v.validateClaims(claims)
+}
+
+func (v *Verifier) validateClaims(claims Claims) error {
+	now := v.now()
+	expiresAt, ok := claims.time("exp")
+	if !ok {
+		return InvalidToken.New("token has no expiry")
+	}
+	if now.After(expiresAt.Add(clockSkew)) {
+		return InvalidToken.New("token expired at %s", expiresAt)
+	}
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(clockSkew).Before(notBefore) {
+		return InvalidToken.New("token is not valid before %s", notBefore)
+	}
+	if v.issuer != "" && claims.String("iss") != v.issuer {
+		return InvalidToken.New("unexpected issuer %s", claims.String("iss"))
+	}
+	if v.audience != "" {
+		for _, audience := range claims.Strings("aud") {
+			if audience == v.audience {
+				return nil
+			}
+		}
+		return InvalidToken.New("token is not for audience %s", v.audience)
+	}
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return InvalidToken.New("unsupported algorithm %s", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(publicKey, hash, digest, signature, nil)
+		default:
+			return InvalidToken.New("algorithm %s does not match rsa key", alg)
+		}
+		if err != nil {
+			return InvalidToken.Wrap(err, "invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return InvalidToken.New("algorithm %s does not match ec key", alg)
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return InvalidToken.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return InvalidToken.New("invalid signature")
+		}
+		return nil
+	default:
+		return InvalidToken.New("unsupported key type")
+	}
+}
+
+func decodeSegment(segment string, dest interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return InvalidToken.Wrap(err, "invalid token encoding")
+	}
+	err = json.Unmarshal(bytes, dest)
+	if err != nil {
+		return InvalidToken.Wrap(err, "invalid token json")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/catalystsquad/go-notifications/internal/auth"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const permissionDenied = "permission denied"
+
+// AuthorizeUnary is a grpc interceptor that checks the authenticated principal's roles against the request. Requests
+// without a principal, which only happens for the unauthenticated health service, are let through.
+func AuthorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	principal, ok := auth.FromContext(ctx)
+	if ok && !authorized(principal, req) {
+		return nil, status.Error(codes.PermissionDenied, permissionDenied)
+	}
+	return handler(ctx, req)
+}
+
+// authorized returns true if the principal may make the request. Api keys need the request's scope. Admins can do
+// everything, services can do everything except the admin scoped requests, and end users can only touch their own
+// inbox, subscriptions and profile.
+func authorized(principal *auth.Principal, req interface{}) bool {
+	scope := requiredScope(req)
+	if principal.IsApiKey() {
+		return hasScope(principal, scope)
+	}
+	if principal.HasRole(auth.RoleAdmin) {
+		return true
+	}
+	if isAdminScope(scope) {
+		return false
+	}
+	if principal.HasRole(auth.RoleService) {
+		return true
+	}
+	if !principal.HasRole(auth.RoleEndUser) || principal.UserId == "" {
+		return false
+	}
+	switch request := req.(type) {
+	case *notificationsv1alpha1.NotificationsServiceGetNotificationsRequest:
+		return request.UserId == principal.UserId
+	case *notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest:
+		return request.UserId == principal.UserId
+	case *notificationsv1alpha1.NotificationsServiceGetUsersRequest:
+		return len(request.Ids) > 0 && allEqual(request.Ids, principal.UserId)
+	case *notificationsv1alpha1.NotificationsServiceUpsertUsersRequest:
+		ids := []string{}
+		for _, user := range request.Users {
+			ids = append(ids, user.Id)
+		}
+		return len(ids) > 0 && allEqual(ids, principal.UserId)
+	default:
+		return false
+	}
+}
+
+// requiredScope returns the api key scope needed to make a notifications service request. Requests that aren't known
+// here need an admin scope.
+func requiredScope(req interface{}) string {
+	switch req.(type) {
+	case *notificationsv1alpha1.NotificationsServiceSendNotificationsRequest:
+		return ScopeNotificationsSend
+	case *notificationsv1alpha1.NotificationsServiceGetNotificationsRequest:
+		return ScopeNotificationsRead
+	case *notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest:
+		return ScopeSchedulesRead
+	case *notificationsv1alpha1.NotificationsServiceUpsertScheduledNotificationsRequest, *notificationsv1alpha1.NotificationsServiceDeleteScheduledNotificationsRequest:
+		return ScopeSchedulesWrite
+	case *notificationsv1alpha1.NotificationsServiceGetUsersRequest:
+		return ScopeUsersRead
+	case *notificationsv1alpha1.NotificationsServiceUpsertUsersRequest, *notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest:
+		return ScopeUsersWrite
+	default:
+		return ScopeUsersAdmin
+	}
+}
+
+// isAdminScope returns true for scopes that only the admin role has
+func isAdminScope(scope string) bool {
+	return scope == ScopeUsersAdmin || scope == ScopeApiKeysAdmin || scope == ScopeAuditRead || scope == ScopeFaultsAdmin
+}
+
+// authorizeHttp wraps the http only endpoints, which aren't scoped to a single end user, so that they require the
+// handler's scope for api keys, and the service role, or the admin role for admin scopes, for jwts
+func authorizeHttp(handler httpHandler) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		principal, ok := auth.FromContext(r.Context())
+		if ok && !authorizedHttp(principal, handler.scope) {
+			writeJson(w, http.StatusForbidden, map[string]string{"error": permissionDenied})
+			return
+		}
+		handler.handler(w, r, pathParams)
+	}
+}
+
+func authorizedHttp(principal *auth.Principal, scope string) bool {
+	if principal.IsApiKey() {
+		return hasScope(principal, scope)
+	}
+	if isAdminScope(scope) {
+		return principal.HasRole(auth.RoleAdmin)
+	}
+	return principal.HasRole(auth.RoleService)
+}
+
+func allEqual(values []string, value string) bool {
+	for _, v := range values {
+		if v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,497 @@
+package internal
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/gorhill/cronexpr"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// CalendarPolicySkip skips cron occurrences that fall on excluded days
+	CalendarPolicySkip = "skip"
+	// CalendarPolicyShift moves cron occurrences that fall on excluded days to the same time on the next business day
+	CalendarPolicyShift = "shift"
+
+	calendarDateFormat = "2006-01-02"
+	// how far ahead to look for a business day before giving up on shifting an occurrence
+	maxBusinessDaySearch = 366
+)
+
+var defaultWorkingDays = []string{"monday", "tuesday", "wednesday", "thursday", "friday"}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Calendar is a named business calendar of working days and holiday dates. A calendar with an empty tenant is the
+// base calendar, a calendar with a tenant overrides the base calendar for that tenant. Overrides replace the working
+// days if they're set, add holidays, and can mark base holidays as working dates. Days and dates are stored as comma
+// separated lists.
+type Calendar struct {
+	Name         string `gorm:"primaryKey"`
+	Tenant       string `gorm:"primaryKey;default:''"`
+	TimeZone     string
+	WorkingDays  string
+	Holidays     string
+	WorkingDates string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// CalendarAssignment applies a calendar to a cron scheduled notification, it's kept in the scheduled notification's
+// settings
+type CalendarAssignment struct {
+	Calendar string `json:"calendar"`
+	Tenant   string `json:"tenant,omitempty"`
+	Policy   string `json:"policy"`
+}
+
+type calendarRequest struct {
+	TimeZone     string   `json:"time_zone"`
+	WorkingDays  []string `json:"working_days"`
+	Holidays     []string `json:"holidays"`
+	WorkingDates []string `json:"working_dates"`
+}
+
+type calendarResponse struct {
+	Name         string             `json:"name"`
+	Tenant       string             `json:"tenant,omitempty"`
+	TimeZone     string             `json:"time_zone,omitempty"`
+	WorkingDays  []string           `json:"working_days,omitempty"`
+	Holidays     []string           `json:"holidays,omitempty"`
+	WorkingDates []string           `json:"working_dates,omitempty"`
+	Overrides    []calendarResponse `json:"overrides,omitempty"`
+}
+
+type calendarAssignmentResponse struct {
+	ScheduledNotificationId string `json:"scheduled_notification_id"`
+	Calendar                string `json:"calendar"`
+	Tenant                  string `json:"tenant,omitempty"`
+	Policy                  string `json:"policy"`
+}
+
+// BusinessCalendar is a calendar with its tenant override applied
+type BusinessCalendar struct {
+	location     *time.Location
+	workingDays  map[time.Weekday]bool
+	holidays     map[string]bool
+	workingDates map[string]bool
+}
+
+// IsBusinessDay returns true if the day of t, in the calendar's time zone, is a working day that isn't a holiday
+func (c BusinessCalendar) IsBusinessDay(t time.Time) bool {
+	date := t.In(c.location).Format(calendarDateFormat)
+	if c.workingDates[date] {
+		return true
+	}
+	return c.workingDays[t.In(c.location).Weekday()] && !c.holidays[date]
+}
+
+// NextBusinessDay returns the same wall clock time as t on the next business day after t
+func (c BusinessCalendar) NextBusinessDay(t time.Time) (time.Time, error) {
+	local := t.In(c.location)
+	for i := 1; i <= maxBusinessDaySearch; i++ {
+		next := local.AddDate(0, 0, i)
+		if c.IsBusinessDay(next) {
+			return next, nil
+		}
+	}
+	return time.Time{}, errorx.IllegalState.New("no business day in the %d days after %s", maxBusinessDaySearch, t)
+}
+
+// UpsertCalendar creates or replaces a base calendar, or a tenant override when tenant is set
+func UpsertCalendar(name, tenant string, request calendarRequest) (*Calendar, error) {
+	if name == "" {
+		return nil, errorx.IllegalArgument.New("calendars must have a name")
+	}
+	if tenant == "" && len(request.WorkingDates) > 0 {
+		return nil, errorx.IllegalArgument.New("working dates can only be set on tenant overrides")
+	}
+	if tenant != "" {
+		err := database.DB.First(&Calendar{}, "name = ? AND tenant = ''", name).Error
+		if err != nil {
+			return nil, calendarLookupError(err, name)
+		}
+	}
+	if tenant == "" && len(request.WorkingDays) == 0 {
+		request.WorkingDays = defaultWorkingDays
+	}
+	if request.TimeZone != "" {
+		_, err := time.LoadLocation(request.TimeZone)
+		if err != nil {
+			return nil, errorx.IllegalArgument.Wrap(err, "invalid time zone")
+		}
+	}
+	workingDays, err := normalizeWorkingDays(request.WorkingDays)
+	if err != nil {
+		return nil, err
+	}
+	holidays, err := normalizeDates(request.Holidays)
+	if err != nil {
+		return nil, err
+	}
+	workingDates, err := normalizeDates(request.WorkingDates)
+	if err != nil {
+		return nil, err
+	}
+	calendar := &Calendar{
+		Name:         name,
+		Tenant:       tenant,
+		TimeZone:     request.TimeZone,
+		WorkingDays:  strings.Join(workingDays, ","),
+		Holidays:     strings.Join(holidays, ","),
+		WorkingDates: strings.Join(workingDates, ","),
+	}
+	err = database.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(calendar).Error
+	return calendar, err
+}
+
+// DeleteCalendar deletes a base calendar and all of its tenant overrides, or a single override when tenant is set
+func DeleteCalendar(name, tenant string) error {
+	query := database.DB.Where("name = ?", name)
+	if tenant != "" {
+		query = query.Where("tenant = ?", tenant)
+	}
+	return query.Delete(&Calendar{}).Error
+}
+
+// AssignCalendar applies a calendar to a cron scheduled notification, replacing the one it had. The assignment is
+// kept in the scheduled notification's settings, so it's kept when the scheduled notification is upserted and deleted
+// with it. Occurrences already shifted by a previous assignment are deleted, so that only the new calendar applies.
+func AssignCalendar(taskDefinitionId uuid.UUID, assignment CalendarAssignment) (*CalendarAssignment, error) {
+	definition, err := getTaskDefinition(taskDefinitionId)
+	if err != nil {
+		return nil, err
+	}
+	err = validateCalendarAssignment(&assignment, definition.CronTrigger != nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = loadBusinessCalendar(assignment.Calendar, assignment.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	err = updateScheduledNotificationSettings(*definition, func(settings *scheduledNotificationSettings) {
+		settings.Calendar = &assignment
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &assignment, deleteDeferredOccurrences([]*uuid.UUID{&taskDefinitionId}, deferredByCalendar)
+}
+
+// validateCalendarAssignment checks a calendar assignment, defaulting its policy to skip. Cron is whether the scheduled
+// notification it's assigned to has a cron trigger.
+func validateCalendarAssignment(assignment *CalendarAssignment, cron bool) error {
+	if assignment.Calendar == "" {
+		return errorx.IllegalArgument.New("calendar is required")
+	}
+	if assignment.Policy == "" {
+		assignment.Policy = CalendarPolicySkip
+	}
+	if assignment.Policy != CalendarPolicySkip && assignment.Policy != CalendarPolicyShift {
+		return errorx.IllegalArgument.New("calendar policy must be %s or %s", CalendarPolicySkip, CalendarPolicyShift)
+	}
+	if !cron {
+		return errorx.IllegalArgument.New("calendars can only be assigned to cron scheduled notifications")
+	}
+	return nil
+}
+
+// UnassignCalendar removes the calendar from a scheduled notification, along with the occurrences it shifted
+func UnassignCalendar(taskDefinitionId uuid.UUID) error {
+	definition, err := getTaskDefinition(taskDefinitionId)
+	if err != nil {
+		return err
+	}
+	err = updateScheduledNotificationSettings(*definition, func(settings *scheduledNotificationSettings) {
+		settings.Calendar = nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteDeferredOccurrences([]*uuid.UUID{&taskDefinitionId}, deferredByCalendar)
+}
+
+// applyBusinessCalendar checks a cron occurrence against the calendar assigned to the scheduled notification, if any.
+// It returns the fired outcome if the notification should be sent now. Occurrences on excluded days are either
+// skipped, or shifted to the next business day by deferring them, unless the cron trigger already fires that day.
+func applyBusinessCalendar(task pkg.TaskInstance, scheduledNotification *notificationsv1alpha1.ScheduledNotification, settings scheduledNotificationSettings) (string, error) {
+	assignment := settings.Calendar
+	if task.TaskDefinition.CronTrigger == nil || assignment == nil {
+		return metrics.OutcomeFired, nil
+	}
+	calendar, err := loadBusinessCalendar(assignment.Calendar, assignment.Tenant)
+	if errorx.IsOfType(err, errorx.DataUnavailable) {
+		// don't stop sending notifications because their calendar was deleted
+		logging.Log.WithError(err).WithField("task_definition_id", task.TaskDefinition.Id.String()).Warn("assigned calendar not found, sending scheduled notification")
+		return metrics.OutcomeFired, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	firedAt := getFireTime(task)
+	if calendar.IsBusinessDay(firedAt) {
+		return metrics.OutcomeFired, nil
+	}
+	logFields := logrus.Fields{"task_definition_id": task.TaskDefinition.Id.String(), "calendar": assignment.Calendar, "fired_at": firedAt}
+	if assignment.Policy != CalendarPolicyShift {
+		logging.Log.WithFields(logFields).Debug("skipping scheduled notification on excluded day")
+		return metrics.OutcomeSuppressed, nil
+	}
+	shiftTo, err := calendar.NextBusinessDay(firedAt)
+	if err != nil {
+		return "", err
+	}
+	firesOnDay, err := calendar.CronFiresOnDay(task.TaskDefinition.CronTrigger.Expression, shiftTo)
+	if err != nil {
+		return "", err
+	}
+	if firesOnDay {
+		logging.Log.WithFields(logFields).Debug("skipping scheduled notification on excluded day, cron already fires on the next business day")
+		return metrics.OutcomeSuppressed, nil
+	}
+	logging.Log.WithFields(logFields).WithField("shift_to", shiftTo).Debug("shifting scheduled notification to the next business day")
+	return metrics.OutcomeDeferred, deferScheduledNotification(task, scheduledNotification, shiftTo.Add(getCronJitter(*task.TaskDefinition.Id, settings.JitterWindow)), deferredByCalendar)
+}
+
+// loadBusinessCalendar loads a base calendar with the tenant's override applied, if the tenant is set and has one
+func loadBusinessCalendar(name, tenant string) (*BusinessCalendar, error) {
+	base := &Calendar{}
+	err := database.DB.First(base, "name = ? AND tenant = ''", name).Error
+	if err != nil {
+		return nil, calendarLookupError(err, name)
+	}
+	if tenant == "" {
+		return NewBusinessCalendar(*base, nil)
+	}
+	override := &Calendar{}
+	err = database.DB.First(override, "name = ? AND tenant = ?", name, tenant).Error
+	if err == gorm.ErrRecordNotFound {
+		return NewBusinessCalendar(*base, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewBusinessCalendar(*base, override)
+}
+
+// NewBusinessCalendar applies a tenant override, if there is one, to a base calendar
+func NewBusinessCalendar(base Calendar, override *Calendar) (*BusinessCalendar, error) {
+	calendar := &BusinessCalendar{
+		location:     time.UTC,
+		workingDays:  map[time.Weekday]bool{},
+		holidays:     map[string]bool{},
+		workingDates: map[string]bool{},
+	}
+	var err error
+	if base.TimeZone != "" {
+		calendar.location, err = time.LoadLocation(base.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	workingDays := splitList(base.WorkingDays)
+	holidays := splitList(base.Holidays)
+	workingDates := []string{}
+	if override != nil {
+		if override.TimeZone != "" {
+			calendar.location, err = time.LoadLocation(override.TimeZone)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if override.WorkingDays != "" {
+			workingDays = splitList(override.WorkingDays)
+		}
+		holidays = append(holidays, splitList(override.Holidays)...)
+		workingDates = splitList(override.WorkingDates)
+	}
+	for _, day := range workingDays {
+		calendar.workingDays[weekdays[day]] = true
+	}
+	for _, date := range holidays {
+		calendar.holidays[date] = true
+	}
+	for _, date := range workingDates {
+		calendar.workingDates[date] = true
+	}
+	return calendar, nil
+}
+
+// CronFiresOnDay returns true if the cron expression has an occurrence on the day of t in the calendar's time zone.
+// Cron expressions are evaluated in utc, like the scheduler does.
+func (c BusinessCalendar) CronFiresOnDay(expression string, t time.Time) (bool, error) {
+	expr, err := cronexpr.Parse(expression)
+	if err != nil {
+		return false, err
+	}
+	local := t.In(c.location)
+	startOfDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, c.location)
+	next := expr.Next(startOfDay.Add(-time.Nanosecond).UTC())
+	return !next.IsZero() && next.Before(startOfDay.AddDate(0, 0, 1)), nil
+}
+
+func calendarLookupError(err error, name string) error {
+	if err == gorm.ErrRecordNotFound {
+		return errorx.DataUnavailable.New("calendar %s not found", name)
+	}
+	return err
+}
+
+func normalizeWorkingDays(days []string) ([]string, error) {
+	normalized := []string{}
+	for _, day := range days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if _, ok := weekdays[day]; !ok {
+			return nil, errorx.IllegalArgument.New("invalid working day %s", day)
+		}
+		normalized = append(normalized, day)
+	}
+	return normalized, nil
+}
+
+func normalizeDates(dates []string) ([]string, error) {
+	normalized := []string{}
+	for _, date := range dates {
+		parsed, err := time.Parse(calendarDateFormat, strings.TrimSpace(date))
+		if err != nil {
+			return nil, errorx.IllegalArgument.Wrap(err, "invalid date %s, dates must be formatted as YYYY-MM-DD", date)
+		}
+		normalized = append(normalized, parsed.Format(calendarDateFormat))
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+func (c Calendar) toResponse() calendarResponse {
+	return calendarResponse{
+		Name:         c.Name,
+		Tenant:       c.Tenant,
+		TimeZone:     c.TimeZone,
+		WorkingDays:  splitList(c.WorkingDays),
+		Holidays:     splitList(c.Holidays),
+		WorkingDates: splitList(c.WorkingDates),
+	}
+}
+
+func handleListCalendars(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	calendars := []Calendar{}
+	err := database.DB.Where("tenant = ''").Order("name").Find(&calendars).Error
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	response := []calendarResponse{}
+	for _, calendar := range calendars {
+		response = append(response, calendar.toResponse())
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func handleGetCalendar(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	calendars := []Calendar{}
+	err := database.DB.Where("name = ?", pathParams["name"]).Order("tenant").Find(&calendars).Error
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	if len(calendars) == 0 || calendars[0].Tenant != "" {
+		writeHttpError(w, errorx.DataUnavailable.New("calendar %s not found", pathParams["name"]))
+		return
+	}
+	response := calendars[0].toResponse()
+	for _, override := range calendars[1:] {
+		response.Overrides = append(response.Overrides, override.toResponse())
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func handleUpsertCalendar(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	request := calendarRequest{}
+	err := decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	calendar, err := UpsertCalendar(pathParams["name"], pathParams["tenant"], request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, calendar.toResponse())
+}
+
+func handleDeleteCalendar(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	err := DeleteCalendar(pathParams["name"], pathParams["tenant"])
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusNoContent, nil)
+}
+
+func handleAssignCalendar(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	request := CalendarAssignment{}
+	err = decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	assignment, err := AssignCalendar(id, request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, calendarAssignmentResponse{
+		ScheduledNotificationId: id.String(),
+		Calendar:                assignment.Calendar,
+		Tenant:                  assignment.Tenant,
+		Policy:                  assignment.Policy,
+	})
+}
+
+func handleUnassignCalendar(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	err = UnassignCalendar(id)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/joomcode/errorx"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OutputTable = "table"
+	OutputJson  = "json"
+	OutputYaml  = "yaml"
+)
+
+// NotFoundIdsHeader is the response header listing the requested ids that weren't found, comma separated
+const NotFoundIdsHeader = "not-found-ids"
+
+// ReadMessages reads protojson encoded messages, either a json array of messages or one message per line. newMessage
+// is called for each message, and returns the message to unmarshal into.
+func ReadMessages(input io.Reader, newMessage func() proto.Message) error {
+	raw, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	raw = bytes.TrimSpace(raw)
+	messages := []json.RawMessage{}
+	if bytes.HasPrefix(raw, []byte("[")) {
+		err = json.Unmarshal(raw, &messages)
+		if err != nil {
+			return errorx.IllegalFormat.Wrap(err, "invalid json array")
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		for decoder.More() {
+			message := json.RawMessage{}
+			err = decoder.Decode(&message)
+			if err != nil {
+				return errorx.IllegalFormat.Wrap(err, "invalid json on message %d", len(messages)+1)
+			}
+			messages = append(messages, message)
+		}
+	}
+	for i, message := range messages {
+		err = protojson.Unmarshal(message, newMessage())
+		if err != nil {
+			return errorx.IllegalFormat.Wrap(err, "invalid message %d", i+1)
+		}
+	}
+	return nil
+}
+
+// NotFoundIds returns the ids listed in the not found ids header of a response
+func NotFoundIds(header metadata.MD) []string {
+	ids := []string{}
+	for _, value := range header.Get(NotFoundIdsHeader) {
+		for _, id := range strings.Split(value, ",") {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// Printer prints results in an output format
+type Printer struct {
+	Out    io.Writer
+	Format string
+}
+
+// ValidateFormat checks that the format is table, json, or yaml
+func ValidateFormat(format string) error {
+	if format != OutputTable && format != OutputJson && format != OutputYaml {
+		return errorx.IllegalArgument.New("output must be one of %s, %s, or %s", OutputTable, OutputJson, OutputYaml)
+	}
+	return nil
+}
+
+// PrintMessages prints messages. Tables have a column for each of the columns, which are protojson field names, with
+// dots for nested fields.
+func (p Printer) PrintMessages(messages []proto.Message, columns []string) error {
+	values := []interface{}{}
+	for _, message := range messages {
+		marshalled, err := protojson.Marshal(message)
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		err = json.Unmarshal(marshalled, &value)
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+	if p.Format != OutputTable {
+		return p.PrintValues(values)
+	}
+	writer := tabwriter.NewWriter(p.Out, 0, 0, 2, ' ', 0)
+	headers := []string{}
+	for _, column := range columns {
+		headers = append(headers, strings.ToUpper(column))
+	}
+	fmt.Fprintln(writer, strings.Join(headers, "\t"))
+	for _, value := range values {
+		row := []string{}
+		for _, column := range columns {
+			row = append(row, TableCell(LookupPath(value, column)))
+		}
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+// PrintResult prints the result of a request that doesn't return messages
+func (p Printer) PrintResult(result map[string]interface{}) error {
+	if p.Format != OutputTable {
+		return p.PrintValues(result)
+	}
+	keys := []string{}
+	for key := range result {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writer := tabwriter.NewWriter(p.Out, 0, 0, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(writer, "%s\t%s\n", strings.ToUpper(key), TableCell(result[key]))
+	}
+	return writer.Flush()
+}
+
+// PrintValues prints values as yaml, or as json for any other format
+func (p Printer) PrintValues(values interface{}) error {
+	if p.Format == OutputYaml {
+		marshalled, err := yaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(p.Out, string(marshalled))
+		return err
+	}
+	marshalled, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(p.Out, string(marshalled))
+	return err
+}
+
+// LookupPath returns the value at a dotted path in a decoded json object, or nil when it isn't there
+func LookupPath(value interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// TableCell formats a decoded json value for a table, nested values are printed as json
+func TableCell(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	case map[string]interface{}, []interface{}:
+		marshalled, _ := json.Marshal(typed)
+		return string(marshalled)
+	default:
+		return fmt.Sprintf("%v", typed)
+	}
+}
@@ -0,0 +1,139 @@
+// Package clock tells the time for code that depends on it, so that tests can replace the wall clock with a fake one
+// that only moves when it's advanced.
+package clock
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the current time and waits for time to pass
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d to pass, it returns the context's error if the context is done first
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wall is the wall clock, it's the clock unless a test sets another
+var Wall Clock = wallClock{}
+
+type holder struct {
+	clock Clock
+}
+
+var current atomic.Pointer[holder]
+
+func init() {
+	current.Store(&holder{clock: Wall})
+}
+
+// Now returns the current time of the clock
+func Now() time.Time {
+	return current.Load().clock.Now()
+}
+
+// Since returns the time elapsed since t on the clock
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// Sleep waits for d to pass on the clock, it returns the context's error if the context is done first
+func Sleep(ctx context.Context, d time.Duration) error {
+	return current.Load().clock.Sleep(ctx, d)
+}
+
+// Set replaces the clock, it returns a function that restores the previous one. It's meant for tests.
+func Set(clock Clock) (restore func()) {
+	previous := current.Swap(&holder{clock: clock})
+	return func() { current.Store(previous) }
+}
+
+// Fake is a clock that's stopped at a time until it's advanced or set. Sleeping on it waits until it's moved past the
+// end of the sleep.
+type Fake struct {
+	mu       sync.Mutex
+	now      time.Time
+	sleepers map[chan struct{}]time.Time
+}
+
+// NewFake returns a fake clock stopped at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, sleepers: map[chan struct{}]time.Time{}}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Sleep(ctx context.Context, d time.Duration) error {
+	f.mu.Lock()
+	if d <= 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	woken := make(chan struct{})
+	f.sleepers[woken] = f.now.Add(d)
+	f.mu.Unlock()
+	select {
+	case <-woken:
+		return nil
+	case <-ctx.Done():
+		f.mu.Lock()
+		delete(f.sleepers, woken)
+		f.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Sleepers returns how many sleeps are waiting for the clock to move, so that tests can wait for sleeps to start
+// before moving it
+func (f *Fake) Sleepers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sleepers)
+}
+
+// Advance moves the clock forward by d, waking the sleeps that end by then
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setTime(f.now.Add(d))
+}
+
+// SetTime moves the clock to t, waking the sleeps that end by then
+func (f *Fake) SetTime(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setTime(t)
+}
+
+func (f *Fake) setTime(t time.Time) {
+	f.now = t
+	for woken, wakeAt := range f.sleepers {
+		if !wakeAt.After(t) {
+			close(woken)
+			delete(f.sleepers, woken)
+		}
+	}
+}
@@ -9,12 +9,49 @@ type RunConfig struct {
 	RunnerWindow                  time.Duration
 	CleanupWindow                 time.Duration
 	CockroachdbUri                string
+	CockroachdbUriFile            string
 	CockroachdbMaxIdleConnections int
 	CockroachdbMaxOpenConnections int
 	CockroachdbConnMaxLifetime    time.Duration
 	NotifoBaseUrl                 string
 	NotifoApiKey                  string
+	NotifoApiKeyFile              string
 	NotifoAppId                   string
+	NotifoConcurrency             int
+	UserCacheTtl                  time.Duration
+	UserCacheNegativeTtl          time.Duration
+	UserCacheMaxSize              int
+	StoreMiddlewares              []string
+	StoreFaultsFile               string
+	StoreRetryAttempts            int
+	StoreRetryBackoff             time.Duration
+	ResolverSecret                string
+	ResolverSecretFile            string
+	ResolverTimeout               time.Duration
+	ResolverFallback              string
+	ResolverMaxRetries            int
+	AuthEnabled                   bool
+	AuthJwksPath                  string
+	AuthJwksUrl                   string
+	AuthJwksRefreshInterval       time.Duration
+	AuthIssuer                    string
+	AuthAudience                  string
+	AuthRolesClaim                string
+	AuthUserIdClaim               string
+	AuthEndUserRoles              []string
+	AuthServiceRoles              []string
+	AuthAdminRoles                []string
+	AuditRetention                time.Duration
+	TracingExporter               string
+	TracingOtlpEndpoint           string
+	TracingOtlpInsecure           bool
+	TracingSampleRatio            float64
+	TracingServiceName            string
+	MetricsDefinitionsInterval    time.Duration
+	HealthCheckInterval           time.Duration
+	HealthCheckTimeout            time.Duration
+	ShutdownGracePeriod           time.Duration
+	ShutdownReadinessDelay        time.Duration
 }
 
 var AppConfig RunConfig
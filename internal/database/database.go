@@ -0,0 +1,38 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DB is the connection used for the service's own tables. The scheduler manages its own connection to the same
+// database.
+var DB *gorm.DB
+
+// Initialize connects to cockroachdb and migrates the given models
+func Initialize(uri string, maxIdleConnections, maxOpenConnections int, connMaxLifetime time.Duration, models ...interface{}) (deferredFunc func(), err error) {
+	db, err := gorm.Open(postgres.Open(uri), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxIdleConns(maxIdleConnections)
+	sqlDB.SetMaxOpenConns(maxOpenConnections)
+	sqlDB.SetConnMaxLifetime(connMaxLifetime)
+	err = db.AutoMigrate(models...)
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	DB = db
+	deferredFunc = func() {
+		sqlDB.Close()
+	}
+	return
+}
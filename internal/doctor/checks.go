@@ -0,0 +1,279 @@
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/joomcode/errorx"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// NotifoReachable checks that notifo answers http requests at the base url
+func NotifoReachable(baseUrl string) Check {
+	return Check{
+		Name: "notifo reachable",
+		Run: func(ctx context.Context) Result {
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseUrl, "/")+"/healthz", nil)
+			if err != nil {
+				return Fail(err, "set --notifo-base-url to the url of notifo, e.g. https://notifo.example.com")
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				return Fail(err, "check --notifo-base-url and that notifo is reachable from this host, e.g. dns, firewalls, and proxies")
+			}
+			response.Body.Close()
+			if response.StatusCode >= http.StatusInternalServerError {
+				return Fail(errorx.ExternalError.New("notifo answered with status %d", response.StatusCode), "check notifo's logs and that notifo is healthy, a proxy in front of it can also answer with 5xx")
+			}
+			return Ok(fmt.Sprintf("%s answered with status %d", baseUrl, response.StatusCode))
+		},
+	}
+}
+
+// NotifoAuth checks that notifo accepts the api key, and that the key has access to the app, by listing a user of
+// the app the way the service does
+func NotifoAuth(baseUrl, apiKey, appId string) []Check {
+	// both checks look at the same response
+	var statusCode int
+	return []Check{
+		{
+			Name:     "notifo api key",
+			Requires: "notifo reachable",
+			Run: func(ctx context.Context) Result {
+				if apiKey == "" {
+					return Fail(errorx.IllegalArgument.New("no api key is configured"), "set --notifo-api-key or --notifo-api-key-file")
+				}
+				var err error
+				statusCode, err = getNotifoUsersStatus(ctx, baseUrl, apiKey, appId)
+				if err != nil {
+					return Fail(err, "check that notifo is reachable from this host")
+				}
+				if statusCode == http.StatusUnauthorized {
+					return Fail(errorx.IllegalArgument.New("notifo rejected the api key"), "create an api key for the app in notifo's app settings and set it with --notifo-api-key or --notifo-api-key-file")
+				}
+				return Ok("notifo accepted the api key")
+			},
+		},
+		{
+			Name:     "notifo app id",
+			Requires: "notifo api key",
+			Run: func(ctx context.Context) Result {
+				if appId == "" {
+					return Fail(errorx.IllegalArgument.New("no app id is configured"), "set --notifo-app-id to the id of the app in notifo")
+				}
+				switch statusCode {
+				case http.StatusOK:
+					return Ok(fmt.Sprintf("app %s exists and the api key can access it", appId))
+				case http.StatusForbidden, http.StatusNotFound:
+					return Fail(errorx.IllegalArgument.New("notifo returned %d listing the users of app %s", statusCode, appId), "check that --notifo-app-id is the id shown in notifo's app settings, and that the api key was created for that app")
+				default:
+					return Fail(errorx.IllegalState.New("notifo returned %d listing the users of app %s", statusCode, appId), "check notifo's logs")
+				}
+			},
+		},
+	}
+}
+
+func getNotifoUsersStatus(ctx context.Context, baseUrl, apiKey, appId string) (int, error) {
+	usersUrl := fmt.Sprintf("%s/api/apps/%s/users?take=1", strings.TrimSuffix(baseUrl, "/"), url.PathEscape(appId))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, usersUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("X-ApiKey", apiKey)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// Cockroachdb checks that cockroachdb accepts connections, whether the service's tables exist, and whether the
+// scheduler's tables exist. The checks only read the schema. Tables that don't exist yet are a warning, because they're
+// created when the service starts.
+func Cockroachdb(uri string, schedulerTables []string, models ...interface{}) []Check {
+	var db *gorm.DB
+	return []Check{
+		{
+			Name: "cockroachdb connection",
+			Run: func(ctx context.Context) Result {
+				if uri == "" {
+					return Fail(errorx.IllegalArgument.New("no connection string is configured"), "set --cockroachdb-uri or --cockroachdb-uri-file")
+				}
+				var err error
+				db, err = gorm.Open(postgres.Open(uri), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+				if err == nil {
+					err = db.WithContext(ctx).Exec("SELECT 1").Error
+					if err != nil {
+						closeDB(db)
+					}
+				}
+				if err != nil {
+					return Fail(err, "check the host, port, user, password, database, and sslmode of --cockroachdb-uri, and that cockroachdb is reachable from this host")
+				}
+				return Ok("connected")
+			},
+		},
+		{
+			Name:     "cockroachdb schema",
+			Requires: "cockroachdb connection",
+			Run: func(ctx context.Context) Result {
+				tables := []string{}
+				for _, model := range models {
+					statement := &gorm.Statement{DB: db}
+					if err := statement.Parse(model); err != nil {
+						return Fail(err, "this is a bug in the service")
+					}
+					tables = append(tables, statement.Table)
+				}
+				return checkTables(ctx, db, tables)
+			},
+		},
+		{
+			Name:     "scheduler schema",
+			Requires: "cockroachdb connection",
+			Run: func(ctx context.Context) Result {
+				defer closeDB(db)
+				return checkTables(ctx, db, schedulerTables)
+			},
+		},
+	}
+}
+
+// checkTables warns about the tables that don't exist
+func checkTables(ctx context.Context, db *gorm.DB, tables []string) Result {
+	missing := []string{}
+	migrator := db.WithContext(ctx).Migrator()
+	for _, table := range tables {
+		if !migrator.HasTable(table) {
+			missing = append(missing, table)
+		}
+	}
+	if ctx.Err() != nil {
+		return Fail(errorx.TimeoutElapsed.Wrap(ctx.Err(), "timed out reading the schema"), "check cockroachdb's load and the network latency to it")
+	}
+	if len(missing) > 0 {
+		return Warn(fmt.Sprintf("tables %s don't exist", strings.Join(missing, ", ")), "the tables are created when the service starts, make sure the database user can create tables")
+	}
+	return Ok(fmt.Sprintf("%d tables exist", len(tables)))
+}
+
+func closeDB(db *gorm.DB) {
+	sqlDB, err := db.DB()
+	if err == nil {
+		sqlDB.Close()
+	}
+}
+
+// Tls checks that the certificate and key are a pair and that the certificates aren't expired or about to expire.
+// The check is skipped when tls isn't configured.
+func Tls(name, certPath, keyPath, caPath string, expiryWarning time.Duration) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) Result {
+			if certPath == "" && keyPath == "" && caPath == "" {
+				return Skip("tls is not configured")
+			}
+			if certPath == "" || keyPath == "" || caPath == "" {
+				return Warn("only some of the tls cert, key, and ca paths are set, so the server runs without tls", "set all of --tls-cert-path, --tls-key-path, and --tls-ca-path to serve with tls, or none of them")
+			}
+			pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				return Fail(err, "check that --tls-cert-path and --tls-key-path are readable pem files and that the key belongs to the certificate")
+			}
+			certificates := []*x509.Certificate{}
+			for _, raw := range pair.Certificate {
+				certificate, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return Fail(err, "check that --tls-cert-path is a pem encoded x509 certificate")
+				}
+				certificates = append(certificates, certificate)
+			}
+			caCertificates, err := readCertificates(caPath)
+			if err != nil {
+				return Fail(err, "check that --tls-ca-path is a readable pem encoded x509 certificate")
+			}
+			certificates = append(certificates, caCertificates...)
+			return checkExpiry(certificates, expiryWarning)
+		},
+	}
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certificates := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errorx.IllegalFormat.New("no certificates found in %s", path)
+	}
+	return certificates, nil
+}
+
+// checkExpiry fails when any certificate is expired or not valid yet, and warns when any expires within the warning
+// window. The detail is the earliest expiry.
+func checkExpiry(certificates []*x509.Certificate, expiryWarning time.Duration) Result {
+	now := clock.Now()
+	earliest := certificates[0]
+	for _, certificate := range certificates {
+		subject := certificate.Subject.String()
+		if now.After(certificate.NotAfter) {
+			return Fail(errorx.IllegalState.New("certificate %s expired at %s", subject, certificate.NotAfter.Format(time.RFC3339)), "renew the certificate")
+		}
+		if now.Before(certificate.NotBefore) {
+			return Fail(errorx.IllegalState.New("certificate %s isn't valid until %s", subject, certificate.NotBefore.Format(time.RFC3339)), "check the clock of this host and the certificate's validity period")
+		}
+		if certificate.NotAfter.Before(earliest.NotAfter) {
+			earliest = certificate
+		}
+	}
+	detail := fmt.Sprintf("certificate %s expires at %s", earliest.Subject.String(), earliest.NotAfter.Format(time.RFC3339))
+	if earliest.NotAfter.Sub(now) < expiryWarning {
+		return Warn(detail, "renew the certificate before it expires")
+	}
+	return Ok(detail)
+}
+
+// Port checks that nothing is listening on a port the service listens on
+func Port(name string, port int) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) Result {
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				return Fail(err, fmt.Sprintf("stop the process using port %d or choose another port. When the service is already running on this host this is expected.", port))
+			}
+			listener.Close()
+			return Ok(fmt.Sprintf("port %d is available", port))
+		},
+	}
+}
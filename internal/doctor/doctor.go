@@ -0,0 +1,96 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	StatusOk   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+)
+
+// Exit codes of the doctor command, following the nagios plugin convention so that monitoring can run it
+const (
+	ExitOk      = 0
+	ExitWarning = 1
+	ExitFailure = 2
+)
+
+// Check diagnoses one part of a deployment
+type Check struct {
+	Name string
+	// Requires is the name of an earlier check that must pass or warn for this one to run, it's skipped otherwise
+	Requires string
+	// Run returns the result of the check, its name is filled in by RunChecks
+	Run func(ctx context.Context) Result
+}
+
+// Result is the outcome of a check. Hint tells the operator how to fix a check that didn't pass.
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+func Ok(detail string) Result {
+	return Result{Status: StatusOk, Detail: detail}
+}
+
+func Skip(detail string) Result {
+	return Result{Status: StatusSkip, Detail: detail}
+}
+
+func Warn(detail, hint string) Result {
+	return Result{Status: StatusWarn, Detail: detail, Hint: hint}
+}
+
+func Fail(err error, hint string) Result {
+	detail := err.Error()
+	// the error type's prefix doesn't help operators
+	if errorxErr := errorx.Cast(err); errorxErr != nil && errorxErr.Cause() == nil {
+		detail = errorxErr.Message()
+	}
+	return Result{Status: StatusFail, Detail: detail, Hint: hint}
+}
+
+// RunChecks runs the checks in order, each with its own timeout
+func RunChecks(ctx context.Context, checks []Check, timeout time.Duration) []Result {
+	results := []Result{}
+	statuses := map[string]string{}
+	for _, check := range checks {
+		var result Result
+		if status, ok := statuses[check.Requires]; check.Requires != "" && (!ok || (status != StatusOk && status != StatusWarn)) {
+			result = Skip(fmt.Sprintf("the %s check didn't pass", check.Requires))
+		} else {
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			result = check.Run(checkCtx)
+			cancel()
+		}
+		result.Name = check.Name
+		statuses[check.Name] = result.Status
+		results = append(results, result)
+	}
+	return results
+}
+
+// ExitCode returns the exit code for the results, the failure code when any check failed and the warning code when
+// any warned
+func ExitCode(results []Result) int {
+	code := ExitOk
+	for _, result := range results {
+		switch result.Status {
+		case StatusFail:
+			return ExitFailure
+		case StatusWarn:
+			code = ExitWarning
+		}
+	}
+	return code
+}
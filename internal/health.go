@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DependencyCockroachdb = "cockroachdb"
+	DependencyNotifo      = "notifo"
+	DependencyScheduler   = "scheduler"
+)
+
+// notificationsServiceName is the grpc service name that the health service reports on, along with the overall ""
+const notificationsServiceName = "notifications.v1alpha1.NotificationsService"
+
+const (
+	statusOk       = "ok"
+	statusNotReady = "not ready"
+	statusShutdown = "shutting down"
+)
+
+// Health holds the results of the readiness checks and the grpc health server that reports them
+var Health = NewHealthChecker()
+
+// HealthChecker periodically checks the service's dependencies. The results back the /readyz endpoint and the serving
+// status of the grpc health service.
+type HealthChecker struct {
+	Server *health.Server
+
+	mu                 sync.RWMutex
+	results            map[string]dependencyResult
+	checkedAt          time.Time
+	schedulerStartedAt *time.Time
+	schedulerErr       error
+	lastExecutionAt    *time.Time
+	shuttingDown       bool
+}
+
+type dependencyResult struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+}
+
+type readinessResponse struct {
+	Status       string                      `json:"status"`
+	CheckedAt    *time.Time                  `json:"checked_at,omitempty"`
+	Dependencies map[string]dependencyResult `json:"dependencies"`
+}
+
+// NewHealthChecker returns a health checker that reports not serving until the first checks have run
+func NewHealthChecker() *HealthChecker {
+	h := &HealthChecker{Server: health.NewServer(), results: map[string]dependencyResult{}}
+	h.setServingStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// SchedulerStarted records that the scheduler loop was started
+func (h *HealthChecker) SchedulerStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := clock.Now()
+	h.schedulerStartedAt = &now
+	h.schedulerErr = nil
+}
+
+// SchedulerFailed records that the scheduler couldn't be started, which fails readiness until it's started
+func (h *HealthChecker) SchedulerFailed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.schedulerStartedAt = nil
+	h.schedulerErr = err
+}
+
+// ScheduledNotificationExecuted records when the scheduler last executed a scheduled notification
+func (h *HealthChecker) ScheduledNotificationExecuted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := clock.Now()
+	h.lastExecutionAt = &now
+}
+
+// Run checks the dependencies every interval until the context is done, each check is given the timeout
+func (h *HealthChecker) Run(ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.Check(ctx, timeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check runs the dependency checks concurrently, saves the results, and updates the grpc serving status
+func (h *HealthChecker) Check(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	checks := map[string]func(ctx context.Context) (map[string]interface{}, error){
+		DependencyCockroachdb: checkCockroachdb,
+		DependencyNotifo:      checkNotifo,
+		DependencyScheduler:   h.checkScheduler,
+	}
+	results := map[string]dependencyResult{}
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) (map[string]interface{}, error)) {
+			defer wg.Done()
+			detail, err := check(ctx)
+			result := dependencyResult{Status: statusOk, Detail: detail}
+			if err != nil {
+				result.Status = statusNotReady
+				result.Error = err.Error()
+			}
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			results[name] = result
+		}(name, check)
+	}
+	wg.Wait()
+	ready := true
+	for name, result := range results {
+		if result.Status != statusOk {
+			ready = false
+			logging.Log.WithFields(logrus.Fields{"dependency": name, "error": result.Error}).Warn("dependency check failed")
+		}
+	}
+	h.mu.Lock()
+	h.results = results
+	h.checkedAt = clock.Now()
+	h.mu.Unlock()
+	if ready {
+		h.setServingStatus(grpc_health_v1.HealthCheckResponse_SERVING)
+	} else {
+		h.setServingStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// Shutdown reports not ready from then on, so that traffic stops being sent to the service while it drains
+func (h *HealthChecker) Shutdown() {
+	h.mu.Lock()
+	h.shuttingDown = true
+	h.mu.Unlock()
+	h.Server.Shutdown()
+}
+
+func (h *HealthChecker) readiness() readinessResponse {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	response := readinessResponse{Status: statusOk, Dependencies: h.results}
+	if h.shuttingDown {
+		response.Status = statusShutdown
+		return response
+	}
+	if h.checkedAt.IsZero() {
+		response.Status = statusNotReady
+		return response
+	}
+	checkedAt := h.checkedAt
+	response.CheckedAt = &checkedAt
+	for _, result := range h.results {
+		if result.Status != statusOk {
+			response.Status = statusNotReady
+		}
+	}
+	return response
+}
+
+func (h *HealthChecker) setServingStatus(status grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	h.Server.SetServingStatus("", status)
+	h.Server.SetServingStatus(notificationsServiceName, status)
+}
+
+func checkCockroachdb(ctx context.Context) (map[string]interface{}, error) {
+	if database.DB == nil {
+		return nil, errorx.IllegalState.New("database is not initialized")
+	}
+	sqlDB, err := database.DB.DB()
+	if err != nil {
+		return nil, err
+	}
+	err = sqlDB.PingContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := sqlDB.Stats()
+	return map[string]interface{}{"open_connections": stats.OpenConnections, "in_use": stats.InUse}, nil
+}
+
+func checkNotifo(ctx context.Context) (map[string]interface{}, error) {
+	if notification_store.NotificationStore == nil {
+		return nil, errorx.IllegalState.New("notification store is not initialized")
+	}
+	return nil, notification_store.NotificationStore.Ping(ctx)
+}
+
+// checkScheduler checks that the scheduler loop was started and hasn't failed, and that it can read its task
+// definitions. The scheduler doesn't expose the state of its loop, so the time of the last execution is included in
+// the detail to show that it's firing.
+func (h *HealthChecker) checkScheduler(ctx context.Context) (map[string]interface{}, error) {
+	h.mu.RLock()
+	startedAt, schedulerErr, lastExecutionAt := h.schedulerStartedAt, h.schedulerErr, h.lastExecutionAt
+	h.mu.RUnlock()
+	detail := map[string]interface{}{}
+	if lastExecutionAt != nil {
+		detail["last_execution_at"] = *lastExecutionAt
+	}
+	if schedulerErr != nil {
+		return detail, schedulerErr
+	}
+	if startedAt == nil || Scheduler == nil {
+		return detail, errorx.IllegalState.New("scheduler is not running")
+	}
+	detail["started_at"] = *startedAt
+	errs := make(chan error, 1)
+	go func() {
+		_, err := Scheduler.ListTaskDefinitions(0, 1, nil)
+		errs <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return detail, errorx.TimeoutElapsed.Wrap(ctx.Err(), "timed out listing task definitions")
+	case err := <-errs:
+		return detail, err
+	}
+}
+
+// HandleLiveness always responds ok, the process is live as long as it can serve http
+func HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{"status": statusOk})
+}
+
+// HandleReadiness responds with the result of the last dependency checks, with a 503 if any of them failed
+func HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	response := Health.readiness()
+	statusCode := http.StatusOK
+	if response.Status != statusOk {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJson(w, statusCode, response)
+}
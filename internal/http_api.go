@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/errors"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/joomcode/errorx"
+)
+
+type httpHandler struct {
+	method  string
+	path    string
+	scope   string // scope required when auth is enabled
+	handler runtime.HandlerFunc
+}
+
+// httpHandlers are endpoints served on the grpc gateway that aren't part of the notifications grpc service
+var httpHandlers = []httpHandler{
+	{http.MethodPost, "/v1alpha1/relative-schedules", ScopeSchedulesWrite, handleRegisterRelativeSchedule},
+	{http.MethodGet, "/v1alpha1/relative-schedules", ScopeSchedulesRead, handleListRelativeSchedules},
+	{http.MethodDelete, "/v1alpha1/relative-schedules/{id}", ScopeSchedulesWrite, handleDeleteRelativeSchedule},
+	{http.MethodPost, "/v1alpha1/schedule-events", ScopeSchedulesWrite, handlePostScheduleEvent},
+	{http.MethodGet, "/v1alpha1/calendars", ScopeSchedulesRead, handleListCalendars},
+	{http.MethodGet, "/v1alpha1/calendars/{name}", ScopeSchedulesRead, handleGetCalendar},
+	{http.MethodPut, "/v1alpha1/calendars/{name}", ScopeSchedulesWrite, handleUpsertCalendar},
+	{http.MethodDelete, "/v1alpha1/calendars/{name}", ScopeSchedulesWrite, handleDeleteCalendar},
+	{http.MethodPut, "/v1alpha1/calendars/{name}/tenants/{tenant}", ScopeSchedulesWrite, handleUpsertCalendar},
+	{http.MethodDelete, "/v1alpha1/calendars/{name}/tenants/{tenant}", ScopeSchedulesWrite, handleDeleteCalendar},
+	{http.MethodPut, "/v1alpha1/scheduled-notifications/{id}/calendar", ScopeSchedulesWrite, handleAssignCalendar},
+	{http.MethodDelete, "/v1alpha1/scheduled-notifications/{id}/calendar", ScopeSchedulesWrite, handleUnassignCalendar},
+	{http.MethodPut, "/v1alpha1/scheduled-notifications/{id}/resolver", ScopeSchedulesWrite, handleSetResolverUrl},
+	{http.MethodDelete, "/v1alpha1/scheduled-notifications/{id}/resolver", ScopeSchedulesWrite, handleDeleteResolverUrl},
+	{http.MethodPut, "/v1alpha1/scheduled-notifications/{id}/jitter", ScopeSchedulesWrite, handleSetJitterWindow},
+	{http.MethodDelete, "/v1alpha1/scheduled-notifications/{id}/jitter", ScopeSchedulesWrite, handleDeleteJitterWindow},
+	{http.MethodPost, "/v1alpha1/api-keys", ScopeApiKeysAdmin, handleCreateApiKey},
+	{http.MethodGet, "/v1alpha1/api-keys", ScopeApiKeysAdmin, handleListApiKeys},
+	{http.MethodDelete, "/v1alpha1/api-keys/{id}", ScopeApiKeysAdmin, handleRevokeApiKey},
+	{http.MethodGet, "/v1alpha1/audit-log", ScopeAuditRead, handleQueryAuditLog},
+	{http.MethodPost, "/v1alpha1/bulk/users", ScopeUsersAdmin, handleImportUsers},
+	{http.MethodGet, "/v1alpha1/bulk/users", ScopeUsersAdmin, handleExportUsers},
+	{http.MethodGet, "/v1alpha1/store-faults", ScopeFaultsAdmin, handleGetStoreFaults},
+	{http.MethodPut, "/v1alpha1/store-faults", ScopeFaultsAdmin, handleSetStoreFaults},
+	{http.MethodDelete, "/v1alpha1/store-faults", ScopeFaultsAdmin, handleClearStoreFaults},
+}
+
+// RegisterHttpHandlers registers the http only endpoints on the grpc gateway mux
+func RegisterHttpHandlers(mux *runtime.ServeMux) error {
+	for _, handler := range httpHandlers {
+		handlerFunc := authorizeHttp(handler)
+		if isAuditedHttpHandler(handler) {
+			handlerFunc = auditHttp(handler.method, handler.path, handlerFunc)
+		}
+		err := mux.HandlePath(handler.method, handler.path, handlerFunc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeJsonBody(r *http.Request, dest interface{}) error {
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(dest)
+	if err != nil {
+		return errorx.IllegalFormat.Wrap(err, "invalid request body")
+	}
+	return nil
+}
+
+// writeJson writes the status code and the body as json. No content responses have no body, whatever body is.
+func writeJson(w http.ResponseWriter, statusCode int, body interface{}) {
+	if statusCode == http.StatusNoContent {
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if body != nil {
+		err := json.NewEncoder(w).Encode(body)
+		if err != nil {
+			logging.Log.WithError(err).Error("error writing response body")
+		}
+	}
+}
+
+func writeHttpError(w http.ResponseWriter, err error) {
+	switch {
+	case errorx.IsOfType(err, errorx.IllegalArgument), errorx.IsOfType(err, errorx.IllegalFormat):
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errorx.IsOfType(err, errorx.DataUnavailable):
+		writeJson(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	default:
+		logging.Log.WithError(err).Error("error handling http request")
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": errors.UnexpectedError})
+	}
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxJitterWindow is the longest jitter window a scheduled notification can have. Executions wait out their offset,
+// so the window is how long an execution can be held up for.
+const MaxJitterWindow = time.Hour
+
+// jitterContext is cancelled when shutdown begins, so that executions waiting out their jitter stop waiting rather
+// than hold up shutdown
+var jitterContext, cancelJitter = context.WithCancel(context.Background())
+
+type jitterWindowRequest struct {
+	Window string `json:"window"`
+}
+
+type jitterWindowResponse struct {
+	ScheduledNotificationId string `json:"scheduled_notification_id"`
+	Window                  string `json:"window"`
+}
+
+// SetJitterWindow sets the window that a cron scheduled notification's occurrences are spread across, or removes it
+// when the window is 0. The window is kept when the scheduled notification is upserted.
+func SetJitterWindow(taskDefinitionId uuid.UUID, window time.Duration) error {
+	definition, err := getTaskDefinition(taskDefinitionId)
+	if err != nil {
+		return err
+	}
+	err = validateJitterWindow(window, definition.CronTrigger != nil)
+	if err != nil {
+		return err
+	}
+	return updateScheduledNotificationSettings(*definition, func(settings *scheduledNotificationSettings) {
+		settings.JitterWindow = window
+	})
+}
+
+// validateJitterWindow checks a scheduled notification's jitter window, cron is whether it has a cron trigger
+func validateJitterWindow(window time.Duration, cron bool) error {
+	if window < 0 || window > MaxJitterWindow {
+		return errorx.IllegalArgument.New("jitter window must be between 0 and %s", MaxJitterWindow)
+	}
+	if window > 0 && !cron {
+		return errorx.IllegalArgument.New("jitter windows can only be set on cron scheduled notifications")
+	}
+	return nil
+}
+
+// getCronJitter returns how long after each cron occurrence a scheduled notification is sent. The offset is derived
+// from the task definition id, so it spreads notifications that share a cron expression across their jitter window
+// while each notification is sent at the same time every occurrence. Offsets are whole seconds, like fire times.
+func getCronJitter(taskDefinitionId uuid.UUID, window time.Duration) time.Duration {
+	windowSeconds := uint64(window / time.Second)
+	if windowSeconds == 0 {
+		return 0
+	}
+	hash := fnv.New64a()
+	hash.Write(taskDefinitionId[:])
+	return time.Duration(hash.Sum64()%windowSeconds) * time.Second
+}
+
+// waitForCronJitter waits until the scheduled notification's jitter offset after the cron occurrence. It returns an
+// error if shutdown begins first, in which case the occurrence isn't sent.
+func waitForCronJitter(task pkg.TaskInstance, window time.Duration) error {
+	if task.TaskDefinition.CronTrigger == nil {
+		return nil
+	}
+	sendAt := getFireTime(task).Add(getCronJitter(*task.TaskDefinition.Id, window))
+	wait := sendAt.Sub(clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	logging.Log.WithFields(logrus.Fields{"task_definition_id": task.TaskDefinition.Id.String(), "send_at": sendAt}).Debug("waiting for scheduled notification's jitter")
+	err := clock.Sleep(jitterContext, wait)
+	if err != nil {
+		return errorx.IllegalState.New("shutting down, not sending scheduled notification %s before its jitter elapsed", task.TaskDefinition.Id)
+	}
+	return nil
+}
+
+func handleSetJitterWindow(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	request := jitterWindowRequest{}
+	err = decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	window, err := time.ParseDuration(request.Window)
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid jitter window"))
+		return
+	}
+	err = SetJitterWindow(id, window)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, jitterWindowResponse{ScheduledNotificationId: id.String(), Window: window.String()})
+}
+
+func handleDeleteJitterWindow(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	err = SetJitterWindow(id, 0)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,120 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+// Component is a long running part of the service
+type Component struct {
+	Name string
+	// Critical components fail the process when they stop before shutdown
+	Critical bool
+	// Run runs the component until it fails or the context is done
+	Run func(ctx context.Context) error
+	// Stop gracefully stops the component, giving up when the context is done. It's optional, components without one
+	// are stopped by cancelling the context passed to Run.
+	Stop func(ctx context.Context) error
+}
+
+// Manager starts components and supervises them until the process is signalled to stop or a critical component
+// stops, then stops them in the reverse of the order they were added
+type Manager struct {
+	gracePeriod time.Duration
+	components  []Component
+}
+
+type exit struct {
+	component Component
+	err       error
+}
+
+func NewManager(gracePeriod time.Duration) *Manager {
+	return &Manager{gracePeriod: gracePeriod}
+}
+
+// Add adds a component, components are started in the order they're added
+func (m *Manager) Add(component Component) {
+	m.components = append(m.components, component)
+}
+
+// Run starts the components and blocks until SIGTERM or SIGINT is received, the context is done, or a critical
+// component stops. Components are then stopped, sharing the grace period. The error is that of the critical component
+// that stopped, if any.
+func (m *Manager) Run(ctx context.Context) error {
+	signalCtx, stopSignals := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	exits := make(chan exit, len(m.components))
+	var running sync.WaitGroup
+	for _, component := range m.components {
+		running.Add(1)
+		go func(component Component) {
+			defer running.Done()
+			err := component.Run(runCtx)
+			exits <- exit{component: component, err: err}
+		}(component)
+	}
+	var runErr error
+supervise:
+	for {
+		select {
+		case <-signalCtx.Done():
+			logging.Log.Info("received shutdown signal")
+			break supervise
+		case exited := <-exits:
+			logFields := logrus.Fields{"component": exited.component.Name}
+			if !exited.component.Critical {
+				logging.Log.WithError(exited.err).WithFields(logFields).Warn("non critical component stopped")
+				continue
+			}
+			runErr = exited.err
+			if runErr == nil {
+				runErr = errorx.IllegalState.New("%s stopped unexpectedly", exited.component.Name)
+			}
+			logging.Log.WithError(runErr).WithFields(logFields).Error("critical component stopped")
+			break supervise
+		}
+	}
+	m.stop(cancelRun, &running)
+	return runErr
+}
+
+// stop stops each component in reverse order, then cancels the run context and waits for the components to return,
+// all within the grace period
+func (m *Manager) stop(cancelRun context.CancelFunc, running *sync.WaitGroup) {
+	logging.Log.WithField("grace_period", m.gracePeriod.String()).Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), m.gracePeriod)
+	defer cancel()
+	for i := len(m.components) - 1; i >= 0; i-- {
+		component := m.components[i]
+		if component.Stop == nil {
+			continue
+		}
+		err := component.Stop(ctx)
+		if err != nil {
+			logging.Log.WithError(err).WithField("component", component.Name).Error("error stopping component")
+		}
+	}
+	cancelRun()
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		logging.Log.Info("shut down")
+	case <-ctx.Done():
+		logging.Log.Warn("grace period elapsed before every component stopped")
+	}
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are registered with the default prometheus registry, which is served by the grpc server when prometheus is
+// enabled
+
+const namespace = "notifications"
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+
+	// scheduled execution outcomes
+	OutcomeFired      = "fired"
+	OutcomeFailed     = "failed"
+	OutcomeSuppressed = "suppressed"
+	OutcomeDeferred   = "deferred"
+
+	// user cache lookup results
+	CacheHit         = "hit"
+	CacheNegativeHit = "negative_hit"
+	CacheMiss        = "miss"
+)
+
+var (
+	EventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_published_total",
+		Help:      "Notification events published to the notification store, by topic kind and outcome",
+	}, []string{"topic", "outcome"})
+
+	StoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_duration_seconds",
+		Help:      "Latency of notification store methods, by method and outcome",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "outcome"})
+
+	NotifoRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "notifo_request_duration_seconds",
+		Help:      "Latency of requests to notifo, by endpoint and response status",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+
+	StoreRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_retries_total",
+		Help:      "Notification store calls retried by the retry store middleware, by method",
+	}, []string{"method"})
+
+	ScheduledExecutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduled_executions_total",
+		Help:      "Scheduled notification executions, by outcome, and for suppressed and deferred executions the reason",
+	}, []string{"outcome", "reason"})
+
+	ScheduledFireLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scheduled_fire_lag_seconds",
+		Help:      "Time between when a scheduled notification was meant to fire and when it was executed",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600},
+	})
+
+	ScheduledDefinitions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scheduled_definitions",
+		Help:      "Scheduled notification definitions, by trigger type",
+	}, []string{"trigger_type"})
+
+	UsersUpserted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "users_upserted_total",
+		Help:      "Users upserted",
+	})
+
+	UsersDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "users_deleted_total",
+		Help:      "Users deleted",
+	})
+
+	UserCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_cache_lookups_total",
+		Help:      "User cache lookups, by result: hit, negative_hit for ids cached as not found, or miss",
+	}, []string{"result"})
+
+	UserCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_cache_evictions_total",
+		Help:      "Users evicted from the user cache to stay within its size limit",
+	})
+
+	UserCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "user_cache_entries",
+		Help:      "Users and not found ids in the user cache",
+	})
+
+	StoreFaultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_faults_injected_total",
+		Help:      "Faults injected into notification store methods, by method and fault",
+	}, []string{"method", "fault"})
+)
+
+// Outcome returns the outcome label for an error
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
+
+// TopicKind returns the first segment of a topic, e.g. users for users/123, so that topics can be used as a label
+// without a series per user
+func TopicKind(topic string) string {
+	if topic == "" {
+		return "none"
+	}
+	kind, _, _ := strings.Cut(topic, "/")
+	return kind
+}
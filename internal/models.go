@@ -0,0 +1,9 @@
+package internal
+
+// DatabaseModels are the tables owned by the notifications service, they're migrated when the database is initialized
+var DatabaseModels = []interface{}{
+	&RelativeSchedule{},
+	&Calendar{},
+	&ApiKey{},
+	&AuditEntry{},
+}
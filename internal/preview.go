@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"time"
+
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/gorhill/cronexpr"
+	"github.com/joomcode/errorx"
+)
+
+// PreviewFireTimes returns up to count times after from that a scheduled notification will be sent. Cron occurrences
+// are evaluated in utc like the scheduler does, and include the notification's offset in the jitter window when it
+// has an id. Calendars are applied when the notification fires, so they aren't reflected in the preview.
+func PreviewFireTimes(scheduledNotification *notificationsv1alpha1.ScheduledNotification, jitterWindow time.Duration, from time.Time, count int) ([]time.Time, error) {
+	fireTimes := []time.Time{}
+	if executeOnceTrigger := scheduledNotification.GetExecuteOnceTrigger(); executeOnceTrigger != nil {
+		fireAt, err := time.Parse(time.RFC3339, executeOnceTrigger.FireAt)
+		if err != nil {
+			return nil, errorx.IllegalArgument.Wrap(err, "invalid fire at time")
+		}
+		if fireAt.After(from) && count > 0 {
+			fireTimes = append(fireTimes, fireAt.UTC())
+		}
+		return fireTimes, nil
+	}
+	cronTrigger := scheduledNotification.GetCronTrigger()
+	if cronTrigger == nil {
+		return nil, errorx.IllegalArgument.New("scheduled notification has no trigger")
+	}
+	expr, err := cronexpr.Parse(cronTrigger.Expression)
+	if err != nil {
+		return nil, errorx.IllegalArgument.Wrap(err, "invalid cron expression")
+	}
+	var jitter time.Duration
+	if scheduledNotification.Id != "" {
+		id, err := uuid.Parse(scheduledNotification.Id)
+		if err != nil {
+			return nil, errorx.IllegalArgument.Wrap(err, "invalid id")
+		}
+		jitter = getCronJitter(id, jitterWindow)
+	}
+	// start early enough to include occurrences whose jittered time is still after from
+	next := from.UTC().Add(-jitter)
+	for len(fireTimes) < count {
+		next = expr.Next(next)
+		if next.IsZero() {
+			break
+		}
+		if fireAt := next.Add(jitter); fireAt.After(from) {
+			fireTimes = append(fireTimes, fireAt)
+		}
+	}
+	return fireTimes, nil
+}
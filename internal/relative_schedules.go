@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// how often relative schedules that have fired are purged
+const relativeSchedulePurgeInterval = time.Hour
+
+// RelativeSchedule is a notification that is scheduled relative to an anchor event posted for a user, e.g. send 24
+// hours after signup unless onboarding is completed. When the anchor event is posted an execute once scheduled
+// notification is created with the same id as the relative schedule, posting the cancel event before it fires deletes
+// it. Relative schedules are purged once they've fired.
+type RelativeSchedule struct {
+	Id           uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserId       string    `gorm:"index;not null"`
+	AnchorEvent  string    `gorm:"not null"`
+	CancelEvent  string
+	Delay        int64      // nanoseconds
+	ExpireAfter  int64      // nanoseconds
+	Notification string     `gorm:"type:jsonb;not null"`
+	FireAt       *time.Time // set when the anchor event is posted
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+type relativeScheduleRequest struct {
+	UserId       string          `json:"user_id"`
+	AnchorEvent  string          `json:"anchor_event"`
+	CancelEvent  string          `json:"cancel_event"`
+	Delay        string          `json:"delay"`
+	ExpireAfter  string          `json:"expire_after"`
+	Notification json.RawMessage `json:"notification"`
+}
+
+type relativeScheduleResponse struct {
+	Id           string          `json:"id"`
+	UserId       string          `json:"user_id"`
+	AnchorEvent  string          `json:"anchor_event"`
+	CancelEvent  string          `json:"cancel_event,omitempty"`
+	Delay        string          `json:"delay"`
+	ExpireAfter  string          `json:"expire_after,omitempty"`
+	Notification json.RawMessage `json:"notification"`
+	FireAt       *time.Time      `json:"fire_at,omitempty"`
+}
+
+type scheduleEventRequest struct {
+	UserId string `json:"user_id"`
+	Event  string `json:"event"`
+}
+
+type scheduleEventResponse struct {
+	Scheduled []string `json:"scheduled"`
+	Cancelled []string `json:"cancelled"`
+}
+
+// RegisterRelativeSchedule validates and saves a relative schedule. Nothing is scheduled until the anchor event is
+// posted for the user.
+func RegisterRelativeSchedule(userId, anchorEvent, cancelEvent string, delay, expireAfter time.Duration, notification *notificationsv1alpha1.NotificationEvent) (*RelativeSchedule, error) {
+	if userId == "" {
+		return nil, errorx.IllegalArgument.New("relative schedules must have a user id")
+	}
+	if anchorEvent == "" {
+		return nil, errorx.IllegalArgument.New("relative schedules must have an anchor event")
+	}
+	if delay < 0 {
+		return nil, errorx.IllegalArgument.New("relative schedule delay must not be negative")
+	}
+	if expireAfter < 0 {
+		return nil, errorx.IllegalArgument.New("relative schedule expire after must not be negative")
+	}
+	if notification == nil {
+		return nil, errorx.IllegalArgument.New("relative schedules must have a notification")
+	}
+	notificationJson, err := protojson.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	schedule := &RelativeSchedule{
+		Id:           uuid.New(),
+		UserId:       userId,
+		AnchorEvent:  anchorEvent,
+		CancelEvent:  cancelEvent,
+		Delay:        delay.Nanoseconds(),
+		ExpireAfter:  expireAfter.Nanoseconds(),
+		Notification: string(notificationJson),
+	}
+	err = database.DB.Create(schedule).Error
+	return schedule, err
+}
+
+// HandleScheduleEvent schedules every pending relative schedule anchored on the event for the user, and cancels every
+// scheduled relative schedule for the user that is cancelled by the event and hasn't fired yet. Relative schedules
+// whose anchor event hasn't been posted aren't cancelled, they're scheduled when it is. It returns the ids of the
+// scheduled and cancelled relative schedules.
+func HandleScheduleEvent(userId, event string) (scheduled, cancelled []string, err error) {
+	if userId == "" || event == "" {
+		return nil, nil, errorx.IllegalArgument.New("schedule events must have a user id and an event")
+	}
+	scheduled, err = anchorRelativeSchedules(userId, event)
+	if err != nil {
+		return
+	}
+	cancelled, err = cancelRelativeSchedules(userId, event)
+	return
+}
+
+func anchorRelativeSchedules(userId, event string) ([]string, error) {
+	schedules := []RelativeSchedule{}
+	err := database.DB.Where("user_id = ? AND anchor_event = ? AND fire_at IS NULL", userId, event).Find(&schedules).Error
+	if err != nil {
+		return nil, err
+	}
+	scheduled := []string{}
+	now := clock.Now()
+	for _, schedule := range schedules {
+		fireAt := now.Add(time.Duration(schedule.Delay))
+		scheduledNotification, err := schedule.toScheduledNotification(fireAt)
+		if err != nil {
+			return scheduled, err
+		}
+		err = upsertNotification(scheduledNotification)
+		if err != nil {
+			return scheduled, err
+		}
+		err = database.DB.Model(&schedule).Update("fire_at", fireAt).Error
+		if err != nil {
+			return scheduled, err
+		}
+		logging.Log.WithFields(logrus.Fields{"relative_schedule_id": schedule.Id.String(), "user_id": userId, "fire_at": fireAt}).Debug("scheduled relative schedule")
+		scheduled = append(scheduled, schedule.Id.String())
+	}
+	return scheduled, nil
+}
+
+func cancelRelativeSchedules(userId, event string) ([]string, error) {
+	schedules := []RelativeSchedule{}
+	err := database.DB.Where("user_id = ? AND cancel_event = ? AND fire_at > ?", userId, event, clock.Now()).Find(&schedules).Error
+	if err != nil {
+		return nil, err
+	}
+	cancelled := []string{}
+	for _, schedule := range schedules {
+		err = DeleteRelativeSchedule(schedule.Id)
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, schedule.Id.String())
+	}
+	return cancelled, nil
+}
+
+// DeleteRelativeSchedule deletes a relative schedule and the scheduled notification created for it, if any
+func DeleteRelativeSchedule(id uuid.UUID) error {
+	err := Scheduler.DeleteTaskDefinitions([]*uuid.UUID{&id})
+	if err != nil {
+		return err
+	}
+	return database.DB.Delete(&RelativeSchedule{}, "id = ?", id).Error
+}
+
+// PurgeFiredRelativeSchedules deletes relative schedules that have fired every hour until the context is done. Their
+// scheduled notifications are cleaned up by the scheduler.
+func PurgeFiredRelativeSchedules(ctx context.Context) {
+	ticker := time.NewTicker(relativeSchedulePurgeInterval)
+	defer ticker.Stop()
+	for {
+		err := purgeFiredRelativeSchedules()
+		if err != nil {
+			logging.Log.WithError(err).Error("error purging fired relative schedules")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeFiredRelativeSchedules() error {
+	result := database.DB.Where("fire_at <= ?", clock.Now()).Delete(&RelativeSchedule{})
+	if result.Error == nil && result.RowsAffected > 0 {
+		logging.Log.WithField("purged", result.RowsAffected).Info("purged fired relative schedules")
+	}
+	return result.Error
+}
+
+// deleteRelativeSchedulesForUsers removes relative schedules for deleted users. Their scheduled notifications are
+// deleted with the rest of the users' scheduled notifications.
+func deleteRelativeSchedulesForUsers(userIds []string) error {
+	return database.DB.Delete(&RelativeSchedule{}, "user_id IN ?", userIds).Error
+}
+
+func (r RelativeSchedule) toScheduledNotification(fireAt time.Time) (*notificationsv1alpha1.ScheduledNotification, error) {
+	notification := &notificationsv1alpha1.NotificationEvent{}
+	err := protojson.Unmarshal([]byte(r.Notification), notification)
+	if err != nil {
+		return nil, err
+	}
+	return &notificationsv1alpha1.ScheduledNotification{
+		Id:           r.Id.String(),
+		UserId:       r.UserId,
+		Notification: notification,
+		ExpireAfter:  r.ExpireAfter,
+		Trigger: &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{
+			ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: fireAt.UTC().Format(time.RFC3339)},
+		},
+	}, nil
+}
+
+func (r RelativeSchedule) toResponse() relativeScheduleResponse {
+	response := relativeScheduleResponse{
+		Id:           r.Id.String(),
+		UserId:       r.UserId,
+		AnchorEvent:  r.AnchorEvent,
+		CancelEvent:  r.CancelEvent,
+		Delay:        time.Duration(r.Delay).String(),
+		Notification: json.RawMessage(r.Notification),
+		FireAt:       r.FireAt,
+	}
+	if r.ExpireAfter > 0 {
+		response.ExpireAfter = time.Duration(r.ExpireAfter).String()
+	}
+	return response
+}
+
+func handleRegisterRelativeSchedule(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	request := relativeScheduleRequest{}
+	err := decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	delay, err := time.ParseDuration(request.Delay)
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid delay"))
+		return
+	}
+	var expireAfter time.Duration
+	if request.ExpireAfter != "" {
+		expireAfter, err = time.ParseDuration(request.ExpireAfter)
+		if err != nil {
+			writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid expire_after"))
+			return
+		}
+	}
+	var notification *notificationsv1alpha1.NotificationEvent
+	if len(request.Notification) > 0 {
+		notification = &notificationsv1alpha1.NotificationEvent{}
+		err = protojson.Unmarshal(request.Notification, notification)
+		if err != nil {
+			writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid notification"))
+			return
+		}
+	}
+	schedule, err := RegisterRelativeSchedule(request.UserId, request.AnchorEvent, request.CancelEvent, delay, expireAfter, notification)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusCreated, schedule.toResponse())
+}
+
+func handleListRelativeSchedules(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	userId := r.URL.Query().Get("user_id")
+	if userId == "" {
+		writeHttpError(w, errorx.IllegalArgument.New("user_id is required"))
+		return
+	}
+	schedules := []RelativeSchedule{}
+	err := database.DB.Where("user_id = ?", userId).Order("created_at").Find(&schedules).Error
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	response := []relativeScheduleResponse{}
+	for _, schedule := range schedules {
+		response = append(response, schedule.toResponse())
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func handleDeleteRelativeSchedule(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	err = DeleteRelativeSchedule(id)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusNoContent, nil)
+}
+
+func handlePostScheduleEvent(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	request := scheduleEventRequest{}
+	err := decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	scheduled, cancelled, err := HandleScheduleEvent(request.UserId, request.Event)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, scheduleEventResponse{Scheduled: scheduled, Cancelled: cancelled})
+}
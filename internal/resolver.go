@@ -0,0 +1,310 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// ResolverFallbackStale sends the notification with the data it was scheduled with
+	ResolverFallbackStale = "stale"
+	// ResolverFallbackSkip drops this execution of the notification
+	ResolverFallbackSkip = "skip"
+	// ResolverFallbackRetry retries the resolver and fails the execution if it never succeeds
+	ResolverFallbackRetry = "retry"
+
+	resolverSignatureHeader = "X-Notifications-Signature"
+	resolverTimestampHeader = "X-Notifications-Timestamp"
+)
+
+// traced transport so that resolver calls get a span and propagate the trace context
+var resolverClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// resolverRequest is the body posted to the resolver url when a scheduled notification fires
+type resolverRequest struct {
+	TaskDefinitionId      string          `json:"task_definition_id"`
+	UserId                string          `json:"user_id"`
+	FiredAt               string          `json:"fired_at"`
+	ScheduledNotification json.RawMessage `json:"scheduled_notification"`
+}
+
+// resolverResponse is the body returned by the resolver. Data is merged into the event data, subject and body are
+// merged into the preformatted subject and body by locale.
+type resolverResponse struct {
+	Data    map[string]interface{} `json:"data"`
+	Subject map[string]interface{} `json:"subject"`
+	Body    map[string]interface{} `json:"body"`
+}
+
+type resolverUrlRequest struct {
+	Url string `json:"url"`
+}
+
+type resolverUrlResponse struct {
+	ScheduledNotificationId string `json:"scheduled_notification_id"`
+	Url                     string `json:"url"`
+}
+
+// SetResolverUrl sets the url that a scheduled notification's data is resolved from when it fires, or removes it
+// when the url is empty. The url is kept when the scheduled notification is upserted.
+func SetResolverUrl(taskDefinitionId uuid.UUID, resolverUrl string) error {
+	err := validateResolverUrl(resolverUrl)
+	if err != nil {
+		return err
+	}
+	definition, err := getTaskDefinition(taskDefinitionId)
+	if err != nil {
+		return err
+	}
+	return updateScheduledNotificationSettings(*definition, func(settings *scheduledNotificationSettings) {
+		settings.ResolverUrl = resolverUrl
+	})
+}
+
+// validateResolverUrl checks that a resolver url is empty or an http or https url
+func validateResolverUrl(resolverUrl string) error {
+	if resolverUrl == "" {
+		return nil
+	}
+	parsed, err := url.Parse(resolverUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errorx.IllegalArgument.New("resolver url %s is not an http or https url", resolverUrl)
+	}
+	return nil
+}
+
+// resolveNotification calls the scheduled notification's resolver, if it has one, and merges the fresh data into the
+// scheduled notification. It returns false if the notification should not be sent. The notification is only changed
+// when the resolver's response is merged successfully, so the stale fallback sends the data it was scheduled with.
+// Retries wait between attempts, and the whole resolution is limited to the resolver timeout for each attempt, so
+// that a failing resolver can't hold up the scheduler for longer.
+func resolveNotification(ctx context.Context, task pkg.TaskInstance, scheduledNotification *notificationsv1alpha1.ScheduledNotification, resolverUrl string) (bool, error) {
+	if resolverUrl == "" {
+		return true, nil
+	}
+	fallback := config.AppConfig.ResolverFallback
+	attempts := 1
+	if fallback == ResolverFallbackRetry {
+		attempts += config.AppConfig.ResolverMaxRetries
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(attempts)*config.AppConfig.ResolverTimeout)
+	defer cancel()
+	var response *resolverResponse
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		response, err = callResolver(ctx, task, scheduledNotification, resolverUrl)
+		if err == nil {
+			err = mergeResolverResponse(response, scheduledNotification.Notification)
+		}
+		if err == nil {
+			return true, nil
+		}
+		logging.Log.WithError(err).WithFields(logrus.Fields{"task_definition_id": task.TaskDefinition.Id.String(), "attempt": attempt}).Warn("error resolving scheduled notification data")
+		if attempt < attempts && !waitForRetry(ctx, time.Duration(attempt)*time.Second) {
+			break
+		}
+	}
+	switch fallback {
+	case ResolverFallbackSkip:
+		return false, nil
+	case ResolverFallbackRetry:
+		return false, err
+	default:
+		// send stale
+		return true, nil
+	}
+}
+
+// waitForRetry waits for the delay, it returns false if the context is done first
+func waitForRetry(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func callResolver(ctx context.Context, task pkg.TaskInstance, scheduledNotification *notificationsv1alpha1.ScheduledNotification, resolverUrl string) (*resolverResponse, error) {
+	notificationJson, err := protojson.Marshal(scheduledNotification)
+	if err != nil {
+		return nil, err
+	}
+	requestBody, err := json.Marshal(resolverRequest{
+		TaskDefinitionId:      task.TaskDefinition.Id.String(),
+		UserId:                scheduledNotification.UserId,
+		FiredAt:               clock.Now().UTC().Format(time.RFC3339),
+		ScheduledNotification: notificationJson,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.AppConfig.ResolverTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, resolverUrl, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	signResolverRequest(request, requestBody)
+	response, err := resolverClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNoContent {
+		// nothing to merge
+		return &resolverResponse{}, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errorx.IllegalState.New("expected status code %d from resolver but got %d with body %s", http.StatusOK, response.StatusCode, responseBody)
+	}
+	resolved := &resolverResponse{}
+	err = json.Unmarshal(responseBody, resolved)
+	return resolved, err
+}
+
+// signResolverRequest signs the timestamp and body with the resolver secret so that resolvers can verify the
+// request came from us. The signature is the hex encoded hmac sha256 of "<timestamp>.<body>".
+func signResolverRequest(request *http.Request, body []byte) {
+	if config.AppConfig.ResolverSecret == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(clock.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(config.AppConfig.ResolverSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	request.Header.Set(resolverTimestampHeader, timestamp)
+	request.Header.Set(resolverSignatureHeader, fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil))))
+}
+
+// mergeResolverResponse merges the resolver's response into the event. The event is left unchanged if the response
+// can't be merged.
+func mergeResolverResponse(response *resolverResponse, event *notificationsv1alpha1.NotificationEvent) error {
+	data := event.Data
+	if len(response.Data) > 0 {
+		merged := map[string]interface{}{}
+		if event.Data != "" {
+			err := json.Unmarshal([]byte(event.Data), &merged)
+			if err != nil {
+				return errorx.IllegalState.Wrap(err, "scheduled notification data must be a json object to merge resolved data")
+			}
+		}
+		for key, value := range response.Data {
+			merged[key] = value
+		}
+		dataBytes, err := json.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		data = string(dataBytes)
+	}
+	if len(response.Subject) == 0 && len(response.Body) == 0 {
+		event.Data = data
+		return nil
+	}
+	preformatted := event.Preformatted
+	if preformatted == nil {
+		preformatted = &notificationsv1alpha1.NotificationEventFormatting{}
+	}
+	subject, err := mergeLocalizedText(preformatted.Subject, response.Subject)
+	if err != nil {
+		return err
+	}
+	body, err := mergeLocalizedText(preformatted.Body, response.Body)
+	if err != nil {
+		return err
+	}
+	event.Data = data
+	event.Preformatted = preformatted
+	event.Preformatted.Subject = subject
+	event.Preformatted.Body = body
+	return nil
+}
+
+// mergeLocalizedText returns the existing text by locale with the resolved text merged in, without changing the
+// existing text
+func mergeLocalizedText(existing *structpb.Struct, resolved map[string]interface{}) (*structpb.Struct, error) {
+	if len(resolved) == 0 {
+		return existing, nil
+	}
+	merged := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	for locale, text := range existing.GetFields() {
+		merged.Fields[locale] = text
+	}
+	for locale, text := range resolved {
+		value, err := structpb.NewValue(text)
+		if err != nil {
+			return nil, err
+		}
+		merged.Fields[locale] = value
+	}
+	return merged, nil
+}
+
+func handleSetResolverUrl(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	request := resolverUrlRequest{}
+	err = decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	if request.Url == "" {
+		writeHttpError(w, errorx.IllegalArgument.New("url is required"))
+		return
+	}
+	err = SetResolverUrl(id, request.Url)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, resolverUrlResponse{ScheduledNotificationId: id.String(), Url: request.Url})
+}
+
+func handleDeleteResolverUrl(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	id, err := uuid.Parse(pathParams["id"])
+	if err != nil {
+		writeHttpError(w, errorx.IllegalArgument.Wrap(err, "invalid id"))
+		return
+	}
+	err = SetResolverUrl(id, "")
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusNoContent, nil)
+}
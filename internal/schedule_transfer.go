@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/go-scheduler/pkg"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	TriggerTypeCron        = "cron"
+	TriggerTypeExecuteOnce = "execute-once"
+
+	ConflictStrategyFail      = "fail"
+	ConflictStrategySkip      = "skip"
+	ConflictStrategyOverwrite = "overwrite"
+
+	// max size of a single jsonl line when importing
+	maxImportLineSize = 1024 * 1024
+	// number of scheduled notifications checked for conflicts and saved at a time when importing
+	importBatchSize = 500
+)
+
+// ExportFilter selects which scheduled notifications are exported
+type ExportFilter struct {
+	Ids         []string
+	UserId      string
+	TriggerType string
+	PageSize    int
+}
+
+// ImportOptions controls how scheduled notifications are imported
+type ImportOptions struct {
+	DryRun     bool
+	RemapIds   bool
+	OnConflict string
+}
+
+// ImportResult summarizes an import. IdMap maps imported ids to the ids they were saved with, it's only populated
+// when ids are remapped or missing. Lines without an id are keyed by their line number, as line:<n>.
+type ImportResult struct {
+	Created int
+	Updated int
+	Skipped int
+	IdMap   map[string]string
+}
+
+// exportedLine is a line of an export, a protojson encoded scheduled notification with the settings that aren't part
+// of the scheduled notification message
+type exportedLine struct {
+	ScheduledNotification json.RawMessage  `json:"scheduledNotification"`
+	Settings              exportedSettings `json:"settings"`
+}
+
+// exportedSettings are the exported scheduledNotificationSettings. Deferred occurrences aren't exported, so neither is
+// what they were deferred from.
+type exportedSettings struct {
+	ResolverUrl  string              `json:"resolverUrl,omitempty"`
+	Calendar     *CalendarAssignment `json:"calendar,omitempty"`
+	JitterWindow string              `json:"jitterWindow,omitempty"`
+}
+
+// importedScheduledNotification is a scheduled notification read from an import, with the line it was on
+type importedScheduledNotification struct {
+	scheduledNotificationMetadata
+	lineNumber int
+}
+
+// ExportScheduledNotifications writes scheduled notifications matching the filter to w as jsonl, one line per
+// scheduled notification holding the protojson encoded scheduled notification and its settings. It returns the number
+// of notifications written.
+func ExportScheduledNotifications(w io.Writer, filter ExportFilter) (int, error) {
+	if filter.PageSize <= 0 {
+		filter.PageSize = 500
+	}
+	if filter.TriggerType != "" && filter.TriggerType != TriggerTypeCron && filter.TriggerType != TriggerTypeExecuteOnce {
+		return 0, errorx.IllegalArgument.New("trigger type must be %s or %s", TriggerTypeCron, TriggerTypeExecuteOnce)
+	}
+	exported := 0
+	if len(filter.Ids) > 0 {
+		uuids, err := GetUuidsFromStrings(filter.Ids)
+		if err != nil {
+			return 0, errorx.IllegalArgument.Wrap(err, "invalid id")
+		}
+		definitions, err := Scheduler.GetTaskDefinitions(uuids)
+		if err != nil {
+			return 0, err
+		}
+		return writeScheduledNotifications(w, definitions, filter)
+	}
+	// deferred occurrences are left out, they belong to the cron scheduled notification they were deferred from
+	query := notDeferredQuery
+	args := []interface{}{}
+	if filter.UserId != "" {
+		query = "metadata->>'user_id' = ? AND " + notDeferredQuery
+		args = append(args, filter.UserId)
+	}
+	for skip := 0; ; skip += filter.PageSize {
+		definitions, err := Scheduler.ListTaskDefinitions(skip, filter.PageSize, query, args...)
+		if err != nil {
+			return exported, err
+		}
+		written, err := writeScheduledNotifications(w, definitions, filter)
+		exported += written
+		if err != nil {
+			return exported, err
+		}
+		if len(definitions) < filter.PageSize {
+			return exported, nil
+		}
+	}
+}
+
+func writeScheduledNotifications(w io.Writer, definitions []pkg.TaskDefinition, filter ExportFilter) (int, error) {
+	written := 0
+	for _, definition := range definitions {
+		if !matchesTriggerType(definition, filter.TriggerType) {
+			continue
+		}
+		scheduledNotification, err := GetScheduledNotificationFromTaskDefinition(definition)
+		if err != nil {
+			return written, err
+		}
+		settings, err := getScheduledNotificationSettings(definition)
+		if err != nil {
+			return written, err
+		}
+		line, err := marshalScheduledNotificationLine(scheduledNotification, settings)
+		if err != nil {
+			return written, err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", line)
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+func marshalScheduledNotificationLine(scheduledNotification *notificationsv1alpha1.ScheduledNotification, settings scheduledNotificationSettings) ([]byte, error) {
+	marshalled, err := protojson.Marshal(scheduledNotification)
+	if err != nil {
+		return nil, err
+	}
+	line := exportedLine{
+		ScheduledNotification: marshalled,
+		Settings:              exportedSettings{ResolverUrl: settings.ResolverUrl, Calendar: settings.Calendar},
+	}
+	if settings.JitterWindow > 0 {
+		line.Settings.JitterWindow = settings.JitterWindow.String()
+	}
+	return json.Marshal(line)
+}
+
+// unmarshalScheduledNotificationLine reads a line written by marshalScheduledNotificationLine
+func unmarshalScheduledNotificationLine(line []byte) (*notificationsv1alpha1.ScheduledNotification, scheduledNotificationSettings, error) {
+	settings := scheduledNotificationSettings{}
+	exported := exportedLine{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&exported)
+	if err != nil {
+		return nil, settings, err
+	}
+	if len(exported.ScheduledNotification) == 0 {
+		return nil, settings, errorx.IllegalFormat.New("missing scheduledNotification")
+	}
+	settings.ResolverUrl = exported.Settings.ResolverUrl
+	settings.Calendar = exported.Settings.Calendar
+	if exported.Settings.JitterWindow != "" {
+		settings.JitterWindow, err = time.ParseDuration(exported.Settings.JitterWindow)
+		if err != nil {
+			return nil, settings, errorx.IllegalFormat.Wrap(err, "invalid jitter window")
+		}
+	}
+	scheduledNotification := &notificationsv1alpha1.ScheduledNotification{}
+	err = protojson.Unmarshal(exported.ScheduledNotification, scheduledNotification)
+	return scheduledNotification, settings, err
+}
+
+func matchesTriggerType(definition pkg.TaskDefinition, triggerType string) bool {
+	switch triggerType {
+	case TriggerTypeCron:
+		return definition.CronTrigger != nil
+	case TriggerTypeExecuteOnce:
+		return definition.ExecuteOnceTrigger != nil
+	default:
+		return true
+	}
+}
+
+// ImportScheduledNotifications reads jsonl scheduled notifications, in the format written by
+// ExportScheduledNotifications, from r and upserts them. The input is read twice, first from r, spooling it to a
+// temporary file, and then from the file, so that it isn't held in memory. The first read validates every line, and
+// with the fail conflict strategy checks every id for conflicts, so a bad line or a conflict fails the import before
+// anything is saved. Scheduled notifications created by something else between the two reads are still conflicts.
+func ImportScheduledNotifications(r io.Reader, options ImportOptions) (*ImportResult, error) {
+	if options.OnConflict == "" {
+		options.OnConflict = ConflictStrategyFail
+	}
+	if options.OnConflict != ConflictStrategyFail && options.OnConflict != ConflictStrategySkip && options.OnConflict != ConflictStrategyOverwrite {
+		return nil, errorx.IllegalArgument.New("conflict strategy must be %s, %s, or %s", ConflictStrategyFail, ConflictStrategySkip, ConflictStrategyOverwrite)
+	}
+	spool, err := os.CreateTemp("", "schedules-import-*.jsonl")
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "error creating import spool file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	err = validateImport(r, spool, options)
+	if err != nil {
+		return nil, err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "error reading import spool file")
+	}
+	result := &ImportResult{IdMap: map[string]string{}}
+	batch := []importedScheduledNotification{}
+	err = readScheduledNotifications(spool, func(lineNumber int, imported scheduledNotificationMetadata) error {
+		batch = append(batch, importedScheduledNotification{scheduledNotificationMetadata: imported, lineNumber: lineNumber})
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		err := importBatch(batch, options, result)
+		batch = batch[:0]
+		return err
+	})
+	if err == nil && len(batch) > 0 {
+		err = importBatch(batch, options, result)
+	}
+	return result, err
+}
+
+// validateImport reads every line, copying it to the spool, and checks for conflicts with the fail conflict strategy.
+// Ids can't be repeated when they're checked for conflicts or remapped, so that each is imported once.
+func validateImport(r io.Reader, spool io.Writer, options ImportOptions) error {
+	checkConflicts := options.OnConflict == ConflictStrategyFail && !options.RemapIds
+	checkRepeats := checkConflicts || options.RemapIds
+	seen := map[string]int{}
+	batch := []*uuid.UUID{}
+	spooled := 0
+	err := readScheduledNotifications(r, func(lineNumber int, imported scheduledNotificationMetadata) error {
+		line, err := marshalScheduledNotificationLine(imported.ScheduledNotification, imported.scheduledNotificationSettings)
+		if err != nil {
+			return err
+		}
+		// blank lines are kept, so that line numbers read from the spool are the input's
+		_, err = fmt.Fprintf(spool, "%s%s\n", strings.Repeat("\n", lineNumber-spooled-1), line)
+		if err != nil {
+			return errorx.ExternalError.Wrap(err, "error writing import spool file")
+		}
+		spooled = lineNumber
+		if !checkRepeats || imported.Id == "" {
+			return nil
+		}
+		id, err := uuid.Parse(imported.Id)
+		if err != nil {
+			return errorx.IllegalArgument.Wrap(err, "invalid scheduled notification id %s on line %d", imported.Id, lineNumber)
+		}
+		if previous, ok := seen[id.String()]; ok {
+			return errorx.IllegalArgument.New("scheduled notification %s is on lines %d and %d", imported.Id, previous, lineNumber)
+		}
+		seen[id.String()] = lineNumber
+		if !checkConflicts {
+			return nil
+		}
+		batch = append(batch, &id)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		err = checkImportConflicts(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return checkImportConflicts(batch)
+}
+
+func checkImportConflicts(ids []*uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	existing, err := Scheduler.GetTaskDefinitions(ids)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return errorx.IllegalState.New("scheduled notification %s already exists", existing[0].Id)
+	}
+	return nil
+}
+
+// importBatch saves a batch of validated scheduled notifications, by the conflict strategy
+func importBatch(batch []importedScheduledNotification, options ImportOptions, result *ImportResult) error {
+	ids := []*uuid.UUID{}
+	for _, imported := range batch {
+		if options.RemapIds || imported.Id == "" {
+			key := imported.Id
+			if key == "" {
+				key = fmt.Sprintf("line:%d", imported.lineNumber)
+			}
+			newId := uuid.NewString()
+			result.IdMap[key] = newId
+			imported.Id = newId
+		}
+		id, err := uuid.Parse(imported.Id)
+		if err != nil {
+			return errorx.IllegalArgument.Wrap(err, "invalid scheduled notification id %s", imported.Id)
+		}
+		ids = append(ids, &id)
+	}
+	existing, err := Scheduler.GetTaskDefinitions(ids)
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, definition := range existing {
+		exists[definition.Id.String()] = true
+	}
+	for i, imported := range batch {
+		exists := exists[ids[i].String()]
+		if exists && options.OnConflict == ConflictStrategyFail {
+			return errorx.IllegalState.New("scheduled notification %s already exists", imported.Id)
+		}
+		if exists && options.OnConflict == ConflictStrategySkip {
+			result.Skipped++
+			continue
+		}
+		if !options.DryRun {
+			err = saveNotification(imported.ScheduledNotification, imported.scheduledNotificationSettings)
+			if err != nil {
+				return err
+			}
+		}
+		if exists {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+	}
+	return nil
+}
+
+// readScheduledNotifications reads and validates jsonl scheduled notifications one at a time, calling handle with each
+func readScheduledNotifications(r io.Reader, handle func(lineNumber int, imported scheduledNotificationMetadata) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		scheduledNotification, settings, err := unmarshalScheduledNotificationLine([]byte(line))
+		if err != nil {
+			return errorx.IllegalFormat.Wrap(err, "invalid scheduled notification on line %d", lineNumber)
+		}
+		err = validateImportedSettings(scheduledNotification, &settings)
+		if err != nil {
+			return errorx.Decorate(err, "invalid scheduled notification on line %d", lineNumber)
+		}
+		// validate the same way upserts do, so that bad lines are caught before anything is saved
+		if scheduledNotification.UserId == "" {
+			return errorx.IllegalArgument.New("scheduled notification on line %d has no user id", lineNumber)
+		}
+		_, err = GetTaskDefinitionFromScheduledNotification(proto.Clone(scheduledNotification).(*notificationsv1alpha1.ScheduledNotification))
+		if err != nil {
+			return errorx.IllegalArgument.Wrap(err, "invalid scheduled notification on line %d", lineNumber)
+		}
+		err = handle(lineNumber, scheduledNotificationMetadata{ScheduledNotification: scheduledNotification, scheduledNotificationSettings: settings})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// validateImportedSettings validates settings the same way setting them through the api does. Assigned calendars
+// aren't looked up, a scheduled notification whose calendar doesn't exist is sent as if it had none.
+func validateImportedSettings(scheduledNotification *notificationsv1alpha1.ScheduledNotification, settings *scheduledNotificationSettings) error {
+	err := validateResolverUrl(settings.ResolverUrl)
+	if err != nil {
+		return err
+	}
+	cron := scheduledNotification.GetCronTrigger() != nil
+	err = validateJitterWindow(settings.JitterWindow, cron)
+	if err != nil {
+		return err
+	}
+	if settings.Calendar != nil {
+		return validateCalendarAssignment(settings.Calendar, cron)
+	}
+	return nil
+}
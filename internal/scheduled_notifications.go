@@ -2,15 +2,57 @@ package internal
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	"github.com/catalystsquad/go-notifications/internal/tracing"
 	"github.com/catalystsquad/go-notifications/notification_store"
 	"github.com/catalystsquad/go-scheduler/pkg"
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
-func HandleScheduledNotification(task pkg.TaskInstance) error {
+// deferredByCalendar is the reason that cron occurrences shifted to the next business day are deferred
+const deferredByCalendar = "calendar"
+
+// notDeferredQuery selects the task definitions of scheduled notifications, leaving out deferred occurrences
+const notDeferredQuery = "metadata->>'parent_id' IS NULL"
+
+func HandleScheduledNotification(task pkg.TaskInstance) (err error) {
+	// executions that start after shutdown has begun fail, rather than risk being interrupted part way through
+	if !beginExecution() {
+		return errorx.IllegalState.New("shutting down, not executing scheduled notification %s", task.TaskDefinition.Id)
+	}
+	defer executions.Done()
+	Health.ScheduledNotificationExecuted()
+	// each execution starts a new trace, tagged with the task definition id and the correlation id of the notification
+	// event sent to the store
+	ctx, span := tracing.Tracer.Start(executionsContext, "HandleScheduledNotification",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("notifications.task_definition_id", task.TaskDefinition.Id.String()),
+			attribute.String("notifications.fire_time", getFireTime(task).UTC().Format(time.RFC3339)),
+		),
+	)
+	outcome, reason := metrics.OutcomeFired, ""
+	defer func() {
+		if err != nil {
+			outcome, reason = metrics.OutcomeFailed, ""
+		}
+		metrics.ScheduledExecutions.WithLabelValues(outcome, reason).Inc()
+		tracing.End(span, err)
+	}()
+	if task.ExecuteAt != nil {
+		metrics.ScheduledFireLag.Observe(clock.Since(*task.ExecuteAt).Seconds())
+	}
 	bytes, err := json.Marshal(task.TaskDefinition.Metadata)
 	if err != nil {
 		logging.Log.WithError(err).Error("error marshalling task defintion metadata to json")
@@ -23,17 +65,100 @@ func HandleScheduledNotification(task pkg.TaskInstance) error {
 		logging.Log.WithError(err).Error("error marshalling json to notification event")
 		return err
 	}
-	event.Notification.Topic = GetUserTopic(event.UserId)
-	// set correlation id to the task definition id, so that the notification
-	// event can be tracked back to the task
-	taskID := task.TaskDefinition.Id.String()
-	if taskID != "" {
-		event.Notification.CorrelationId = &taskID
+	settings, err := getScheduledNotificationSettings(task.TaskDefinition)
+	if err != nil {
+		logging.Log.WithError(err).Error("error reading scheduled notification settings")
+		return err
+	}
+	// the correlation id is the task definition id, or for deferred occurrences the id of the cron scheduled
+	// notification they were deferred from, so that the notification event can be tracked back to the scheduled
+	// notification
+	correlationId := task.TaskDefinition.Id.String()
+	if settings.ParentId != "" {
+		correlationId = settings.ParentId
+	}
+	span.SetAttributes(
+		attribute.String("notifications.user_id", event.UserId),
+		attribute.String("notifications.correlation_id", correlationId),
+	)
+	calendarOutcome, err := applyBusinessCalendar(task, event, settings)
+	if err != nil {
+		logging.Log.WithError(err).Error("error applying business calendar to scheduled notification")
+		return err
+	}
+	if calendarOutcome != metrics.OutcomeFired {
+		outcome, reason = calendarOutcome, "calendar"
+		return nil
+	}
+	err = waitForCronJitter(task, settings.JitterWindow)
+	if err != nil {
+		logging.Log.WithError(err).Warn("error waiting for scheduled notification's jitter")
+		return err
+	}
+	event.Notification.Topic = notification_store.GetUserTopic(event.UserId)
+	event.Notification.CorrelationId = &correlationId
+	send, err := resolveNotification(ctx, task, event, settings.ResolverUrl)
+	if err != nil {
+		logging.Log.WithError(err).Error("error resolving scheduled notification")
+		return err
+	}
+	if !send {
+		logging.Log.WithField("task_definition_id", task.TaskDefinition.Id.String()).Info("skipping scheduled notification, resolver failed")
+		outcome, reason = metrics.OutcomeSuppressed, "resolver"
+		return nil
 	}
-	err = notification_store.NotificationStore.PublishEvents([]*notificationsv1alpha1.NotificationEvent{event.Notification})
+	err = notification_store.NotificationStore.PublishEvents(ctx, []*notificationsv1alpha1.NotificationEvent{event.Notification})
 	if err != nil {
 		logging.Log.WithError(err).Error("error sending scheduled notification")
 		return err
 	}
 	return nil
 }
+
+// deferScheduledNotification schedules a single execution of a fired cron scheduled notification at a later time.
+// The deferred occurrence's id is derived from the fired notification's id, the reason, and the time, so deferring the
+// same occurrence more than once only schedules it once. Deferred occurrences keep the fired notification's settings,
+// are sent with its id as their correlation id, aren't listed or exported, and are deleted with it.
+func deferScheduledNotification(task pkg.TaskInstance, scheduledNotification *notificationsv1alpha1.ScheduledNotification, fireAt time.Time, reason string) error {
+	settings, err := getScheduledNotificationSettings(task.TaskDefinition)
+	if err != nil {
+		return err
+	}
+	settings.ParentId = task.TaskDefinition.Id.String()
+	settings.DeferredBy = reason
+	deferredId := uuid.NewSHA1(*task.TaskDefinition.Id, []byte(fmt.Sprintf("%s/%s", reason, fireAt.UTC().Format(time.RFC3339))))
+	deferred := &notificationsv1alpha1.ScheduledNotification{
+		Id:           deferredId.String(),
+		UserId:       scheduledNotification.UserId,
+		Notification: scheduledNotification.Notification,
+		ExpireAfter:  scheduledNotification.ExpireAfter,
+		Trigger: &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{
+			ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: fireAt.UTC().Format(time.RFC3339)},
+		},
+	}
+	return saveNotification(deferred, settings)
+}
+
+// deleteDeferredOccurrences deletes the pending deferred occurrences of cron scheduled notifications, only the ones
+// deferred for the reason when it's set
+func deleteDeferredOccurrences(parentIds []*uuid.UUID, reason string) error {
+	if len(parentIds) == 0 {
+		return nil
+	}
+	ids := []string{}
+	for _, id := range parentIds {
+		ids = append(ids, id.String())
+	}
+	if reason == "" {
+		return Scheduler.DeleteTaskDefinitionsByMetadataQuery("metadata->>'parent_id' IN ?", ids)
+	}
+	return Scheduler.DeleteTaskDefinitionsByMetadataQuery("metadata->>'parent_id' IN ? AND metadata->>'deferred_by' = ?", ids, reason)
+}
+
+// getFireTime returns the time the task instance was scheduled to execute at, or now if it isn't known
+func getFireTime(task pkg.TaskInstance) time.Time {
+	if task.ExecuteAt != nil {
+		return *task.ExecuteAt
+	}
+	return clock.Now()
+}
@@ -1,5 +1,114 @@
 package internal
 
-import pkg2 "github.com/catalystsquad/go-scheduler/pkg"
+import (
+	"context"
+	"sync"
+	"time"
 
-var Scheduler *pkg2.Scheduler
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	pkg2 "github.com/catalystsquad/go-scheduler/pkg"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+)
+
+// TaskScheduler is the part of the scheduler the service uses, so that tests can replace it
+type TaskScheduler interface {
+	Run()
+	UpsertTaskDefinition(definition pkg2.TaskDefinition) error
+	GetTaskDefinitions(ids []*uuid.UUID) ([]pkg2.TaskDefinition, error)
+	ListTaskDefinitions(skip, limit int, query interface{}, args ...interface{}) ([]pkg2.TaskDefinition, error)
+	DeleteTaskDefinitions(ids []*uuid.UUID) error
+	DeleteTaskDefinitionsByMetadataQuery(query interface{}, args ...interface{}) error
+}
+
+var Scheduler TaskScheduler
+
+// executions tracks scheduled notifications being executed so that shutdown can wait for them
+var executions sync.WaitGroup
+var executionsMu sync.Mutex
+var draining bool
+
+// executionsContext is the parent context of scheduled notification executions, it's cancelled when shutdown stops
+// waiting for them so that they stop waiting on the resolver and store
+var executionsContext, cancelExecutions = context.WithCancel(context.Background())
+
+// number of definitions read at a time when counting them
+const definitionCountPageSize = 500
+
+// RecordScheduledDefinitionCounts counts scheduled notification definitions by trigger type for the scheduled
+// definitions gauge, every interval until the context is done
+func RecordScheduledDefinitionCounts(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		counts, err := countScheduledDefinitions()
+		if err != nil {
+			logging.Log.WithError(err).Error("error counting scheduled notification definitions")
+		} else {
+			for triggerType, count := range counts {
+				metrics.ScheduledDefinitions.WithLabelValues(triggerType).Set(float64(count))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func countScheduledDefinitions() (map[string]int, error) {
+	counts := map[string]int{TriggerTypeCron: 0, TriggerTypeExecuteOnce: 0}
+	for skip := 0; ; skip += definitionCountPageSize {
+		definitions, err := Scheduler.ListTaskDefinitions(skip, definitionCountPageSize, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, definition := range definitions {
+			if matchesTriggerType(definition, TriggerTypeCron) {
+				counts[TriggerTypeCron]++
+			} else if matchesTriggerType(definition, TriggerTypeExecuteOnce) {
+				counts[TriggerTypeExecuteOnce]++
+			}
+		}
+		if len(definitions) < definitionCountPageSize {
+			return counts, nil
+		}
+	}
+}
+
+// beginExecution registers a scheduled notification execution, it returns false once the service is shutting down
+func beginExecution() bool {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+	if draining {
+		return false
+	}
+	executions.Add(1)
+	return true
+}
+
+// DrainScheduledNotifications stops new scheduled notification executions and waits for the ones in flight to finish,
+// or for the context to be done
+func DrainScheduledNotifications(ctx context.Context) error {
+	executionsMu.Lock()
+	draining = true
+	executionsMu.Unlock()
+	cancelJitter()
+	done := make(chan struct{})
+	go func() {
+		executions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancelExecutions()
+		return errorx.TimeoutElapsed.New("timed out waiting for scheduled notifications to finish")
+	}
+}
@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/fsnotify/fsnotify"
+	"github.com/joomcode/errorx"
+)
+
+// Secret is a secret value that can change while the service is running. Read it with Value each time it's used so
+// that rotations are picked up.
+type Secret struct {
+	path  string
+	mu    sync.RWMutex
+	value string
+}
+
+// NewSecret returns a secret with a fixed value
+func NewSecret(value string) *Secret {
+	return &Secret{value: value}
+}
+
+// NewFileSecret returns a secret read from a file. Call Watch to reload it when the file changes.
+func NewFileSecret(path string) (*Secret, error) {
+	value, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Secret{path: path, value: value}, nil
+}
+
+// ReadFile reads a secret from a file, surrounding whitespace such as a trailing newline is removed
+func ReadFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", errorx.ExternalError.Wrap(err, "error reading secret file %s", path)
+	}
+	value := strings.TrimSpace(string(contents))
+	if value == "" {
+		return "", errorx.IllegalArgument.New("secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// Value returns the current value of the secret
+func (s *Secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// Watch reloads a file secret when its file changes, until the context is done. The file's directory is watched rather
+// than the file, so that files which are replaced rather than written to, like kubernetes secret volumes which swap
+// a symlink, are picked up. When the file can't be read the previous value is kept.
+func (s *Secret) Watch(ctx context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	err = watcher.Add(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			logging.Log.WithError(err).WithField("path", s.path).Error("error watching secret file")
+		case <-watcher.Events:
+			s.reload()
+		}
+	}
+}
+
+func (s *Secret) reload() {
+	value, err := ReadFile(s.path)
+	if err != nil {
+		logging.Log.WithError(err).Error("error reloading secret file, keeping the previous value")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value != s.value {
+		s.value = value
+		logging.Log.WithField("path", s.path).Info("reloaded secret file")
+	}
+}
@@ -2,15 +2,20 @@ package internal
 
 import (
 	"context"
-	"fmt"
+	"strings"
 
 	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/client"
 	"github.com/catalystsquad/go-notifications/internal/errors"
+	"github.com/catalystsquad/go-notifications/internal/sliceutil"
 	"github.com/catalystsquad/go-notifications/notification_store"
 	"github.com/catalystsquad/go-scheduler/pkg"
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
 	"github.com/joomcode/errorx"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -18,6 +23,9 @@ import (
 // will fail if the interface isn't implemented corectly.
 var _ notificationsv1alpha1.NotificationsServiceServer = &NotificationsServiceServer{}
 
+// NotFoundIdsHeader is the response header listing the requested ids that weren't found, comma separated
+const NotFoundIdsHeader = client.NotFoundIdsHeader
+
 type NotificationsServiceServer struct{}
 
 func (n NotificationsServiceServer) UpsertScheduledNotifications(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceUpsertScheduledNotificationsRequest) (*notificationsv1alpha1.NotificationsServiceUpsertScheduledNotificationsResponse, error) {
@@ -48,14 +56,13 @@ func (n NotificationsServiceServer) GetScheduledNotifications(ctx context.Contex
 		}
 	} else if request.UserId != "" {
 		// query by user id
-		query := fmt.Sprintf("metadata->>'user_id' = '%s'", request.UserId)
-		taskDefinitions, err = Scheduler.ListTaskDefinitions(int(request.Skip), int(request.Limit), query)
+		taskDefinitions, err = Scheduler.ListTaskDefinitions(int(request.Skip), int(request.Limit), "metadata->>'user_id' = ? AND "+notDeferredQuery, request.UserId)
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		// simple list
-		taskDefinitions, err = Scheduler.ListTaskDefinitions(int(request.Skip), int(request.Limit), nil)
+		taskDefinitions, err = Scheduler.ListTaskDefinitions(int(request.Skip), int(request.Limit), notDeferredQuery)
 	}
 	if err != nil {
 		logging.Log.WithError(err).Error("error getting scheduled notifications")
@@ -74,16 +81,21 @@ func (n NotificationsServiceServer) DeleteScheduledNotifications(ctx context.Con
 	if err != nil {
 		return nil, err
 	}
-	// delete from scheduler
+	// delete from scheduler, along with pending deferred occurrences so that they aren't sent
 	err = Scheduler.DeleteTaskDefinitions(ids)
 	if err != nil {
 		return nil, err
 	}
+	err = deleteDeferredOccurrences(ids, "")
+	if err != nil {
+		logging.Log.WithError(err).Error("error deleting deferred occurrences")
+		return nil, status.Error(codes.Internal, errors.UnexpectedError)
+	}
 	return &notificationsv1alpha1.NotificationsServiceDeleteScheduledNotificationsResponse{Success: true}, nil
 }
 
 func (n NotificationsServiceServer) UpsertUsers(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceUpsertUsersRequest) (*notificationsv1alpha1.NotificationsServiceUpsertUsersResponse, error) {
-	users, err := notification_store.NotificationStore.UpsertUsers(request.Users)
+	users, err := notification_store.NotificationStore.UpsertUsers(ctx, request.Users)
 	if err != nil {
 		logging.Log.WithError(err).Error("error upserting users")
 		return nil, status.Error(codes.Internal, errors.UnexpectedError)
@@ -91,17 +103,23 @@ func (n NotificationsServiceServer) UpsertUsers(ctx context.Context, request *no
 	return &notificationsv1alpha1.NotificationsServiceUpsertUsersResponse{Users: users}, nil
 }
 
+// GetUsers returns the users that were found, in the order they were requested. The ids that weren't found are sent in
+// the not-found-ids header. When any id fails the request fails, naming the ids.
 func (n NotificationsServiceServer) GetUsers(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceGetUsersRequest) (*notificationsv1alpha1.NotificationsServiceGetUsersResponse, error) {
-	users, err := notification_store.NotificationStore.GetUsers(request.Ids)
+	result, err := notification_store.NotificationStore.GetUsers(ctx, request.Ids)
 	if err != nil {
 		logging.Log.WithError(err).Error("error getting users")
+		return nil, status.FromContextError(err).Err()
+	}
+	err = usersResultError(ctx, result, "getting")
+	if err != nil {
 		return nil, err
 	}
-	return &notificationsv1alpha1.NotificationsServiceGetUsersResponse{Users: users}, nil
+	return &notificationsv1alpha1.NotificationsServiceGetUsersResponse{Users: result.Users}, nil
 }
 
 func (n NotificationsServiceServer) ListUsers(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceListUsersRequest) (*notificationsv1alpha1.NotificationsServiceListUsersResponse, error) {
-	users, err := notification_store.NotificationStore.ListUsers(request.Skip, request.Limit)
+	users, err := notification_store.NotificationStore.ListUsers(ctx, request.Skip, request.Limit)
 	if err != nil {
 		logging.Log.WithError(err).Error("error listing users")
 		return nil, status.Error(codes.Internal, errors.UnexpectedError)
@@ -111,25 +129,66 @@ func (n NotificationsServiceServer) ListUsers(ctx context.Context, request *noti
 
 func (n NotificationsServiceServer) DeleteUsers(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceDeleteUsersRequest) (*notificationsv1alpha1.NotificationsServiceDeleteUsersResponse, error) {
 	// delete from notifications store
-	err := notification_store.NotificationStore.DeleteUsers(request.Ids)
+	result, err := notification_store.NotificationStore.DeleteUsers(ctx, request.Ids)
 	if err != nil {
 		logging.Log.WithError(err).Error("error deleting users")
-		return nil, status.Error(codes.Internal, errors.UnexpectedError)
+		return nil, status.FromContextError(err).Err()
+	}
+	// users that failed to delete keep their schedules, so that deleting them again leaves nothing behind. Users that
+	// weren't found may have had schedules left by an earlier failure.
+	deletedIds := withoutIds(request.Ids, result.FailedIds())
+	resultErr := usersResultError(ctx, result, "deleting")
+	if resultErr != nil && len(deletedIds) == 0 {
+		return nil, resultErr
 	}
-	formattedIds := []string{}
-	for _, id := range request.Ids {
-		formattedIds = append(formattedIds, fmt.Sprintf("'%s'", id))
+	if len(deletedIds) == 0 {
+		return &notificationsv1alpha1.NotificationsServiceDeleteUsersResponse{Success: true}, nil
 	}
-	query := fmt.Sprintf("metadata->'user_id'?|array%s;", formattedIds)
-	err = Scheduler.DeleteTaskDefinitionsByMetadataQuery(query)
+	err = Scheduler.DeleteTaskDefinitionsByMetadataQuery("metadata->>'user_id' IN ?", deletedIds)
 	if err != nil {
 		return nil, err
 	}
+	err = deleteRelativeSchedulesForUsers(deletedIds)
+	if err != nil {
+		logging.Log.WithError(err).Error("error deleting relative schedules")
+		return nil, status.Error(codes.Internal, errors.UnexpectedError)
+	}
+	if resultErr != nil {
+		return nil, resultErr
+	}
 	return &notificationsv1alpha1.NotificationsServiceDeleteUsersResponse{Success: true}, nil
 }
 
+// usersResultError sends the ids that weren't found in the not-found-ids header, and returns an error naming the ids
+// that failed, if any
+func usersResultError(ctx context.Context, result *notification_store.UsersResult, action string) error {
+	if len(result.NotFound) > 0 {
+		err := grpc.SetHeader(ctx, metadata.Pairs(NotFoundIdsHeader, strings.Join(result.NotFound, ",")))
+		if err != nil {
+			logging.Log.WithError(err).Warn("error setting not found ids header")
+		}
+	}
+	if len(result.Failed) == 0 {
+		return nil
+	}
+	for _, failed := range result.Failed {
+		logging.Log.WithError(failed.Err).WithField("user_id", failed.Id).Errorf("error %s user", action)
+	}
+	return status.Errorf(codes.Internal, "error %s users %s", action, strings.Join(result.FailedIds(), ", "))
+}
+
+func withoutIds(ids, excluded []string) []string {
+	remaining := []string{}
+	for _, id := range ids {
+		if !sliceutil.Contains(excluded, id) {
+			remaining = append(remaining, id)
+		}
+	}
+	return remaining
+}
+
 func (n NotificationsServiceServer) GetNotifications(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceGetNotificationsRequest) (*notificationsv1alpha1.NotificationsServiceGetNotificationsResponse, error) {
-	notifications, total, err := notification_store.NotificationStore.GetNotifications(request.Channels, request.UserId, request.Query, request.Limit, request.Skip, request.CorrelationId)
+	notifications, total, err := notification_store.NotificationStore.GetNotifications(ctx, request.Channels, request.UserId, request.Query, request.Limit, request.Skip, request.CorrelationId)
 	if err != nil {
 		logging.Log.WithError(err).Error("error getting notifications")
 		return nil, status.Error(codes.Internal, errors.UnexpectedError)
@@ -141,7 +200,7 @@ func (n NotificationsServiceServer) GetNotifications(ctx context.Context, reques
 }
 
 func (n NotificationsServiceServer) SendNotifications(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceSendNotificationsRequest) (*notificationsv1alpha1.NotificationsServiceSendNotificationsResponse, error) {
-	err := notification_store.NotificationStore.PublishEvents(request.Notifications)
+	err := notification_store.NotificationStore.PublishEvents(ctx, request.Notifications)
 	if err != nil {
 		logging.Log.WithError(err).Error("error sending notifications")
 		return nil, status.Error(codes.Internal, errors.UnexpectedError)
@@ -150,7 +209,7 @@ func (n NotificationsServiceServer) SendNotifications(ctx context.Context, reque
 }
 
 func (n NotificationsServiceServer) UpdateSubscriptions(ctx context.Context, request *notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest) (*notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsResponse, error) {
-	err := notification_store.NotificationStore.UpdateSubscriptions(request.UserId, request.Subscribe, request.Unsubscribe)
+	err := notification_store.NotificationStore.UpdateSubscriptions(ctx, request.UserId, request.Subscribe, request.Unsubscribe)
 	if err != nil {
 		logging.Log.WithError(err).Error("error updating subscriptions")
 		return nil, status.Error(codes.Internal, errors.UnexpectedError)
@@ -158,9 +217,16 @@ func (n NotificationsServiceServer) UpdateSubscriptions(ctx context.Context, req
 	return &notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsResponse{Success: true}, nil
 }
 
+// upsertNotifications upserts scheduled notifications, keeping the settings stored with the ones that already exist
 func upsertNotifications(scheduledNotifications []*notificationsv1alpha1.ScheduledNotification) error {
+	settings, err := getStoredSettings(scheduledNotifications)
+	if err != nil {
+		return err
+	}
 	for _, scheduledNotification := range scheduledNotifications {
-		err := upsertNotification(scheduledNotification)
+		// ids that don't parse are the nil uuid, which has no settings
+		id, _ := uuid.Parse(scheduledNotification.Id)
+		err = saveNotification(scheduledNotification, settings[id.String()])
 		if err != nil {
 			return err
 		}
@@ -169,10 +235,15 @@ func upsertNotifications(scheduledNotifications []*notificationsv1alpha1.Schedul
 }
 
 func upsertNotification(notification *notificationsv1alpha1.ScheduledNotification) error {
+	return upsertNotifications([]*notificationsv1alpha1.ScheduledNotification{notification})
+}
+
+// saveNotification upserts a scheduled notification with its settings, replacing any stored settings
+func saveNotification(notification *notificationsv1alpha1.ScheduledNotification, settings scheduledNotificationSettings) error {
 	if notification.UserId == "" {
 		return errorx.IllegalArgument.New("scheduled notifications must have a user id")
 	}
-	definition, err := GetTaskDefinitionFromScheduledNotification(notification)
+	definition, err := newTaskDefinition(notification, settings)
 	if err != nil {
 		return err
 	}
@@ -182,3 +253,30 @@ func upsertNotification(notification *notificationsv1alpha1.ScheduledNotificatio
 	}
 	return nil
 }
+
+// getStoredSettings returns the stored settings of the scheduled notifications that already exist, by id. Ids that
+// aren't valid are left for saveNotification to reject.
+func getStoredSettings(scheduledNotifications []*notificationsv1alpha1.ScheduledNotification) (map[string]scheduledNotificationSettings, error) {
+	ids := []*uuid.UUID{}
+	for _, scheduledNotification := range scheduledNotifications {
+		id, err := uuid.Parse(scheduledNotification.Id)
+		if err == nil {
+			ids = append(ids, &id)
+		}
+	}
+	settings := map[string]scheduledNotificationSettings{}
+	if len(ids) == 0 {
+		return settings, nil
+	}
+	definitions, err := Scheduler.GetTaskDefinitions(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, definition := range definitions {
+		settings[definition.Id.String()], err = getScheduledNotificationSettings(definition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,13 @@
+// Package sliceutil has the slice helpers that the standard library doesn't have in the go version the module targets.
+// They match the standard library's slices package, so they can be replaced by it once the module moves to go 1.21.
+package sliceutil
+
+// Contains reports whether the value is in the slice
+func Contains[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
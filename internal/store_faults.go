@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/joomcode/errorx"
+)
+
+type storeFaultsRequest struct {
+	Rules []notification_store.FaultRule `json:"rules"`
+}
+
+type storeFaultsResponse struct {
+	Enabled bool                           `json:"enabled"`
+	Rules   []notification_store.FaultRule `json:"rules"`
+}
+
+func handleGetStoreFaults(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	writeJson(w, http.StatusOK, storeFaultsResponse{Enabled: notification_store.Faults.Enabled(), Rules: notification_store.Faults.Rules()})
+}
+
+// handleSetStoreFaults replaces the fault rules. It fails when the faults middleware isn't in the store's chain, since
+// the rules would silently have no effect.
+func handleSetStoreFaults(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	if !notification_store.Faults.Enabled() {
+		writeHttpError(w, errorx.IllegalArgument.New("store fault injection requires the %s store middleware", notification_store.MiddlewareFaults))
+		return
+	}
+	request := storeFaultsRequest{}
+	err := decodeJsonBody(r, &request)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	err = notification_store.Faults.SetRules(request.Rules)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, storeFaultsResponse{Enabled: true, Rules: notification_store.Faults.Rules()})
+}
+
+func handleClearStoreFaults(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	_ = notification_store.Faults.SetRules(nil)
+	writeJson(w, http.StatusNoContent, nil)
+}
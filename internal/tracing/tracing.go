@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+const instrumentationName = "github.com/catalystsquad/go-notifications"
+
+// how long to wait for buffered spans to be exported on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// Tracer creates the service's spans. It uses the global tracer provider, so spans are dropped until Initialize sets
+// up an exporter.
+var Tracer = otel.Tracer(instrumentationName)
+
+// Initialize sets up the global tracer provider with the exporter, which is one of none, otlp, or stdout. The otlp
+// exporter sends spans over grpc to the endpoint, or to the endpoint in the standard OTEL_EXPORTER_OTLP_ENDPOINT env
+// var when it's empty. Trace context is propagated with w3c headers whatever the exporter is.
+func Initialize(exporter, endpoint string, insecure bool, sampleRatio float64, serviceName string) (deferredFunc func(), err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case "", ExporterNone:
+		return func() {}, nil
+	case ExporterOtlp:
+		opts := []otlptracegrpc.Option{}
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		spanExporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, errorx.IllegalArgument.New("invalid tracing exporter %s, must be one of %s, %s, or %s", exporter, ExporterNone, ExporterOtlp, ExporterStdout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceNameKey.String(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	logging.Log.WithFields(logrus.Fields{"exporter": exporter, "sample_ratio": sampleRatio}).Info("initialized tracing")
+	deferredFunc = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := provider.Shutdown(ctx)
+		if err != nil {
+			logging.Log.WithError(err).Error("error shutting down tracer provider")
+		}
+	}
+	return deferredFunc, nil
+}
+
+// End records the error, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
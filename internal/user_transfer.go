@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/errors"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// UserTransferBatchSize is the number of users upserted or listed per notifo request
+	UserTransferBatchSize = 100
+	// maxUserLineSize is the longest line of a user import, 1MiB
+	maxUserLineSize = 1 << 20
+)
+
+// UserImportEvent is a line of the user import's response. Rows that fail are reported with their error, a checkpoint
+// is reported after each batch, and the summary is reported at the end. A line with only an error means the import
+// stopped.
+type UserImportEvent struct {
+	Row        int                `json:"row,omitempty"`
+	Id         string             `json:"id,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Checkpoint int                `json:"checkpoint,omitempty"`
+	Summary    *UserImportSummary `json:"summary,omitempty"`
+}
+
+type UserImportSummary struct {
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	Skipped  int `json:"skipped"`
+}
+
+type userImportRow struct {
+	row  int
+	user *notificationsv1alpha1.NotificationUser
+}
+
+// ImportUsers upserts the users read from input, which has one protojson encoded user per line, in batches of
+// UserTransferBatchSize. The first skip rows are skipped, so that an import can be resumed from its last checkpoint.
+// Rows that can't be parsed or upserted are reported to emit and don't stop the import. When a batch fails, its users
+// are upserted one at a time to find the rows that failed. Checkpoints are the row number that every row up to has
+// been imported or reported.
+func ImportUsers(ctx context.Context, input io.Reader, skip int, emit func(event UserImportEvent) error) (*UserImportSummary, error) {
+	summary := &UserImportSummary{}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxUserLineSize)
+	batch := []userImportRow{}
+	row := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := importUserBatch(ctx, batch, summary, emit)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return emit(UserImportEvent{Checkpoint: row})
+	}
+	for scanner.Scan() {
+		row++
+		if row <= skip {
+			summary.Skipped++
+			continue
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		user := &notificationsv1alpha1.NotificationUser{}
+		err := protojson.Unmarshal(line, user)
+		if err == nil && user.Id == "" {
+			err = errorx.IllegalArgument.New("id is required")
+		}
+		if err != nil {
+			summary.Failed++
+			err = emit(UserImportEvent{Row: row, Error: err.Error()})
+			if err != nil {
+				return summary, err
+			}
+			continue
+		}
+		batch = append(batch, userImportRow{row: row, user: user})
+		if len(batch) == UserTransferBatchSize {
+			err = flush()
+			if err != nil {
+				return summary, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, errorx.IllegalFormat.Wrap(err, "error reading row %d", row+1)
+	}
+	err := flush()
+	if err != nil {
+		return summary, err
+	}
+	return summary, emit(UserImportEvent{Summary: summary})
+}
+
+func importUserBatch(ctx context.Context, batch []userImportRow, summary *UserImportSummary, emit func(event UserImportEvent) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	users := []*notificationsv1alpha1.NotificationUser{}
+	for _, row := range batch {
+		users = append(users, row.user)
+	}
+	_, err := notification_store.NotificationStore.UpsertUsers(ctx, users)
+	if err == nil {
+		summary.Imported += len(batch)
+		return nil
+	}
+	logging.Log.WithError(err).WithField("rows", len(batch)).Warn("error upserting batch of users, upserting them one at a time")
+	for _, row := range batch {
+		_, err = notification_store.NotificationStore.UpsertUsers(ctx, []*notificationsv1alpha1.NotificationUser{row.user})
+		if err == nil {
+			summary.Imported++
+			continue
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		summary.Failed++
+		err = emit(UserImportEvent{Row: row.row, Id: row.user.Id, Error: err.Error()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportUsers lists every user, skipping the first skip users, in pages of UserTransferBatchSize, and passes each to
+// emit. The order is notifo's, so an export can be resumed by skipping the users already exported as long as no users
+// were added in between.
+func ExportUsers(ctx context.Context, skip int, emit func(user *notificationsv1alpha1.NotificationUser) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		users, err := notification_store.NotificationStore.ListUsers(ctx, int32(skip), UserTransferBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			err = emit(user)
+			if err != nil {
+				return err
+			}
+		}
+		if len(users) < UserTransferBatchSize {
+			return nil
+		}
+		skip += len(users)
+	}
+}
+
+// handleImportUsers streams a user import. The response has a line per event, see UserImportEvent, which is flushed as
+// it happens. The request body is spooled to a file before the response starts, because net/http doesn't read the
+// request body once the response has started on http/1.x, and the rest of the import would be lost.
+func handleImportUsers(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	defer r.Body.Close()
+	skip, err := getSkipParam(r)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	spool, err := spoolRequestBody(r)
+	if err != nil {
+		logging.Log.WithError(err).Error("error spooling user import")
+		writeHttpError(w, err)
+		auditStream(r, err)
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	stream := newJsonLinesStream(w)
+	summary, err := ImportUsers(r.Context(), spool, skip, func(event UserImportEvent) error {
+		return stream.write(event)
+	})
+	if err != nil {
+		logging.Log.WithError(err).Error("error importing users")
+		stream.writeError(err)
+	}
+	auditStream(r, err)
+	if summary != nil {
+		logging.Log.WithFields(logrus.Fields{"imported": summary.Imported, "failed": summary.Failed, "skipped": summary.Skipped}).Info("imported users")
+	}
+}
+
+// spoolRequestBody copies the request body to a temporary file, and returns the file ready to read from the start. The
+// caller removes the file.
+func spoolRequestBody(r *http.Request) (*os.File, error) {
+	spool, err := os.CreateTemp("", "users-import-*.jsonl")
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "error creating import spool file")
+	}
+	_, err = io.Copy(spool, r.Body)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, errorx.IllegalFormat.Wrap(err, "error reading request body")
+	}
+	return spool, nil
+}
+
+// handleExportUsers streams every user as a line of protojson
+func handleExportUsers(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+	skip, err := getSkipParam(r)
+	if err != nil {
+		writeHttpError(w, err)
+		return
+	}
+	stream := newJsonLinesStream(w)
+	err = ExportUsers(r.Context(), skip, func(user *notificationsv1alpha1.NotificationUser) error {
+		marshalled, err := protojson.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return stream.write(json.RawMessage(marshalled))
+	})
+	if err != nil {
+		logging.Log.WithError(err).Error("error exporting users")
+		stream.writeError(err)
+	}
+	auditStream(r, err)
+}
+
+// auditStream records a streaming request in the audit log. Streams aren't wrapped with auditHttp, which reads the
+// whole request body to hash it.
+func auditStream(r *http.Request, err error) {
+	entry := newAuditEntry(r.Context(), fmt.Sprintf("%s %s", r.Method, r.URL.Path), nil, err)
+	entry.Source = r.RemoteAddr
+	recordAuditEntry(entry)
+}
+
+func getSkipParam(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("skip")
+	if value == "" {
+		return 0, nil
+	}
+	skip, err := strconv.Atoi(value)
+	if err != nil || skip < 0 {
+		return 0, errorx.IllegalArgument.New("skip must be a non negative integer")
+	}
+	return skip, nil
+}
+
+// jsonLinesStream writes json lines to a response, flushing after each line. The status code is sent with the first
+// line, so errors after that are reported as a last line with an error.
+type jsonLinesStream struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+	flusher http.Flusher
+}
+
+func newJsonLinesStream(w http.ResponseWriter) *jsonLinesStream {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &jsonLinesStream{w: w, encoder: json.NewEncoder(w), flusher: flusher}
+}
+
+func (s *jsonLinesStream) write(value interface{}) error {
+	err := s.encoder.Encode(value)
+	if err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// writeError writes the error as the last line. Like writeHttpError, only errors caused by the request are described.
+func (s *jsonLinesStream) writeError(err error) {
+	message := errors.UnexpectedError
+	if errorx.IsOfType(err, errorx.IllegalArgument) || errorx.IsOfType(err, errorx.IllegalFormat) {
+		message = err.Error()
+	}
+	if writeErr := s.write(map[string]string{"error": message}); writeErr != nil {
+		logging.Log.WithError(writeErr).Error("error writing response body")
+	}
+}
@@ -2,15 +2,41 @@ package internal
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/catalystsquad/go-scheduler/pkg"
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
 	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
 	"google.golang.org/protobuf/encoding/protojson"
 	"time"
 )
 
+// scheduledNotificationSettings are settings of a scheduled notification that aren't part of the scheduled notification
+// message. They're stored alongside it in the task definition metadata.
+type scheduledNotificationSettings struct {
+	// ResolverUrl is where the notification's data is resolved from when it fires, see resolveNotification
+	ResolverUrl string `json:"resolver_url,omitempty"`
+	// ParentId is the id of the cron scheduled notification that a deferred occurrence was scheduled for, see
+	// deferScheduledNotification
+	ParentId string `json:"parent_id,omitempty"`
+	// DeferredBy is why a deferred occurrence was deferred
+	DeferredBy string `json:"deferred_by,omitempty"`
+	// Calendar is the business calendar applied to a cron scheduled notification, see applyBusinessCalendar
+	Calendar *CalendarAssignment `json:"calendar,omitempty"`
+	// JitterWindow spreads a cron scheduled notification's occurrences, see getCronJitter
+	JitterWindow time.Duration `json:"jitter_window,omitempty"`
+}
+
+// scheduledNotificationMetadata is the task definition metadata of a scheduled notification
+type scheduledNotificationMetadata struct {
+	*notificationsv1alpha1.ScheduledNotification
+	scheduledNotificationSettings
+}
+
 func GetTaskDefinitionFromScheduledNotification(notification *notificationsv1alpha1.ScheduledNotification) (*pkg.TaskDefinition, error) {
+	return newTaskDefinition(notification, scheduledNotificationSettings{})
+}
+
+func newTaskDefinition(notification *notificationsv1alpha1.ScheduledNotification, settings scheduledNotificationSettings) (*pkg.TaskDefinition, error) {
 	if notification.Id == "" {
 		notification.Id = uuid.Nil.String()
 	}
@@ -20,7 +46,7 @@ func GetTaskDefinitionFromScheduledNotification(notification *notificationsv1alp
 	}
 	scheduledNotificationDefinition := &pkg.TaskDefinition{
 		Id:          &id,
-		Metadata:    notification,
+		Metadata:    scheduledNotificationMetadata{ScheduledNotification: notification, scheduledNotificationSettings: settings},
 		ExpireAfter: time.Duration(notification.ExpireAfter),
 	}
 	notificationExecuteOnceTrigger := notification.GetExecuteOnceTrigger()
@@ -81,6 +107,43 @@ func GetScheduledNotificationFromTaskDefinition(definition pkg.TaskDefinition) (
 	return scheduledNotification, err
 }
 
+// getScheduledNotificationSettings reads the settings stored in a task definition's metadata
+func getScheduledNotificationSettings(definition pkg.TaskDefinition) (scheduledNotificationSettings, error) {
+	settings := scheduledNotificationSettings{}
+	metadataJson, err := json.Marshal(definition.Metadata)
+	if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal(metadataJson, &settings)
+	return settings, err
+}
+
+// getTaskDefinition returns the task definition of a scheduled notification
+func getTaskDefinition(id uuid.UUID) (*pkg.TaskDefinition, error) {
+	definitions, err := Scheduler.GetTaskDefinitions([]*uuid.UUID{&id})
+	if err != nil {
+		return nil, err
+	}
+	if len(definitions) == 0 {
+		return nil, errorx.DataUnavailable.New("scheduled notification %s not found", id)
+	}
+	return &definitions[0], nil
+}
+
+// updateScheduledNotificationSettings changes the settings of a stored scheduled notification and saves it
+func updateScheduledNotificationSettings(definition pkg.TaskDefinition, update func(settings *scheduledNotificationSettings)) error {
+	scheduledNotification, err := GetScheduledNotificationFromTaskDefinition(definition)
+	if err != nil {
+		return err
+	}
+	settings, err := getScheduledNotificationSettings(definition)
+	if err != nil {
+		return err
+	}
+	update(&settings)
+	return saveNotification(scheduledNotification, settings)
+}
+
 func setId(definition pkg.TaskDefinition, scheduledNotification *notificationsv1alpha1.ScheduledNotification) {
 	scheduledNotification.Id = definition.Id.String()
 }
@@ -111,7 +174,3 @@ func setTrigger(definition pkg.TaskDefinition, scheduledNotification *notificati
 	}
 	return nil
 }
-
-func GetUserTopic(userId string) string {
-	return fmt.Sprintf("users/%s", userId)
-}
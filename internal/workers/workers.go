@@ -0,0 +1,40 @@
+package workers
+
+import (
+	"context"
+	"sync"
+)
+
+// Run calls f for each index from 0 to n on a pool of at most concurrency workers, and returns the errors by index.
+// Callers keep results in slices indexed the same way, so that results are in order and each call only writes its
+// own index. Once the context is done the remaining indexes aren't called and get the context's error.
+func Run(ctx context.Context, n, concurrency int, f func(ctx context.Context, i int) error) []error {
+	errs := make([]error, n)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+	indexes := make(chan int)
+	var running sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = f(ctx, i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	running.Wait()
+	return errs
+}
@@ -0,0 +1,211 @@
+package notification_store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+)
+
+// CachingNotificationStore wraps a notification store with a read through cache of users by id. Users are cached for
+// the ttl, and ids that weren't found for the negative ttl, so that lookups of unknown ids don't reach the store
+// either. The least recently used entries are evicted to keep at most max size entries. Upserting or deleting users
+// through the store invalidates their entries, changes made another way, like by another replica, are seen once the
+// entries expire.
+//
+// Cached users are shared between callers, so they must not be modified.
+type CachingNotificationStore struct {
+	Store       NotificationStoreInterface
+	ttl         time.Duration
+	negativeTtl time.Duration
+	maxSize     int
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	// recency has the most recently used entry at the front
+	recency *list.List
+	// generation is incremented by each invalidation, users read from the store are only cached if there was no
+	// invalidation while they were read, since they may be stale
+	generation uint64
+}
+
+type userCacheEntry struct {
+	id string
+	// user is nil for ids that weren't found
+	user      *notificationsv1alpha1.NotificationUser
+	expiresAt time.Time
+}
+
+func NewCachingNotificationStore(store NotificationStoreInterface, ttl, negativeTtl time.Duration, maxSize int) *CachingNotificationStore {
+	return &CachingNotificationStore{
+		Store:       store,
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		maxSize:     maxSize,
+		entries:     map[string]*list.Element{},
+		recency:     list.New(),
+	}
+}
+
+func (c *CachingNotificationStore) Initialize() (deferredFunc func(), err error) {
+	return c.Store.Initialize()
+}
+
+func (c *CachingNotificationStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+	// invalidated even when the upsert fails, since some of the users may have been upserted
+	defer c.invalidate(ids)
+	return c.Store.UpsertUsers(ctx, users)
+}
+
+// GetUsers returns cached users and ids cached as not found, and gets the rest from the store. The result is in the
+// order of the requested ids, like the store's. Ids that fail aren't cached.
+func (c *CachingNotificationStore) GetUsers(ctx context.Context, ids []string) (*UsersResult, error) {
+	cached := map[string]*userCacheEntry{}
+	missing := []string{}
+	for _, id := range ids {
+		entry, ok := c.get(id)
+		if ok {
+			cached[id] = entry
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	failed := map[string]error{}
+	if len(missing) > 0 {
+		generation := c.currentGeneration()
+		result, err := c.Store.GetUsers(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range result.Users {
+			cached[user.Id] = c.put(generation, user.Id, user)
+		}
+		for _, id := range result.NotFound {
+			cached[id] = c.put(generation, id, nil)
+		}
+		for _, idErr := range result.Failed {
+			failed[idErr.Id] = idErr.Err
+		}
+	}
+	result := &UsersResult{}
+	for _, id := range ids {
+		if err, ok := failed[id]; ok {
+			result.Failed = append(result.Failed, IdError{Id: id, Err: err})
+		} else if entry := cached[id]; entry != nil && entry.user != nil {
+			result.Users = append(result.Users, entry.user)
+		} else {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+	return result, nil
+}
+
+func (c *CachingNotificationStore) ListUsers(ctx context.Context, skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error) {
+	return c.Store.ListUsers(ctx, skip, limit)
+}
+
+func (c *CachingNotificationStore) DeleteUsers(ctx context.Context, ids []string) (*UsersResult, error) {
+	defer c.invalidate(ids)
+	return c.Store.DeleteUsers(ctx, ids)
+}
+
+func (c *CachingNotificationStore) GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
+	return c.Store.GetNotifications(ctx, channels, userId, query, limit, skip, correlationId)
+}
+
+func (c *CachingNotificationStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	return c.Store.PublishEvents(ctx, events)
+}
+
+func (c *CachingNotificationStore) UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error {
+	return c.Store.UpdateSubscriptions(ctx, userId, subscriptions, unsubscribe)
+}
+
+func (c *CachingNotificationStore) Ping(ctx context.Context) error {
+	return c.Store.Ping(ctx)
+}
+
+// get returns the unexpired entry for an id, and records the lookup
+func (c *CachingNotificationStore) get(id string) (*userCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		metrics.UserCacheLookups.WithLabelValues(metrics.CacheMiss).Inc()
+		return nil, false
+	}
+	entry := element.Value.(*userCacheEntry)
+	if clock.Now().After(entry.expiresAt) {
+		c.remove(element)
+		metrics.UserCacheEntries.Set(float64(c.recency.Len()))
+		metrics.UserCacheLookups.WithLabelValues(metrics.CacheMiss).Inc()
+		return nil, false
+	}
+	c.recency.MoveToFront(element)
+	if entry.user == nil {
+		metrics.UserCacheLookups.WithLabelValues(metrics.CacheNegativeHit).Inc()
+	} else {
+		metrics.UserCacheLookups.WithLabelValues(metrics.CacheHit).Inc()
+	}
+	return entry, true
+}
+
+func (c *CachingNotificationStore) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches a user, or an id that wasn't found when the user is nil, evicting the least recently used entries to
+// stay within the size limit. Nothing is cached when there was an invalidation since the generation. The entry is
+// returned either way.
+func (c *CachingNotificationStore) put(generation uint64, id string, user *notificationsv1alpha1.NotificationUser) *userCacheEntry {
+	ttl := c.ttl
+	if user == nil {
+		ttl = c.negativeTtl
+	}
+	entry := &userCacheEntry{id: id, user: user, expiresAt: clock.Now().Add(ttl)}
+	if ttl <= 0 {
+		return entry
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return entry
+	}
+	if element, ok := c.entries[id]; ok {
+		c.remove(element)
+	}
+	c.entries[id] = c.recency.PushFront(entry)
+	for c.recency.Len() > c.maxSize {
+		c.remove(c.recency.Back())
+		metrics.UserCacheEvictions.Inc()
+	}
+	metrics.UserCacheEntries.Set(float64(c.recency.Len()))
+	return entry
+}
+
+func (c *CachingNotificationStore) invalidate(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, id := range ids {
+		if element, ok := c.entries[id]; ok {
+			c.remove(element)
+		}
+	}
+	metrics.UserCacheEntries.Set(float64(c.recency.Len()))
+}
+
+// remove removes an entry, the lock must be held
+func (c *CachingNotificationStore) remove(element *list.Element) {
+	c.recency.Remove(element)
+	delete(c.entries, element.Value.(*userCacheEntry).id)
+}
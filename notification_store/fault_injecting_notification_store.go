@@ -0,0 +1,418 @@
+package notification_store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	"github.com/catalystsquad/go-notifications/internal/sliceutil"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FaultError fails the call without calling the store
+	FaultError = "error"
+	// FaultLatency delays the call
+	FaultLatency = "latency"
+	// FaultTimeout waits for the call's context to be done, or for the latency, then fails the call without calling the
+	// store
+	FaultTimeout = "timeout"
+	// FaultPartial fails some of the ids or events of a call, and calls the store with the rest
+	FaultPartial = "partial"
+)
+
+// InjectedFault is the error of calls, ids and events that failed because of an injected fault
+var InjectedFault = errorx.CommonErrors.NewType("injected_fault")
+
+// faultMethods are the store methods that faults can be injected into
+var faultMethods = []string{"UpsertUsers", "GetUsers", "ListUsers", "DeleteUsers", "GetNotifications", "PublishEvents", "UpdateSubscriptions", "Ping"}
+
+// partialFaultMethods are the store methods that take several ids or events, which partial faults can be injected into
+var partialFaultMethods = []string{"GetUsers", "DeleteUsers", "PublishEvents"}
+
+// Faults are the fault rules of the faults middleware
+var Faults = &FaultInjector{}
+
+// FaultRule injects a fault into calls to store methods
+type FaultRule struct {
+	// Methods are the store methods the rule applies to, every method that the fault can be injected into when empty
+	Methods []string `json:"methods,omitempty"`
+	// Fault is one of error, latency, timeout, or partial
+	Fault string `json:"fault"`
+	// Probability is the chance that the fault is injected into a matching call, or for partial faults into each
+	// matching id or event, from 0 to 1
+	Probability float64 `json:"probability"`
+	// Latency is the delay of latency faults, and the longest that timeout faults wait, e.g. 5s
+	Latency string `json:"latency,omitempty"`
+	// UserIds scope the rule to calls for the users, including events published on their topics, users/<id>
+	UserIds []string `json:"user_ids,omitempty"`
+	// TopicPrefixes scope the rule to events published on topics with the prefixes
+	TopicPrefixes []string `json:"topic_prefixes,omitempty"`
+	// Unscoped applies the rule to every call. Rules without user ids or topic prefixes must set it, so that faults
+	// aren't injected into every call by mistake.
+	Unscoped bool `json:"unscoped,omitempty"`
+	latency  time.Duration
+}
+
+// FaultInjector holds the fault rules, they can be replaced while the service is running
+type FaultInjector struct {
+	mu      sync.RWMutex
+	rules   []FaultRule
+	enabled bool
+}
+
+// SetRules validates and replaces the rules
+func (f *FaultInjector) SetRules(rules []FaultRule) error {
+	err := validateFaultRules(rules)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = rules
+	if len(rules) > 0 {
+		logging.Log.WithField("rules", len(rules)).Warn("store fault injection rules set")
+	}
+	return nil
+}
+
+// Rules returns the rules
+func (f *FaultInjector) Rules() []FaultRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]FaultRule{}, f.rules...)
+}
+
+// Enabled returns true when the faults middleware wraps the store, rules have no effect otherwise
+func (f *FaultInjector) Enabled() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.enabled
+}
+
+func (f *FaultInjector) setEnabled() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled = true
+}
+
+func (r *FaultRule) validate() error {
+	if !sliceutil.Contains([]string{FaultError, FaultLatency, FaultTimeout, FaultPartial}, r.Fault) {
+		return errorx.IllegalArgument.New("fault must be one of %s, %s, %s, or %s", FaultError, FaultLatency, FaultTimeout, FaultPartial)
+	}
+	allowedMethods := faultMethods
+	if r.Fault == FaultPartial {
+		allowedMethods = partialFaultMethods
+	}
+	for _, method := range r.Methods {
+		if !sliceutil.Contains(allowedMethods, method) {
+			return errorx.IllegalArgument.New("%s faults can't be injected into %s, methods must be any of %s", r.Fault, method, strings.Join(allowedMethods, ", "))
+		}
+	}
+	if r.Probability <= 0 || r.Probability > 1 {
+		return errorx.IllegalArgument.New("probability must be more than 0 and at most 1")
+	}
+	r.latency = 0
+	if r.Latency != "" {
+		latency, err := time.ParseDuration(r.Latency)
+		if err != nil || latency <= 0 {
+			return errorx.IllegalArgument.New("latency %s is not a positive duration", r.Latency)
+		}
+		r.latency = latency
+	}
+	if (r.Fault == FaultLatency || r.Fault == FaultTimeout) && r.latency == 0 {
+		return errorx.IllegalArgument.New("%s faults must have a latency", r.Fault)
+	}
+	if !r.Unscoped && len(r.UserIds) == 0 && len(r.TopicPrefixes) == 0 {
+		return errorx.IllegalArgument.New("rules must have user ids or topic prefixes, or be unscoped")
+	}
+	return nil
+}
+
+// appliesTo returns true when the rule applies to a call to the method for the users or topics
+func (r FaultRule) appliesTo(method string, userIds, topics []string) bool {
+	if len(r.Methods) > 0 && !sliceutil.Contains(r.Methods, method) {
+		return false
+	}
+	if r.Fault == FaultPartial && !sliceutil.Contains(partialFaultMethods, method) {
+		return false
+	}
+	if r.Unscoped {
+		return true
+	}
+	for _, userId := range userIds {
+		if sliceutil.Contains(r.UserIds, userId) {
+			return true
+		}
+	}
+	for _, topic := range topics {
+		for _, prefix := range r.TopicPrefixes {
+			if strings.HasPrefix(topic, prefix) {
+				return true
+			}
+		}
+		if userId, ok := strings.CutPrefix(topic, UserTopicPrefix); ok && sliceutil.Contains(r.UserIds, userId) {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultInjectingNotificationStore wraps a notification store and injects faults into its calls by the rules of the
+// fault injector, for rehearsing store outages. Faults are only injected into calls that the rules are scoped to.
+type FaultInjectingNotificationStore struct {
+	Store  NotificationStoreInterface
+	Faults *FaultInjector
+}
+
+func (s FaultInjectingNotificationStore) Initialize() (deferredFunc func(), err error) {
+	return s.Store.Initialize()
+}
+
+func (s FaultInjectingNotificationStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
+	userIds := []string{}
+	for _, user := range users {
+		userIds = append(userIds, user.Id)
+	}
+	err := s.inject(ctx, "UpsertUsers", userIds, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Store.UpsertUsers(ctx, users)
+}
+
+func (s FaultInjectingNotificationStore) GetUsers(ctx context.Context, ids []string) (*UsersResult, error) {
+	return s.usersCall(ctx, "GetUsers", ids, s.Store.GetUsers)
+}
+
+func (s FaultInjectingNotificationStore) ListUsers(ctx context.Context, skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error) {
+	err := s.inject(ctx, "ListUsers", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Store.ListUsers(ctx, skip, limit)
+}
+
+func (s FaultInjectingNotificationStore) DeleteUsers(ctx context.Context, ids []string) (*UsersResult, error) {
+	return s.usersCall(ctx, "DeleteUsers", ids, s.Store.DeleteUsers)
+}
+
+func (s FaultInjectingNotificationStore) GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
+	err := s.inject(ctx, "GetNotifications", []string{userId}, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.Store.GetNotifications(ctx, channels, userId, query, limit, skip, correlationId)
+}
+
+// PublishEvents only injects faults into the events the rules are scoped to. The events no rule applies to are
+// published first, in their own call, then error, latency, and timeout faults are injected into a call with the rest,
+// and partial faults drop single events. When some events are dropped or fail, the error names how many of them were
+// published, since callers that retry the whole batch, like the api's clients, send those events again.
+func (s FaultInjectingNotificationStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	scoped, unaffected := s.scopeEvents("PublishEvents", events)
+	if len(scoped) == 0 {
+		return s.Store.PublishEvents(ctx, events)
+	}
+	if len(unaffected) > 0 {
+		err := s.Store.PublishEvents(ctx, unaffected)
+		if err != nil {
+			return err
+		}
+	}
+	topics := []string{}
+	for _, event := range scoped {
+		topics = append(topics, event.Topic)
+	}
+	err := s.inject(ctx, "PublishEvents", nil, topics)
+	if err != nil {
+		return publishFaultError(err, len(unaffected), len(events))
+	}
+	published := []*notificationsv1alpha1.NotificationEvent{}
+	for _, event := range scoped {
+		if !s.injectPartial("PublishEvents", nil, []string{event.Topic}) {
+			published = append(published, event)
+		}
+	}
+	if len(published) > 0 {
+		err = s.Store.PublishEvents(ctx, published)
+		if err != nil {
+			return publishFaultError(err, len(unaffected), len(events))
+		}
+	}
+	if dropped := len(scoped) - len(published); dropped > 0 {
+		return InjectedFault.New("injected partial fault into PublishEvents, dropped %d of %d events, the other %d were published", dropped, len(events), len(events)-dropped)
+	}
+	return nil
+}
+
+// scopeEvents splits the events that any rule applies to from the unaffected ones
+func (s FaultInjectingNotificationStore) scopeEvents(method string, events []*notificationsv1alpha1.NotificationEvent) (scoped, unaffected []*notificationsv1alpha1.NotificationEvent) {
+	rules := s.Faults.Rules()
+	for _, event := range events {
+		inScope := false
+		for _, rule := range rules {
+			if rule.appliesTo(method, nil, []string{event.Topic}) {
+				inScope = true
+				break
+			}
+		}
+		if inScope {
+			scoped = append(scoped, event)
+		} else {
+			unaffected = append(unaffected, event)
+		}
+	}
+	return scoped, unaffected
+}
+
+// publishFaultError names how many events were published before the error, when some were
+func publishFaultError(err error, published, total int) error {
+	if published == 0 {
+		return err
+	}
+	return errorx.Decorate(err, "%d of %d events were published", published, total)
+}
+
+func (s FaultInjectingNotificationStore) UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error {
+	err := s.inject(ctx, "UpdateSubscriptions", []string{userId}, nil)
+	if err != nil {
+		return err
+	}
+	return s.Store.UpdateSubscriptions(ctx, userId, subscriptions, unsubscribe)
+}
+
+func (s FaultInjectingNotificationStore) Ping(ctx context.Context) error {
+	err := s.inject(ctx, "Ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	return s.Store.Ping(ctx)
+}
+
+// usersCall fails the ids that partial faults are injected into, and calls the store with the rest. The failed ids are
+// merged into the store's result in the order they were requested.
+func (s FaultInjectingNotificationStore) usersCall(ctx context.Context, method string, ids []string, call func(ctx context.Context, ids []string) (*UsersResult, error)) (*UsersResult, error) {
+	err := s.inject(ctx, method, ids, nil)
+	if err != nil {
+		return nil, err
+	}
+	injected := map[string]bool{}
+	remaining := []string{}
+	for _, id := range ids {
+		if s.injectPartial(method, []string{id}, nil) {
+			injected[id] = true
+		} else {
+			remaining = append(remaining, id)
+		}
+	}
+	if len(injected) == 0 {
+		return call(ctx, ids)
+	}
+	result := &UsersResult{}
+	if len(remaining) > 0 {
+		result, err = call(ctx, remaining)
+		if err != nil {
+			return nil, err
+		}
+	}
+	failed := map[string]error{}
+	for _, idErr := range result.Failed {
+		failed[idErr.Id] = idErr.Err
+	}
+	result.Failed = nil
+	for _, id := range ids {
+		if injected[id] {
+			result.Failed = append(result.Failed, IdError{Id: id, Err: InjectedFault.New("injected partial fault into %s", method)})
+		} else if err, ok := failed[id]; ok {
+			result.Failed = append(result.Failed, IdError{Id: id, Err: err})
+		}
+	}
+	return result, nil
+}
+
+// inject injects the error, latency, and timeout faults of the rules that apply to the call, each with its probability
+func (s FaultInjectingNotificationStore) inject(ctx context.Context, method string, userIds, topics []string) error {
+	for _, rule := range s.Faults.Rules() {
+		if rule.Fault == FaultPartial || !rule.appliesTo(method, userIds, topics) || rand.Float64() >= rule.Probability {
+			continue
+		}
+		recordFault(method, rule.Fault)
+		switch rule.Fault {
+		case FaultError:
+			return InjectedFault.New("injected error into %s", method)
+		case FaultLatency:
+			err := sleep(ctx, rule.latency)
+			if err != nil {
+				return err
+			}
+		case FaultTimeout:
+			_ = sleep(ctx, rule.latency)
+			return errorx.TimeoutElapsed.New("injected timeout into %s", method)
+		}
+	}
+	return nil
+}
+
+// injectPartial returns true when a partial fault is injected into an id or event of a call
+func (s FaultInjectingNotificationStore) injectPartial(method string, userIds, topics []string) bool {
+	for _, rule := range s.Faults.Rules() {
+		if rule.Fault == FaultPartial && rule.appliesTo(method, userIds, topics) && rand.Float64() < rule.Probability {
+			recordFault(method, rule.Fault)
+			return true
+		}
+	}
+	return false
+}
+
+func recordFault(method, fault string) {
+	metrics.StoreFaultsInjected.WithLabelValues(method, fault).Inc()
+	logging.Log.WithFields(logrus.Fields{"method": method, "fault": fault}).Debug("injected store fault")
+}
+
+// sleep waits for the duration or for the context to be done, whichever is first, and returns the context's error
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LoadFaultRules reads a json array of fault rules from a file and validates them, see FaultRule
+func LoadFaultRules(path string) ([]FaultRule, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "error reading fault rules file %s", path)
+	}
+	rules := []FaultRule{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&rules)
+	if err != nil {
+		return nil, errorx.IllegalFormat.New("invalid fault rules file %s, %s", path, err.Error())
+	}
+	return rules, validateFaultRules(rules)
+}
+
+func validateFaultRules(rules []FaultRule) error {
+	for i := range rules {
+		err := rules[i].validate()
+		if err != nil {
+			return errorx.IllegalArgument.New("invalid fault rule %d, %s", i+1, errorx.Cast(err).Message())
+		}
+	}
+	return nil
+}
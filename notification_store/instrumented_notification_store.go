@@ -0,0 +1,113 @@
+package notification_store
+
+import (
+	"context"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	"github.com/catalystsquad/go-notifications/internal/tracing"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentedNotificationStore wraps a notification store with a span and latency metrics for each method
+type InstrumentedNotificationStore struct {
+	Store NotificationStoreInterface
+}
+
+func (i InstrumentedNotificationStore) Initialize() (deferredFunc func(), err error) {
+	return i.Store.Initialize()
+}
+
+func (i InstrumentedNotificationStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) (result []*notificationsv1alpha1.NotificationUser, err error) {
+	ctx, span, done := start(ctx, "UpsertUsers")
+	defer func() { done(err) }()
+	span.SetAttributes(attribute.Int("notifications.user_count", len(users)))
+	result, err = i.Store.UpsertUsers(ctx, users)
+	if err == nil {
+		metrics.UsersUpserted.Add(float64(len(users)))
+	}
+	return result, err
+}
+
+func (i InstrumentedNotificationStore) GetUsers(ctx context.Context, ids []string) (result *UsersResult, err error) {
+	ctx, span, done := start(ctx, "GetUsers")
+	defer func() { done(err) }()
+	span.SetAttributes(attribute.StringSlice("notifications.user_ids", ids))
+	result, err = i.Store.GetUsers(ctx, ids)
+	setUsersResultAttributes(span, result)
+	return result, err
+}
+
+func (i InstrumentedNotificationStore) ListUsers(ctx context.Context, skip, limit int32) (result []*notificationsv1alpha1.NotificationUser, err error) {
+	ctx, _, done := start(ctx, "ListUsers")
+	defer func() { done(err) }()
+	return i.Store.ListUsers(ctx, skip, limit)
+}
+
+func (i InstrumentedNotificationStore) DeleteUsers(ctx context.Context, ids []string) (result *UsersResult, err error) {
+	ctx, span, done := start(ctx, "DeleteUsers")
+	defer func() { done(err) }()
+	span.SetAttributes(attribute.StringSlice("notifications.user_ids", ids))
+	result, err = i.Store.DeleteUsers(ctx, ids)
+	setUsersResultAttributes(span, result)
+	if result != nil {
+		metrics.UsersDeleted.Add(float64(len(ids) - len(result.NotFound) - len(result.Failed)))
+	}
+	return result, err
+}
+
+// setUsersResultAttributes records the ids that weren't found or failed on the span
+func setUsersResultAttributes(span trace.Span, result *UsersResult) {
+	if result == nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.StringSlice("notifications.not_found_user_ids", result.NotFound),
+		attribute.StringSlice("notifications.failed_user_ids", result.FailedIds()),
+	)
+}
+
+func (i InstrumentedNotificationStore) GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) (result []*notificationsv1alpha1.Notification, total int32, err error) {
+	ctx, span, done := start(ctx, "GetNotifications")
+	defer func() { done(err) }()
+	span.SetAttributes(attribute.String("notifications.user_id", userId))
+	if correlationId != nil {
+		span.SetAttributes(attribute.String("notifications.correlation_id", *correlationId))
+	}
+	return i.Store.GetNotifications(ctx, channels, userId, query, limit, skip, correlationId)
+}
+
+func (i InstrumentedNotificationStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) (err error) {
+	ctx, span, done := start(ctx, "PublishEvents")
+	defer func() { done(err) }()
+	span.SetAttributes(attribute.Int("notifications.event_count", len(events)))
+	err = i.Store.PublishEvents(ctx, events)
+	outcome := metrics.Outcome(err)
+	for _, event := range events {
+		metrics.EventsPublished.WithLabelValues(metrics.TopicKind(event.Topic), outcome).Inc()
+	}
+	return err
+}
+
+func (i InstrumentedNotificationStore) UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) (err error) {
+	ctx, span, done := start(ctx, "UpdateSubscriptions")
+	defer func() { done(err) }()
+	span.SetAttributes(attribute.String("notifications.user_id", userId))
+	return i.Store.UpdateSubscriptions(ctx, userId, subscriptions, unsubscribe)
+}
+
+func (i InstrumentedNotificationStore) Ping(ctx context.Context) error {
+	return i.Store.Ping(ctx)
+}
+
+// start starts a span for a store method, and returns a function that ends it and records the method's latency
+func start(ctx context.Context, method string) (context.Context, trace.Span, func(err error)) {
+	startedAt := time.Now()
+	ctx, span := tracing.Tracer.Start(ctx, "NotificationStore."+method)
+	return ctx, span, func(err error) {
+		metrics.StoreDuration.WithLabelValues(method, metrics.Outcome(err)).Observe(time.Since(startedAt).Seconds())
+		tracing.End(span, err)
+	}
+}
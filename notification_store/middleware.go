@@ -0,0 +1,97 @@
+package notification_store
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/joomcode/errorx"
+)
+
+const (
+	MiddlewareInstrumented = "instrumented"
+	MiddlewareCache        = "cache"
+	MiddlewareFaults       = "faults"
+	MiddlewareRetry        = "retry"
+)
+
+// Middleware wraps a notification store in another one that adds a cross-cutting behavior, like metrics or retries,
+// around calls to the wrapped store. Middlewares shouldn't depend on which store they wrap.
+type Middleware func(store NotificationStoreInterface) NotificationStoreInterface
+
+// middlewares are the middlewares that can be stacked by name. Each is created from the config when the chain is
+// built, after the config has been loaded.
+var middlewares = map[string]func() Middleware{
+	MiddlewareInstrumented: func() Middleware {
+		return func(store NotificationStoreInterface) NotificationStoreInterface {
+			return InstrumentedNotificationStore{Store: store}
+		}
+	},
+	MiddlewareCache: func() Middleware {
+		return func(store NotificationStoreInterface) NotificationStoreInterface {
+			// the cache is disabled by default, so it's left out of the chain rather than making it a required choice
+			if config.AppConfig.UserCacheTtl <= 0 {
+				return store
+			}
+			return NewCachingNotificationStore(store, config.AppConfig.UserCacheTtl, config.AppConfig.UserCacheNegativeTtl, config.AppConfig.UserCacheMaxSize)
+		}
+	},
+	MiddlewareRetry: func() Middleware {
+		return func(store NotificationStoreInterface) NotificationStoreInterface {
+			return RetryingNotificationStore{Store: store, Attempts: config.AppConfig.StoreRetryAttempts, Backoff: config.AppConfig.StoreRetryBackoff}
+		}
+	},
+	MiddlewareFaults: func() Middleware {
+		return func(store NotificationStoreInterface) NotificationStoreInterface {
+			Faults.setEnabled()
+			return FaultInjectingNotificationStore{Store: store, Faults: Faults}
+		}
+	},
+}
+
+// RegisterMiddleware makes a middleware available to Chain by name, newMiddleware is called each time a chain that
+// includes it is built. It panics if the name is taken, since that's a programming error.
+func RegisterMiddleware(name string, newMiddleware func() Middleware) {
+	if _, ok := middlewares[name]; ok {
+		panic("store middleware " + name + " is already registered")
+	}
+	middlewares[name] = newMiddleware
+}
+
+// MiddlewareNames returns the names of the registered middlewares, sorted
+func MiddlewareNames() []string {
+	names := []string{}
+	for name := range middlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateMiddlewareNames checks that each name is a registered middleware and that none is repeated
+func ValidateMiddlewareNames(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := middlewares[name]; !ok {
+			return errorx.IllegalArgument.New("unknown store middleware %s, must be one of %s", name, strings.Join(MiddlewareNames(), ", "))
+		}
+		if seen[name] {
+			return errorx.IllegalArgument.New("store middleware %s is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Chain wraps a store in the named middlewares. The first middleware is the outermost, so it sees each call first and
+// the store's result last.
+func Chain(store NotificationStoreInterface, names []string) (NotificationStoreInterface, error) {
+	err := ValidateMiddlewareNames(names)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		store = middlewares[names[i]]()(store)
+	}
+	return store, nil
+}
@@ -1,18 +1,70 @@
 package notification_store
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
 )
 
 var NotificationStore NotificationStoreInterface
 
+// UserTopicPrefix is the prefix of user topics, events published to a user's topic are delivered to the user
+const UserTopicPrefix = "users/"
+
+// GetUserTopic returns the topic of a user
+func GetUserTopic(userId string) string {
+	return UserTopicPrefix + userId
+}
+
 type NotificationStoreInterface interface {
 	Initialize() (deferredFunc func(), err error)
-	UpsertUsers(users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error)
-	GetUsers(ids []string) ([]*notificationsv1alpha1.NotificationUser, error)
-	ListUsers(skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error)
-	DeleteUsers(ids []string) error
-	GetNotifications(channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error)
-	PublishEvents(events []*notificationsv1alpha1.NotificationEvent) error
-	UpdateSubscriptions(userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error
+	UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error)
+	// GetUsers gets users by id, see UsersResult
+	GetUsers(ctx context.Context, ids []string) (*UsersResult, error)
+	ListUsers(ctx context.Context, skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error)
+	// DeleteUsers deletes users by id, see UsersResult
+	DeleteUsers(ctx context.Context, ids []string) (*UsersResult, error)
+	GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error)
+	PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error
+	UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error
+	// Ping checks that the store is reachable, it's used for readiness checks
+	Ping(ctx context.Context) error
+}
+
+// UsersResult is the outcome of getting or deleting users by id. A failure for one id doesn't stop the others, so ids
+// that weren't found and ids that failed are reported separately, each in the order they were requested.
+type UsersResult struct {
+	// Users are the users that were found, in the order they were requested. It's only set by GetUsers.
+	Users    []*notificationsv1alpha1.NotificationUser
+	NotFound []string
+	Failed   []IdError
+}
+
+type IdError struct {
+	Id  string
+	Err error
+}
+
+// FailedIds returns the ids that failed
+func (r *UsersResult) FailedIds() []string {
+	ids := []string{}
+	for _, failed := range r.Failed {
+		ids = append(ids, failed.Id)
+	}
+	return ids
+}
+
+// Err returns an error describing the ids that failed, or nil when none did. Ids that weren't found aren't failures.
+func (r *UsersResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, failed := range r.Failed {
+		messages = append(messages, fmt.Sprintf("%s: %s", failed.Id, failed.Err.Error()))
+	}
+	return errorx.ExternalError.New("%d of the users failed: %s", len(r.Failed), strings.Join(messages, "; "))
 }
@@ -0,0 +1,37 @@
+package notifo_store
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+)
+
+type endpointContextKey struct{}
+
+// withEndpoint names the notifo endpoint a request is made to, for the request latency metric
+func withEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, endpointContextKey{}, endpoint)
+}
+
+// metricsTransport records the latency and status of notifo requests
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+	response, err := t.next.RoundTrip(request)
+	endpoint, ok := request.Context().Value(endpointContextKey{}).(string)
+	if !ok {
+		endpoint = "unknown"
+	}
+	status := metrics.OutcomeError
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+	metrics.NotifoRequestDuration.WithLabelValues(endpoint, status).Observe(time.Since(startedAt).Seconds())
+	return response, err
+}
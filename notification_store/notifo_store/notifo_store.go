@@ -6,13 +6,15 @@ import (
 	"errors"
 	"github.com/catalystsquad/app-utils-go/logging"
 	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/internal/secrets"
+	"github.com/catalystsquad/go-notifications/internal/workers"
+	"github.com/catalystsquad/go-notifications/notification_store"
 	"github.com/catalystsquad/notifo-client-go"
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
-	"github.com/deepmap/oapi-codegen/pkg/securityprovider"
 	"github.com/joomcode/errorx"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/errgroup"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/protobuf/encoding/protojson"
 	"io"
 	"net/http"
@@ -20,6 +22,7 @@ import (
 
 var NotifoStore = NotifoNotificationStore{}
 var notifoClient *notifo_client_go.ClientWithResponses
+var notifoApiKey *secrets.Secret
 var standardJSON = jsoniter.ConfigCompatibleWithStandardLibrary
 var snakeCaseJSON = jsoniter.Config{TagKey: "snake"}.Froze()
 var camelCaseJSON = jsoniter.Config{TagKey: "camel"}.Froze()
@@ -27,7 +30,7 @@ var protoUnmarshaller = protojson.UnmarshalOptions{DiscardUnknown: true}
 
 type NotifoNotificationStore struct{}
 
-func (n NotifoNotificationStore) UpdateSubscriptions(userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error {
+func (n NotifoNotificationStore) UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error {
 	subscribe := []notifo_client_go.SubscribeDto{}
 	for _, subscriptionProto := range subscriptions {
 		bytes, err := protojson.Marshal(subscriptionProto)
@@ -45,7 +48,7 @@ func (n NotifoNotificationStore) UpdateSubscriptions(userId string, subscription
 		Subscribe:   &subscribe,
 		Unsubscribe: &unsubscribe,
 	}
-	response, err := notifoClient.UsersPostSubscriptionsWithResponse(context.Background(), config.AppConfig.NotifoAppId, userId, body)
+	response, err := notifoClient.UsersPostSubscriptionsWithResponse(withEndpoint(ctx, "post_subscriptions"), config.AppConfig.NotifoAppId, userId, body)
 	if err != nil {
 		return err
 	}
@@ -56,24 +59,41 @@ func (n NotifoNotificationStore) UpdateSubscriptions(userId string, subscription
 }
 
 func (n NotifoNotificationStore) Initialize() (deferredFunc func(), err error) {
+	notifoApiKey = secrets.NewSecret(config.AppConfig.NotifoApiKey)
+	deferredFunc = func() {}
+	if config.AppConfig.NotifoApiKeyFile != "" {
+		// watch the key file so that the key can be rotated without a restart
+		notifoApiKey, err = secrets.NewFileSecret(config.AppConfig.NotifoApiKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			err := notifoApiKey.Watch(ctx)
+			if err != nil {
+				logging.Log.WithError(err).Error("error watching notifo api key file, the key won't be reloaded")
+			}
+		}()
+		deferredFunc = cancel
+	}
 	notifoClient = initializeNotifoClient()
 	return
 }
 
-func (n NotifoNotificationStore) GetNotifications(channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
-	return getNotifications(channels, userId, query, limit, skip, correlationId)
+func (n NotifoNotificationStore) GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
+	return getNotifications(ctx, channels, userId, query, limit, skip, correlationId)
 }
 
-func (n NotifoNotificationStore) PublishEvents(events []*notificationsv1alpha1.NotificationEvent) error {
-	return publishEvents(events)
+func (n NotifoNotificationStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	return publishEvents(ctx, events)
 }
 
-func (n NotifoNotificationStore) ListUsers(skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error) {
+func (n NotifoNotificationStore) ListUsers(ctx context.Context, skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error) {
 	params := &notifo_client_go.UsersGetUsersParams{
 		Take: &limit,
 		Skip: &skip,
 	}
-	response, err := notifoClient.UsersGetUsersWithResponse(context.Background(), config.AppConfig.NotifoAppId, params)
+	response, err := notifoClient.UsersGetUsersWithResponse(withEndpoint(ctx, "get_users"), config.AppConfig.NotifoAppId, params)
 	if err != nil {
 		logging.Log.WithError(err).Error("error listing users")
 		return nil, err
@@ -94,7 +114,7 @@ func (n NotifoNotificationStore) ListUsers(skip, limit int32) ([]*notificationsv
 	return users, nil
 }
 
-func (n NotifoNotificationStore) UpsertUsers(users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
+func (n NotifoNotificationStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
 	// format request
 	requestUsers := []notifo_client_go.UpsertUserDto{}
 	for _, user := range users {
@@ -105,7 +125,7 @@ func (n NotifoNotificationStore) UpsertUsers(users []*notificationsv1alpha1.Noti
 		requestUsers = append(requestUsers, dto)
 	}
 	request := notifo_client_go.UsersPostUsersJSONRequestBody{Requests: requestUsers}
-	response, err := notifoClient.UsersPostUsersWithResponse(context.Background(), config.AppConfig.NotifoAppId, request)
+	response, err := notifoClient.UsersPostUsersWithResponse(withEndpoint(ctx, "post_users"), config.AppConfig.NotifoAppId, request)
 	if err != nil {
 		return nil, err
 	}
@@ -125,44 +145,77 @@ func (n NotifoNotificationStore) UpsertUsers(users []*notificationsv1alpha1.Noti
 	return protos, nil
 }
 
-func (n NotifoNotificationStore) GetUsers(ids []string) ([]*notificationsv1alpha1.NotificationUser, error) {
-	users := []*notificationsv1alpha1.NotificationUser{}
-	group := errgroup.Group{}
-	for _, id := range ids {
-		id := id // https://golang.org/doc/faq#closures_and_goroutines
-		group.Go(func() error {
-			proto, err := getUser(id, false)
-			if err != nil {
-				return err
-			}
-			if proto != nil {
-				users = append(users, proto)
+// GetUsers gets the users on a pool of --notifo-concurrency workers, since notifo gets one user per request
+func (n NotifoNotificationStore) GetUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	users := make([]*notificationsv1alpha1.NotificationUser, len(ids))
+	errs := workers.Run(ctx, len(ids), config.AppConfig.NotifoConcurrency, func(ctx context.Context, i int) error {
+		user, err := getUser(ctx, ids[i], false)
+		if err == nil && user == nil {
+			err = userNotFoundError(ids[i])
+		}
+		users[i] = user
+		return err
+	})
+	return newUsersResult(ctx, ids, users, errs)
+}
+
+// DeleteUsers deletes the users on a pool of --notifo-concurrency workers, since notifo deletes one user per request
+func (n NotifoNotificationStore) DeleteUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	errs := workers.Run(ctx, len(ids), config.AppConfig.NotifoConcurrency, func(ctx context.Context, i int) error {
+		return deleteUser(ctx, ids[i])
+	})
+	return newUsersResult(ctx, ids, nil, errs)
+}
+
+// newUsersResult sorts the outcome for each id into found users, ids that weren't found, and ids that failed. The
+// error is the context's, when it's done before every id was handled.
+func newUsersResult(ctx context.Context, ids []string, users []*notificationsv1alpha1.NotificationUser, errs []error) (*notification_store.UsersResult, error) {
+	result := &notification_store.UsersResult{}
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if users != nil {
+				result.Users = append(result.Users, users[i])
 			}
-			return nil
-		})
+		case errorx.IsOfType(err, errorx.DataUnavailable):
+			result.NotFound = append(result.NotFound, ids[i])
+		default:
+			result.Failed = append(result.Failed, notification_store.IdError{Id: ids[i], Err: err})
+		}
 	}
-	err := group.Wait()
-	return users, err
+	return result, ctx.Err()
 }
 
-func (n NotifoNotificationStore) DeleteUsers(ids []string) error {
-	group := errgroup.Group{}
-	for _, id := range ids {
-		id := id // https://golang.org/doc/faq#closures_and_goroutines
-		group.Go(func() error {
-			return deleteUser(id)
-		})
-	}
-	return group.Wait()
+func userNotFoundError(id string) error {
+	return errorx.DataUnavailable.New("user %s not found", id)
 }
 
-func initializeNotifoClient() *notifo_client_go.ClientWithResponses {
-	logging.Log.WithFields(logrus.Fields{"base_url": config.AppConfig.NotifoBaseUrl}).Info("initializing notifo client")
-	apiKeyProvider, err := securityprovider.NewSecurityProviderApiKey("header", "X-ApiKey", config.AppConfig.NotifoApiKey)
+// Ping lists a single user, which checks that notifo is reachable and that the api key and app id are valid
+func (n NotifoNotificationStore) Ping(ctx context.Context) error {
+	take := int32(1)
+	params := &notifo_client_go.UsersGetUsersParams{Take: &take}
+	response, err := notifoClient.UsersGetUsersWithResponse(withEndpoint(ctx, "ping"), config.AppConfig.NotifoAppId, params)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	notifoClient, err := notifo_client_go.NewClientWithResponses(config.AppConfig.NotifoBaseUrl, notifo_client_go.WithRequestEditorFn(apiKeyProvider.Intercept))
+	if response.StatusCode() != http.StatusOK {
+		return unexpectedStatusCodeErrorr(http.StatusOK, response.HTTPResponse)
+	}
+	return nil
+}
+
+// setApiKey sets the api key header on each request with the current key, so a rotated key is used from the next
+// request while requests already sent finish with the old one
+func setApiKey(ctx context.Context, req *http.Request) error {
+	req.Header.Set("X-ApiKey", notifoApiKey.Value())
+	return nil
+}
+
+func initializeNotifoClient() *notifo_client_go.ClientWithResponses {
+	logging.Log.WithFields(logrus.Fields{"base_url": config.AppConfig.NotifoBaseUrl}).Info("initializing notifo client")
+	// instrumented transport so that each notifo request gets a span, propagates the trace context, and is measured
+	httpClient := &http.Client{Transport: metricsTransport{next: otelhttp.NewTransport(http.DefaultTransport)}}
+	notifoClient, err := notifo_client_go.NewClientWithResponses(config.AppConfig.NotifoBaseUrl, notifo_client_go.WithRequestEditorFn(setApiKey), notifo_client_go.WithHTTPClient(httpClient))
 	if err != nil {
 		panic(err)
 	}
@@ -174,11 +227,11 @@ func unexpectedStatusCodeErrorr(expectedStatusCode int, resp *http.Response) err
 	return errorx.IllegalState.New("expected status code %d but got %d with body %s", expectedStatusCode, resp.StatusCode, body)
 }
 
-func getUser(id string, withDetails bool) (*notificationsv1alpha1.NotificationUser, error) {
+func getUser(ctx context.Context, id string, withDetails bool) (*notificationsv1alpha1.NotificationUser, error) {
 	params := &notifo_client_go.UsersGetUserParams{
 		WithDetails: &withDetails,
 	}
-	response, err := notifoClient.UsersGetUserWithResponse(context.Background(), config.AppConfig.NotifoAppId, id, params)
+	response, err := notifoClient.UsersGetUserWithResponse(withEndpoint(ctx, "get_user"), config.AppConfig.NotifoAppId, id, params)
 	if err != nil {
 		return nil, err
 	}
@@ -194,18 +247,21 @@ func getUser(id string, withDetails bool) (*notificationsv1alpha1.NotificationUs
 	return proto, err
 }
 
-func deleteUser(id string) error {
-	response, err := notifoClient.UsersDeleteUser(context.Background(), config.AppConfig.NotifoAppId, id)
+func deleteUser(ctx context.Context, id string) error {
+	response, err := notifoClient.UsersDeleteUser(withEndpoint(ctx, "delete_user"), config.AppConfig.NotifoAppId, id)
 	if err != nil {
 		return err
 	}
+	if response.StatusCode == http.StatusNotFound {
+		return userNotFoundError(id)
+	}
 	if response.StatusCode != http.StatusNoContent {
 		return unexpectedStatusCodeErrorr(http.StatusNoContent, response)
 	}
 	return nil
 }
 
-func getNotifications(channels []string, userId, query string, take, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
+func getNotifications(ctx context.Context, channels []string, userId, query string, take, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
 	params := &notifo_client_go.NotificationsGetNotificationsParams{
 		Take:     &take,
 		Skip:     &skip,
@@ -219,7 +275,7 @@ func getNotifications(channels []string, userId, query string, take, skip int32,
 	if correlationId != nil {
 		params.CorrelationId = correlationId
 	}
-	response, err := notifoClient.NotificationsGetNotificationsWithResponse(context.Background(), config.AppConfig.NotifoAppId, userId, params)
+	response, err := notifoClient.NotificationsGetNotificationsWithResponse(withEndpoint(ctx, "get_notifications"), config.AppConfig.NotifoAppId, userId, params)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -239,7 +295,7 @@ func getNotifications(channels []string, userId, query string, take, skip int32,
 	return protos, int32(response.JSON200.Total), err
 }
 
-func publishEvents(events []*notificationsv1alpha1.NotificationEvent) error {
+func publishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
 	publishes := []notifo_client_go.PublishDto{}
 	for _, event := range events {
 		bytes, err := protojson.Marshal(event)
@@ -256,7 +312,7 @@ func publishEvents(events []*notificationsv1alpha1.NotificationEvent) error {
 	params := notifo_client_go.EventsPostEventsJSONRequestBody{
 		Requests: publishes,
 	}
-	response, err := notifoClient.EventsPostEventsWithResponse(context.Background(), config.AppConfig.NotifoAppId, params)
+	response, err := notifoClient.EventsPostEventsWithResponse(withEndpoint(ctx, "post_events"), config.AppConfig.NotifoAppId, params)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,397 @@
+// Package notifotest runs an in memory stand-in for the parts of the notifo api that notifo_store uses, so that the
+// store can be tested without a notifo instance.
+package notifotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The endpoints that faults can be injected into, named like notifo_store's request metrics
+const (
+	EndpointHealth            = "healthz"
+	EndpointGetUsers          = "get_users"
+	EndpointPostUsers         = "post_users"
+	EndpointGetUser           = "get_user"
+	EndpointDeleteUser        = "delete_user"
+	EndpointPostSubscriptions = "post_subscriptions"
+	EndpointPostEvents        = "post_events"
+	EndpointGetNotifications  = "get_notifications"
+)
+
+const (
+	DefaultAppId  = "notifotest-app"
+	DefaultApiKey = "notifotest-api-key"
+)
+
+// Fault is injected into requests to an endpoint
+type Fault struct {
+	// Latency delays the response, or the request's failure when Status is set
+	Latency time.Duration
+	// Status fails the request with the status code, when it's set
+	Status int
+	// Times is the number of requests the fault applies to, 0 applies it to every request until the faults are cleared
+	Times int
+}
+
+// Server is a notifo stand-in for one app. Events are delivered to inboxes before the request that publishes them
+// returns, so tests don't have to wait for deliveries. Events on a user's topic, users/<id>, are delivered to the user,
+// and other events to the users subscribed to a prefix of their topic.
+type Server struct {
+	*httptest.Server
+	AppId  string
+	ApiKey string
+	mu     sync.Mutex
+	// userIds are in the order the users were created, which is the order they're listed in
+	userIds       []string
+	users         map[string]*user
+	faults        map[string][]*Fault
+	notifications int
+}
+
+type user struct {
+	Id            string  `json:"id"`
+	EmailAddress  *string `json:"emailAddress,omitempty"`
+	subscriptions map[string]bool
+	// inbox has the most recent notification first, like notifo lists them
+	inbox []Notification
+}
+
+// Notification is a notification in a user's inbox
+type Notification struct {
+	Id            string `json:"id"`
+	Topic         string `json:"topic"`
+	Subject       string `json:"subject,omitempty"`
+	Body          string `json:"body,omitempty"`
+	Data          string `json:"data,omitempty"`
+	CorrelationId string `json:"correlationId,omitempty"`
+}
+
+type listResponse struct {
+	Items interface{} `json:"items"`
+	Total int         `json:"total"`
+}
+
+type upsertUsersRequest struct {
+	Requests []struct {
+		Id           *string `json:"id"`
+		EmailAddress *string `json:"emailAddress"`
+	} `json:"requests"`
+}
+
+type subscriptionsRequest struct {
+	Subscribe []struct {
+		TopicPrefix string `json:"topicPrefix"`
+	} `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+type publishRequest struct {
+	Requests []struct {
+		Topic         string `json:"topic"`
+		Data          string `json:"data"`
+		CorrelationId string `json:"correlationId"`
+		Preformatted  *struct {
+			Subject map[string]string `json:"subject"`
+			Body    map[string]string `json:"body"`
+		} `json:"preformatted"`
+	} `json:"requests"`
+}
+
+// NewServer starts a server for the default app id and api key, close it when done
+func NewServer() *Server {
+	s := &Server{
+		AppId:  DefaultAppId,
+		ApiKey: DefaultApiKey,
+		users:  map[string]*user{},
+		faults: map[string][]*Fault{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Inject injects a fault into requests to the endpoint. Faults apply in the order they were injected, once a fault's
+// times are used up the next one applies.
+func (s *Server) Inject(endpoint string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = append(s.faults[endpoint], &fault)
+}
+
+// ClearFaults removes every fault
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = map[string][]*Fault{}
+}
+
+// Inbox returns the notifications delivered to a user, most recent first
+func (s *Server) Inbox(userId string) []Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userId]
+	if !ok {
+		return nil
+	}
+	return append([]Notification{}, u.inbox...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		if s.applyFault(w, r, EndpointHealth) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Header.Get("X-ApiKey") != s.ApiKey {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return
+	}
+	// paths are /api/apps/{app}/users[/{id}[/subscriptions|/notifications]] and /api/apps/{app}/events
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "api" || parts[1] != "apps" {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[2] != s.AppId {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	route := parts[3]
+	var endpoint string
+	var handler func(w http.ResponseWriter, r *http.Request, userId string)
+	switch {
+	case route == "events" && len(parts) == 4 && r.Method == http.MethodPost:
+		endpoint, handler = EndpointPostEvents, s.postEvents
+	case route == "users" && len(parts) == 4 && r.Method == http.MethodGet:
+		endpoint, handler = EndpointGetUsers, s.getUsers
+	case route == "users" && len(parts) == 4 && r.Method == http.MethodPost:
+		endpoint, handler = EndpointPostUsers, s.postUsers
+	case route == "users" && len(parts) == 5 && r.Method == http.MethodGet:
+		endpoint, handler = EndpointGetUser, s.getUser
+	case route == "users" && len(parts) == 5 && r.Method == http.MethodDelete:
+		endpoint, handler = EndpointDeleteUser, s.deleteUser
+	case route == "users" && len(parts) == 6 && parts[5] == "subscriptions" && r.Method == http.MethodPost:
+		endpoint, handler = EndpointPostSubscriptions, s.postSubscriptions
+	case route == "users" && len(parts) == 6 && parts[5] == "notifications" && r.Method == http.MethodGet:
+		endpoint, handler = EndpointGetNotifications, s.getNotifications
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if s.applyFault(w, r, endpoint) {
+		return
+	}
+	userId := ""
+	if len(parts) > 4 {
+		userId = parts[4]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	handler(w, r, userId)
+}
+
+// applyFault waits for the latency of the endpoint's current fault, if any, and fails the request when the fault has a
+// status. It returns whether the request failed.
+func (s *Server) applyFault(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	s.mu.Lock()
+	var fault Fault
+	if faults := s.faults[endpoint]; len(faults) > 0 {
+		fault = *faults[0]
+		if faults[0].Times > 0 {
+			faults[0].Times--
+			if faults[0].Times == 0 {
+				s.faults[endpoint] = faults[1:]
+			}
+		}
+	}
+	s.mu.Unlock()
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if fault.Status != 0 {
+		http.Error(w, fmt.Sprintf("injected %s fault", endpoint), fault.Status)
+		return true
+	}
+	return false
+}
+
+func (s *Server) getUsers(w http.ResponseWriter, r *http.Request, _ string) {
+	skip, take := paging(r)
+	users := []*user{}
+	for i := skip; i < len(s.userIds) && len(users) < take; i++ {
+		users = append(users, s.users[s.userIds[i]])
+	}
+	writeJson(w, http.StatusOK, listResponse{Items: users, Total: len(s.userIds)})
+}
+
+func (s *Server) postUsers(w http.ResponseWriter, r *http.Request, _ string) {
+	request := upsertUsersRequest{}
+	if !readJson(w, r, &request) {
+		return
+	}
+	upserted := []*user{}
+	for _, upsert := range request.Requests {
+		if upsert.Id == nil || *upsert.Id == "" {
+			http.Error(w, "user id is required", http.StatusBadRequest)
+			return
+		}
+		u, ok := s.users[*upsert.Id]
+		if !ok {
+			u = &user{Id: *upsert.Id, subscriptions: map[string]bool{}}
+			s.users[u.Id] = u
+			s.userIds = append(s.userIds, u.Id)
+		}
+		if upsert.EmailAddress != nil {
+			u.EmailAddress = upsert.EmailAddress
+		}
+		upserted = append(upserted, u)
+	}
+	writeJson(w, http.StatusOK, upserted)
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, userId string) {
+	u, ok := s.users[userId]
+	if !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, u)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, userId string) {
+	if _, ok := s.users[userId]; !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	delete(s.users, userId)
+	for i, id := range s.userIds {
+		if id == userId {
+			s.userIds = append(s.userIds[:i], s.userIds[i+1:]...)
+			break
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) postSubscriptions(w http.ResponseWriter, r *http.Request, userId string) {
+	request := subscriptionsRequest{}
+	if !readJson(w, r, &request) {
+		return
+	}
+	u, ok := s.users[userId]
+	if !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	for _, subscription := range request.Subscribe {
+		u.subscriptions[subscription.TopicPrefix] = true
+	}
+	for _, prefix := range request.Unsubscribe {
+		delete(u.subscriptions, prefix)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) postEvents(w http.ResponseWriter, r *http.Request, _ string) {
+	request := publishRequest{}
+	if !readJson(w, r, &request) {
+		return
+	}
+	for _, event := range request.Requests {
+		for _, u := range s.recipients(event.Topic) {
+			s.notifications++
+			notification := Notification{
+				Id:            fmt.Sprintf("notification-%d", s.notifications),
+				Topic:         event.Topic,
+				Data:          event.Data,
+				CorrelationId: event.CorrelationId,
+			}
+			if event.Preformatted != nil {
+				notification.Subject = event.Preformatted.Subject["en"]
+				notification.Body = event.Preformatted.Body["en"]
+			}
+			u.inbox = append([]Notification{notification}, u.inbox...)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) recipients(topic string) []*user {
+	if userId, ok := strings.CutPrefix(topic, "users/"); ok {
+		if u, exists := s.users[userId]; exists {
+			return []*user{u}
+		}
+		return nil
+	}
+	recipients := []*user{}
+	for _, id := range s.userIds {
+		u := s.users[id]
+		for prefix := range u.subscriptions {
+			if strings.HasPrefix(topic, prefix) {
+				recipients = append(recipients, u)
+				break
+			}
+		}
+	}
+	return recipients
+}
+
+func (s *Server) getNotifications(w http.ResponseWriter, r *http.Request, userId string) {
+	matching := []Notification{}
+	correlationId := r.URL.Query().Get("correlationId")
+	query := r.URL.Query().Get("query")
+	if u, ok := s.users[userId]; ok {
+		for _, notification := range u.inbox {
+			if correlationId != "" && notification.CorrelationId != correlationId {
+				continue
+			}
+			if query != "" && !strings.Contains(notification.Subject+" "+notification.Body, query) {
+				continue
+			}
+			matching = append(matching, notification)
+		}
+	}
+	skip, take := paging(r)
+	page := []Notification{}
+	for i := skip; i < len(matching) && len(page) < take; i++ {
+		page = append(page, matching[i])
+	}
+	writeJson(w, http.StatusOK, listResponse{Items: page, Total: len(matching)})
+}
+
+// paging returns the skip and take query parameters, take defaults to 20 like notifo's
+func paging(r *http.Request) (skip, take int) {
+	skip, _ = strconv.Atoi(r.URL.Query().Get("skip"))
+	take, err := strconv.Atoi(r.URL.Query().Get("take"))
+	if err != nil {
+		take = 20
+	}
+	return skip, take
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,105 @@
+package notification_store
+
+import (
+	"context"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+)
+
+// RetryingNotificationStore retries store calls that fail, making up to Attempts calls, and waits Backoff before the
+// first retry and twice as long before each one after. Only calls that are safe to repeat are retried. PublishEvents
+// isn't, since the events of a failed call may have been published, and the scheduler retries failed executions
+// anyway. DeleteUsers isn't either, since a repeated call reports the users the failed call deleted as not found.
+// Errors caused by the request, like invalid arguments or users that don't exist, and the context ending aren't
+// retried.
+type RetryingNotificationStore struct {
+	Store    NotificationStoreInterface
+	Attempts int
+	Backoff  time.Duration
+}
+
+func (r RetryingNotificationStore) Initialize() (deferredFunc func(), err error) {
+	return r.Store.Initialize()
+}
+
+func (r RetryingNotificationStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) (result []*notificationsv1alpha1.NotificationUser, err error) {
+	err = r.retry(ctx, "UpsertUsers", func() error {
+		result, err = r.Store.UpsertUsers(ctx, users)
+		return err
+	})
+	return result, err
+}
+
+func (r RetryingNotificationStore) GetUsers(ctx context.Context, ids []string) (result *UsersResult, err error) {
+	err = r.retry(ctx, "GetUsers", func() error {
+		result, err = r.Store.GetUsers(ctx, ids)
+		return err
+	})
+	return result, err
+}
+
+func (r RetryingNotificationStore) ListUsers(ctx context.Context, skip, limit int32) (result []*notificationsv1alpha1.NotificationUser, err error) {
+	err = r.retry(ctx, "ListUsers", func() error {
+		result, err = r.Store.ListUsers(ctx, skip, limit)
+		return err
+	})
+	return result, err
+}
+
+func (r RetryingNotificationStore) DeleteUsers(ctx context.Context, ids []string) (*UsersResult, error) {
+	return r.Store.DeleteUsers(ctx, ids)
+}
+
+func (r RetryingNotificationStore) GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) (result []*notificationsv1alpha1.Notification, total int32, err error) {
+	err = r.retry(ctx, "GetNotifications", func() error {
+		result, total, err = r.Store.GetNotifications(ctx, channels, userId, query, limit, skip, correlationId)
+		return err
+	})
+	return result, total, err
+}
+
+func (r RetryingNotificationStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	return r.Store.PublishEvents(ctx, events)
+}
+
+func (r RetryingNotificationStore) UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error {
+	return r.retry(ctx, "UpdateSubscriptions", func() error {
+		return r.Store.UpdateSubscriptions(ctx, userId, subscriptions, unsubscribe)
+	})
+}
+
+// Ping isn't retried, so that readiness checks see the store's failures
+func (r RetryingNotificationStore) Ping(ctx context.Context) error {
+	return r.Store.Ping(ctx)
+}
+
+func (r RetryingNotificationStore) retry(ctx context.Context, method string, call func() error) error {
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= r.Attempts || !isRetryable(ctx, err) {
+			return err
+		}
+		logging.Log.WithError(err).WithField("method", method).WithField("attempt", attempt).Warn("notification store call failed, retrying")
+		metrics.StoreRetries.WithLabelValues(method).Inc()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return !errorx.IsOfType(err, errorx.IllegalArgument) && !errorx.IsOfType(err, errorx.IllegalFormat) && !errorx.IsOfType(err, errorx.DataUnavailable)
+}
@@ -0,0 +1,238 @@
+// Package storetest is a conformance suite for NotificationStoreInterface implementations. Call Run from a test of
+// the implementation.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Options configure the suite for a store
+type Options struct {
+	// NewStore returns an initialized store. It's called once per test, the store doesn't have to be empty since tests
+	// use their own users and topics.
+	NewStore func(t *testing.T) notification_store.NotificationStoreInterface
+	// Channel is the channel that published notifications are delivered on, web when empty
+	Channel string
+	// DeliveryTimeout is how long published events can take to show up in inboxes, for stores that deliver them
+	// asynchronously like notifo. Tests that check an event wasn't delivered wait this long.
+	DeliveryTimeout time.Duration
+}
+
+// pollInterval is how often inboxes are checked while waiting for deliveries
+const pollInterval = 100 * time.Millisecond
+
+type suite struct {
+	*testing.T
+	options Options
+	store   notification_store.NotificationStoreInterface
+	ctx     context.Context
+}
+
+// Run runs the conformance tests against the store, each as a subtest
+func Run(t *testing.T, options Options) {
+	if options.Channel == "" {
+		options.Channel = "web"
+	}
+	tests := []struct {
+		name string
+		test func(s *suite)
+	}{
+		{"UpsertAndGetUsers", testUpsertAndGetUsers},
+		{"UpsertUpdatesUsers", testUpsertUpdatesUsers},
+		{"GetUsersReportsMissingUsers", testGetUsersReportsMissingUsers},
+		{"ListUsersPages", testListUsersPages},
+		{"DeleteUsers", testDeleteUsers},
+		{"NotificationPagingAndTotals", testNotificationPagingAndTotals},
+		{"CorrelationIdFilter", testCorrelationIdFilter},
+		{"UpdateSubscriptions", testUpdateSubscriptions},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(&suite{T: t, options: options, store: options.NewStore(t), ctx: context.Background()})
+		})
+	}
+}
+
+func testUpsertAndGetUsers(s *suite) {
+	users := s.upsertUsers(2)
+	result, err := s.store.GetUsers(s.ctx, []string{users[1].Id, users[0].Id})
+	require.NoError(s, err)
+	require.Empty(s, result.NotFound)
+	require.Empty(s, result.Failed)
+	// users are returned in the order they were requested
+	require.Equal(s, []string{users[1].Id, users[0].Id}, userIds(result.Users))
+	require.Equal(s, users[1].EmailAddress, result.Users[0].EmailAddress)
+}
+
+func testUpsertUpdatesUsers(s *suite) {
+	user := s.upsertUsers(1)[0]
+	updated := &notificationsv1alpha1.NotificationUser{Id: user.Id, EmailAddress: "updated-" + user.EmailAddress}
+	upserted, err := s.store.UpsertUsers(s.ctx, []*notificationsv1alpha1.NotificationUser{updated})
+	require.NoError(s, err)
+	require.Equal(s, []string{user.Id}, userIds(upserted))
+	result, err := s.store.GetUsers(s.ctx, []string{user.Id})
+	require.NoError(s, err)
+	require.Len(s, result.Users, 1)
+	require.Equal(s, updated.EmailAddress, result.Users[0].EmailAddress)
+}
+
+func testGetUsersReportsMissingUsers(s *suite) {
+	user := s.upsertUsers(1)[0]
+	missing := uniqueId("missing")
+	result, err := s.store.GetUsers(s.ctx, []string{missing, user.Id})
+	// missing users aren't errors
+	require.NoError(s, err)
+	require.NoError(s, result.Err())
+	require.Equal(s, []string{user.Id}, userIds(result.Users))
+	require.Equal(s, []string{missing}, result.NotFound)
+}
+
+func testListUsersPages(s *suite) {
+	users := s.upsertUsers(3)
+	listed := map[string]int{}
+	for skip := int32(0); ; skip += 2 {
+		page, err := s.store.ListUsers(s.ctx, skip, 2)
+		require.NoError(s, err)
+		require.LessOrEqual(s, len(page), 2)
+		for _, user := range page {
+			listed[user.Id]++
+		}
+		if len(page) < 2 {
+			break
+		}
+	}
+	for _, user := range users {
+		require.Equal(s, 1, listed[user.Id], "user %s should be listed exactly once", user.Id)
+	}
+}
+
+func testDeleteUsers(s *suite) {
+	users := s.upsertUsers(2)
+	missing := uniqueId("missing")
+	result, err := s.store.DeleteUsers(s.ctx, []string{users[0].Id, missing})
+	require.NoError(s, err)
+	require.NoError(s, result.Err())
+	require.Equal(s, []string{missing}, result.NotFound)
+	getResult, err := s.store.GetUsers(s.ctx, []string{users[0].Id, users[1].Id})
+	require.NoError(s, err)
+	require.Equal(s, []string{users[0].Id}, getResult.NotFound)
+	require.Equal(s, []string{users[1].Id}, userIds(getResult.Users))
+}
+
+func testNotificationPagingAndTotals(s *suite) {
+	user := s.upsertUsers(1)[0]
+	topic := notification_store.GetUserTopic(user.Id)
+	s.publish(event(topic, nil), event(topic, nil), event(topic, nil))
+	s.waitForTotal(user.Id, nil, 3)
+	ids := map[string]bool{}
+	for skip := int32(0); skip < 3; skip += 2 {
+		notifications, total, err := s.store.GetNotifications(s.ctx, []string{s.options.Channel}, user.Id, "", 2, skip, nil)
+		require.NoError(s, err)
+		require.Equal(s, int32(3), total, "the total doesn't depend on the page")
+		for _, notification := range notifications {
+			ids[notification.Id] = true
+		}
+	}
+	require.Len(s, ids, 3, "pages should contain each notification once")
+	notifications, total, err := s.store.GetNotifications(s.ctx, []string{s.options.Channel}, user.Id, "", 2, 3, nil)
+	require.NoError(s, err)
+	require.Empty(s, notifications)
+	require.Equal(s, int32(3), total)
+}
+
+func testCorrelationIdFilter(s *suite) {
+	user := s.upsertUsers(1)[0]
+	topic := notification_store.GetUserTopic(user.Id)
+	correlationId := uniqueId("correlation")
+	otherCorrelationId := uniqueId("correlation")
+	s.publish(event(topic, &correlationId), event(topic, &otherCorrelationId), event(topic, nil))
+	s.waitForTotal(user.Id, nil, 3)
+	notifications, total := s.waitForTotal(user.Id, &correlationId, 1)
+	require.Len(s, notifications, 1)
+	require.Equal(s, int32(1), total)
+}
+
+func testUpdateSubscriptions(s *suite) {
+	user := s.upsertUsers(1)[0]
+	prefix := uniqueId("conformance")
+	err := s.store.UpdateSubscriptions(s.ctx, user.Id, []*notificationsv1alpha1.SubscriptionSettings{{TopicPrefix: prefix}}, nil)
+	require.NoError(s, err)
+	s.publish(event(prefix+"/subscribed", nil))
+	s.waitForTotal(user.Id, nil, 1)
+	err = s.store.UpdateSubscriptions(s.ctx, user.Id, nil, []string{prefix})
+	require.NoError(s, err)
+	s.publish(event(prefix+"/unsubscribed", nil))
+	// give the event time to be delivered, then check that it wasn't
+	time.Sleep(s.options.DeliveryTimeout)
+	_, total, err := s.store.GetNotifications(s.ctx, []string{s.options.Channel}, user.Id, "", 10, 0, nil)
+	require.NoError(s, err)
+	require.Equal(s, int32(1), total)
+}
+
+// upsertUsers upserts users with unique ids, which are deleted when the test ends
+func (s *suite) upsertUsers(count int) []*notificationsv1alpha1.NotificationUser {
+	users := []*notificationsv1alpha1.NotificationUser{}
+	for i := 0; i < count; i++ {
+		id := uniqueId("user")
+		users = append(users, &notificationsv1alpha1.NotificationUser{Id: id, EmailAddress: id + "@example.com"})
+	}
+	upserted, err := s.store.UpsertUsers(s.ctx, users)
+	require.NoError(s, err)
+	require.ElementsMatch(s, userIds(users), userIds(upserted))
+	s.Cleanup(func() {
+		_, _ = s.store.DeleteUsers(context.Background(), userIds(users))
+	})
+	return users
+}
+
+func (s *suite) publish(events ...*notificationsv1alpha1.NotificationEvent) {
+	require.NoError(s, s.store.PublishEvents(s.ctx, events))
+}
+
+// waitForTotal waits for the user's inbox to have the total, within the delivery timeout, and returns the first page
+func (s *suite) waitForTotal(userId string, correlationId *string, expected int32) ([]*notificationsv1alpha1.Notification, int32) {
+	deadline := time.Now().Add(s.options.DeliveryTimeout)
+	for {
+		notifications, total, err := s.store.GetNotifications(s.ctx, []string{s.options.Channel}, userId, "", 10, 0, correlationId)
+		require.NoError(s, err)
+		if total == expected || time.Now().After(deadline) {
+			require.Equal(s, expected, total)
+			return notifications, total
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func event(topic string, correlationId *string) *notificationsv1alpha1.NotificationEvent {
+	// notifo drops events that it can't format, so they're preformatted
+	subject, _ := structpb.NewStruct(map[string]interface{}{"en": "conformance subject"})
+	body, _ := structpb.NewStruct(map[string]interface{}{"en": "conformance body"})
+	return &notificationsv1alpha1.NotificationEvent{
+		Topic:         topic,
+		Data:          `{"conformance": true}`,
+		Preformatted:  &notificationsv1alpha1.NotificationEventFormatting{Subject: subject, Body: body},
+		CorrelationId: correlationId,
+	}
+}
+
+func uniqueId(prefix string) string {
+	return fmt.Sprintf("%s-%s", prefix, uuid.NewString())
+}
+
+func userIds(users []*notificationsv1alpha1.NotificationUser) []string {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
@@ -0,0 +1,218 @@
+package test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// capturedStatement is a statement built against a dry run database
+type capturedStatement struct {
+	sql  string
+	vars []interface{}
+	dest interface{}
+}
+
+// statementCapture collects the statements built against a dry run database
+type statementCapture struct {
+	mu         sync.Mutex
+	statements []capturedStatement
+}
+
+func (c *statementCapture) capture(db *gorm.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = append(c.statements, capturedStatement{sql: db.Statement.SQL.String(), vars: db.Statement.Vars, dest: db.Statement.Dest})
+}
+
+func (c *statementCapture) captured() []capturedStatement {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]capturedStatement{}, c.statements...)
+}
+
+// auditEntries returns the audit entries that were created
+func (c *statementCapture) auditEntries() []internal.AuditEntry {
+	entries := []internal.AuditEntry{}
+	for _, statement := range c.captured() {
+		if entry, ok := statement.dest.(*internal.AuditEntry); ok {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// newDryRunDatabase replaces the database with one that builds statements without running them, for the length of
+// the test, and captures the create, query and delete statements
+func newDryRunDatabase(t *testing.T) *statementCapture {
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"), &gorm.Config{DryRun: true, SkipDefaultTransaction: true, DisableAutomaticPing: true, Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	capture := &statementCapture{}
+	require.NoError(t, db.Callback().Create().After("gorm:create").Register("test:capture", capture.capture))
+	require.NoError(t, db.Callback().Query().After("gorm:query").Register("test:capture", capture.capture))
+	require.NoError(t, db.Callback().Delete().After("gorm:delete").Register("test:capture", capture.capture))
+	previousDB := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previousDB })
+	return capture
+}
+
+func sha256Hex(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestAuditUnaryRecordsDeniedRequests(t *testing.T) {
+	capture := newDryRunDatabase(t)
+	denyAll := func(ctx context.Context) (context.Context, error) {
+		return nil, status.Error(codes.Unauthenticated, "no token")
+	}
+	// the order the service chains them in, see the run command
+	interceptor := grpc_middleware.ChainUnaryServer(internal.AuditUnary, grpc_auth.UnaryServerInterceptor(denyAll))
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}})
+	info := &grpc.UnaryServerInfo{FullMethod: "/notifications.v1alpha1.NotificationsService/DeleteUsers"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		require.Fail(t, "denied requests aren't handled")
+		return nil, nil
+	}
+	_, err := interceptor(ctx, &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: []string{"a", "b"}}, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	entries := capture.auditEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, "anonymous", entries[0].Actor)
+	require.Equal(t, info.FullMethod, entries[0].Action)
+	require.JSONEq(t, `["a", "b"]`, entries[0].TargetIds)
+	require.Equal(t, "10.0.0.1:1234", entries[0].Source)
+	require.False(t, entries[0].Success)
+	require.Contains(t, entries[0].Error, "no token")
+	require.NotEmpty(t, entries[0].RequestHash)
+
+	// requests that aren't audited aren't recorded
+	_, err = interceptor(ctx, &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: []string{"a"}}, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Len(t, capture.auditEntries(), 1)
+}
+
+func TestAuditHttpRecordsRequests(t *testing.T) {
+	mux := runtime.NewServeMux()
+	require.NoError(t, internal.RegisterHttpHandlers(mux))
+	oversized := strings.Repeat("x", 1024*1024+1)
+	testCases := []struct {
+		name          string
+		method        string
+		body          string
+		status        int
+		success       bool
+		error         string
+		hashesRequest bool
+	}{
+		{"handled", http.MethodDelete, "", http.StatusNoContent, true, "", true},
+		// store faults can't be set without the faults store middleware
+		{"failed", http.MethodPut, `{"rules": []}`, http.StatusBadRequest, false, "status code 400", true},
+		{"body too large", http.MethodPut, oversized, http.StatusRequestEntityTooLarge, false, "larger than", false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			capture := newDryRunDatabase(t)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(testCase.method, "/v1alpha1/store-faults", strings.NewReader(testCase.body)))
+			require.Equal(t, testCase.status, recorder.Code)
+
+			entries := capture.auditEntries()
+			require.Len(t, entries, 1)
+			require.Equal(t, "anonymous", entries[0].Actor)
+			require.Equal(t, testCase.method+" /v1alpha1/store-faults", entries[0].Action)
+			require.JSONEq(t, `[]`, entries[0].TargetIds)
+			require.Equal(t, "192.0.2.1:1234", entries[0].Source)
+			require.Equal(t, testCase.success, entries[0].Success)
+			if testCase.error == "" {
+				require.Empty(t, entries[0].Error)
+			} else {
+				require.Contains(t, entries[0].Error, testCase.error)
+			}
+			if testCase.hashesRequest {
+				require.Equal(t, sha256Hex(testCase.body), entries[0].RequestHash)
+			}
+		})
+	}
+}
+
+func TestQueryAuditLogFilters(t *testing.T) {
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(24 * time.Hour)
+	testCases := []struct {
+		name     string
+		query    internal.AuditQuery
+		clauses  []string
+		vars     []interface{}
+		paginate string
+	}{
+		{"no filters", internal.AuditQuery{}, nil, nil, "LIMIT 100"},
+		{"actor", internal.AuditQuery{Actor: "admin"}, []string{"actor = $1"}, []interface{}{"admin"}, "LIMIT 100"},
+		{"action", internal.AuditQuery{Action: "DELETE /v1alpha1/api-keys/{id}"}, []string{"action = $1"}, []interface{}{"DELETE /v1alpha1/api-keys/{id}"}, "LIMIT 100"},
+		{"target id", internal.AuditQuery{TargetId: "user-1"}, []string{"target_ids @> $1"}, []interface{}{`["user-1"]`}, "LIMIT 100"},
+		{"time range", internal.AuditQuery{Since: since, Until: until}, []string{"created_at >= $1", "created_at < $2"}, []interface{}{since, until}, "LIMIT 100"},
+		{
+			"everything",
+			internal.AuditQuery{Actor: "admin", Action: "delete", TargetId: "user-1", Since: since, Until: until, Skip: 20, Limit: 10},
+			[]string{"actor = $1", "action = $2", "target_ids @> $3", "created_at >= $4", "created_at < $5"},
+			[]interface{}{"admin", "delete", `["user-1"]`, since, until},
+			"LIMIT 10 OFFSET 20",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			capture := newDryRunDatabase(t)
+			_, err := internal.QueryAuditLog(testCase.query)
+			require.NoError(t, err)
+			statements := capture.captured()
+			require.Len(t, statements, 1)
+			sql := statements[0].sql
+			require.Contains(t, sql, `FROM "audit_entries"`)
+			require.Contains(t, sql, "ORDER BY created_at DESC")
+			require.Contains(t, sql, testCase.paginate)
+			for _, clause := range testCase.clauses {
+				require.Contains(t, sql, clause)
+			}
+			if len(testCase.clauses) == 0 {
+				require.NotContains(t, sql, "WHERE")
+			}
+			require.Equal(t, testCase.vars, nilIfEmpty(statements[0].vars))
+		})
+	}
+
+	capture := newDryRunDatabase(t)
+	_, err := internal.QueryAuditLog(internal.AuditQuery{Limit: 1001})
+	require.Error(t, err)
+	require.Empty(t, capture.captured())
+}
+
+func nilIfEmpty(values []interface{}) []interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
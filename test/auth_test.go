@@ -0,0 +1,169 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/auth"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const testIssuer = "https://issuer.example.com"
+const testAudience = "go-notifications"
+
+type AuthSuite struct {
+	suite.Suite
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	verifier *auth.Verifier
+}
+
+func TestAuthSuite(t *testing.T) {
+	suite.Run(t, new(AuthSuite))
+}
+
+func (s *AuthSuite) SetupSuite() {
+	var err error
+	s.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(s.T(), err)
+	s.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(s.T(), err)
+	jwksPath := writeJwks(s.T(), s.rsaKey, s.ecKey)
+	keySet, err := auth.NewKeySet(jwksPath, "")
+	require.NoError(s.T(), err)
+	s.verifier = auth.NewVerifier(keySet, testIssuer, testAudience)
+}
+
+func (s *AuthSuite) TestValidRsaToken() {
+	token := signRsaToken(s.T(), s.rsaKey, "rsa", validClaims())
+	claims, err := s.verifier.Verify(token)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "user-1", claims.String("sub"))
+}
+
+func (s *AuthSuite) TestValidEcToken() {
+	token := signEcToken(s.T(), s.ecKey, "ec", validClaims())
+	claims, err := s.verifier.Verify(token)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "user-1", claims.String("sub"))
+}
+
+func (s *AuthSuite) TestAudienceList() {
+	claims := validClaims()
+	claims["aud"] = []string{"something-else", testAudience}
+	_, err := s.verifier.Verify(signRsaToken(s.T(), s.rsaKey, "rsa", claims))
+	require.NoError(s.T(), err)
+}
+
+func (s *AuthSuite) TestRejectedTokens() {
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://someone-else.example.com"
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "someone-else"
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+	notYetValid := validClaims()
+	notYetValid["nbf"] = time.Now().Add(time.Hour).Unix()
+	valid := signRsaToken(s.T(), s.rsaKey, "rsa", validClaims())
+	tokens := map[string]string{
+		"expired":        signRsaToken(s.T(), s.rsaKey, "rsa", expired),
+		"wrong issuer":   signRsaToken(s.T(), s.rsaKey, "rsa", wrongIssuer),
+		"wrong audience": signRsaToken(s.T(), s.rsaKey, "rsa", wrongAudience),
+		"no expiry":      signRsaToken(s.T(), s.rsaKey, "rsa", noExpiry),
+		"not yet valid":  signRsaToken(s.T(), s.rsaKey, "rsa", notYetValid),
+		"unknown key id": signRsaToken(s.T(), s.rsaKey, "unknown", validClaims()),
+		"wrong key":      signRsaToken(s.T(), s.rsaKey, "ec", validClaims()),
+		"tampered":       valid[:len(valid)-4] + "AAAA",
+		"unsigned":       encodeSegment(s.T(), map[string]string{"alg": "none", "kid": "rsa"}) + "." + encodeSegment(s.T(), validClaims()) + ".",
+		"not a jwt":      "not-a-jwt",
+	}
+	for name, token := range tokens {
+		_, err := s.verifier.Verify(token)
+		require.Error(s.T(), err, name)
+	}
+}
+
+func (s *AuthSuite) TestExpiryFollowsTheClock() {
+	token := signRsaToken(s.T(), s.rsaKey, "rsa", validClaims())
+	fake := clock.NewFake(time.Now())
+	defer clock.Set(fake)()
+	_, err := s.verifier.Verify(token)
+	require.NoError(s.T(), err)
+	fake.Advance(2 * time.Hour)
+	_, err = s.verifier.Verify(token)
+	require.ErrorContains(s.T(), err, "token expired")
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user-1",
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+}
+
+func writeJwks(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kid": "ec",
+				"kty": "EC",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	}
+	bytes, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, bytes, 0600))
+	return path
+}
+
+func signRsaToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signEcToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	signature := append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	bytes, err := json.Marshal(value)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
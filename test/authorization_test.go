@@ -0,0 +1,66 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/auth"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizeUnary(t *testing.T) {
+	endUser := &auth.Principal{Subject: "user-1", UserId: "user-1", Roles: []auth.Role{auth.RoleEndUser}}
+	service := &auth.Principal{Subject: "service", Roles: []auth.Role{auth.RoleService}}
+	admin := &auth.Principal{Subject: "admin", Roles: []auth.Role{auth.RoleAdmin}}
+	noRoles := &auth.Principal{Subject: "user-1", UserId: "user-1"}
+	sender := &auth.Principal{Subject: "sender", ApiKeyId: "key-1", Scopes: []string{internal.ScopeNotificationsSend, internal.ScopeSchedulesWrite}}
+	userAdmin := &auth.Principal{Subject: "user-admin", ApiKeyId: "key-2", Scopes: []string{internal.ScopeUsersAdmin}}
+	cases := []struct {
+		name      string
+		principal *auth.Principal
+		request   interface{}
+		allowed   bool
+	}{
+		{"end user reads own inbox", endUser, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: "user-1"}, true},
+		{"end user reads another inbox", endUser, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: "user-2"}, false},
+		{"end user reads every inbox", endUser, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{}, false},
+		{"end user updates own subscriptions", endUser, &notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest{UserId: "user-1"}, true},
+		{"end user updates another's subscriptions", endUser, &notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest{UserId: "user-2"}, false},
+		{"end user gets own profile", endUser, &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: []string{"user-1"}}, true},
+		{"end user gets another profile", endUser, &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: []string{"user-1", "user-2"}}, false},
+		{"end user upserts own profile", endUser, &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: []*notificationsv1alpha1.NotificationUser{{Id: "user-1"}}}, true},
+		{"end user upserts another profile", endUser, &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: []*notificationsv1alpha1.NotificationUser{{Id: "user-2"}}}, false},
+		{"end user sends notifications", endUser, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{}, false},
+		{"no roles", noRoles, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: "user-1"}, false},
+		{"service sends notifications", service, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{}, true},
+		{"service reads any inbox", service, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: "user-2"}, true},
+		{"service deletes users", service, &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: []string{"user-1"}}, false},
+		{"service lists users", service, &notificationsv1alpha1.NotificationsServiceListUsersRequest{}, false},
+		{"admin deletes users", admin, &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: []string{"user-1"}}, true},
+		{"admin sends notifications", admin, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{}, true},
+		{"api key with send scope sends notifications", sender, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{}, true},
+		{"api key with schedules write reads schedules", sender, &notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest{}, true},
+		{"api key without read scope reads inbox", sender, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: "user-1"}, false},
+		{"api key without users admin deletes users", sender, &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: []string{"user-1"}}, false},
+		{"api key with users admin deletes users", userAdmin, &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: []string{"user-1"}}, true},
+		{"api key with users admin updates subscriptions", userAdmin, &notificationsv1alpha1.NotificationsServiceUpdateSubscriptionsRequest{UserId: "user-2"}, true},
+		{"api key with users admin sends notifications", userAdmin, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{}, false},
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	}
+	for _, c := range cases {
+		ctx := auth.NewContext(context.Background(), c.principal)
+		_, err := internal.AuthorizeUnary(ctx, c.request, &grpc.UnaryServerInfo{}, handler)
+		if c.allowed {
+			require.NoError(t, err, c.name)
+		} else {
+			require.Equal(t, codes.PermissionDenied, status.Code(err), c.name)
+		}
+	}
+}
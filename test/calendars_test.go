@@ -0,0 +1,118 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/stretchr/testify/require"
+)
+
+var calendarsTestBase = internal.Calendar{
+	Name:        "us",
+	TimeZone:    "America/New_York",
+	WorkingDays: "monday,tuesday,wednesday,thursday,friday",
+	Holidays:    "2026-12-25",
+}
+
+// the tenant also has christmas eve off, but works on christmas
+var calendarsTestOverride = internal.Calendar{
+	Name:         "us",
+	Tenant:       "acme",
+	Holidays:     "2026-12-24",
+	WorkingDates: "2026-12-25",
+}
+
+func newTestBusinessCalendar(t *testing.T, override *internal.Calendar) *internal.BusinessCalendar {
+	calendar, err := internal.NewBusinessCalendar(calendarsTestBase, override)
+	require.NoError(t, err)
+	return calendar
+}
+
+func newYorkTime(t *testing.T, value string) time.Time {
+	location, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	require.NoError(t, err)
+	return parsed
+}
+
+func TestBusinessCalendarIsBusinessDay(t *testing.T) {
+	testCases := []struct {
+		name     string
+		override *internal.Calendar
+		time     time.Time
+		expected bool
+	}{
+		{"working day", nil, newYorkTime(t, "2026-12-24 09:00"), true},
+		{"holiday", nil, newYorkTime(t, "2026-12-25 09:00"), false},
+		{"weekend", nil, newYorkTime(t, "2026-12-26 09:00"), false},
+		// 22:00 on christmas in new york is already the 26th in utc, the day is taken in the calendar's time zone
+		{"holiday in the calendar's time zone", nil, time.Date(2026, 12, 26, 3, 0, 0, 0, time.UTC), false},
+		{"working day in the calendar's time zone", nil, time.Date(2026, 12, 25, 3, 0, 0, 0, time.UTC), true},
+		{"tenant holiday", &calendarsTestOverride, newYorkTime(t, "2026-12-24 09:00"), false},
+		{"tenant working date on a base holiday", &calendarsTestOverride, newYorkTime(t, "2026-12-25 09:00"), true},
+		{"weekend with a tenant override", &calendarsTestOverride, newYorkTime(t, "2026-12-26 09:00"), false},
+		{"tenant working days", &internal.Calendar{Name: "us", Tenant: "weekends", WorkingDays: "saturday,sunday"}, newYorkTime(t, "2026-12-26 09:00"), true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			calendar := newTestBusinessCalendar(t, testCase.override)
+			require.Equal(t, testCase.expected, calendar.IsBusinessDay(testCase.time))
+		})
+	}
+}
+
+func TestBusinessCalendarNextBusinessDay(t *testing.T) {
+	testCases := []struct {
+		name     string
+		override *internal.Calendar
+		from     time.Time
+		expected time.Time
+	}{
+		{"skips holidays and weekends", nil, newYorkTime(t, "2026-12-24 14:00"), newYorkTime(t, "2026-12-28 14:00")},
+		{"tenant holidays and working dates", &calendarsTestOverride, newYorkTime(t, "2026-12-23 14:00"), newYorkTime(t, "2026-12-25 14:00")},
+		// daylight saving time starts on the 8th, the wall clock time is kept rather than the elapsed time
+		{"keeps the wall clock time across daylight saving", nil, newYorkTime(t, "2026-03-06 09:00"), newYorkTime(t, "2026-03-09 09:00")},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			calendar := newTestBusinessCalendar(t, testCase.override)
+			next, err := calendar.NextBusinessDay(testCase.from)
+			require.NoError(t, err)
+			require.True(t, testCase.expected.Equal(next), "expected %s but got %s", testCase.expected, next)
+		})
+	}
+}
+
+func TestBusinessCalendarNextBusinessDayWithoutBusinessDays(t *testing.T) {
+	calendar, err := internal.NewBusinessCalendar(internal.Calendar{Name: "never"}, nil)
+	require.NoError(t, err)
+	_, err = calendar.NextBusinessDay(time.Date(2026, 12, 24, 9, 0, 0, 0, time.UTC))
+	require.Error(t, err)
+}
+
+func TestBusinessCalendarCronFiresOnDay(t *testing.T) {
+	testCases := []struct {
+		name       string
+		expression string
+		day        time.Time
+		expected   bool
+	}{
+		{"fires", "0 14 * * 1-5", newYorkTime(t, "2026-12-28 00:00"), true},
+		{"doesn't fire", "0 14 * * 1-5", newYorkTime(t, "2026-12-26 00:00"), false},
+		// cron expressions are in utc, 03:00 utc on monday is still sunday in new york
+		{"fires on the previous day in the calendar's time zone", "0 3 * * 1-5", newYorkTime(t, "2026-12-27 12:00"), true},
+		{"doesn't fire on the day in utc", "0 3 * * 1-5", newYorkTime(t, "2026-12-25 12:00"), false},
+	}
+	calendar := newTestBusinessCalendar(t, nil)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			fires, err := calendar.CronFiresOnDay(testCase.expression, testCase.day)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, fires)
+		})
+	}
+	_, err := calendar.CronFiresOnDay("not a cron expression", newYorkTime(t, "2026-12-28 00:00"))
+	require.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/client"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// newBufconnClient serves the notifications service over an in memory listener, backed by the store
+func newBufconnClient(t *testing.T, store notification_store.NotificationStoreInterface) notificationsv1alpha1.NotificationsServiceClient {
+	previousStore := notification_store.NotificationStore
+	notification_store.NotificationStore = store
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	notificationsv1alpha1.RegisterNotificationsServiceServer(server, internal.NotificationsServiceServer{})
+	go server.Serve(listener)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		notification_store.NotificationStore = previousStore
+	})
+	return notificationsv1alpha1.NewNotificationsServiceClient(conn)
+}
+
+func readUsers(t *testing.T, input string) []*notificationsv1alpha1.NotificationUser {
+	users := []*notificationsv1alpha1.NotificationUser{}
+	err := client.ReadMessages(strings.NewReader(input), func() proto.Message {
+		user := &notificationsv1alpha1.NotificationUser{}
+		users = append(users, user)
+		return user
+	})
+	require.NoError(t, err)
+	return users
+}
+
+func TestClientReadMessagesArrayAndLines(t *testing.T) {
+	fromArray := readUsers(t, `[{"id": "a", "emailAddress": "a@example.com"}, {"id": "b"}]`)
+	require.Len(t, fromArray, 2)
+	require.Equal(t, "a", fromArray[0].Id)
+	require.Equal(t, "a@example.com", fromArray[0].EmailAddress)
+	require.Equal(t, "b", fromArray[1].Id)
+	fromLines := readUsers(t, "{\"id\": \"a\", \"emailAddress\": \"a@example.com\"}\n\n{\"id\": \"b\"}\n")
+	require.Len(t, fromLines, 2)
+	require.Equal(t, "a", fromLines[0].Id)
+	require.Equal(t, "b", fromLines[1].Id)
+	err := client.ReadMessages(strings.NewReader(`{"id": "a"} {"id": `), func() proto.Message { return &notificationsv1alpha1.NotificationUser{} })
+	require.Error(t, err)
+}
+
+func TestClientUpsertAndPrintUsers(t *testing.T) {
+	notificationsClient := newBufconnClient(t, newMemoryStore())
+	users := readUsers(t, `[{"id": "a", "emailAddress": "a@example.com"}, {"id": "b", "emailAddress": "b@example.com"}]`)
+	_, err := notificationsClient.UpsertUsers(context.Background(), &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: users})
+	require.NoError(t, err)
+	response, err := notificationsClient.GetUsers(context.Background(), &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: []string{"a", "b"}})
+	require.NoError(t, err)
+	messages := []proto.Message{}
+	for _, user := range response.Users {
+		messages = append(messages, user)
+	}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, client.Printer{Out: out, Format: client.OutputTable}.PrintMessages(messages, []string{"id", "emailAddress"}))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, []string{"ID", "EMAILADDRESS"}, strings.Fields(lines[0]))
+	require.Equal(t, []string{"a", "a@example.com"}, strings.Fields(lines[1]))
+	require.Equal(t, []string{"b", "b@example.com"}, strings.Fields(lines[2]))
+
+	out.Reset()
+	require.NoError(t, client.Printer{Out: out, Format: client.OutputJson}.PrintMessages(messages, nil))
+	fromJson := []map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &fromJson))
+	require.Equal(t, []map[string]interface{}{{"id": "a", "emailAddress": "a@example.com"}, {"id": "b", "emailAddress": "b@example.com"}}, fromJson)
+
+	out.Reset()
+	require.NoError(t, client.Printer{Out: out, Format: client.OutputYaml}.PrintMessages(messages, nil))
+	fromYaml := []map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal(out.Bytes(), &fromYaml))
+	require.Equal(t, fromJson, fromYaml)
+}
+
+func TestClientNotFoundIdsHeader(t *testing.T) {
+	store := newMemoryStore()
+	notificationsClient := newBufconnClient(t, store)
+	_, err := store.UpsertUsers(context.Background(), []*notificationsv1alpha1.NotificationUser{{Id: "a"}})
+	require.NoError(t, err)
+	header := metadata.MD{}
+	response, err := notificationsClient.GetUsers(context.Background(), &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: []string{"missing-1", "a", "missing-2"}}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Len(t, response.Users, 1)
+	require.Equal(t, []string{"missing-1", "missing-2"}, client.NotFoundIds(header))
+
+	header = metadata.MD{}
+	_, err = notificationsClient.GetUsers(context.Background(), &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: []string{"a"}}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Empty(t, client.NotFoundIds(header))
+}
+
+func TestClientPrintResultAndValidateFormat(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, client.Printer{Out: out, Format: client.OutputTable}.PrintResult(map[string]interface{}{"upserted": 2, "ids": []interface{}{"a", "b"}}))
+	require.Equal(t, []string{"IDS", `["a","b"]`}, strings.Fields(strings.Split(out.String(), "\n")[0]))
+	require.Equal(t, []string{"UPSERTED", "2"}, strings.Fields(strings.Split(out.String(), "\n")[1]))
+	require.NoError(t, client.ValidateFormat(client.OutputYaml))
+	require.Error(t, client.ValidateFormat("xml"))
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// publishCountingStore counts and keeps the events published to the store
+type publishCountingStore struct {
+	notification_store.NotificationStoreInterface
+	published int32
+	mu        sync.Mutex
+	events    []*notificationsv1alpha1.NotificationEvent
+}
+
+func (s *publishCountingStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	atomic.AddInt32(&s.published, int32(len(events)))
+	s.mu.Lock()
+	s.events = append(s.events, events...)
+	s.mu.Unlock()
+	return s.NotificationStoreInterface.PublishEvents(ctx, events)
+}
+
+func (s *publishCountingStore) publishedEvents() []*notificationsv1alpha1.NotificationEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*notificationsv1alpha1.NotificationEvent{}, s.events...)
+}
+
+// TestCronJitterFollowsFakeClock fires a cron scheduled notification with a jitter window at each occurrence, the way
+// the scheduler does, and moves the fake clock a second at a time, checking the exact number of notifications sent
+// after each move. The scheduler's own loop runs on the wall clock, so the test fires the occurrences in its place.
+func TestCronJitterFollowsFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	defer clock.Set(fake)()
+	store := &publishCountingStore{NotificationStoreInterface: newMemoryStore()}
+	previousStore := notification_store.NotificationStore
+	notification_store.NotificationStore = store
+	defer func() { notification_store.NotificationStore = previousStore }()
+
+	// the id's offset in the window is 14s
+	id := uuid.MustParse("0b7e6d0c-3f5a-4c1e-8d2b-9a4f1e7c5d60")
+	window := 30 * time.Second
+	scheduledNotification := &notificationsv1alpha1.ScheduledNotification{
+		Id:           id.String(),
+		UserId:       "user",
+		Notification: &notificationsv1alpha1.NotificationEvent{Data: `{"some": "data"}`},
+		Trigger:      &notificationsv1alpha1.ScheduledNotification_CronTrigger{CronTrigger: &notificationsv1alpha1.CronTrigger{Expression: "* * * * *"}},
+	}
+	occurrences, err := internal.PreviewFireTimes(scheduledNotification, 0, start.Add(-time.Second), 3)
+	require.NoError(t, err)
+	sendTimes, err := internal.PreviewFireTimes(scheduledNotification, window, start.Add(-time.Second), 3)
+	require.NoError(t, err)
+	require.Equal(t, 14*time.Second, sendTimes[0].Sub(occurrences[0]))
+	metadata := taskMetadata(t, scheduledNotification)
+	metadata["jitter_window"] = int64(window)
+	cronTrigger, err := pkg.NewCronTrigger("* * * * *")
+	require.NoError(t, err)
+
+	var executions sync.WaitGroup
+	errs := make(chan error, len(occurrences))
+	fired := 0
+	for now := start; !now.After(sendTimes[len(sendTimes)-1]); now = now.Add(time.Second) {
+		fake.SetTime(now)
+		if fired < len(occurrences) && occurrences[fired].Equal(now) {
+			executeAt := now
+			executions.Add(1)
+			go func() {
+				defer executions.Done()
+				errs <- internal.HandleScheduledNotification(pkg.TaskInstance{
+					ExecuteAt:      &executeAt,
+					TaskDefinition: pkg.TaskDefinition{Id: &id, Metadata: metadata, CronTrigger: cronTrigger},
+				})
+			}()
+			fired++
+			// the clock only wakes the execution if it's already waiting out its jitter when the clock moves
+			require.Eventually(t, func() bool { return fake.Sleepers() == 1 }, time.Second, time.Millisecond)
+		}
+		expected := int32(0)
+		for _, sendTime := range sendTimes {
+			if !sendTime.After(now) {
+				expected++
+			}
+		}
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&store.published) == expected }, time.Second, time.Millisecond, "at %s", now)
+	}
+	executions.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(len(occurrences)), atomic.LoadInt32(&store.published))
+}
+
+func TestFakeClockSleepWakesWhenMovedPastIt(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	woken := make(chan error, 1)
+	go func() { woken <- fake.Sleep(context.Background(), 10*time.Second) }()
+	require.Eventually(t, func() bool { return fake.Sleepers() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(9 * time.Second)
+	select {
+	case <-woken:
+		require.Fail(t, "woken before the sleep ended")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.Advance(time.Second)
+	require.NoError(t, <-woken)
+	require.Zero(t, fake.Sleepers())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { woken <- fake.Sleep(ctx, time.Second) }()
+	require.Eventually(t, func() bool { return fake.Sleepers() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-woken, context.Canceled)
+	require.Zero(t, fake.Sleepers())
+	require.NoError(t, fake.Sleep(context.Background(), 0))
+}
+
+func TestClockSetRestoresPreviousClock(t *testing.T) {
+	stopped := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restore := clock.Set(clock.NewFake(stopped))
+	require.Equal(t, stopped, clock.Now())
+	restore()
+	require.WithinDuration(t, time.Now(), clock.Now(), time.Second)
+}
@@ -0,0 +1,177 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/cmd"
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// requiredConfig is the config file sections that set the required keys
+func requiredConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"store": map[string]interface{}{
+			"notifo-api-key":  "key",
+			"notifo-app-id":   "app",
+			"cockroachdb-uri": "postgresql://root@localhost:26257/defaultdb",
+		},
+	}
+}
+
+// writeConfigFile writes a config file with the required keys and the sections. The keys of a section replace the
+// required keys in it, and a nil value removes one.
+func writeConfigFile(t *testing.T, sections map[string]interface{}) string {
+	file := requiredConfig()
+	for name, section := range sections {
+		keys, isMap := section.(map[string]interface{})
+		required, hasRequired := file[name].(map[string]interface{})
+		if !isMap || !hasRequired {
+			file[name] = section
+			continue
+		}
+		for key, value := range keys {
+			if value == nil {
+				delete(required, key)
+			} else {
+				required[key] = value
+			}
+		}
+	}
+	contents, err := yaml.Marshal(file)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "go-notifications.yaml")
+	require.NoError(t, os.WriteFile(path, contents, 0600))
+	return path
+}
+
+// loadTestConfig loads the config of a new run command, whose flags set the global config, from the args, environment
+// variables, and a config file with the sections. The global config is restored when the test ends.
+func loadTestConfig(t *testing.T, sections map[string]interface{}, env map[string]string, args ...string) error {
+	previousConfig := config.AppConfig
+	previousServerConfig := cmd.ServerConfig
+	t.Cleanup(func() {
+		config.AppConfig = previousConfig
+		cmd.ServerConfig = previousServerConfig
+	})
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	command := cmd.NewRunCommand()
+	require.NoError(t, command.ParseFlags(args))
+	return cmd.LoadConfig(command, writeConfigFile(t, sections))
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	testCases := []struct {
+		name        string
+		sections    map[string]interface{}
+		env         map[string]string
+		args        []string
+		port        int
+		middlewares []string
+	}{
+		{"defaults", nil, nil, nil, 6000, []string{"cache", "instrumented"}},
+		{"config file", map[string]interface{}{"server": map[string]interface{}{"port": 7000}, "store": map[string]interface{}{"middlewares": []string{"cache"}}}, nil, nil, 7000, []string{"cache"}},
+		{"environment over config file", map[string]interface{}{"server": map[string]interface{}{"port": 7000}}, map[string]string{"PORT": "7001", "STORE_MIDDLEWARES": "instrumented"}, nil, 7001, []string{"instrumented"}},
+		{"flag over environment", map[string]interface{}{"server": map[string]interface{}{"port": 7000}}, map[string]string{"PORT": "7001"}, []string{"--port", "7002"}, 7002, []string{"cache", "instrumented"}},
+		// a null value leaves the flag's default
+		{"null in config file", map[string]interface{}{"server": map[string]interface{}{"port": nil}}, nil, nil, 6000, []string{"cache", "instrumented"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.NoError(t, loadTestConfig(t, testCase.sections, testCase.env, testCase.args...))
+			require.Equal(t, testCase.port, cmd.ServerConfig.Port)
+			require.Equal(t, testCase.middlewares, config.AppConfig.StoreMiddlewares)
+			require.Equal(t, "key", config.AppConfig.NotifoApiKey)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sections map[string]interface{}
+		env      map[string]string
+		args     []string
+		errors   []string
+	}{
+		{"unknown section", map[string]interface{}{"servers": map[string]interface{}{"port": 7000}}, nil, nil, []string{"unknown section servers, must be one of server, gateway"}},
+		{"unknown key", map[string]interface{}{"server": map[string]interface{}{"prot": 7000}}, nil, nil, []string{"unknown key server.prot"}},
+		{"section that isn't a map", map[string]interface{}{"server": 7000}, nil, nil, []string{"section server must be a map"}},
+		{"value of the wrong type", map[string]interface{}{"server": map[string]interface{}{"port": "high"}}, nil, nil, []string{"invalid server.port"}},
+		{"environment variable of the wrong type", nil, map[string]string{"PORT": "high"}, nil, []string{"invalid PORT"}},
+		{"invalid value in the config file", map[string]interface{}{"server": map[string]interface{}{"port": 70000}}, nil, nil, []string{"invalid port: 70000 is not a port between 1 and 65535"}},
+		{"invalid environment variable", nil, map[string]string{"RESOLVER_FALLBACK": "later"}, nil, []string{"invalid resolver-fallback: later must be one of stale, skip, retry"}},
+		{"invalid flag", nil, nil, []string{"--tracing-sample-ratio", "2"}, []string{"invalid tracing-sample-ratio: 2 is not a ratio between 0 and 1"}},
+		{"missing required key", map[string]interface{}{"store": map[string]interface{}{"notifo-app-id": nil}}, nil, nil, []string{"invalid notifo-app-id: must be set"}},
+		{"every problem in the config file", map[string]interface{}{"server": map[string]interface{}{"prot": 7000}, "servers": map[string]interface{}{"port": 7000}}, nil, nil, []string{"unknown key server.prot", "unknown section servers"}},
+		// values are validated once they've all been set, and every invalid value is reported
+		{"every invalid value", map[string]interface{}{"server": map[string]interface{}{"health-check-interval": "0s"}}, map[string]string{"NOTIFO_CONCURRENCY": "0"}, nil, []string{"invalid health-check-interval: 0s is not a positive duration", "invalid notifo-concurrency: 0 is not a positive integer"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := loadTestConfig(t, testCase.sections, testCase.env, testCase.args...)
+			require.Error(t, err)
+			for _, expected := range testCase.errors {
+				require.ErrorContains(t, err, expected)
+			}
+		})
+	}
+
+	t.Run("missing config file", func(t *testing.T) {
+		previousConfig := config.AppConfig
+		previousServerConfig := cmd.ServerConfig
+		t.Cleanup(func() {
+			config.AppConfig = previousConfig
+			cmd.ServerConfig = previousServerConfig
+		})
+		err := cmd.LoadConfig(cmd.NewRunCommand(), filepath.Join(t.TempDir(), "missing.yaml"))
+		require.Error(t, err)
+	})
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "notifo-api-key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(" key-from-file\n"), 0600))
+	emptyFile := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(emptyFile, []byte("\n"), 0600))
+	uriFile := filepath.Join(dir, "cockroachdb-uri")
+	require.NoError(t, os.WriteFile(uriFile, []byte("not a url"), 0600))
+	withoutKey := map[string]interface{}{"store": map[string]interface{}{"notifo-api-key": nil}}
+	withKeyFile := map[string]interface{}{"store": map[string]interface{}{"notifo-api-key": nil, "notifo-api-key-file": keyFile}}
+
+	testCases := []struct {
+		name     string
+		sections map[string]interface{}
+		env      map[string]string
+		args     []string
+		error    string
+	}{
+		{"flag", withoutKey, nil, []string{"--notifo-api-key-file", keyFile}, ""},
+		{"environment variable", withoutKey, map[string]string{"NOTIFO_API_KEY_FILE": keyFile}, nil, ""},
+		{"config file", withKeyFile, nil, nil, ""},
+		{"secret and its file", withoutKey, map[string]string{"NOTIFO_API_KEY": "key"}, []string{"--notifo-api-key-file", keyFile}, "only one of notifo-api-key and notifo-api-key-file can be set"},
+		// a secret set in the config file conflicts with its file too
+		{"secret in the config file and its file", nil, nil, []string{"--notifo-api-key-file", keyFile}, "only one of notifo-api-key and notifo-api-key-file can be set"},
+		{"missing file", withoutKey, nil, []string{"--notifo-api-key-file", filepath.Join(dir, "missing")}, "error reading secret file"},
+		{"empty file", withoutKey, nil, []string{"--notifo-api-key-file", emptyFile}, "is empty"},
+		// secrets read from files are validated like any other value
+		{"invalid secret in a file", map[string]interface{}{"store": map[string]interface{}{"cockroachdb-uri": nil, "cockroachdb-uri-file": uriFile}}, nil, nil, "invalid cockroachdb-uri: must be a postgresql:// connection url"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := loadTestConfig(t, testCase.sections, testCase.env, testCase.args...)
+			if testCase.error != "" {
+				require.ErrorContains(t, err, testCase.error)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "key-from-file", config.AppConfig.NotifoApiKey)
+		})
+	}
+}
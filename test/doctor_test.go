@@ -0,0 +1,105 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/doctor"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store/notifotest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoctorNotifoChecks(t *testing.T) {
+	notifo := notifotest.NewServer()
+	defer notifo.Close()
+	tests := []struct {
+		apiKey, appId string
+		statuses      []string
+	}{
+		{notifo.ApiKey, notifo.AppId, []string{doctor.StatusOk, doctor.StatusOk, doctor.StatusOk}},
+		{"wrong", notifo.AppId, []string{doctor.StatusOk, doctor.StatusFail, doctor.StatusSkip}},
+		{notifo.ApiKey, "wrong", []string{doctor.StatusOk, doctor.StatusOk, doctor.StatusFail}},
+	}
+	for _, test := range tests {
+		checks := append([]doctor.Check{doctor.NotifoReachable(notifo.URL)}, doctor.NotifoAuth(notifo.URL, test.apiKey, test.appId)...)
+		results := doctor.RunChecks(context.Background(), checks, time.Second)
+		statuses := []string{}
+		for _, result := range results {
+			statuses = append(statuses, result.Status)
+		}
+		require.Equal(t, test.statuses, statuses, "api key %s app id %s", test.apiKey, test.appId)
+	}
+}
+
+func TestDoctorNotifoReachableFailsOnServerErrors(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		status     string
+	}{
+		{http.StatusOK, doctor.StatusOk},
+		{http.StatusNotFound, doctor.StatusOk},
+		{http.StatusBadGateway, doctor.StatusFail},
+		{http.StatusServiceUnavailable, doctor.StatusFail},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.statusCode)
+		}))
+		results := doctor.RunChecks(context.Background(), []doctor.Check{doctor.NotifoReachable(server.URL)}, time.Second)
+		server.Close()
+		require.Equal(t, test.status, results[0].Status, "status code %d", test.statusCode)
+	}
+}
+
+func TestDoctorTlsCheck(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		notAfter time.Duration
+		status   string
+		exitCode int
+	}{
+		{365 * 24 * time.Hour, doctor.StatusOk, doctor.ExitOk},
+		{24 * time.Hour, doctor.StatusWarn, doctor.ExitWarning},
+		{-time.Hour, doctor.StatusFail, doctor.ExitFailure},
+	}
+	for _, test := range tests {
+		certPath, keyPath := writeCertificate(t, dir, time.Now().Add(test.notAfter))
+		check := doctor.Tls("tls", certPath, keyPath, certPath, 30*24*time.Hour)
+		results := doctor.RunChecks(context.Background(), []doctor.Check{check}, time.Second)
+		require.Equal(t, test.status, results[0].Status, results[0].Detail)
+		require.Equal(t, test.exitCode, doctor.ExitCode(results))
+	}
+}
+
+// writeCertificate writes a self signed certificate and its key, and returns their paths
+func writeCertificate(t *testing.T, dir string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-notifications"},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey}), 0600))
+	return certPath, keyPath
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+)
+
+// fakeScheduler keeps task definitions in memory. Queries aren't evaluated, so listing returns every definition in id
+// order, and deleting by a metadata query isn't supported.
+type fakeScheduler struct {
+	mu          sync.Mutex
+	definitions map[uuid.UUID]pkg.TaskDefinition
+}
+
+// newFakeScheduler replaces the service's scheduler with a fake for the length of the test
+func newFakeScheduler(t *testing.T) *fakeScheduler {
+	scheduler := &fakeScheduler{definitions: map[uuid.UUID]pkg.TaskDefinition{}}
+	previousScheduler := internal.Scheduler
+	internal.Scheduler = scheduler
+	t.Cleanup(func() { internal.Scheduler = previousScheduler })
+	return scheduler
+}
+
+func (s *fakeScheduler) Run() {}
+
+func (s *fakeScheduler) UpsertTaskDefinition(definition pkg.TaskDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.definitions[*definition.Id] = definition
+	return nil
+}
+
+func (s *fakeScheduler) GetTaskDefinitions(ids []*uuid.UUID) ([]pkg.TaskDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	definitions := []pkg.TaskDefinition{}
+	for _, id := range ids {
+		if definition, ok := s.definitions[*id]; ok {
+			definitions = append(definitions, definition)
+		}
+	}
+	return definitions, nil
+}
+
+func (s *fakeScheduler) ListTaskDefinitions(skip, limit int, query interface{}, args ...interface{}) ([]pkg.TaskDefinition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	definitions := []pkg.TaskDefinition{}
+	for _, definition := range s.definitions {
+		definitions = append(definitions, definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Id.String() < definitions[j].Id.String() })
+	if skip >= len(definitions) {
+		return []pkg.TaskDefinition{}, nil
+	}
+	definitions = definitions[skip:]
+	if limit < len(definitions) {
+		definitions = definitions[:limit]
+	}
+	return definitions, nil
+}
+
+func (s *fakeScheduler) DeleteTaskDefinitions(ids []*uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.definitions, *id)
+	}
+	return nil
+}
+
+func (s *fakeScheduler) DeleteTaskDefinitionsByMetadataQuery(query interface{}, args ...interface{}) error {
+	return errorx.NotImplemented.New("the fake scheduler doesn't evaluate metadata queries")
+}
+
+// ids returns the ids of the stored definitions
+func (s *fakeScheduler) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id := range s.definitions {
+		ids = append(ids, id.String())
+	}
+	sort.Strings(ids)
+	return ids
+}
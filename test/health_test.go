@@ -0,0 +1,157 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// pingConnector is a database driver whose connections can only be pinged
+type pingConnector struct{}
+
+func (c pingConnector) Connect(ctx context.Context) (driver.Conn, error) { return pingConn{}, nil }
+func (c pingConnector) Driver() driver.Driver                            { return nil }
+
+type pingConn struct{}
+
+func (c pingConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c pingConn) Close() error                              { return nil }
+func (c pingConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+func (c pingConn) Ping(ctx context.Context) error            { return nil }
+
+// pingFailingStore fails every ping
+type pingFailingStore struct {
+	notification_store.NotificationStoreInterface
+}
+
+func (s pingFailingStore) Ping(ctx context.Context) error {
+	return errors.New("notifo unavailable")
+}
+
+type readiness struct {
+	Status       string `json:"status"`
+	Dependencies map[string]struct {
+		Status string                 `json:"status"`
+		Error  string                 `json:"error"`
+		Detail map[string]interface{} `json:"detail"`
+	} `json:"dependencies"`
+}
+
+// newTestHealthChecker replaces the health checker, and the dependencies it checks, for the length of the test. Every
+// dependency is healthy, but the scheduler hasn't been started.
+func newTestHealthChecker(t *testing.T) *internal.HealthChecker {
+	previousHealth := internal.Health
+	internal.Health = internal.NewHealthChecker()
+	t.Cleanup(func() { internal.Health = previousHealth })
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(pingConnector{})}), &gorm.Config{DisableAutomaticPing: true, Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	previousDB := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previousDB })
+	previousStore := notification_store.NotificationStore
+	notification_store.NotificationStore = newMemoryStore()
+	t.Cleanup(func() { notification_store.NotificationStore = previousStore })
+	newFakeScheduler(t)
+	return internal.Health
+}
+
+func getReadiness(t *testing.T) (int, readiness) {
+	recorder := httptest.NewRecorder()
+	internal.HandleReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	response := readiness{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+func requireServingStatus(t *testing.T, health *internal.HealthChecker, expected grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	for _, service := range []string{"", "notifications.v1alpha1.NotificationsService"} {
+		response, err := health.Server.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		require.Equal(t, expected, response.Status, "service %q", service)
+	}
+}
+
+func TestHealthReadinessTransitions(t *testing.T) {
+	health := newTestHealthChecker(t)
+	// not ready until the dependencies have been checked
+	code, response := getReadiness(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "not ready", response.Status)
+	requireServingStatus(t, health, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	// the scheduler fails readiness until it's started
+	health.Check(context.Background(), time.Second)
+	code, response = getReadiness(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "not ready", response.Status)
+	require.Equal(t, "not ready", response.Dependencies[internal.DependencyScheduler].Status)
+	require.Equal(t, "ok", response.Dependencies[internal.DependencyCockroachdb].Status)
+	require.Equal(t, "ok", response.Dependencies[internal.DependencyNotifo].Status)
+	requireServingStatus(t, health, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	health.SchedulerStarted()
+	health.Check(context.Background(), time.Second)
+	code, response = getReadiness(t)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", response.Status)
+	require.Len(t, response.Dependencies, 3)
+	require.Contains(t, response.Dependencies[internal.DependencyScheduler].Detail, "started_at")
+	requireServingStatus(t, health, grpc_health_v1.HealthCheckResponse_SERVING)
+
+	// one failing dependency fails readiness, and the others are still reported
+	notification_store.NotificationStore = pingFailingStore{NotificationStoreInterface: newMemoryStore()}
+	health.Check(context.Background(), time.Second)
+	code, response = getReadiness(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "not ready", response.Status)
+	require.Equal(t, "not ready", response.Dependencies[internal.DependencyNotifo].Status)
+	require.Equal(t, "notifo unavailable", response.Dependencies[internal.DependencyNotifo].Error)
+	require.Equal(t, "ok", response.Dependencies[internal.DependencyScheduler].Status)
+	requireServingStatus(t, health, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	// and recovers with it
+	notification_store.NotificationStore = newMemoryStore()
+	health.Check(context.Background(), time.Second)
+	code, _ = getReadiness(t)
+	require.Equal(t, http.StatusOK, code)
+	requireServingStatus(t, health, grpc_health_v1.HealthCheckResponse_SERVING)
+
+	health.SchedulerFailed(errors.New("scheduler stopped running"))
+	health.Check(context.Background(), time.Second)
+	code, response = getReadiness(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "scheduler stopped running", response.Dependencies[internal.DependencyScheduler].Error)
+	health.SchedulerStarted()
+	health.Check(context.Background(), time.Second)
+
+	// shutting down is reported ahead of the dependencies, and isn't undone by later checks
+	health.Shutdown()
+	health.Check(context.Background(), time.Second)
+	code, response = getReadiness(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "shutting down", response.Status)
+	requireServingStatus(t, health, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestHealthLiveness(t *testing.T) {
+	newTestHealthChecker(t).Shutdown()
+	recorder := httptest.NewRecorder()
+	internal.HandleLiveness(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `{"status": "ok"}`, recorder.Body.String())
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/lifecycle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleStopsComponentsWhenCriticalComponentFails(t *testing.T) {
+	failure := errors.New("listener closed")
+	stopped := []string{}
+	manager := lifecycle.NewManager(time.Second)
+	for _, name := range []string{"first", "second"} {
+		name := name
+		manager.Add(lifecycle.Component{
+			Name:     name,
+			Critical: true,
+			Run: func(ctx context.Context) error {
+				<-ctx.Done()
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				stopped = append(stopped, name)
+				return nil
+			},
+		})
+	}
+	manager.Add(lifecycle.Component{
+		Name: "non critical",
+		Run: func(ctx context.Context) error {
+			return errors.New("ignored")
+		},
+	})
+	manager.Add(lifecycle.Component{
+		Name:     "failing",
+		Critical: true,
+		Run: func(ctx context.Context) error {
+			time.Sleep(10 * time.Millisecond)
+			return failure
+		},
+	})
+	err := manager.Run(context.Background())
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, []string{"second", "first"}, stopped)
+}
+
+func TestLifecycleStopsOnContextDone(t *testing.T) {
+	manager := lifecycle.NewManager(time.Second)
+	manager.Add(lifecycle.Component{
+		Name:     "server",
+		Critical: true,
+		Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.NoError(t, manager.Run(ctx))
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/internal/metrics"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store/notifotest"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// failingPublishStore fails every publish
+type failingPublishStore struct {
+	notification_store.NotificationStoreInterface
+}
+
+func (s failingPublishStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	return errors.New("publish failed")
+}
+
+// histogramSampleCount returns the number of observations of the histogram series with the labels, from the default
+// registry. Metrics are global, so tests compare counts before and after.
+func histogramSampleCount(t *testing.T, name string, labels map[string]string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matches := 0
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] == label.GetValue() {
+					matches++
+				}
+			}
+			if matches == len(labels) && len(metric.GetLabel()) == len(labels) {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestTopicKind(t *testing.T) {
+	testCases := map[string]string{
+		"":                "none",
+		"users/123":       "users",
+		"users/123/inbox": "users",
+		"broadcast":       "broadcast",
+	}
+	for topic, expected := range testCases {
+		require.Equal(t, expected, metrics.TopicKind(topic), "topic %q", topic)
+	}
+}
+
+func TestInstrumentedStoreMetricLabels(t *testing.T) {
+	ctx := context.Background()
+	store := notification_store.InstrumentedNotificationStore{Store: newMemoryStore()}
+	usersSuccess := metrics.EventsPublished.WithLabelValues("users", metrics.OutcomeSuccess)
+	noneSuccess := metrics.EventsPublished.WithLabelValues("none", metrics.OutcomeSuccess)
+	usersError := metrics.EventsPublished.WithLabelValues("users", metrics.OutcomeError)
+	before := []float64{testutil.ToFloat64(usersSuccess), testutil.ToFloat64(noneSuccess), testutil.ToFloat64(usersError)}
+	publishSuccesses := histogramSampleCount(t, "notifications_store_duration_seconds", map[string]string{"method": "PublishEvents", "outcome": metrics.OutcomeSuccess})
+	publishErrors := histogramSampleCount(t, "notifications_store_duration_seconds", map[string]string{"method": "PublishEvents", "outcome": metrics.OutcomeError})
+
+	events := []*notificationsv1alpha1.NotificationEvent{{Topic: "users/1"}, {Topic: "users/2"}, {}}
+	require.NoError(t, store.PublishEvents(ctx, events))
+	failing := notification_store.InstrumentedNotificationStore{Store: failingPublishStore{NotificationStoreInterface: newMemoryStore()}}
+	require.Error(t, failing.PublishEvents(ctx, events[:1]))
+
+	// events are counted by the first segment of their topic, not per user
+	require.Equal(t, before[0]+2, testutil.ToFloat64(usersSuccess))
+	require.Equal(t, before[1]+1, testutil.ToFloat64(noneSuccess))
+	require.Equal(t, before[2]+1, testutil.ToFloat64(usersError))
+	require.Equal(t, publishSuccesses+1, histogramSampleCount(t, "notifications_store_duration_seconds", map[string]string{"method": "PublishEvents", "outcome": metrics.OutcomeSuccess}))
+	require.Equal(t, publishErrors+1, histogramSampleCount(t, "notifications_store_duration_seconds", map[string]string{"method": "PublishEvents", "outcome": metrics.OutcomeError}))
+
+	upserted := testutil.ToFloat64(metrics.UsersUpserted)
+	deleted := testutil.ToFloat64(metrics.UsersDeleted)
+	_, err := store.UpsertUsers(ctx, []*notificationsv1alpha1.NotificationUser{{Id: "a"}, {Id: "b"}})
+	require.NoError(t, err)
+	// ids that weren't found aren't counted as deleted
+	_, err = store.DeleteUsers(ctx, []string{"a", "missing"})
+	require.NoError(t, err)
+	require.Equal(t, upserted+2, testutil.ToFloat64(metrics.UsersUpserted))
+	require.Equal(t, deleted+1, testutil.ToFloat64(metrics.UsersDeleted))
+}
+
+func TestNotifoRequestDurationLabels(t *testing.T) {
+	notifo := notifotest.NewServer()
+	previousConfig := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previousConfig })
+	config.AppConfig.NotifoApiKey = notifo.ApiKey
+	config.AppConfig.NotifoAppId = notifo.AppId
+	config.AppConfig.NotifoBaseUrl = notifo.URL
+	config.AppConfig.NotifoConcurrency = 10
+	store := notifo_store.NotifoNotificationStore{}
+	deferredFunc, err := store.Initialize()
+	require.NoError(t, err)
+	t.Cleanup(deferredFunc)
+	pingOk := map[string]string{"endpoint": "ping", "status": "200"}
+	pingError := map[string]string{"endpoint": "ping", "status": metrics.OutcomeError}
+	oks := histogramSampleCount(t, "notifications_notifo_request_duration_seconds", pingOk)
+	errs := histogramSampleCount(t, "notifications_notifo_request_duration_seconds", pingError)
+
+	require.NoError(t, store.Ping(context.Background()))
+	require.Equal(t, oks+1, histogramSampleCount(t, "notifications_notifo_request_duration_seconds", pingOk))
+	// requests that don't get a response are labelled error rather than with a status code
+	notifo.Close()
+	require.Error(t, store.Ping(context.Background()))
+	require.Equal(t, errs+1, histogramSampleCount(t, "notifications_notifo_request_duration_seconds", pingError))
+}
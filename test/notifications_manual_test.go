@@ -3,11 +3,12 @@ package test
 import (
 	"context"
 	"encoding/json"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
-	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/notification_store"
 	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
@@ -22,17 +23,26 @@ var NotificationsConn *grpc.ClientConn
 
 const oncePerSecondCron = "* * * * * * *"
 
-// these tests can be used to test notifo and the notifications api. Notifo requries setup that is difficult to replicate in CI, so I'm leaving these tests as local/manual tests for now.
+// NotificationsSuite tests scheduled notifications end to end against a running service, which stores them with the
+// scheduler in cockroachdb and sends them through notifo. It's skipped unless NOTIFICATIONS_ADDRESS is the address of
+// the service's grpc server, e.g. 127.0.0.1:6000. Everything that only needs notifo runs against the fake notifo in
+// notifications_test.go.
 type NotificationsSuite struct {
 	suite.Suite
 }
 
 func (s *NotificationsSuite) SetupSuite() {
-	initializeNotificationsClient(5 * time.Second)
+	address := os.Getenv("NOTIFICATIONS_ADDRESS")
+	if address == "" {
+		s.T().Skip("NOTIFICATIONS_ADDRESS isn't set")
+	}
+	initializeNotificationsClient(address, 5*time.Second)
 }
 
 func (s *NotificationsSuite) TearDownSuite() {
-	NotificationsConn.Close()
+	if NotificationsConn != nil {
+		NotificationsConn.Close()
+	}
 }
 
 func (s *NotificationsSuite) TearDownTest() {
@@ -45,101 +55,42 @@ func TestNotificationsSuite(t *testing.T) {
 	suite.Run(t, new(NotificationsSuite))
 }
 
-func (s *NotificationsSuite) TestUserCrud() {
+func (s *NotificationsSuite) TestScheduledExecuteOnceNotification() {
 	// upsert
 	numUsers := 1
 	users := generateUsers(numUsers)
 	req := &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: users}
-	resp, err := NotificationsClient.UpsertUsers(context.Background(), req)
-	require.NoError(s.T(), err)
-	require.Len(s.T(), resp.Users, numUsers)
-	// get
-	ids := []string{}
-	for _, user := range users {
-		ids = append(ids, user.Id)
-	}
-	getReq := &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: ids}
-	getResp, err := NotificationsClient.GetUsers(context.Background(), getReq)
+	_, err := NotificationsClient.UpsertUsers(context.Background(), req)
 	require.NoError(s.T(), err)
-	require.Len(s.T(), getResp.Users, numUsers)
 	testUser := users[0]
-	testUserTopic := internal.GetUserTopic(testUser.Id)
-	// send event
-	publishResponse, err := sendNotifications(testUser.Id, testUserTopic, `{"some": "stuff"}`, "test subject", "test body")
-	require.NoError(s.T(), err)
-	require.True(s.T(), publishResponse.Success)
-	// get notifications, need to sleep to give notifo time to process the notification, it has rabbit/mongo stuff
-	// to do and if we don't sleep, this call fails because no notifications are present.
-	time.Sleep(2 * time.Second)
-	getNotificationsResponse, err := getNotifications(testUser.Id, []string{"web"}, 10, 0)
-	require.NoError(s.T(), err)
-	require.Len(s.T(), getNotificationsResponse.Notifications, 1)
+	testUserTopic := notification_store.GetUserTopic(testUser.Id)
 	// schedule a notification for 5 seconds from now
-	trigger := &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: time.Now().Add(5 * time.Second).Format(time.RFC3339)}}
+	trigger := &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: time.Now().Add(5 * time.Second).UTC().Format(time.RFC3339)}}
 	scheduleNotificationResponse, err := scheduleNotification(trigger, nil, 1*time.Minute.Nanoseconds(), testUser.Id, testUserTopic, `{"scheduled": "data"}`, "test subject", "test body")
 	require.NoError(s.T(), err)
 	require.True(s.T(), scheduleNotificationResponse.Success)
-	// test simple scheduled notification list
+	// list all, by user id, and by id
 	listedScheduledNotificationsResponse, err := NotificationsClient.GetScheduledNotifications(context.Background(), &notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest{Skip: 0, Limit: 100})
 	require.NoError(s.T(), err)
 	require.Len(s.T(), listedScheduledNotificationsResponse.ScheduledNotifications, 1)
 	scheduledNotification := listedScheduledNotificationsResponse.ScheduledNotifications[0]
-	// test list by user id
 	listedScheduledNotificationsResponse, err = NotificationsClient.GetScheduledNotifications(context.Background(), &notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest{UserId: testUser.Id})
 	require.NoError(s.T(), err)
 	require.Len(s.T(), listedScheduledNotificationsResponse.ScheduledNotifications, 1)
-	// test list by id
 	listedScheduledNotificationsResponse, err = NotificationsClient.GetScheduledNotifications(context.Background(), &notificationsv1alpha1.NotificationsServiceGetScheduledNotificationsRequest{Ids: []string{scheduledNotification.Id}})
 	require.NoError(s.T(), err)
 	require.Len(s.T(), listedScheduledNotificationsResponse.ScheduledNotifications, 1)
 	// sleep for 2 seconds, get notifications, verify it's not there
 	time.Sleep(2 * time.Second)
 	// get notifications
-	getNotificationsResponse, err = getNotifications(testUser.Id, []string{"web"}, 10, 0)
-	require.NoError(s.T(), err)
-	// should still only be one because the user unsubscribed
-	require.Len(s.T(), getNotificationsResponse.Notifications, 1)
-	// sleep for 4 seconds, get notifications, verify it's there
-	time.Sleep(4 * time.Second)
-	getNotificationsResponse, err = getNotifications(testUser.Id, []string{"web"}, 10, 0)
-	require.NoError(s.T(), err)
-	require.Len(s.T(), getNotificationsResponse.Notifications, 2)
-	// delete
-	deleteReq := &notificationsv1alpha1.NotificationsServiceDeleteUsersRequest{Ids: ids}
-	deleteResp, err := NotificationsClient.DeleteUsers(context.Background(), deleteReq)
-	require.NoError(s.T(), err)
-	require.True(s.T(), deleteResp.Success)
-	// get to ensure delete
-	getResp, err = NotificationsClient.GetUsers(context.Background(), getReq)
-	require.NoError(s.T(), err)
-	require.Len(s.T(), getResp.Users, 0)
-}
-
-func (s *NotificationsSuite) TestScheduledExecuteOnceNotification() {
-	// upsert
-	numUsers := 1
-	users := generateUsers(numUsers)
-	req := &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: users}
-	_, err := NotificationsClient.UpsertUsers(context.Background(), req)
-	require.NoError(s.T(), err)
-	testUser := users[0]
-	testUserTopic := internal.GetUserTopic(testUser.Id)
-	// schedule a notification for 5 seconds from now
-	trigger := &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: time.Now().Add(5 * time.Second).UTC().Format(time.RFC3339)}}
-	scheduleNotificationResponse, err := scheduleNotification(trigger, nil, 1*time.Minute.Nanoseconds(), testUser.Id, testUserTopic, `{"scheduled": "data"}`, "test subject", "test body")
-	require.NoError(s.T(), err)
-	require.True(s.T(), scheduleNotificationResponse.Success)
-	// sleep for 2 seconds, get notifications, verify it's not there
-	time.Sleep(2 * time.Second)
-	// get notifications
 	getNotificationsResponse, err := getNotifications(testUser.Id, []string{"web"}, 10, 0)
 	require.NoError(s.T(), err)
 	require.Len(s.T(), getNotificationsResponse.Notifications, 0)
-	// sleep for 4 seconds, get notifications, verify it's there
-	time.Sleep(4 * time.Second)
-	getNotificationsResponse, err = getNotifications(testUser.Id, []string{"web"}, 10, 0)
-	require.NoError(s.T(), err)
-	require.Len(s.T(), getNotificationsResponse.Notifications, 1)
+	// wait for it to be delivered
+	require.Eventually(s.T(), func() bool {
+		getNotificationsResponse, err := getNotifications(testUser.Id, []string{"web"}, 10, 0)
+		return err == nil && len(getNotificationsResponse.Notifications) == 1
+	}, 10*time.Second, 250*time.Millisecond)
 	// sleep for 6 seconds, verify it wasn't redelivered
 	time.Sleep(6 * time.Second)
 	getNotificationsResponse, err = getNotifications(testUser.Id, []string{"web"}, 10, 0)
@@ -155,20 +106,25 @@ func (s *NotificationsSuite) TestScheduledCronNotification() {
 	_, err := NotificationsClient.UpsertUsers(context.Background(), req)
 	require.NoError(s.T(), err)
 	testUser := users[0]
-	testUserTopic := internal.GetUserTopic(testUser.Id)
+	testUserTopic := notification_store.GetUserTopic(testUser.Id)
 	// schedule a notification for once per second
+	scheduledAt := time.Now()
 	trigger := &notificationsv1alpha1.ScheduledNotification_CronTrigger{CronTrigger: &notificationsv1alpha1.CronTrigger{Expression: oncePerSecondCron}}
 	scheduleNotificationResponse, err := scheduleNotification(nil, trigger, 1*time.Minute.Nanoseconds(), testUser.Id, testUserTopic, `{"scheduled": "data"}`, gofakeit.HackeringVerb(), gofakeit.HackerPhrase())
 	require.NoError(s.T(), err)
 	require.True(s.T(), scheduleNotificationResponse.Success)
-	// sleep for 6 seconds, get notifications, verify it's executed at least 4 times, no more than 6 times. This is imprecise because
-	// notifo has to process things in it's internal event structure before the notifications appear and that's not always as exact as
-	// we'd want for testing.
-	time.Sleep(7 * time.Second)
-	getNotificationsResponse, err := getNotifications(testUser.Id, []string{"web"}, 10, 0)
-	require.NoError(s.T(), err)
-	require.GreaterOrEqual(s.T(), len(getNotificationsResponse.Notifications), 4)
-	require.LessOrEqual(s.T(), len(getNotificationsResponse.Notifications), 7)
+	// the scheduler fires on the wall clock and notifo delivers asynchronously, so the exact count isn't known. Wait for
+	// a few deliveries, and check that there weren't more than one per second since the cron was scheduled.
+	var delivered int
+	require.Eventually(s.T(), func() bool {
+		getNotificationsResponse, err := getNotifications(testUser.Id, []string{"web"}, 100, 0)
+		if err != nil {
+			return false
+		}
+		delivered = len(getNotificationsResponse.Notifications)
+		return delivered >= 4
+	}, 15*time.Second, 250*time.Millisecond)
+	require.LessOrEqual(s.T(), delivered, int(time.Since(scheduledAt)/time.Second)+1)
 }
 
 func generateUsers(num int) []*notificationsv1alpha1.NotificationUser {
@@ -187,11 +143,10 @@ func generateUser() *notificationsv1alpha1.NotificationUser {
 	}
 }
 
-func initializeNotificationsClient(timeout time.Duration) {
-	connectTo := "127.0.0.1:6000"
+func initializeNotificationsClient(address string, timeout time.Duration) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	conn, err := grpc.DialContext(ctx, connectTo, grpc.WithInsecure())
+	conn, err := grpc.DialContext(ctx, address, grpc.WithInsecure())
 	if err != nil {
 		panic(err)
 	}
@@ -218,17 +173,6 @@ func scheduleNotification(executeOnceTrigger *notificationsv1alpha1.ScheduledNot
 	return NotificationsClient.UpsertScheduledNotifications(context.Background(), req)
 }
 
-func sendNotifications(user_id, topic, data, subject, body string) (*notificationsv1alpha1.NotificationsServiceSendNotificationsResponse, error) {
-	event, err := buildNotificationEvent(topic, data, subject, body)
-	if err != nil {
-		return nil, err
-	}
-	publishReq := &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{
-		Notifications: []*notificationsv1alpha1.NotificationEvent{event},
-	}
-	return NotificationsClient.SendNotifications(context.Background(), publishReq)
-}
-
 func buildNotificationEvent(topic, data, subject, body string) (*notificationsv1alpha1.NotificationEvent, error) {
 	subjectMap := map[string]interface{}{"en": subject}
 	bodyMap := map[string]interface{}{"en": body}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store/notifotest"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// newNotifoBackedClient serves the notifications service over bufconn, backed by the notifo store and a fake notifo,
+// which delivers events before publishing returns
+func newNotifoBackedClient(t *testing.T) (notificationsv1alpha1.NotificationsServiceClient, *notifotest.Server) {
+	notifo := notifotest.NewServer()
+	t.Cleanup(notifo.Close)
+	previousConfig := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previousConfig })
+	config.AppConfig.NotifoApiKey = notifo.ApiKey
+	config.AppConfig.NotifoAppId = notifo.AppId
+	config.AppConfig.NotifoBaseUrl = notifo.URL
+	config.AppConfig.NotifoConcurrency = 10
+	store := notifo_store.NotifoNotificationStore{}
+	deferredFunc, err := store.Initialize()
+	require.NoError(t, err)
+	t.Cleanup(deferredFunc)
+	return newBufconnClient(t, store), notifo
+}
+
+func TestNotificationsUserCrud(t *testing.T) {
+	notificationsClient, _ := newNotifoBackedClient(t)
+	ctx := context.Background()
+	users := generateUsers(2)
+	ids := []string{users[0].Id, users[1].Id}
+	upsertResponse, err := notificationsClient.UpsertUsers(ctx, &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: users})
+	require.NoError(t, err)
+	require.Len(t, upsertResponse.Users, 2)
+	getResponse, err := notificationsClient.GetUsers(ctx, &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: ids})
+	require.NoError(t, err)
+	require.Len(t, getResponse.Users, 2)
+	require.Equal(t, users[0].EmailAddress, getResponse.Users[0].EmailAddress)
+
+	event, err := buildNotificationEvent(notification_store.GetUserTopic(users[0].Id), `{"some": "stuff"}`, "test subject", "test body")
+	require.NoError(t, err)
+	sendResponse, err := notificationsClient.SendNotifications(ctx, &notificationsv1alpha1.NotificationsServiceSendNotificationsRequest{Notifications: []*notificationsv1alpha1.NotificationEvent{event}})
+	require.NoError(t, err)
+	require.True(t, sendResponse.Success)
+	// the fake notifo delivers events before publishing returns, so there's no need to wait for them
+	for i, expected := range []int{1, 0} {
+		notificationsResponse, err := notificationsClient.GetNotifications(ctx, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: ids[i], Channels: []string{"web"}, Limit: 10})
+		require.NoError(t, err)
+		require.Len(t, notificationsResponse.Notifications, expected)
+	}
+
+	// the DeleteUsers rpc also deletes the users' schedules, which needs the scheduler and its database, so the users
+	// are deleted through the store
+	deleteResult, err := notification_store.NotificationStore.DeleteUsers(ctx, ids)
+	require.NoError(t, err)
+	require.Empty(t, deleteResult.NotFound)
+	require.Empty(t, deleteResult.Failed)
+	getResponse, err = notificationsClient.GetUsers(ctx, &notificationsv1alpha1.NotificationsServiceGetUsersRequest{Ids: ids})
+	require.NoError(t, err)
+	require.Empty(t, getResponse.Users)
+}
+
+// TestScheduledExecuteOnceNotificationSends fires an execute once scheduled notification the way the scheduler does
+// when its time comes, and checks that it's delivered once, correlated with the scheduled notification
+func TestScheduledExecuteOnceNotificationSends(t *testing.T) {
+	notificationsClient, notifo := newNotifoBackedClient(t)
+	ctx := context.Background()
+	user := generateUser()
+	_, err := notificationsClient.UpsertUsers(ctx, &notificationsv1alpha1.NotificationsServiceUpsertUsersRequest{Users: []*notificationsv1alpha1.NotificationUser{user}})
+	require.NoError(t, err)
+	event, err := buildNotificationEvent(notification_store.GetUserTopic(user.Id), `{"scheduled": "data"}`, "test subject", "test body")
+	require.NoError(t, err)
+	fireAt := time.Now().UTC().Truncate(time.Second)
+	scheduledNotification := &notificationsv1alpha1.ScheduledNotification{
+		UserId:       user.Id,
+		Notification: event,
+		ExpireAfter:  time.Minute.Nanoseconds(),
+		Trigger:      &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: fireAt.Format(time.RFC3339)}},
+	}
+	id := uuid.New()
+	require.NoError(t, internal.HandleScheduledNotification(pkg.TaskInstance{
+		ExecuteAt: &fireAt,
+		TaskDefinition: pkg.TaskDefinition{
+			Id:                 &id,
+			Metadata:           taskMetadata(t, scheduledNotification),
+			ExecuteOnceTrigger: pkg.NewExecuteOnceTrigger(fireAt),
+		},
+	}))
+
+	inbox := notifo.Inbox(user.Id)
+	require.Len(t, inbox, 1)
+	require.Equal(t, id.String(), inbox[0].CorrelationId)
+	require.Equal(t, "test subject", inbox[0].Subject)
+	notificationsResponse, err := notificationsClient.GetNotifications(ctx, &notificationsv1alpha1.NotificationsServiceGetNotificationsRequest{UserId: user.Id, Channels: []string{"web"}, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, notificationsResponse.Notifications, 1)
+}
+
+// taskMetadata returns a scheduled notification as it's stored in task definition metadata
+func taskMetadata(t *testing.T, scheduledNotification *notificationsv1alpha1.ScheduledNotification) map[string]interface{} {
+	marshalled, err := protojson.Marshal(scheduledNotification)
+	require.NoError(t, err)
+	metadata := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(marshalled, &metadata))
+	return metadata
+}
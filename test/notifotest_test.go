@@ -0,0 +1,88 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store/notifotest"
+	"github.com/stretchr/testify/require"
+)
+
+// notifoRequest calls the fake notifo's api for its app, and decodes the response into result when it's set
+func notifoRequest(t *testing.T, notifo *notifotest.Server, method, path string, body, result interface{}) int {
+	var requestBody bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&requestBody).Encode(body))
+	}
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/api/apps/%s%s", notifo.URL, notifo.AppId, path), &requestBody)
+	require.NoError(t, err)
+	request.Header.Set("X-ApiKey", notifo.ApiKey)
+	response, err := notifo.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	if result != nil && response.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(response.Body).Decode(result))
+	}
+	return response.StatusCode
+}
+
+type notifoNotifications struct {
+	Items []notifotest.Notification `json:"items"`
+	Total int                       `json:"total"`
+}
+
+func TestFakeNotifoDeliversEvents(t *testing.T) {
+	notifo := notifotest.NewServer()
+	defer notifo.Close()
+	users := map[string]interface{}{"requests": []map[string]string{{"id": "a"}, {"id": "b"}}}
+	require.Equal(t, http.StatusOK, notifoRequest(t, notifo, http.MethodPost, "/users", users, nil))
+	subscriptions := map[string]interface{}{"subscribe": []map[string]string{{"topicPrefix": "news"}}}
+	require.Equal(t, http.StatusNoContent, notifoRequest(t, notifo, http.MethodPost, "/users/b/subscriptions", subscriptions, nil))
+	events := map[string]interface{}{"requests": []map[string]interface{}{
+		{"topic": "users/a", "correlationId": "first", "preformatted": map[string]interface{}{"subject": map[string]string{"en": "hello"}}},
+		{"topic": "users/a", "correlationId": "second"},
+		{"topic": "news/today"},
+		{"topic": "users/unknown"},
+	}}
+	require.Equal(t, http.StatusNoContent, notifoRequest(t, notifo, http.MethodPost, "/events", events, nil))
+	// delivered before the publish returns, most recent first
+	inbox := notifoNotifications{}
+	require.Equal(t, http.StatusOK, notifoRequest(t, notifo, http.MethodGet, "/users/a/notifications?take=1&skip=1", nil, &inbox))
+	require.Equal(t, 2, inbox.Total)
+	require.Len(t, inbox.Items, 1)
+	require.Equal(t, "hello", inbox.Items[0].Subject)
+	inbox = notifoNotifications{}
+	require.Equal(t, http.StatusOK, notifoRequest(t, notifo, http.MethodGet, "/users/a/notifications?correlationId=second", nil, &inbox))
+	require.Equal(t, 1, inbox.Total)
+	require.Len(t, notifo.Inbox("b"), 1)
+	require.Equal(t, http.StatusNoContent, notifoRequest(t, notifo, http.MethodDelete, "/users/a", nil, nil))
+	require.Equal(t, http.StatusNotFound, notifoRequest(t, notifo, http.MethodGet, "/users/a", nil, nil))
+	require.Equal(t, http.StatusNotFound, notifoRequest(t, notifo, http.MethodDelete, "/users/a", nil, nil))
+}
+
+func TestFakeNotifoInjectsFaults(t *testing.T) {
+	notifo := notifotest.NewServer()
+	defer notifo.Close()
+	notifo.Inject(notifotest.EndpointGetUsers, notifotest.Fault{Status: http.StatusServiceUnavailable, Times: 2})
+	notifo.Inject(notifotest.EndpointGetUsers, notifotest.Fault{Latency: 50 * time.Millisecond})
+	require.Equal(t, http.StatusServiceUnavailable, notifoRequest(t, notifo, http.MethodGet, "/users", nil, nil))
+	require.Equal(t, http.StatusServiceUnavailable, notifoRequest(t, notifo, http.MethodGet, "/users", nil, nil))
+	startedAt := time.Now()
+	require.Equal(t, http.StatusOK, notifoRequest(t, notifo, http.MethodGet, "/users", nil, nil))
+	require.GreaterOrEqual(t, time.Since(startedAt), 50*time.Millisecond)
+	// a request that times out while delayed fails on the client
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/apps/%s/users", notifo.URL, notifo.AppId), nil)
+	require.NoError(t, err)
+	request.Header.Set("X-ApiKey", notifo.ApiKey)
+	_, err = notifo.Client().Do(request)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	notifo.ClearFaults()
+	require.Equal(t, http.StatusOK, notifoRequest(t, notifo, http.MethodGet, "/users", nil, nil))
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	"github.com/google/uuid"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterRelativeScheduleValidates(t *testing.T) {
+	testCases := []struct {
+		name        string
+		userId      string
+		anchorEvent string
+		delay       time.Duration
+		expireAfter time.Duration
+	}{
+		{"no user id", "", "signup", time.Hour, 0},
+		{"no anchor event", "user", "", time.Hour, 0},
+		{"negative delay", "user", "signup", -time.Hour, 0},
+		{"negative expire after", "user", "signup", time.Hour, -time.Minute},
+		{"no notification", "user", "signup", time.Hour, time.Minute},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			capture := newDryRunDatabase(t)
+			_, err := internal.RegisterRelativeSchedule(testCase.userId, testCase.anchorEvent, "onboarded", testCase.delay, testCase.expireAfter, nil)
+			require.Error(t, err)
+			require.Empty(t, capture.captured())
+		})
+	}
+}
+
+// TestScheduleEventOnlyCancelsUnfiredSchedules checks the relative schedules an event looks up. The dry run database
+// finds none, so nothing is scheduled or cancelled.
+func TestScheduleEventOnlyCancelsUnfiredSchedules(t *testing.T) {
+	now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	defer clock.Set(clock.NewFake(now))()
+	capture := newDryRunDatabase(t)
+	scheduled, cancelled, err := internal.HandleScheduleEvent("user", "onboarded")
+	require.NoError(t, err)
+	require.Empty(t, scheduled)
+	require.Empty(t, cancelled)
+
+	statements := capture.captured()
+	require.Len(t, statements, 2)
+	require.Contains(t, statements[0].sql, "user_id = $1 AND anchor_event = $2 AND fire_at IS NULL")
+	require.Equal(t, []interface{}{"user", "onboarded"}, statements[0].vars)
+	// schedules that haven't been anchored, or have already fired, aren't cancelled
+	require.Contains(t, statements[1].sql, "user_id = $1 AND cancel_event = $2 AND fire_at > $3")
+	require.Equal(t, []interface{}{"user", "onboarded", now}, statements[1].vars)
+
+	_, _, err = internal.HandleScheduleEvent("user", "")
+	require.Error(t, err)
+}
+
+func TestDeleteRelativeScheduleHasNoContent(t *testing.T) {
+	capture := newDryRunDatabase(t)
+	scheduler := newFakeScheduler(t)
+	id := uuid.New()
+	require.NoError(t, scheduler.UpsertTaskDefinition(pkg.TaskDefinition{Id: &id, ExecuteOnceTrigger: pkg.NewExecuteOnceTrigger(time.Now())}))
+	mux := runtime.NewServeMux()
+	require.NoError(t, internal.RegisterHttpHandlers(mux))
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v1alpha1/relative-schedules/"+id.String(), nil))
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+	require.Empty(t, recorder.Body.String())
+	require.Empty(t, recorder.Header().Get("Content-Type"))
+	// the scheduled notification is deleted with the relative schedule
+	require.Empty(t, scheduler.ids())
+	// followed by the audit entry
+	statements := capture.captured()
+	require.Len(t, statements, 2)
+	require.Contains(t, statements[0].sql, `DELETE FROM "relative_schedules" WHERE id = $1`)
+	require.Equal(t, []interface{}{id}, statements[0].vars)
+}
+
+func TestPurgeFiredRelativeSchedules(t *testing.T) {
+	now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	defer clock.Set(clock.NewFake(now))()
+	capture := newDryRunDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// purges once before waiting for the context
+	internal.PurgeFiredRelativeSchedules(ctx)
+	statements := capture.captured()
+	require.Len(t, statements, 1)
+	require.Contains(t, statements[0].sql, `DELETE FROM "relative_schedules" WHERE fire_at <= $1`)
+	require.Equal(t, []interface{}{now}, statements[0].vars)
+}
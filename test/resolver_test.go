@@ -0,0 +1,163 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const resolverTestSecret = "resolver-secret"
+
+// resolverRequest is a request received by the fake resolver
+type resolverRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// fakeResolver answers each call with the next of its responses, repeating the last one
+type fakeResolver struct {
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter)
+	requests  []resolverRequest
+}
+
+func (f *fakeResolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, resolverRequest{header: r.Header.Clone(), body: body})
+	respond := f.responses[len(f.responses)-1]
+	if len(f.requests) <= len(f.responses) {
+		respond = f.responses[len(f.requests)-1]
+	}
+	f.mu.Unlock()
+	respond(w)
+}
+
+func (f *fakeResolver) received() []resolverRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]resolverRequest{}, f.requests...)
+}
+
+func resolverFails(w http.ResponseWriter) {
+	http.Error(w, "unavailable", http.StatusServiceUnavailable)
+}
+
+func resolverResolves(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"data": {"balance": 42}, "subject": {"en": "Your balance"}}`))
+}
+
+// resolveScheduledNotification fires an execute once scheduled notification with the resolver, the way the scheduler
+// does, and returns the error and the events published
+func resolveScheduledNotification(t *testing.T, fallback string, responses ...func(w http.ResponseWriter)) (*fakeResolver, uuid.UUID, error, []*notificationsv1alpha1.NotificationEvent) {
+	previousConfig := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previousConfig })
+	config.AppConfig.ResolverFallback = fallback
+	config.AppConfig.ResolverMaxRetries = 1
+	config.AppConfig.ResolverTimeout = 5 * time.Second
+	config.AppConfig.ResolverSecret = resolverTestSecret
+	resolver := &fakeResolver{responses: responses}
+	server := httptest.NewServer(resolver)
+	t.Cleanup(server.Close)
+	store := &publishCountingStore{NotificationStoreInterface: newMemoryStore()}
+	previousStore := notification_store.NotificationStore
+	notification_store.NotificationStore = store
+	t.Cleanup(func() { notification_store.NotificationStore = previousStore })
+
+	fireAt := time.Now().UTC().Truncate(time.Second)
+	scheduledNotification := &notificationsv1alpha1.ScheduledNotification{
+		UserId:       "user",
+		Notification: &notificationsv1alpha1.NotificationEvent{Data: `{"name": "ada"}`},
+		Trigger:      &notificationsv1alpha1.ScheduledNotification_ExecuteOnceTrigger{ExecuteOnceTrigger: &notificationsv1alpha1.ExecuteOnceTrigger{FireAt: fireAt.Format(time.RFC3339)}},
+	}
+	metadata := taskMetadata(t, scheduledNotification)
+	metadata["resolver_url"] = server.URL
+	id := uuid.New()
+	err := internal.HandleScheduledNotification(pkg.TaskInstance{
+		ExecuteAt:      &fireAt,
+		TaskDefinition: pkg.TaskDefinition{Id: &id, Metadata: metadata, ExecuteOnceTrigger: pkg.NewExecuteOnceTrigger(fireAt)},
+	})
+	return resolver, id, err, store.publishedEvents()
+}
+
+func TestResolverMergesResolvedData(t *testing.T) {
+	resolver, id, err, published := resolveScheduledNotification(t, internal.ResolverFallbackStale, resolverResolves)
+	require.NoError(t, err)
+	require.Len(t, published, 1)
+	require.JSONEq(t, `{"name": "ada", "balance": 42}`, published[0].Data)
+	require.Equal(t, "Your balance", published[0].Preformatted.Subject.Fields["en"].GetStringValue())
+
+	requests := resolver.received()
+	require.Len(t, requests, 1)
+	body := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(requests[0].body, &body))
+	require.Equal(t, id.String(), body["task_definition_id"])
+	require.Equal(t, "user", body["user_id"])
+	// the signature is the hmac of the timestamp and the body
+	timestamp := requests[0].header.Get("X-Notifications-Timestamp")
+	require.NotEmpty(t, timestamp)
+	mac := hmac.New(sha256.New, []byte(resolverTestSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(requests[0].body)
+	require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), requests[0].header.Get("X-Notifications-Signature"))
+}
+
+func TestResolverNoContentSendsScheduledData(t *testing.T) {
+	_, _, err, published := resolveScheduledNotification(t, internal.ResolverFallbackSkip, func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	require.NoError(t, err)
+	require.Len(t, published, 1)
+	require.JSONEq(t, `{"name": "ada"}`, published[0].Data)
+}
+
+func TestResolverFallbacks(t *testing.T) {
+	testCases := []struct {
+		name      string
+		fallback  string
+		responses []func(w http.ResponseWriter)
+		calls     int
+		fails     bool
+		published string
+	}{
+		{"stale sends the scheduled data", internal.ResolverFallbackStale, []func(w http.ResponseWriter){resolverFails}, 1, false, `{"name": "ada"}`},
+		{"skip doesn't send", internal.ResolverFallbackSkip, []func(w http.ResponseWriter){resolverFails}, 1, false, ""},
+		{"retry sends once the resolver recovers", internal.ResolverFallbackRetry, []func(w http.ResponseWriter){resolverFails, resolverResolves}, 2, false, `{"name": "ada", "balance": 42}`},
+		{"retry fails when the resolver doesn't recover", internal.ResolverFallbackRetry, []func(w http.ResponseWriter){resolverFails}, 2, true, ""},
+		// a response that can't be read is handled like the resolver failing
+		{"stale when the response can't be read", internal.ResolverFallbackStale, []func(w http.ResponseWriter){func(w http.ResponseWriter) { w.Write([]byte(`{"data": "not an object"}`)) }}, 1, false, `{"name": "ada"}`},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resolver, _, err, published := resolveScheduledNotification(t, testCase.fallback, testCase.responses...)
+			if testCase.fails {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Len(t, resolver.received(), testCase.calls)
+			if testCase.published == "" {
+				require.Empty(t, published)
+			} else {
+				require.Len(t, published, 1)
+				require.JSONEq(t, testCase.published, published[0].Data)
+			}
+		})
+	}
+}
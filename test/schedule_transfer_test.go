@@ -0,0 +1,154 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-scheduler/pkg"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	transferTestExistingId = "6f1c2a9e-4b3d-4e8a-9c7f-2d5e8a1b3c40"
+	transferTestNewId      = "a3e5c7d9-1b2f-4a6c-8e0d-5f7b9d1c3e20"
+)
+
+// cronScheduleLine returns an exported line holding a cron scheduled notification, settings is the json of its settings
+func cronScheduleLine(id, settings string) string {
+	return fmt.Sprintf(`{"scheduledNotification": {"id": %q, "userId": "user", "notification": {"data": "{}"}, "cronTrigger": {"expression": "0 9 * * *"}}, "settings": %s}`, id, settings)
+}
+
+// newTransferTestScheduler returns a fake scheduler holding one scheduled notification, with the existing id
+func newTransferTestScheduler(t *testing.T) *fakeScheduler {
+	scheduler := newFakeScheduler(t)
+	id := uuid.MustParse(transferTestExistingId)
+	cronTrigger, err := pkg.NewCronTrigger("0 9 * * *")
+	require.NoError(t, err)
+	require.NoError(t, scheduler.UpsertTaskDefinition(pkg.TaskDefinition{Id: &id, CronTrigger: cronTrigger}))
+	return scheduler
+}
+
+func importSchedules(input string, options internal.ImportOptions) (*internal.ImportResult, error) {
+	return internal.ImportScheduledNotifications(strings.NewReader(input), options)
+}
+
+func TestImportSchedulesConflicts(t *testing.T) {
+	input := cronScheduleLine(transferTestNewId, "{}") + "\n" + cronScheduleLine(transferTestExistingId, "{}") + "\n"
+	testCases := []struct {
+		onConflict string
+		expected   internal.ImportResult
+	}{
+		{internal.ConflictStrategySkip, internal.ImportResult{Created: 1, Skipped: 1, IdMap: map[string]string{}}},
+		{internal.ConflictStrategyOverwrite, internal.ImportResult{Created: 1, Updated: 1, IdMap: map[string]string{}}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.onConflict, func(t *testing.T) {
+			scheduler := newTransferTestScheduler(t)
+			result, err := importSchedules(input, internal.ImportOptions{OnConflict: testCase.onConflict})
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, *result)
+			require.Equal(t, []string{transferTestExistingId, transferTestNewId}, scheduler.ids())
+		})
+	}
+
+	t.Run(internal.ConflictStrategyFail, func(t *testing.T) {
+		scheduler := newTransferTestScheduler(t)
+		_, err := importSchedules(input, internal.ImportOptions{OnConflict: internal.ConflictStrategyFail})
+		require.ErrorContains(t, err, transferTestExistingId)
+		// conflicts are found before anything is saved
+		require.Equal(t, []string{transferTestExistingId}, scheduler.ids())
+	})
+
+	t.Run("repeated id", func(t *testing.T) {
+		scheduler := newTransferTestScheduler(t)
+		repeated := cronScheduleLine(transferTestNewId, "{}") + "\n" + cronScheduleLine(transferTestNewId, "{}") + "\n"
+		_, err := importSchedules(repeated, internal.ImportOptions{OnConflict: internal.ConflictStrategyFail})
+		require.ErrorContains(t, err, "lines 1 and 2")
+		require.Equal(t, []string{transferTestExistingId}, scheduler.ids())
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		scheduler := newTransferTestScheduler(t)
+		result, err := importSchedules(input, internal.ImportOptions{OnConflict: internal.ConflictStrategyOverwrite, DryRun: true})
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Created)
+		require.Equal(t, 1, result.Updated)
+		require.Equal(t, []string{transferTestExistingId}, scheduler.ids())
+	})
+}
+
+func TestImportSchedulesRemapsIds(t *testing.T) {
+	scheduler := newTransferTestScheduler(t)
+	// the blank line still counts, lines without an id are keyed by their line number in the input
+	input := cronScheduleLine(transferTestExistingId, "{}") + "\n\n" + cronScheduleLine("", "{}") + "\n" + cronScheduleLine("", "{}") + "\n"
+	result, err := importSchedules(input, internal.ImportOptions{RemapIds: true})
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Created)
+	require.Len(t, result.IdMap, 3)
+	saved := []string{transferTestExistingId}
+	for _, key := range []string{transferTestExistingId, "line:3", "line:4"} {
+		require.Contains(t, result.IdMap, key)
+		require.NotEqual(t, transferTestExistingId, result.IdMap[key])
+		saved = append(saved, result.IdMap[key])
+	}
+	require.ElementsMatch(t, saved, scheduler.ids())
+
+	// lines without an id get one even when ids aren't remapped
+	result, err = importSchedules(cronScheduleLine("", "{}")+"\n", internal.ImportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Created)
+	require.Contains(t, result.IdMap, "line:1")
+}
+
+func TestExportImportSchedulesKeepsSettings(t *testing.T) {
+	newFakeScheduler(t)
+	settings := `{"resolverUrl": "https://resolver.example.com", "calendar": {"calendar": "us", "tenant": "acme", "policy": "shift"}, "jitterWindow": "10m0s"}`
+	_, err := importSchedules(cronScheduleLine(transferTestNewId, settings)+"\n", internal.ImportOptions{})
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	exported, err := internal.ExportScheduledNotifications(out, internal.ExportFilter{Ids: []string{transferTestNewId}})
+	require.NoError(t, err)
+	require.Equal(t, 1, exported)
+	line := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	require.JSONEq(t, settings, string(line["settings"]))
+
+	// the export imports back into an empty scheduler with the same settings
+	newFakeScheduler(t)
+	_, err = internal.ImportScheduledNotifications(bytes.NewReader(out.Bytes()), internal.ImportOptions{})
+	require.NoError(t, err)
+	reexported := &bytes.Buffer{}
+	_, err = internal.ExportScheduledNotifications(reexported, internal.ExportFilter{Ids: []string{transferTestNewId}})
+	require.NoError(t, err)
+	require.JSONEq(t, out.String(), reexported.String())
+}
+
+func TestImportSchedulesValidatesSettings(t *testing.T) {
+	executeOnce := fmt.Sprintf(`{"scheduledNotification": {"id": %q, "userId": "user", "notification": {"data": "{}"}, "executeOnceTrigger": {"fireAt": "2026-12-24T09:00:00Z"}}, "settings": {"jitterWindow": "1m"}}`, transferTestNewId)
+	testCases := []struct {
+		name string
+		line string
+	}{
+		{"not an export line", fmt.Sprintf(`{"id": %q, "userId": "user", "cronTrigger": {"expression": "0 9 * * *"}}`, transferTestNewId)},
+		{"invalid resolver url", cronScheduleLine(transferTestNewId, `{"resolverUrl": "not a url"}`)},
+		{"invalid jitter window", cronScheduleLine(transferTestNewId, `{"jitterWindow": "soon"}`)},
+		{"jitter window too long", cronScheduleLine(transferTestNewId, `{"jitterWindow": "2h"}`)},
+		{"jitter window on an execute once notification", executeOnce},
+		{"invalid calendar policy", cronScheduleLine(transferTestNewId, `{"calendar": {"calendar": "us", "policy": "later"}}`)},
+		{"calendar without a name", cronScheduleLine(transferTestNewId, `{"calendar": {"policy": "skip"}}`)},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			scheduler := newFakeScheduler(t)
+			_, err := importSchedules(cronScheduleLine("", "{}")+"\n"+testCase.line+"\n", internal.ImportOptions{})
+			require.ErrorContains(t, err, "line 2")
+			require.Empty(t, scheduler.ids())
+		})
+	}
+}
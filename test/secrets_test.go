@@ -0,0 +1,42 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSecretReloadsWhenFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifo-api-key")
+	require.NoError(t, os.WriteFile(path, []byte("old-key\n"), 0600))
+	secret, err := secrets.NewFileSecret(path)
+	require.NoError(t, err)
+	require.Equal(t, "old-key", secret.Value())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go secret.Watch(ctx)
+	// replace the file the way kubernetes does, rather than writing to it. Changes made before the watcher starts
+	// aren't seen, so the file is replaced until the new key is
+	replacement := path + ".new"
+	require.Eventually(t, func() bool {
+		if secret.Value() == "new-key" {
+			return true
+		}
+		if err := os.WriteFile(replacement, []byte("new-key\n"), 0600); err == nil {
+			os.Rename(replacement, path)
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestFileSecretRejectsEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty")
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+	_, err := secrets.NewFileSecret(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,249 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/config"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store"
+	"github.com/catalystsquad/go-notifications/notification_store/notifo_store/notifotest"
+	"github.com/catalystsquad/go-notifications/notification_store/storetest"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNotifoStoreConformance runs the conformance suite against the notifo store, on its own and wrapped in the default
+// middlewares. It's the fake notifo unless NOTIFO_API_KEY and NOTIFO_APP_ID are set, then it's the notifo at
+// NOTIFO_BASE_URL.
+func TestNotifoStoreConformance(t *testing.T) {
+	previousConfig := config.AppConfig
+	defer func() { config.AppConfig = previousConfig }()
+	config.AppConfig.NotifoApiKey = os.Getenv("NOTIFO_API_KEY")
+	config.AppConfig.NotifoAppId = os.Getenv("NOTIFO_APP_ID")
+	config.AppConfig.NotifoBaseUrl = os.Getenv("NOTIFO_BASE_URL")
+	// the fake delivers events before publishing returns
+	deliveryTimeout := time.Duration(0)
+	if config.AppConfig.NotifoApiKey == "" || config.AppConfig.NotifoAppId == "" {
+		notifo := notifotest.NewServer()
+		defer notifo.Close()
+		config.AppConfig.NotifoApiKey = notifo.ApiKey
+		config.AppConfig.NotifoAppId = notifo.AppId
+		config.AppConfig.NotifoBaseUrl = notifo.URL
+	} else {
+		deliveryTimeout = 10 * time.Second
+		if config.AppConfig.NotifoBaseUrl == "" {
+			config.AppConfig.NotifoBaseUrl = "http://localhost:5000"
+		}
+	}
+	config.AppConfig.NotifoConcurrency = 10
+	config.AppConfig.UserCacheTtl = time.Minute
+	config.AppConfig.UserCacheNegativeTtl = time.Minute
+	config.AppConfig.UserCacheMaxSize = 100
+	tests := []struct {
+		name        string
+		middlewares []string
+	}{
+		{"bare", nil},
+		{"middlewares", []string{notification_store.MiddlewareCache, notification_store.MiddlewareInstrumented}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storetest.Run(t, storetest.Options{
+				NewStore: func(t *testing.T) notification_store.NotificationStoreInterface {
+					store, err := notification_store.Chain(notifo_store.NotifoNotificationStore{}, test.middlewares)
+					require.NoError(t, err)
+					deferredFunc, err := store.Initialize()
+					require.NoError(t, err)
+					t.Cleanup(deferredFunc)
+					return store
+				},
+				DeliveryTimeout: deliveryTimeout,
+			})
+		})
+	}
+}
+
+// TestStoreMiddlewaresConformance runs the conformance suite against the default middlewares and the retry middleware,
+// wrapping the in memory store
+func TestStoreMiddlewaresConformance(t *testing.T) {
+	previousConfig := config.AppConfig
+	defer func() { config.AppConfig = previousConfig }()
+	config.AppConfig.UserCacheTtl = time.Minute
+	config.AppConfig.UserCacheNegativeTtl = time.Minute
+	config.AppConfig.UserCacheMaxSize = 100
+	config.AppConfig.StoreRetryAttempts = 3
+	config.AppConfig.StoreRetryBackoff = time.Millisecond
+	storetest.Run(t, storetest.Options{
+		NewStore: func(t *testing.T) notification_store.NotificationStoreInterface {
+			store, err := notification_store.Chain(newMemoryStore(), []string{notification_store.MiddlewareCache, notification_store.MiddlewareInstrumented, notification_store.MiddlewareRetry})
+			require.NoError(t, err)
+			return store
+		},
+	})
+}
+
+// memoryStore is a notification store that delivers events synchronously to inboxes in memory. Events on a user's
+// topic are delivered to the user, other events to the users subscribed to a prefix of their topic.
+type memoryStore struct {
+	mu            sync.Mutex
+	users         map[string]*notificationsv1alpha1.NotificationUser
+	userIds       []string
+	subscriptions map[string]map[string]bool
+	inboxes       map[string][]memoryNotification
+	nextId        int
+}
+
+type memoryNotification struct {
+	notification  *notificationsv1alpha1.Notification
+	correlationId string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:         map[string]*notificationsv1alpha1.NotificationUser{},
+		subscriptions: map[string]map[string]bool{},
+		inboxes:       map[string][]memoryNotification{},
+	}
+}
+
+func (m *memoryStore) Initialize() (deferredFunc func(), err error) {
+	return func() {}, nil
+}
+
+func (m *memoryStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upserted := []*notificationsv1alpha1.NotificationUser{}
+	for _, user := range users {
+		if _, ok := m.users[user.Id]; !ok {
+			m.userIds = append(m.userIds, user.Id)
+		}
+		stored := &notificationsv1alpha1.NotificationUser{Id: user.Id, EmailAddress: user.EmailAddress}
+		m.users[user.Id] = stored
+		upserted = append(upserted, stored)
+	}
+	return upserted, nil
+}
+
+func (m *memoryStore) GetUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := &notification_store.UsersResult{}
+	for _, id := range ids {
+		if user, ok := m.users[id]; ok {
+			result.Users = append(result.Users, user)
+		} else {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryStore) ListUsers(ctx context.Context, skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []*notificationsv1alpha1.NotificationUser{}
+	for i := int(skip); i < len(m.userIds) && len(users) < int(limit); i++ {
+		users = append(users, m.users[m.userIds[i]])
+	}
+	return users, nil
+}
+
+func (m *memoryStore) DeleteUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := &notification_store.UsersResult{}
+	for _, id := range ids {
+		if _, ok := m.users[id]; !ok {
+			result.NotFound = append(result.NotFound, id)
+			continue
+		}
+		delete(m.users, id)
+		delete(m.subscriptions, id)
+		delete(m.inboxes, id)
+		for i, userId := range m.userIds {
+			if userId == id {
+				m.userIds = append(m.userIds[:i], m.userIds[i+1:]...)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryStore) GetNotifications(ctx context.Context, channels []string, userId, query string, limit, skip int32, correlationId *string) ([]*notificationsv1alpha1.Notification, int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	matching := []*notificationsv1alpha1.Notification{}
+	for _, notification := range m.inboxes[userId] {
+		if correlationId == nil || notification.correlationId == *correlationId {
+			matching = append(matching, notification.notification)
+		}
+	}
+	page := []*notificationsv1alpha1.Notification{}
+	for i := int(skip); i < len(matching) && len(page) < int(limit); i++ {
+		page = append(page, matching[i])
+	}
+	return page, int32(len(matching)), nil
+}
+
+func (m *memoryStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, event := range events {
+		for _, userId := range m.recipients(event.Topic) {
+			m.nextId++
+			notification := memoryNotification{notification: &notificationsv1alpha1.Notification{Id: fmt.Sprintf("notification-%d", m.nextId)}}
+			if event.CorrelationId != nil {
+				notification.correlationId = *event.CorrelationId
+			}
+			m.inboxes[userId] = append(m.inboxes[userId], notification)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) recipients(topic string) []string {
+	userId, ok := strings.CutPrefix(topic, "users/")
+	if ok {
+		if _, exists := m.users[userId]; exists {
+			return []string{userId}
+		}
+		return nil
+	}
+	recipients := []string{}
+	for userId, prefixes := range m.subscriptions {
+		for prefix := range prefixes {
+			if strings.HasPrefix(topic, prefix) {
+				recipients = append(recipients, userId)
+				break
+			}
+		}
+	}
+	return recipients
+}
+
+func (m *memoryStore) UpdateSubscriptions(ctx context.Context, userId string, subscriptions []*notificationsv1alpha1.SubscriptionSettings, unsubscribe []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscriptions[userId] == nil {
+		m.subscriptions[userId] = map[string]bool{}
+	}
+	for _, subscription := range subscriptions {
+		m.subscriptions[userId][subscription.TopicPrefix] = true
+	}
+	for _, prefix := range unsubscribe {
+		delete(m.subscriptions[userId], prefix)
+	}
+	return nil
+}
+
+func (m *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/require"
+)
+
+// topicRecordingStore records the topics of published events
+type topicRecordingStore struct {
+	notification_store.NotificationStoreInterface
+	topics []string
+}
+
+func (s *topicRecordingStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	for _, event := range events {
+		s.topics = append(s.topics, event.Topic)
+	}
+	return nil
+}
+
+func newFaultInjectingStore(t *testing.T, store notification_store.NotificationStoreInterface, rules ...notification_store.FaultRule) notification_store.NotificationStoreInterface {
+	faults := &notification_store.FaultInjector{}
+	require.NoError(t, faults.SetRules(rules))
+	return notification_store.FaultInjectingNotificationStore{Store: store, Faults: faults}
+}
+
+func TestFaultRulesValidation(t *testing.T) {
+	faults := &notification_store.FaultInjector{}
+	err := faults.SetRules([]notification_store.FaultRule{{Fault: notification_store.FaultError, Probability: 1}})
+	require.ErrorContains(t, err, "or be unscoped")
+	err = faults.SetRules([]notification_store.FaultRule{{Fault: notification_store.FaultLatency, Probability: 1, Unscoped: true}})
+	require.ErrorContains(t, err, "must have a latency")
+	err = faults.SetRules([]notification_store.FaultRule{{Fault: notification_store.FaultPartial, Methods: []string{"ListUsers"}, Probability: 1, Unscoped: true}})
+	require.ErrorContains(t, err, "can't be injected into ListUsers")
+	err = faults.SetRules([]notification_store.FaultRule{{Fault: notification_store.FaultError, Probability: 1.5, UserIds: []string{"a"}}})
+	require.ErrorContains(t, err, "probability")
+	require.Empty(t, faults.Rules())
+}
+
+func TestErrorFaultsOnlyApplyToScopedUsers(t *testing.T) {
+	ctx := context.Background()
+	store := newFaultInjectingStore(t, newCountingUserStore("a", "b"), notification_store.FaultRule{
+		Methods:     []string{"GetUsers"},
+		Fault:       notification_store.FaultError,
+		Probability: 1,
+		UserIds:     []string{"a"},
+	})
+	_, err := store.GetUsers(ctx, []string{"b", "a"})
+	require.True(t, errorx.IsOfType(err, notification_store.InjectedFault))
+	result, err := store.GetUsers(ctx, []string{"b"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, userIds(result.Users))
+	// the rule is scoped to GetUsers
+	_, err = store.UpsertUsers(ctx, []*notificationsv1alpha1.NotificationUser{{Id: "a"}})
+	require.NoError(t, err)
+}
+
+func TestPartialFaultsFailScopedIdsAndEvents(t *testing.T) {
+	ctx := context.Background()
+	users := newCountingUserStore("a", "b", "c")
+	users.failing["c"] = true
+	store := newFaultInjectingStore(t, users, notification_store.FaultRule{
+		Fault:       notification_store.FaultPartial,
+		Probability: 1,
+		UserIds:     []string{"b"},
+	})
+	result, err := store.GetUsers(ctx, []string{"c", "a", "b", "unknown"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, userIds(result.Users))
+	require.Equal(t, []string{"unknown"}, result.NotFound)
+	require.Equal(t, []string{"c", "b"}, result.FailedIds())
+	require.Equal(t, [][]string{{"c", "a", "unknown"}}, users.gets)
+
+	events := &topicRecordingStore{}
+	store = newFaultInjectingStore(t, events, notification_store.FaultRule{
+		Fault:         notification_store.FaultPartial,
+		Probability:   1,
+		TopicPrefixes: []string{"orders/"},
+	})
+	err = store.PublishEvents(ctx, []*notificationsv1alpha1.NotificationEvent{{Topic: "orders/1"}, {Topic: "users/a"}, {Topic: "orders/2"}})
+	require.ErrorContains(t, err, "dropped 2 of 3 events, the other 1 were published")
+	require.Equal(t, []string{"users/a"}, events.topics)
+}
+
+func TestCallFaultsOnlyApplyToScopedEvents(t *testing.T) {
+	ctx := context.Background()
+	events := &topicRecordingStore{}
+	store := newFaultInjectingStore(t, events, notification_store.FaultRule{
+		Fault:         notification_store.FaultError,
+		Probability:   1,
+		TopicPrefixes: []string{"orders/"},
+	})
+	err := store.PublishEvents(ctx, []*notificationsv1alpha1.NotificationEvent{{Topic: "orders/1"}, {Topic: "users/a"}, {Topic: "orders/2"}})
+	require.ErrorContains(t, err, "injected error into PublishEvents")
+	require.ErrorContains(t, err, "1 of 3 events were published")
+	require.Equal(t, []string{"users/a"}, events.topics)
+
+	events.topics = nil
+	require.NoError(t, store.PublishEvents(ctx, []*notificationsv1alpha1.NotificationEvent{{Topic: "users/a"}, {Topic: "users/b"}}))
+	require.Equal(t, []string{"users/a", "users/b"}, events.topics)
+
+	events.topics = nil
+	err = store.PublishEvents(ctx, []*notificationsv1alpha1.NotificationEvent{{Topic: "orders/1"}})
+	require.ErrorContains(t, err, "injected error into PublishEvents")
+	require.NotContains(t, err.Error(), "were published")
+	require.Empty(t, events.topics)
+
+	latency := newFaultInjectingStore(t, events, notification_store.FaultRule{
+		Fault:         notification_store.FaultLatency,
+		Probability:   1,
+		Latency:       "1m",
+		TopicPrefixes: []string{"orders/"},
+	})
+	events.topics = nil
+	start := time.Now()
+	require.NoError(t, latency.PublishEvents(ctx, []*notificationsv1alpha1.NotificationEvent{{Topic: "users/a"}}))
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, []string{"users/a"}, events.topics)
+}
+
+func TestTimeoutFaultsHonorTheContext(t *testing.T) {
+	store := newFaultInjectingStore(t, &topicRecordingStore{}, notification_store.FaultRule{
+		Fault:       notification_store.FaultTimeout,
+		Probability: 1,
+		Latency:     "1m",
+		Unscoped:    true,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := store.Ping(ctx)
+	require.True(t, errorx.IsOfType(err, errorx.TimeoutElapsed))
+	require.Less(t, time.Since(start), 10*time.Second)
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStore records the order that the stores in a chain are called in
+type recordingStore struct {
+	notification_store.NotificationStoreInterface
+	name  string
+	calls *[]string
+}
+
+func (s recordingStore) Ping(ctx context.Context) error {
+	*s.calls = append(*s.calls, s.name)
+	if s.NotificationStoreInterface == nil {
+		return nil
+	}
+	return s.NotificationStoreInterface.Ping(ctx)
+}
+
+func TestChainWrapsOutermostFirst(t *testing.T) {
+	calls := []string{}
+	for _, name := range []string{"test-outer", "test-inner"} {
+		name := name
+		notification_store.RegisterMiddleware(name, func() notification_store.Middleware {
+			return func(store notification_store.NotificationStoreInterface) notification_store.NotificationStoreInterface {
+				return recordingStore{NotificationStoreInterface: store, name: name, calls: &calls}
+			}
+		})
+	}
+	store, err := notification_store.Chain(recordingStore{name: "store", calls: &calls}, []string{"test-outer", notification_store.MiddlewareCache, "test-inner"})
+	require.NoError(t, err)
+	require.NoError(t, store.Ping(context.Background()))
+	// the cache is left out of the chain since it's disabled
+	require.Equal(t, []string{"test-outer", "test-inner", "store"}, calls)
+	require.Panics(t, func() {
+		notification_store.RegisterMiddleware("test-outer", nil)
+	})
+}
+
+func TestChainRejectsUnknownAndRepeatedMiddlewares(t *testing.T) {
+	_, err := notification_store.Chain(recordingStore{}, []string{"unknown"})
+	require.ErrorContains(t, err, "unknown store middleware unknown")
+	_, err = notification_store.Chain(recordingStore{}, []string{notification_store.MiddlewareInstrumented, notification_store.MiddlewareInstrumented})
+	require.ErrorContains(t, err, "listed more than once")
+}
+
+// flakyStore fails its calls with err until failures calls have failed
+type flakyStore struct {
+	notification_store.NotificationStoreInterface
+	err      error
+	failures int
+	calls    int
+}
+
+func (s *flakyStore) call() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyStore) GetUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return &notification_store.UsersResult{NotFound: ids}, nil
+}
+
+func (s *flakyStore) PublishEvents(ctx context.Context, events []*notificationsv1alpha1.NotificationEvent) error {
+	return s.call()
+}
+
+func TestRetryMiddlewareRetriesFailedCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		failures int
+		calls    int
+		failed   bool
+	}{
+		{"recovers", errorx.IllegalState.New("notifo answered 503"), 2, 3, false},
+		{"gives up after the attempts", errorx.IllegalState.New("notifo answered 503"), 5, 3, true},
+		{"doesn't retry invalid requests", errorx.IllegalArgument.New("invalid id"), 1, 1, true},
+		{"doesn't retry users that don't exist", errorx.DataUnavailable.New("user not found"), 1, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flaky := &flakyStore{err: test.err, failures: test.failures}
+			store := notification_store.RetryingNotificationStore{Store: flaky, Attempts: 3, Backoff: time.Millisecond}
+			result, err := store.GetUsers(context.Background(), []string{"user"})
+			require.Equal(t, test.calls, flaky.calls)
+			if test.failed {
+				require.ErrorIs(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{"user"}, result.NotFound)
+		})
+	}
+}
+
+func TestRetryMiddlewareDoesntRetryPublishingOrCanceledCalls(t *testing.T) {
+	flaky := &flakyStore{err: errorx.IllegalState.New("notifo answered 503"), failures: 1}
+	store := notification_store.RetryingNotificationStore{Store: flaky, Attempts: 3, Backoff: time.Millisecond}
+	require.Error(t, store.PublishEvents(context.Background(), nil))
+	require.Equal(t, 1, flaky.calls)
+
+	flaky = &flakyStore{err: errorx.IllegalState.New("notifo answered 503"), failures: 5}
+	store = notification_store.RetryingNotificationStore{Store: flaky, Attempts: 3, Backoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := store.GetUsers(ctx, []string{"user"})
+	require.Error(t, err)
+	require.Equal(t, 1, flaky.calls)
+}
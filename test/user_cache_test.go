@@ -0,0 +1,123 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/clock"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUserStore gets users from a map and records the ids each GetUsers call asked for
+type countingUserStore struct {
+	notification_store.NotificationStoreInterface
+	users   map[string]*notificationsv1alpha1.NotificationUser
+	failing map[string]bool
+	gets    [][]string
+}
+
+func newCountingUserStore(ids ...string) *countingUserStore {
+	store := &countingUserStore{users: map[string]*notificationsv1alpha1.NotificationUser{}, failing: map[string]bool{}}
+	for _, id := range ids {
+		store.users[id] = &notificationsv1alpha1.NotificationUser{Id: id}
+	}
+	return store
+}
+
+func (s *countingUserStore) GetUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	s.gets = append(s.gets, ids)
+	result := &notification_store.UsersResult{}
+	for _, id := range ids {
+		if s.failing[id] {
+			result.Failed = append(result.Failed, notification_store.IdError{Id: id, Err: errors.New("unavailable")})
+		} else if user, ok := s.users[id]; ok {
+			result.Users = append(result.Users, user)
+		} else {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+	return result, nil
+}
+
+func (s *countingUserStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
+	for _, user := range users {
+		s.users[user.Id] = user
+	}
+	return users, nil
+}
+
+func (s *countingUserStore) DeleteUsers(ctx context.Context, ids []string) (*notification_store.UsersResult, error) {
+	for _, id := range ids {
+		delete(s.users, id)
+	}
+	return &notification_store.UsersResult{}, nil
+}
+
+func userIds(users []*notificationsv1alpha1.NotificationUser) []string {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
+
+func TestUserCacheHitsNegativeHitsAndFailures(t *testing.T) {
+	ctx := context.Background()
+	store := newCountingUserStore("a", "b")
+	cache := notification_store.NewCachingNotificationStore(store, time.Minute, time.Minute, 100)
+	result, err := cache.GetUsers(ctx, []string{"a", "unknown"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, userIds(result.Users))
+	require.Equal(t, []string{"unknown"}, result.NotFound)
+	// only b reaches the store, a and the unknown id are cached
+	store.failing["c"] = true
+	result, err = cache.GetUsers(ctx, []string{"b", "unknown", "a", "c"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "a"}, userIds(result.Users))
+	require.Equal(t, []string{"unknown"}, result.NotFound)
+	require.Equal(t, []string{"c"}, result.FailedIds())
+	// failed ids aren't cached
+	_, err = cache.GetUsers(ctx, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"a", "unknown"}, {"b", "c"}, {"c"}}, store.gets)
+}
+
+func TestUserCacheExpiresAndEvicts(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Now())
+	defer clock.Set(fake)()
+	store := newCountingUserStore("a", "b", "c")
+	cache := notification_store.NewCachingNotificationStore(store, time.Minute, 0, 2)
+	_, err := cache.GetUsers(ctx, []string{"a", "b", "unknown"})
+	require.NoError(t, err)
+	// the unknown id isn't cached with a 0 negative ttl, and c evicts a, the least recently used
+	_, err = cache.GetUsers(ctx, []string{"b", "unknown", "c"})
+	require.NoError(t, err)
+	_, err = cache.GetUsers(ctx, []string{"a", "b"})
+	require.NoError(t, err)
+	fake.Advance(time.Minute + time.Second)
+	_, err = cache.GetUsers(ctx, []string{"b"})
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"a", "b", "unknown"}, {"unknown", "c"}, {"a"}, {"b"}}, store.gets)
+}
+
+func TestUserCacheInvalidatesOnUpsertAndDelete(t *testing.T) {
+	ctx := context.Background()
+	store := newCountingUserStore("a", "b")
+	cache := notification_store.NewCachingNotificationStore(store, time.Minute, time.Minute, 100)
+	_, err := cache.GetUsers(ctx, []string{"a", "b", "new"})
+	require.NoError(t, err)
+	_, err = cache.UpsertUsers(ctx, []*notificationsv1alpha1.NotificationUser{{Id: "new"}})
+	require.NoError(t, err)
+	_, err = cache.DeleteUsers(ctx, []string{"a"})
+	require.NoError(t, err)
+	result, err := cache.GetUsers(ctx, []string{"a", "b", "new"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "new"}, userIds(result.Users))
+	require.Equal(t, []string{"a"}, result.NotFound)
+	require.Equal(t, [][]string{{"a", "b", "new"}, {"a", "new"}}, store.gets)
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/catalystsquad/go-notifications/internal"
+	"github.com/catalystsquad/go-notifications/internal/database"
+	"github.com/catalystsquad/go-notifications/notification_store"
+	notificationsv1alpha1 "github.com/catalystsquad/protos-go-notifications/gen/proto/go/notifications/v1alpha1"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// pagedUserStore lists users from a slice, like notifo does with skip and take
+type pagedUserStore struct {
+	notification_store.NotificationStoreInterface
+	users []*notificationsv1alpha1.NotificationUser
+	calls int
+}
+
+func (s *pagedUserStore) ListUsers(ctx context.Context, skip, limit int32) ([]*notificationsv1alpha1.NotificationUser, error) {
+	s.calls++
+	if int(skip) >= len(s.users) {
+		return nil, nil
+	}
+	end := int(skip + limit)
+	if end > len(s.users) {
+		end = len(s.users)
+	}
+	return s.users[skip:end], nil
+}
+
+func TestExportUsersPagesAndResumes(t *testing.T) {
+	store := &pagedUserStore{}
+	for i := 0; i < internal.UserTransferBatchSize*2+5; i++ {
+		store.users = append(store.users, &notificationsv1alpha1.NotificationUser{Id: fmt.Sprintf("user-%d", i)})
+	}
+	previousStore := notification_store.NotificationStore
+	notification_store.NotificationStore = store
+	defer func() { notification_store.NotificationStore = previousStore }()
+
+	exported := []string{}
+	err := internal.ExportUsers(context.Background(), 0, func(user *notificationsv1alpha1.NotificationUser) error {
+		exported = append(exported, user.Id)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, exported, len(store.users))
+	require.Equal(t, 3, store.calls)
+
+	resumed := []string{}
+	err = internal.ExportUsers(context.Background(), internal.UserTransferBatchSize+1, func(user *notificationsv1alpha1.NotificationUser) error {
+		resumed = append(resumed, user.Id)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, exported[internal.UserTransferBatchSize+1:], resumed)
+}
+
+// batchCountingStore counts the upserts of a memory store
+type batchCountingStore struct {
+	*memoryStore
+	upserts int
+}
+
+func (s *batchCountingStore) UpsertUsers(ctx context.Context, users []*notificationsv1alpha1.NotificationUser) ([]*notificationsv1alpha1.NotificationUser, error) {
+	s.upserts++
+	return s.memoryStore.UpsertUsers(ctx, users)
+}
+
+// TestImportUsersOverHttp imports more than net/http would read of an unread request body once the response has
+// started, over several batches, through the gateway's http/1.1 endpoint
+func TestImportUsersOverHttp(t *testing.T) {
+	store := &batchCountingStore{memoryStore: newMemoryStore()}
+	previousStore := notification_store.NotificationStore
+	notification_store.NotificationStore = store
+	defer func() { notification_store.NotificationStore = previousStore }()
+	// audit entries fail to save without a database, which doesn't fail the request
+	previousDB := database.DB
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"), &gorm.Config{DisableAutomaticPing: true, Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	database.DB = db
+	defer func() { database.DB = previousDB }()
+	mux := runtime.NewServeMux()
+	require.NoError(t, internal.RegisterHttpHandlers(mux))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	rows := 2000
+	invalidRows := map[int]bool{}
+	body := &bytes.Buffer{}
+	for row := 1; row <= rows; row++ {
+		if row%500 == 0 {
+			invalidRows[row] = true
+			body.WriteString("not json\n")
+			continue
+		}
+		fmt.Fprintf(body, "{\"id\": \"user-%d\", \"emailAddress\": \"user-%d@example.com\", \"fullName\": \"%s\"}\n", row, row, strings.Repeat("x", 150))
+	}
+	require.Greater(t, body.Len(), 256<<10)
+
+	response, err := http.Post(server.URL+"/v1alpha1/bulk/users", "application/x-ndjson", body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, 1, response.ProtoMajor)
+	failedRows := map[int]bool{}
+	checkpoints := []int{}
+	var summary *internal.UserImportSummary
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		event := internal.UserImportEvent{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		require.Nil(t, summary, "no events after the summary")
+		switch {
+		case event.Row != 0:
+			failedRows[event.Row] = true
+		case event.Checkpoint != 0:
+			checkpoints = append(checkpoints, event.Checkpoint)
+		case event.Summary != nil:
+			summary = event.Summary
+		default:
+			t.Fatalf("import stopped: %s", event.Error)
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	require.NotNil(t, summary)
+	require.Equal(t, internal.UserImportSummary{Imported: rows - len(invalidRows), Failed: len(invalidRows)}, *summary)
+	require.Equal(t, invalidRows, failedRows)
+	require.Equal(t, rows, checkpoints[len(checkpoints)-1])
+	for i := 1; i < len(checkpoints); i++ {
+		require.Greater(t, checkpoints[i], checkpoints[i-1])
+	}
+	require.Equal(t, (rows-len(invalidRows)+internal.UserTransferBatchSize-1)/internal.UserTransferBatchSize, store.upserts)
+	result, err := store.GetUsers(context.Background(), []string{"user-1", fmt.Sprintf("user-%d", rows-1)})
+	require.NoError(t, err)
+	require.Len(t, result.Users, 2)
+	require.Len(t, store.users, rows-len(invalidRows))
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/go-notifications/internal/workers"
+	"github.com/stretchr/testify/require"
+)
+
+// run with -race, results are written from the workers
+func TestWorkersRunIsOrderedAndBounded(t *testing.T) {
+	ids := []string{}
+	for i := 0; i < 50; i++ {
+		ids = append(ids, fmt.Sprintf("user-%d", i))
+	}
+	var running, maxRunning int32
+	results := make([]string, len(ids))
+	errs := workers.Run(context.Background(), len(ids), 4, func(ctx context.Context, i int) error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			previous := atomic.LoadInt32(&maxRunning)
+			if current <= previous || atomic.CompareAndSwapInt32(&maxRunning, previous, current) {
+				break
+			}
+		}
+		// later ids finish first, so the order of the results can't come from the order they finish in
+		time.Sleep(time.Duration(len(ids)-i) * 100 * time.Microsecond)
+		if i%10 == 0 {
+			return errors.New("failed")
+		}
+		results[i] = ids[i]
+		return nil
+	})
+	require.LessOrEqual(t, maxRunning, int32(4))
+	for i, err := range errs {
+		if i%10 == 0 {
+			require.Error(t, err, "index %d", i)
+			require.Empty(t, results[i])
+		} else {
+			require.NoError(t, err, "index %d", i)
+			require.Equal(t, ids[i], results[i])
+		}
+	}
+}
+
+func TestWorkersRunStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	errs := workers.Run(ctx, 20, 2, func(ctx context.Context, i int) error {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	require.Len(t, errs, 20)
+	require.ErrorIs(t, errs[len(errs)-1], context.Canceled)
+	require.Less(t, atomic.LoadInt32(&calls), int32(20))
+}